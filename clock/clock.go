@@ -0,0 +1,43 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package clock provides a way of telling the time and waiting for it to pass
+// that can be replaced by a FakeClock in tests, so that they don't have to
+// sleep.
+package clock
+
+import "time"
+
+// Clock describes an interface to the current time, and to timers and tickers
+// driven by it.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After returns a channel that receives the time once d has passed.
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns a Ticker that sends the time each period d.
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Ticker holds a channel that receives the time each period, like a
+// time.Ticker.
+type Ticker struct {
+	C    <-chan time.Time
+	stop func()
+}
+
+// Stop turns off the Ticker.  No more ticks are sent once it returns.
+func (t *Ticker) Stop() { t.stop() }
+
+// Real is the Clock of the system, which uses the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: t.Stop}
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock implements a Clock whose time only passes when a test advances
+// it.
+type FakeClock struct {
+	mu      sync.Mutex
+	changed *sync.Cond // Broadcast when a waiter is added.
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a timer or ticker waiting for the FakeClock to reach its time.
+type waiter struct {
+	when   time.Time
+	period time.Duration // The interval of a ticker, or zero for a timer.
+	c      chan time.Time
+}
+
+// NewFakeClock returns a fake Clock set to now, for use in tests.
+func NewFakeClock(now time.Time) *FakeClock {
+	f := &FakeClock{now: now}
+	f.changed = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now returns the time the FakeClock is set to.
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel that receives the time once the FakeClock has been
+// advanced by d.
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.addWaiter(&waiter{when: f.now.Add(d), c: c})
+	return c
+}
+
+// NewTicker returns a Ticker that sends the time each time the FakeClock is
+// advanced past another period d.  Like a time.Ticker, ticks are dropped for
+// a slow receiver.
+func (f *FakeClock) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &waiter{when: f.now.Add(d), period: d, c: make(chan time.Time, 1)}
+	f.addWaiter(w)
+	return &Ticker{C: w.c, stop: func() { f.removeWaiter(w) }}
+}
+
+// Advance moves the FakeClock on by d, and sends to the timers and tickers
+// whose time has come, in the order of their times.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	for len(f.waiters) > 0 {
+		sort.SliceStable(f.waiters, func(i, j int) bool { return f.waiters[i].when.Before(f.waiters[j].when) })
+		w := f.waiters[0]
+		if w.when.After(f.now) {
+			return
+		}
+		select {
+		case w.c <- w.when:
+		default:
+		}
+		if w.period == 0 {
+			f.waiters = f.waiters[1:]
+			continue
+		}
+		for !w.when.After(f.now) {
+			w.when = w.when.Add(w.period)
+		}
+	}
+}
+
+// BlockUntil waits until at least n timers and tickers are waiting on the
+// FakeClock, so that a test can be sure a goroutine has started waiting
+// before advancing the time.
+func (f *FakeClock) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.changed.Wait()
+	}
+}
+
+// addWaiter adds w to the waiters.  The FakeClock must be locked.
+func (f *FakeClock) addWaiter(w *waiter) {
+	f.waiters = append(f.waiters, w)
+	f.changed.Broadcast()
+}
+
+// removeWaiter stops w from waiting.
+func (f *FakeClock) removeWaiter(w *waiter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, o := range f.waiters {
+		if o == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func TestFakeClockAfter(t *testing.T) {
+	f := NewFakeClock(start)
+	c := f.After(time.Minute)
+	f.Advance(59 * time.Second)
+	select {
+	case <-c:
+		t.Fatalf("timer fired early at %s", f.Now())
+	default:
+	}
+	f.Advance(time.Second)
+	select {
+	case tm := <-c:
+		if !tm.Equal(start.Add(time.Minute)) {
+			t.Errorf("timer fired with %s, want %s", tm, start.Add(time.Minute))
+		}
+	default:
+		t.Fatalf("timer not fired at %s", f.Now())
+	}
+	if len(f.waiters) != 0 {
+		t.Errorf("fired timer still waiting: %v", f.waiters)
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	f := NewFakeClock(start)
+	tk := f.NewTicker(time.Second)
+	f.Advance(time.Second)
+	if tm := <-tk.C; !tm.Equal(start.Add(time.Second)) {
+		t.Errorf("first tick at %s, want %s", tm, start.Add(time.Second))
+	}
+	// Ticks are dropped rather than queued for a slow receiver.
+	f.Advance(3 * time.Second)
+	<-tk.C
+	select {
+	case tm := <-tk.C:
+		t.Errorf("dropped tick received: %s", tm)
+	default:
+	}
+	tk.Stop()
+	f.Advance(time.Second)
+	select {
+	case tm := <-tk.C:
+		t.Errorf("tick after Stop: %s", tm)
+	default:
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	f := NewFakeClock(start)
+	done := make(chan time.Time)
+	go func() {
+		done <- <-f.After(time.Hour)
+	}()
+	f.BlockUntil(1)
+	f.Advance(time.Hour)
+	if tm := <-done; !tm.Equal(start.Add(time.Hour)) {
+		t.Errorf("timer fired with %s, want %s", tm, start.Add(time.Hour))
+	}
+}
@@ -90,6 +90,18 @@ func TestExamplePrograms(t *testing.T) {
 	}
 }
 
+// TestExampleProgramsCompile tests that every example program loads.  Their
+// compile warnings are tolerated, as many keep capture groups unused to
+// document the log format, so they wouldn't load with -Werror.
+func TestExampleProgramsCompile(t *testing.T) {
+	o := mtail.Options{Progs: "examples", W: watcher.NewFakeWatcher(), Store: metrics.NewStore(), CompileOnly: true}
+	m, err := mtail.New(o)
+	if err != nil {
+		t.Fatalf("examples failed to compile: %s", err)
+	}
+	m.Close()
+}
+
 func benchmarkProgram(b *testing.B, programfile string, logfile string) {
 	w := watcher.NewFakeWatcher()
 	o := mtail.Options{Progs: programfile, W: w}
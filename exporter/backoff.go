@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"flag"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+var (
+	pushMaxBackoff = flag.Duration("push_max_backoff", 10*time.Minute,
+		"Longest wait before pushing again to a service that failed. The wait doubles from the push interval after each consecutive failure, up to this.")
+	pushBreakerFailures = flag.Int("push_breaker_failures", 5,
+		"Consecutive failed pushes to a service after which it's only probed once each push_max_backoff, until a probe succeeds. Pushes are never stopped if zero.")
+
+	// pushBreakerOpen is 1 for each push target that has stopped being
+	// pushed to until a probe succeeds, by address.
+	pushBreakerOpen = expvar.NewMap("push_breaker_open")
+)
+
+// pushBackoff delays the pushes to a service that is failing, so that it's
+// not sent every metric every interval while it's down.  Each consecutive
+// failure doubles the delay from the push interval, up to max, with up to a
+// fifth taken off at random so that many mtails don't retry in step.  After
+// breakerFailures consecutive failures the circuit breaker opens, and the
+// pushes are only probes sent each max, until one succeeds.
+type pushBackoff struct {
+	addr            string
+	interval, max   time.Duration
+	breakerFailures int // Consecutive failures that open the breaker; it never opens if zero.
+
+	failures int         // Consecutive failed pushes.
+	next     time.Time   // No push is attempted before this.
+	open     *expvar.Int // 1 while the breaker is open.
+}
+
+func newPushBackoff(addr string, interval, max time.Duration, breakerFailures int) *pushBackoff {
+	if max < interval {
+		max = interval
+	}
+	open := new(expvar.Int)
+	pushBreakerOpen.Set(addr, open)
+	return &pushBackoff{
+		addr:            addr,
+		interval:        interval,
+		max:             max,
+		breakerFailures: breakerFailures,
+		open:            open,
+	}
+}
+
+// allow returns true if a push may be attempted at now.
+func (b *pushBackoff) allow(now time.Time) bool {
+	return !now.Before(b.next)
+}
+
+// record records whether the push attempted at now succeeded, and delays the
+// next push after a failure.
+func (b *pushBackoff) record(now time.Time, ok bool) {
+	if ok {
+		if b.open.Value() == 1 {
+			glog.Infof("Push to %s succeeded, resuming pushes.", b.addr)
+			b.open.Set(0)
+		}
+		b.failures = 0
+		b.next = time.Time{}
+		return
+	}
+	b.failures++
+	delay := b.interval
+	for i := 1; i < b.failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		delay = b.max
+	}
+	if b.breakerFailures > 0 && b.failures >= b.breakerFailures {
+		if b.open.Value() == 0 {
+			glog.Infof("Push to %s failed %d times in a row, probing it every %s until it succeeds.", b.addr, b.failures, b.max)
+			b.open.Set(1)
+		}
+		delay = b.max
+	}
+	delay -= time.Duration(rand.Float64() * float64(delay) / 5)
+	b.next = now.Add(delay)
+}
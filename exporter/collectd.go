@@ -7,7 +7,7 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/google/mtail/metrics"
 )
@@ -18,28 +18,59 @@ const (
 
 var (
 	collectdSocketPath = flag.String("collectd_socketpath", "",
-		"Path to collectd unixsock to write metrics to.")
+		"Path to collectd unixsock to write metrics to, or its address if collectd_network is not unix.")
+	collectdNetwork = flag.String("collectd_network", "unix",
+		"Network of the collectd socket: unix, tcp or udp.")
+	collectdPushInterval = flag.Duration("collectd_push_interval", 0,
+		"Interval between metric pushes to collectd. Uses metric_push_interval_seconds if zero.")
 
 	collectdExportTotal   = expvar.NewInt("collectd_export_total")
 	collectdExportSuccess = expvar.NewInt("collectd_export_success")
+	collectdExportDropped = expvar.NewInt("collectd_export_dropped")
 )
 
-func metricToCollectd(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
-	m.RLock()
-	defer m.RUnlock()
+// collectdFormatter formats metrics as collectd PUTVAL commands.
+type collectdFormatter struct {
+	interval time.Duration // The push interval, sent as the interval of each value.
+}
+
+func (c *collectdFormatter) format(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	if m.Kind == metrics.Histogram {
+		var r string
+		for _, hs := range histogramToSeries(l.Datum) {
+			name := formatLabels(m.ExportedName()+hs.suffix, l.Labels, "-", "-")
+			if hs.le != "" {
+				name += "-le-" + hs.le
+			}
+			r += fmt.Sprintf(collectdFormat,
+				hostname,
+				m.Program,
+				kindToCollectdType(m.Kind),
+				name,
+				int64(c.interval/time.Second),
+				l.Datum.Time/1e9,
+				hs.value)
+		}
+		return r
+	}
 	return fmt.Sprintf(collectdFormat,
 		hostname,
 		m.Program,
 		kindToCollectdType(m.Kind),
-		formatLabels(m.Name, l.Labels, "-", "-"),
-		*pushInterval,
+		formatLabels(m.ExportedName(), l.Labels, "-", "-"),
+		int64(c.interval/time.Second),
 		l.Datum.Time/1e9,
 		l.Datum.Get())
 }
 
+// kindToCollectdType returns the collectd data source type for a kind of
+// metric.  Counters, histograms and summaries are sent as derive rather than
+// counter values, so that collectd handles a reset without seeing a
+// wraparound.
 func kindToCollectdType(kind metrics.Kind) string {
-	if kind != metrics.Timer {
-		return strings.ToLower(kind.String())
+	switch kind {
+	case metrics.Counter, metrics.Histogram, metrics.Summary:
+		return "derive"
 	}
 	return "gauge"
 }
@@ -13,30 +13,80 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/clock"
 	"github.com/google/mtail/metrics"
 )
 
 // Commandline Flags.
 var (
 	pushInterval = flag.Int("metric_push_interval_seconds", 60,
-		"Interval between metric pushes, in seconds")
+		"Interval between metric pushes, in seconds, for push exporters without their own interval.")
 )
 
 // Exporter manages the export of metrics to passive and active collectors.
 type Exporter struct {
 	store       *metrics.Store
 	hostname    string
-	pushTargets []pushOptions
+	omitExpvars bool
+	timestamps  bool // Export the time of each sample to Prometheus.
+	pushTargets []*pushTarget
+	clock       clock.Clock // Ticks the push intervals.
+
+	maxBackoff      time.Duration // Longest wait before pushing again to a failing target.
+	breakerFailures int           // Consecutive failures after which a target is only probed.
+
+	pushQuit chan struct{}  // Closed to stop the push loops.
+	pushWg   sync.WaitGroup // Waits for the push loops to stop.
 }
 
 // Options contains the required and optional parameters for constructing an
 // Exporter.
 type Options struct {
 	Store    *metrics.Store
-	Hostname string // Not required, uses os.Hostname if zero.
+	Hostname string      // Not required, uses os.Hostname if zero.
+	Clock    clock.Clock // Not required, uses clock.Real if zero.
+
+	OmitInternalMetrics  bool // Don't export mtail's own expvars to Prometheus.
+	PrometheusTimestamps bool // Export the time each sample was last updated to Prometheus; also set by the prometheus_timestamps flag.
+
+	PushInterval time.Duration // Not required, uses the metric_push_interval_seconds flag if zero.
+
+	PushMaxBackoff      time.Duration // Not required, uses the push_max_backoff flag if zero.
+	PushBreakerFailures int           // Not required, uses the push_breaker_failures flag if zero.
+
+	StatsdPushInterval   time.Duration // Not required, uses the statsd_push_interval flag, then PushInterval, if zero.
+	CollectdPushInterval time.Duration // Not required, uses the collectd_push_interval flag, then PushInterval, if zero.
+	GraphitePushInterval time.Duration // Not required, uses the graphite_push_interval flag, then PushInterval, if zero.
+	OpenTSDBPushInterval time.Duration // Not required, uses the opentsdb_push_interval flag, then PushInterval, if zero.
+	InfluxDBPushInterval time.Duration // Not required, uses the influxdb_push_interval flag, then PushInterval, if zero.
+
+	RemoteWritePushInterval time.Duration // Not required, uses the remote_write_push_interval flag, then PushInterval, if zero.
+
+	StatsdHostPort string // Not required, uses the statsd_hostport flag if zero.
+	StatsdTags     bool   // Send labels to StatsD as tags; also set by the statsd_tags flag.
+
+	CollectdSocketPath string // Not required, uses the collectd_socketpath flag if zero.
+	CollectdNetwork    string // Not required, uses the collectd_network flag if zero.
+
+	GraphiteHostPort       string // Not required, uses the graphite_host_port flag if zero.
+	GraphitePrefix         string // Not required, uses the graphite_prefix flag if zero.
+	GraphiteLabelSeparator string // Not required, uses the graphite_label_separator flag if zero.
+
+	OpenTSDBURL       string // Not required, uses the opentsdb_url flag if zero.
+	OpenTSDBBatchSize int    // Not required, uses the opentsdb_batch_size flag if zero.
+
+	InfluxDBURL         string // Not required, uses the influxdb_url flag if zero.
+	InfluxDBUDPHostPort string // Not required, uses the influxdb_udp_host_port flag if zero.
+	InfluxDBDatabase    string // Not required, uses the influxdb_database flag if zero.
+	InfluxDBPrecision   string // Not required, uses the influxdb_precision flag if zero.
+
+	RemoteWriteURL         string // Not required, uses the remote_write_url flag if zero.
+	RemoteWriteBearerToken string // Not required, read from the remote_write_bearer_token_file flag if zero.
+	RemoteWriteBatchSize   int    // Not required, uses the remote_write_batch_size flag if zero.
 }
 
 // New creates a new Exporter.
@@ -52,18 +102,133 @@ func New(o Options) (*Exporter, error) {
 			return nil, fmt.Errorf("Error getting hostname: %s\n", err)
 		}
 	}
-	e := &Exporter{store: o.Store, hostname: hostname}
+	c := o.Clock
+	if c == nil {
+		c = clock.Real
+	}
+	e := &Exporter{store: o.Store, hostname: hostname, omitExpvars: o.OmitInternalMetrics, timestamps: o.PrometheusTimestamps || *prometheusTimestamps, clock: c, pushQuit: make(chan struct{})}
+
+	e.maxBackoff, e.breakerFailures = o.PushMaxBackoff, o.PushBreakerFailures
+	if e.maxBackoff == 0 {
+		e.maxBackoff = *pushMaxBackoff
+	}
+	if e.breakerFailures == 0 {
+		e.breakerFailures = *pushBreakerFailures
+	}
+
+	defaultInterval := o.PushInterval
+	if defaultInterval == 0 {
+		defaultInterval = time.Duration(*pushInterval) * time.Second
+	}
+	// interval returns the first non-zero of an exporter's option and flag,
+	// or the default push interval.
+	interval := func(option, flag time.Duration) time.Duration {
+		if option != 0 {
+			return option
+		}
+		if flag != 0 {
+			return flag
+		}
+		return defaultInterval
+	}
 
-	if *collectdSocketPath != "" {
-		o := pushOptions{"unix", *collectdSocketPath, metricToCollectd, collectdExportTotal, collectdExportSuccess}
+	collectdAddr, collectdNet := o.CollectdSocketPath, o.CollectdNetwork
+	if collectdAddr == "" {
+		collectdAddr = *collectdSocketPath
+	}
+	if collectdNet == "" {
+		collectdNet = *collectdNetwork
+	}
+	if collectdAddr != "" {
+		c := &collectdFormatter{interval(o.CollectdPushInterval, *collectdPushInterval)}
+		o := pushOptions{collectdNet, collectdAddr, c.format, c.interval, collectdExportTotal, collectdExportSuccess, collectdExportDropped, nil, nil}
+		e.RegisterPushExport(o)
+	}
+	graphiteAddr := o.GraphiteHostPort
+	if graphiteAddr == "" {
+		graphiteAddr = *graphiteHostPort
+	}
+	if graphiteAddr != "" {
+		g := &graphiteFormatter{prefix: o.GraphitePrefix, sep: o.GraphiteLabelSeparator}
+		if g.prefix == "" {
+			g.prefix = *graphitePrefix
+		}
+		if g.sep == "" {
+			g.sep = *graphiteLabelSeparator
+		}
+		o := pushOptions{"tcp", graphiteAddr, g.format, interval(o.GraphitePushInterval, *graphitePushInterval), graphiteExportTotal, graphiteExportSuccess, graphiteExportDropped, nil, nil}
 		e.RegisterPushExport(o)
 	}
-	if *graphiteHostPort != "" {
-		o := pushOptions{"tcp", *graphiteHostPort, metricToGraphite, graphiteExportTotal, graphiteExportSuccess}
+	statsdAddr := o.StatsdHostPort
+	if statsdAddr == "" {
+		statsdAddr = *statsdHostPort
+	}
+	if statsdAddr != "" {
+		f := newStatsdFormatter(o.StatsdTags || *statsdTags)
+		o := pushOptions{"udp", statsdAddr, f.format, interval(o.StatsdPushInterval, *statsdPushInterval), statsdExportTotal, statsdExportSuccess, statsdExportDropped, nil, nil}
 		e.RegisterPushExport(o)
 	}
-	if *statsdHostPort != "" {
-		o := pushOptions{"udp", *statsdHostPort, metricToStatsd, statsdExportTotal, statsdExportSuccess}
+	opentsdbAddr := o.OpenTSDBURL
+	if opentsdbAddr == "" {
+		opentsdbAddr = *opentsdbURL
+	}
+	if opentsdbAddr != "" {
+		batchSize := o.OpenTSDBBatchSize
+		if batchSize == 0 {
+			batchSize = *opentsdbBatchSize
+		}
+		p := newOpenTSDBPusher(opentsdbAddr, batchSize)
+		o := pushOptions{"http", p.url, openTSDBFormat, interval(o.OpenTSDBPushInterval, *opentsdbPushInterval), opentsdbExportTotal, opentsdbExportSuccess, opentsdbExportDropped, p.send, nil}
+		e.RegisterPushExport(o)
+	}
+	influxdbAddr, influxdbUDPAddr := o.InfluxDBURL, o.InfluxDBUDPHostPort
+	if influxdbAddr == "" {
+		influxdbAddr = *influxdbURL
+	}
+	if influxdbUDPAddr == "" {
+		influxdbUDPAddr = *influxdbUDPHostPort
+	}
+	if influxdbAddr != "" || influxdbUDPAddr != "" {
+		precision, database := o.InfluxDBPrecision, o.InfluxDBDatabase
+		if precision == "" {
+			precision = *influxdbPrecision
+		}
+		if database == "" {
+			database = *influxdbDatabase
+		}
+		f, err := newInfluxDBFormatter(precision)
+		if err != nil {
+			return nil, err
+		}
+		i := interval(o.InfluxDBPushInterval, *influxdbPushInterval)
+		if influxdbAddr != "" {
+			p := newInfluxDBPusher(influxdbAddr, database, precision)
+			o := pushOptions{"http", p.url, f.format, i, influxdbExportTotal, influxdbExportSuccess, influxdbExportDropped, p.send, nil}
+			e.RegisterPushExport(o)
+		}
+		if influxdbUDPAddr != "" {
+			o := pushOptions{"udp", influxdbUDPAddr, f.format, i, influxdbExportTotal, influxdbExportSuccess, influxdbExportDropped, nil, nil}
+			e.RegisterPushExport(o)
+		}
+	}
+	remoteWriteAddr := o.RemoteWriteURL
+	if remoteWriteAddr == "" {
+		remoteWriteAddr = *remoteWriteURL
+	}
+	if remoteWriteAddr != "" {
+		token, batchSize := o.RemoteWriteBearerToken, o.RemoteWriteBatchSize
+		if token == "" && *remoteWriteBearerTokenFile != "" {
+			var err error
+			token, err = readBearerToken(*remoteWriteBearerTokenFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if batchSize == 0 {
+			batchSize = *remoteWriteBatchSize
+		}
+		p := newRemoteWritePusher(remoteWriteAddr, token, batchSize)
+		o := pushOptions{"http", p.url, nil, interval(o.RemoteWritePushInterval, *remoteWritePushInterval), remoteWriteExportTotal, remoteWriteExportSuccess, remoteWriteExportDropped, nil, p}
 		e.RegisterPushExport(o)
 	}
 
@@ -84,77 +249,198 @@ func formatLabels(name string, m map[string]string, ksep, sep string) string {
 	return r
 }
 
+// metricHelp returns the description of a metric: the help text declared by
+// its program, or else where it was defined.
+func metricHelp(m *metrics.Metric) string {
+	if m.Help != "" {
+		return m.Help
+	}
+	return m.ExportedName() + " defined in " + m.Program
+}
+
+// histogramSeries is one of the timeseries a histogram LabelSet is exported
+// as: a cumulative _bucket series for each upper bound, then _sum and _count.
+type histogramSeries struct {
+	suffix string
+	le     string // The bucket upper bound; empty unless suffix is _bucket.
+	value  int64
+}
+
+func histogramToSeries(d *metrics.Datum) []histogramSeries {
+	var r []histogramSeries
+	buckets, count, sum := d.GetObservations()
+	for _, b := range buckets {
+		r = append(r, histogramSeries{"_bucket", fmt.Sprintf("%d", b.UpperBound), b.Count})
+	}
+	return append(r,
+		histogramSeries{"_bucket", "+Inf", count},
+		histogramSeries{"_sum", "", sum},
+		histogramSeries{"_count", "", count})
+}
+
 // Format a LabelSet into a string to be written to one of the timeseries
 // sockets.
 type formatter func(string, *metrics.Metric, *metrics.LabelSet) string
 
-func (e *Exporter) writeSocketMetrics(c net.Conn, f formatter, exportTotal *expvar.Int, exportSuccess *expvar.Int) error {
+// exportedMetrics returns the Metrics in the store that aren't hidden.  The
+// store is only locked while they're listed, and each Metric is only locked
+// while its LabelSets are copied, so that a slow client or service doesn't
+// hold up the programs loading or writing them.
+func (e *Exporter) exportedMetrics() []*metrics.Metric {
 	e.store.RLock()
 	defer e.store.RUnlock()
-
+	ms := make([]*metrics.Metric, 0, len(e.store.Metrics))
 	for _, m := range e.store.Metrics {
-		m.RLock()
-		defer m.RUnlock()
+		if !m.Hidden {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// visitLabelSets calls visit with each LabelSet in the store that's
+// exported, and its Metric.
+func (e *Exporter) visitLabelSets(exportTotal *expvar.Int, visit func(*metrics.Metric, *metrics.LabelSet)) {
+	for _, m := range e.exportedMetrics() {
 		exportTotal.Add(1)
-		lc := make(chan *metrics.LabelSet)
-		go m.EmitLabelSets(lc)
-		for l := range lc {
-			line := f(e.hostname, m, l)
-			n, err := fmt.Fprint(c, line)
-			glog.Infof("Sent %d bytes\n", n)
-			if err == nil {
-				exportSuccess.Add(1)
-			} else {
-				return fmt.Errorf("write error: %s\n", err)
-			}
+		for _, l := range m.LabelSets() {
+			visit(m, l)
 		}
 	}
-	return nil
 }
 
-// WriteMetrics writes metrics to each of the configured services.
-// TODO(jaq) rename to PushMetrics.
-func (e *Exporter) WriteMetrics() {
-	for _, target := range e.pushTargets {
-		glog.Infof("pushing to %s", target.addr)
+// formatSocketMetrics formats each LabelSet in the store for writing to one
+// of the timeseries sockets.
+func (e *Exporter) formatSocketMetrics(f formatter, exportTotal *expvar.Int) []string {
+	var lines []string
+	e.visitLabelSets(exportTotal, func(m *metrics.Metric, l *metrics.LabelSet) {
+		lines = append(lines, f(e.hostname, m, l))
+	})
+	return lines
+}
+
+// pushMetrics sends the metrics to the target.
+func (e *Exporter) pushMetrics(target *pushTarget) {
+	if target.remoteWrite != nil {
+		series := e.remoteWriteMetrics(target.total)
+		e.push(target, len(series), func() (int, int) { return target.remoteWrite.send(series) })
+		return
+	}
+	lines := e.formatSocketMetrics(target.f, target.total)
+	e.push(target, len(lines), func() (int, int) { return sendMetrics(target.pushOptions, lines) })
+}
+
+// push sends n metrics to the target with send, unless it's backing off after
+// failed pushes, in which case they're counted as dropped.  A push fails if
+// none of the metrics could be sent.
+func (e *Exporter) push(target *pushTarget, n int, send func() (sent, dropped int)) {
+	if !target.backoff.allow(e.clock.Now()) {
+		target.dropped.Add(int64(n))
+		return
+	}
+	sent, dropped := send()
+	target.success.Add(int64(sent))
+	target.dropped.Add(int64(dropped))
+	target.backoff.record(e.clock.Now(), sent > 0 || dropped == 0)
+}
+
+// sendMetrics writes the lines to the target, or has the target's send
+// function send them.  If the connection fails, it is redialled once to write
+// the remaining lines; those still unwritten are dropped.
+func sendMetrics(target pushOptions, lines []string) (sent, dropped int) {
+	if target.send != nil {
+		return target.send(lines)
+	}
+	for attempt := 0; attempt < 2 && len(lines) > 0; attempt++ {
 		conn, err := net.Dial(target.net, target.addr)
 		if err != nil {
 			glog.Infof("pusher dial error: %s", err)
 			continue
 		}
-		err = e.writeSocketMetrics(conn, target.f, target.total, target.success)
-		if err != nil {
-			glog.Infof("pusher write error: %s", err)
+		for len(lines) > 0 {
+			n, err := fmt.Fprint(conn, lines[0])
+			if err != nil {
+				glog.Infof("pusher write error: %s", err)
+				break
+			}
+			glog.Infof("Sent %d bytes\n", n)
+			sent++
+			lines = lines[1:]
 		}
 		conn.Close()
 	}
+	return sent, len(lines)
+}
+
+// WriteMetrics writes metrics to each of the configured services.
+// TODO(jaq) rename to PushMetrics.
+func (e *Exporter) WriteMetrics() {
+	for _, target := range e.pushTargets {
+		glog.Infof("pushing to %s", target.addr)
+		e.pushMetrics(target)
+	}
 }
 
-// StartMetricPush pushes metrics to the configured services each interval.
+// StartMetricPush pushes metrics to each of the configured services at its
+// interval, until Close is called.
 func (e *Exporter) StartMetricPush() {
-	if len(e.pushTargets) > 0 {
-		glog.Info("Started metric push.")
-		ticker := time.NewTicker(time.Duration(*pushInterval) * time.Second)
-		go func() {
-			for {
-				select {
-				case <-ticker.C:
-					e.WriteMetrics()
-				}
-			}
-		}()
+	for _, target := range e.pushTargets {
+		glog.Infof("Started metric push to %s every %s.", target.addr, target.interval)
+		e.pushWg.Add(1)
+		go e.pushLoop(target)
+	}
+}
+
+// pushLoop pushes metrics to the target each of its intervals until pushQuit
+// is closed.
+func (e *Exporter) pushLoop(target *pushTarget) {
+	defer e.pushWg.Done()
+	ticker := e.clock.NewTicker(target.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.pushMetrics(target)
+		case <-e.pushQuit:
+			return
+		}
 	}
 }
 
+// Close stops pushing metrics each interval, and pushes them to each of the
+// configured services a final time.
+func (e *Exporter) Close() {
+	close(e.pushQuit)
+	e.pushWg.Wait()
+	e.WriteMetrics()
+}
+
 type pushOptions struct {
-	net, addr      string
-	f              formatter
-	total, success *expvar.Int
+	net, addr               string
+	f                       formatter
+	interval                time.Duration // How often to push to this target.
+	total, success, dropped *expvar.Int
+
+	// send sends the formatted metrics, returning the numbers sent and
+	// dropped, instead of writing them to a connection to addr, if not nil.
+	send func(lines []string) (sent, dropped int)
+
+	// remoteWrite pushes the metrics as remote write series, rather than as
+	// lines formatted by f, if not nil.
+	remoteWrite *remoteWritePusher
+}
+
+// pushTarget is a registered push export, and the backoff of the pushes to
+// it.
+type pushTarget struct {
+	pushOptions
+	backoff *pushBackoff
 }
 
 // RegisterPushExport adds a push export connection to the Exporter.  Items in
 // the list must describe a Dial()able connection and will have all the metrics
-// pushed to each pushInterval.
+// pushed to each interval.
 func (e *Exporter) RegisterPushExport(p pushOptions) {
-	e.pushTargets = append(e.pushTargets, p)
+	b := newPushBackoff(p.addr, p.interval, e.maxBackoff, e.breakerFailures)
+	e.pushTargets = append(e.pushTargets, &pushTarget{p, b})
 }
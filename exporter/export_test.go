@@ -4,11 +4,23 @@
 package exporter
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/google/mtail/clock"
 	"github.com/google/mtail/metrics"
 	"github.com/kylelemons/godebug/pretty"
 )
@@ -24,6 +36,18 @@ func FakeSocketWrite(f formatter, m *metrics.Metric) []string {
 	return ret
 }
 
+// newTestHistogram returns a histogram with buckets at 10 and 100, and three
+// observations, one of which is outside every bucket.
+func newTestHistogram(ts time.Time) *metrics.Metric {
+	m := metrics.NewMetric("foo", "prog", metrics.Histogram)
+	m.Buckets = []int64{10, 100}
+	d, _ := m.GetDatum()
+	d.Observe(2, ts)
+	d.Observe(60, ts)
+	d.Observe(1000, ts)
+	return m
+}
+
 func TestMetricToCollectd(t *testing.T) {
 	ts, terr := time.Parse("2006/01/02 15:04:05", "2012/07/24 10:14:00")
 	if terr != nil {
@@ -36,8 +60,8 @@ func TestMetricToCollectd(t *testing.T) {
 	d.Set(37, ts)
 	ms.Add(scalarMetric)
 
-	r := FakeSocketWrite(metricToCollectd, scalarMetric)
-	expected := []string{"PUTVAL \"gunstar/mtail-prog/counter-foo\" interval=60 1343124840:37\n"}
+	r := FakeSocketWrite((&collectdFormatter{time.Minute}).format, scalarMetric)
+	expected := []string{"PUTVAL \"gunstar/mtail-prog/derive-foo\" interval=60 1343124840:37\n"}
 	diff := pretty.Compare(r, expected)
 	if len(diff) > 0 {
 		t.Errorf("String didn't match:\n%s", diff)
@@ -51,7 +75,7 @@ func TestMetricToCollectd(t *testing.T) {
 	ms.ClearMetrics()
 	ms.Add(dimensionedMetric)
 
-	r = FakeSocketWrite(metricToCollectd, dimensionedMetric)
+	r = FakeSocketWrite((&collectdFormatter{time.Minute}).format, dimensionedMetric)
 	expected = []string{
 		"PUTVAL \"gunstar/mtail-prog/gauge-bar-label-quux\" interval=60 1343124840:37\n",
 		"PUTVAL \"gunstar/mtail-prog/gauge-bar-label-snuh\" interval=60 1343124840:37\n"}
@@ -65,12 +89,70 @@ func TestMetricToCollectd(t *testing.T) {
 	d.Set(123, ts)
 	ms.Add(timingMetric)
 
-	r = FakeSocketWrite(metricToCollectd, timingMetric)
+	r = FakeSocketWrite((&collectdFormatter{time.Minute}).format, timingMetric)
 	expected = []string{"PUTVAL \"gunstar/mtail-prog/gauge-foo\" interval=60 1343124840:123\n"}
 	diff = pretty.Compare(r, expected)
 	if len(diff) > 0 {
 		t.Errorf("String didn't match:\n%s", diff)
 	}
+
+	histogramMetric := newTestHistogram(ts)
+	ms.Add(histogramMetric)
+
+	r = FakeSocketWrite((&collectdFormatter{time.Minute}).format, histogramMetric)
+	expected = []string{"PUTVAL \"gunstar/mtail-prog/derive-foo_bucket-le-10\" interval=60 1343124840:1\n" +
+		"PUTVAL \"gunstar/mtail-prog/derive-foo_bucket-le-100\" interval=60 1343124840:2\n" +
+		"PUTVAL \"gunstar/mtail-prog/derive-foo_bucket-le-+Inf\" interval=60 1343124840:3\n" +
+		"PUTVAL \"gunstar/mtail-prog/derive-foo_sum\" interval=60 1343124840:1062\n" +
+		"PUTVAL \"gunstar/mtail-prog/derive-foo_count\" interval=60 1343124840:3\n"}
+	diff = pretty.Compare(r, expected)
+	if len(diff) > 0 {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+}
+
+func TestCollectdPush(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "collectd_test")
+	if err != nil {
+		t.Fatalf("couldn't make temp dir: %s", err)
+	}
+	defer os.RemoveAll(workdir)
+	l, err := net.Listen("unix", filepath.Join(workdir, "unixsock"))
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer l.Close()
+
+	ms := metrics.NewStore()
+	c := metrics.NewMetric("foo", "prog", metrics.Counter)
+	d, _ := c.GetDatum()
+	d.Set(37, time.Unix(1343124840, 0))
+	ms.Add(c)
+	g := metrics.NewMetric("bar", "prog", metrics.Gauge, "label")
+	d, _ = g.GetDatum("quux")
+	d.Set(12, time.Unix(1343124840, 0))
+	ms.Add(g)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", CollectdSocketPath: l.Addr().String()})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	received := make(chan string)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		received <- string(b)
+	}()
+	e.WriteMetrics()
+	expected := "PUTVAL \"gunstar/mtail-prog/derive-foo\" interval=60 1343124840:37\n" +
+		"PUTVAL \"gunstar/mtail-prog/gauge-bar-label-quux\" interval=60 1343124840:12\n"
+	if diff := pretty.Compare(expected, <-received); len(diff) > 0 {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
 }
 
 func TestMetricToGraphite(t *testing.T) {
@@ -82,7 +164,8 @@ func TestMetricToGraphite(t *testing.T) {
 	scalarMetric := metrics.NewMetric("foo", "prog", metrics.Counter)
 	d, _ := scalarMetric.GetDatum()
 	d.Set(37, ts)
-	r := FakeSocketWrite(metricToGraphite, scalarMetric)
+	g := &graphiteFormatter{sep: "."}
+	r := FakeSocketWrite(g.format, scalarMetric)
 	expected := []string{"prog.foo 37 1343124840\n"}
 	diff := pretty.Compare(r, expected)
 	if len(diff) > 0 {
@@ -94,7 +177,7 @@ func TestMetricToGraphite(t *testing.T) {
 	d.Set(37, ts)
 	d, _ = dimensionedMetric.GetDatum("snuh")
 	d.Set(37, ts)
-	r = FakeSocketWrite(metricToGraphite, dimensionedMetric)
+	r = FakeSocketWrite(g.format, dimensionedMetric)
 	expected = []string{
 		"prog.bar.l.quux 37 1343124840\n",
 		"prog.bar.l.snuh 37 1343124840\n"}
@@ -102,6 +185,88 @@ func TestMetricToGraphite(t *testing.T) {
 	if len(diff) > 0 {
 		t.Errorf("String didn't match:\n%s", diff)
 	}
+
+	histogramMetric := newTestHistogram(ts)
+	r = FakeSocketWrite(g.format, histogramMetric)
+	expected = []string{"prog.foo_bucket.le.10 1 1343124840\n" +
+		"prog.foo_bucket.le.100 2 1343124840\n" +
+		"prog.foo_bucket.le.+Inf 3 1343124840\n" +
+		"prog.foo_sum 1062 1343124840\n" +
+		"prog.foo_count 3 1343124840\n"}
+	diff = pretty.Compare(r, expected)
+	if len(diff) > 0 {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+
+	g = &graphiteFormatter{prefix: "mtail", sep: "_"}
+	r = FakeSocketWrite(g.format, dimensionedMetric)
+	expected = []string{
+		"mtail.prog.bar_l_quux 37 1343124840\n",
+		"mtail.prog.bar_l_snuh 37 1343124840\n"}
+	diff = pretty.Compare(r, expected)
+	if len(diff) > 0 {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+}
+
+func TestGraphitePush(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer l.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter)
+	d, _ := m.GetDatum()
+	d.Set(37, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", GraphiteHostPort: l.Addr().String(), GraphitePrefix: "mtail"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	received := make(chan string)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer c.Close()
+		b, _ := ioutil.ReadAll(c)
+		received <- string(b)
+	}()
+	e.WriteMetrics()
+	if diff := pretty.Compare("mtail.prog.foo 37 1343124840\n", <-received); len(diff) > 0 {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+}
+
+func TestGraphitePushDropped(t *testing.T) {
+	// Find an address with nothing listening on it.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, "l")
+	d, _ := m.GetDatum("a")
+	d.Set(1, time.Now())
+	d, _ = m.GetDatum("b")
+	d.Set(2, time.Now())
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", GraphiteHostPort: addr})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	before := graphiteExportDropped.Value()
+	e.WriteMetrics()
+	if dropped := graphiteExportDropped.Value() - before; dropped != 2 {
+		t.Errorf("dropped samples not counted: got %d, want 2", dropped)
+	}
 }
 
 func TestMetricToStatsd(t *testing.T) {
@@ -110,21 +275,31 @@ func TestMetricToStatsd(t *testing.T) {
 		t.Errorf("time parse error: %s", terr)
 	}
 
+	f := newStatsdFormatter(false)
+
 	scalarMetric := metrics.NewMetric("foo", "prog", metrics.Counter)
 	d, _ := scalarMetric.GetDatum()
 	d.Set(37, ts)
-	r := FakeSocketWrite(metricToStatsd, scalarMetric)
+	r := FakeSocketWrite(f.format, scalarMetric)
 	expected := []string{"prog.foo:37|c"}
 	if !reflect.DeepEqual(expected, r) {
 		t.Errorf("String didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
 
+	// Counters are sent as the change since the last push.
+	d.Set(40, ts)
+	r = FakeSocketWrite(f.format, scalarMetric)
+	expected = []string{"prog.foo:3|c"}
+	if !reflect.DeepEqual(expected, r) {
+		t.Errorf("String didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
+	}
+
 	dimensionedMetric := metrics.NewMetric("bar", "prog", metrics.Gauge, "l")
 	d, _ = dimensionedMetric.GetDatum("quux")
 	d.Set(37, ts)
 	d, _ = dimensionedMetric.GetDatum("snuh")
 	d.Set(42, ts)
-	r = FakeSocketWrite(metricToStatsd, dimensionedMetric)
+	r = FakeSocketWrite(f.format, dimensionedMetric)
 	expected = []string{
 		"prog.bar.l.quux:37|g",
 		"prog.bar.l.snuh:42|g"}
@@ -135,9 +310,559 @@ func TestMetricToStatsd(t *testing.T) {
 	timingMetric := metrics.NewMetric("foo", "prog", metrics.Timer)
 	d, _ = timingMetric.GetDatum()
 	d.Set(37, ts)
-	r = FakeSocketWrite(metricToStatsd, timingMetric)
+	r = FakeSocketWrite(f.format, timingMetric)
 	expected = []string{"prog.foo:37|ms"}
 	if !reflect.DeepEqual(expected, r) {
 		t.Errorf("String didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
 	}
+
+	histogramMetric := newTestHistogram(ts)
+	r = FakeSocketWrite(f.format, histogramMetric)
+	expected = []string{"prog.foo_bucket.le.10:1|g\n" +
+		"prog.foo_bucket.le.100:2|g\n" +
+		"prog.foo_bucket.le.+Inf:3|g\n" +
+		"prog.foo_sum:1062|g\n" +
+		"prog.foo_count:3|g"}
+	if !reflect.DeepEqual(expected, r) {
+		t.Errorf("String didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
+	}
+}
+
+func TestMetricToStatsdTags(t *testing.T) {
+	ts, terr := time.Parse("2006/01/02 15:04:05", "2012/07/24 10:14:00")
+	if terr != nil {
+		t.Errorf("time parse error: %s", terr)
+	}
+	f := newStatsdFormatter(true)
+
+	dimensionedMetric := metrics.NewMetric("bar", "prog", metrics.Counter, "l", "a")
+	d, _ := dimensionedMetric.GetDatum("quux", "1")
+	d.Set(37, ts)
+	r := FakeSocketWrite(f.format, dimensionedMetric)
+	expected := []string{"prog.bar:37|c|#a:1,l:quux"}
+	if !reflect.DeepEqual(expected, r) {
+		t.Errorf("String didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
+	}
+
+	histogramMetric := newTestHistogram(ts)
+	r = FakeSocketWrite(f.format, histogramMetric)
+	expected = []string{"prog.foo_bucket:1|g|#le:10\n" +
+		"prog.foo_bucket:2|g|#le:100\n" +
+		"prog.foo_bucket:3|g|#le:+Inf\n" +
+		"prog.foo_sum:1062|g\n" +
+		"prog.foo_count:3|g"}
+	if !reflect.DeepEqual(expected, r) {
+		t.Errorf("String didn't match:\n\texpected: %v\n\treceived: %v", expected, r)
+	}
+}
+
+func TestStatsdPush(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer c.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter)
+	d, _ := m.GetDatum()
+	d.Set(37, time.Now())
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", StatsdHostPort: c.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.WriteMetrics()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1024)
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("couldn't read packet: %s", err)
+	}
+	if diff := pretty.Compare("prog.foo:37|c", string(b[:n])); len(diff) > 0 {
+		t.Errorf("packet didn't match:\n%s", diff)
+	}
+}
+
+func TestPushIntervals(t *testing.T) {
+	graphite, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer graphite.Close()
+	statsd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer statsd.Close()
+
+	var graphitePushes, statsdPushes int64
+	go func() {
+		for {
+			c, err := graphite.Accept()
+			if err != nil {
+				return
+			}
+			ioutil.ReadAll(c)
+			c.Close()
+			atomic.AddInt64(&graphitePushes, 1)
+		}
+	}()
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			if _, _, err := statsd.ReadFrom(b); err != nil {
+				return
+			}
+			atomic.AddInt64(&statsdPushes, 1)
+		}
+	}()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter)
+	d, _ := m.GetDatum()
+	d.Set(1, time.Now())
+	ms.Add(m)
+	c := clock.NewFakeClock(time.Now())
+	e, err := New(Options{
+		Store:                ms,
+		Hostname:             "gunstar",
+		Clock:                c,
+		PushInterval:         time.Hour,
+		GraphiteHostPort:     graphite.Addr().String(),
+		GraphitePushInterval: 20 * time.Second,
+		StatsdHostPort:       statsd.LocalAddr().String(),
+	})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.StartMetricPush()
+	c.BlockUntil(2)
+
+	// waitFor waits for the pushes to be received, as they're sent
+	// asynchronously.
+	waitFor := func(pushes *int64, want int64) {
+		for deadline := time.Now().Add(time.Second); atomic.LoadInt64(pushes) < want && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// Five pushes each 20s, and a final push on Close.
+	for i := int64(1); i <= 5; i++ {
+		c.Advance(20 * time.Second)
+		waitFor(&graphitePushes, i)
+	}
+	e.Close()
+	waitFor(&graphitePushes, 6)
+	waitFor(&statsdPushes, 1)
+	if g, s := atomic.LoadInt64(&graphitePushes), atomic.LoadInt64(&statsdPushes); g != 6 || s != 1 {
+		t.Errorf("expected 6 graphite pushes and 1 statsd push, got %d and %d", g, s)
+	}
+}
+
+func TestMetricToOpenTSDB(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, "l", "empty")
+	d, _ := m.GetDatum("a b", "")
+	d.Set(37, ts)
+	r := FakeSocketWrite(openTSDBFormat, m)
+	expected := []string{`{"metric":"foo","timestamp":1343124840000,"value":37,"tags":{"host":"gunstar","l":"a_b","prog":"prog"}}` + "\n"}
+	if diff := pretty.Compare(expected, r); len(diff) > 0 {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+
+	r = FakeSocketWrite(openTSDBFormat, newTestHistogram(ts))
+	expected = []string{
+		`{"metric":"foo_bucket","timestamp":1343124840000,"value":1,"tags":{"host":"gunstar","le":"10","prog":"prog"}}` + "\n" +
+			`{"metric":"foo_bucket","timestamp":1343124840000,"value":2,"tags":{"host":"gunstar","le":"100","prog":"prog"}}` + "\n" +
+			`{"metric":"foo_bucket","timestamp":1343124840000,"value":3,"tags":{"host":"gunstar","le":"_Inf","prog":"prog"}}` + "\n" +
+			`{"metric":"foo_sum","timestamp":1343124840000,"value":1062,"tags":{"host":"gunstar","prog":"prog"}}` + "\n" +
+			`{"metric":"foo_count","timestamp":1343124840000,"value":3,"tags":{"host":"gunstar","prog":"prog"}}` + "\n",
+	}
+	if diff := pretty.Compare(expected, r); len(diff) > 0 {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+}
+
+func TestOpenTSDBPush(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		bodies [][]openTSDBPoint
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/put" || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+		var points []openTSDBPoint
+		if err := json.NewDecoder(r.Body).Decode(&points); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		bodies = append(bodies, points)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, "l")
+	for i, l := range []string{"a", "b", "c"} {
+		d, _ := m.GetDatum(l)
+		d.Set(int64(i), time.Unix(1343124840, 0))
+	}
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", OpenTSDBURL: s.URL + "/", OpenTSDBBatchSize: 2})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	before := opentsdbExportSuccess.Value()
+	e.WriteMetrics()
+	if sent := opentsdbExportSuccess.Value() - before; sent != 3 {
+		t.Errorf("sent data points not counted: got %d, want 3", sent)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 || len(bodies[0]) != 2 || len(bodies[1]) != 1 {
+		t.Fatalf("expected batches of 2 and 1 data points, got %v", bodies)
+	}
+	tags := map[string]bool{}
+	for _, b := range bodies {
+		for _, p := range b {
+			if p.Metric != "foo" || p.Timestamp != 1343124840000 || p.Tags["host"] != "gunstar" || p.Tags["prog"] != "prog" {
+				t.Errorf("unexpected data point %+v", p)
+			}
+			tags[p.Tags["l"]] = true
+		}
+	}
+	if !tags["a"] || !tags["b"] || !tags["c"] {
+		t.Errorf("data points missing, got labels %v", tags)
+	}
+}
+
+func TestOpenTSDBPushRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		statuses []int // Status of each request; the last is repeated.
+		requests int32
+		sent     int64
+		dropped  int64
+	}{
+		{"server error then success", []int{http.StatusInternalServerError, http.StatusNoContent}, 2, 1, 0},
+		{"server errors", []int{http.StatusServiceUnavailable}, httpPushAttempts, 0, 1},
+		{"rejected", []int{http.StatusBadRequest}, 1, 0, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var requests int32
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(atomic.AddInt32(&requests, 1))
+				if n > len(tc.statuses) {
+					n = len(tc.statuses)
+				}
+				w.WriteHeader(tc.statuses[n-1])
+			}))
+			defer s.Close()
+
+			ms := metrics.NewStore()
+			m := metrics.NewMetric("foo", "prog", metrics.Counter)
+			d, _ := m.GetDatum()
+			d.Set(1, time.Now())
+			ms.Add(m)
+			e, err := New(Options{Store: ms, Hostname: "gunstar"})
+			if err != nil {
+				t.Fatalf("couldn't make exporter: %s", err)
+			}
+			p := newOpenTSDBPusher(s.URL, 10)
+			p.retryDelay = time.Millisecond
+			e.RegisterPushExport(pushOptions{"http", p.url, openTSDBFormat, time.Minute, opentsdbExportTotal, opentsdbExportSuccess, opentsdbExportDropped, p.send, nil})
+
+			sentBefore, droppedBefore := opentsdbExportSuccess.Value(), opentsdbExportDropped.Value()
+			e.WriteMetrics()
+			if n := atomic.LoadInt32(&requests); n != tc.requests {
+				t.Errorf("requests: got %d, want %d", n, tc.requests)
+			}
+			if sent := opentsdbExportSuccess.Value() - sentBefore; sent != tc.sent {
+				t.Errorf("sent: got %d, want %d", sent, tc.sent)
+			}
+			if dropped := opentsdbExportDropped.Value() - droppedBefore; dropped != tc.dropped {
+				t.Errorf("dropped: got %d, want %d", dropped, tc.dropped)
+			}
+		})
+	}
+}
+
+// TestPushBackoff tests that pushes to a failing service back off, stop but
+// for probes once the breaker opens, and resume when a probe succeeds.
+func TestPushBackoff(t *testing.T) {
+	var requests, down int32 = 0, 1
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter)
+	d, _ := m.GetDatum()
+	d.Set(1, time.Now())
+	ms.Add(m)
+	c := clock.NewFakeClock(time.Unix(1500000000, 0))
+	e, err := New(Options{Store: ms, Hostname: "gunstar", Clock: c, PushMaxBackoff: 4 * time.Minute, PushBreakerFailures: 3})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	p := newOpenTSDBPusher(s.URL, 10)
+	e.RegisterPushExport(pushOptions{"http", p.url, openTSDBFormat, time.Minute, opentsdbExportTotal, opentsdbExportSuccess, opentsdbExportDropped, p.send, nil})
+	target := e.pushTargets[0]
+
+	// The service recovers after 9 minutes.  Failures wait 1, then 2
+	// minutes; the third opens the breaker, and it's probed every 4 minutes.
+	var attempts []int
+	droppedBefore := opentsdbExportDropped.Value()
+	for i := 0; i <= 12; i++ {
+		if i == 9 {
+			atomic.StoreInt32(&down, 0)
+		}
+		before := atomic.LoadInt32(&requests)
+		e.pushMetrics(target)
+		if atomic.LoadInt32(&requests) != before {
+			attempts = append(attempts, i)
+		}
+		if i == 3 && target.backoff.open.Value() != 1 {
+			t.Errorf("breaker not open after 3 failures")
+		}
+		c.Advance(time.Minute)
+	}
+	expected := []int{0, 1, 3, 7, 11, 12}
+	if diff := pretty.Compare(expected, attempts); len(diff) > 0 {
+		t.Errorf("push attempts don't match:\n%s", diff)
+	}
+	if target.backoff.open.Value() != 0 {
+		t.Errorf("breaker not closed after a probe succeeded")
+	}
+	// Every push but the two that succeeded dropped the metric.
+	if dropped := opentsdbExportDropped.Value() - droppedBefore; dropped != 11 {
+		t.Errorf("dropped: got %d, want 11", dropped)
+	}
+}
+
+func TestMetricToInfluxDB(t *testing.T) {
+	ts := time.Unix(1343124840, 0)
+	f, err := newInfluxDBFormatter("s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := metrics.NewMetric("foo bar", "prog", metrics.Counter, "l", "k=v", "empty")
+	d, _ := m.GetDatum("a,b c", "x", "")
+	d.Set(37, ts)
+	r := FakeSocketWrite(f.format, m)
+	expected := []string{`foo\ bar,host=gunstar,k\=v=x,l=a\,b\ c,prog=prog value=37i 1343124840` + "\n"}
+	if diff := pretty.Compare(expected, r); len(diff) > 0 {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+
+	f, err = newInfluxDBFormatter("ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = FakeSocketWrite(f.format, newTestHistogram(ts))
+	expected = []string{
+		"foo_bucket,host=gunstar,le=10,prog=prog value=1i 1343124840000\n" +
+			"foo_bucket,host=gunstar,le=100,prog=prog value=2i 1343124840000\n" +
+			"foo_bucket,host=gunstar,le=+Inf,prog=prog value=3i 1343124840000\n" +
+			"foo_sum,host=gunstar,prog=prog value=1062i 1343124840000\n" +
+			"foo_count,host=gunstar,prog=prog value=3i 1343124840000\n",
+	}
+	if diff := pretty.Compare(expected, r); len(diff) > 0 {
+		t.Errorf("String didn't match:\n%s", diff)
+	}
+
+	if _, err := newInfluxDBFormatter("h"); err == nil {
+		t.Error("expected error for unsupported precision")
+	}
+}
+
+func TestInfluxDBPush(t *testing.T) {
+	received := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- r.Method + " " + r.URL.String() + "\n" + string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, "l")
+	d, _ := m.GetDatum("a")
+	d.Set(37, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", InfluxDBURL: s.URL, InfluxDBDatabase: "metrics", InfluxDBPrecision: "ms"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	before := influxdbExportSuccess.Value()
+	e.WriteMetrics()
+	expected := "POST /write?db=metrics&precision=ms\nfoo,host=gunstar,l=a,prog=prog value=37i 1343124840000\n"
+	if diff := pretty.Compare(expected, <-received); len(diff) > 0 {
+		t.Errorf("request didn't match:\n%s", diff)
+	}
+	if sent := influxdbExportSuccess.Value() - before; sent != 1 {
+		t.Errorf("sent lines not counted: got %d, want 1", sent)
+	}
+}
+
+func TestInfluxDBPushUDP(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	defer c.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge)
+	d, _ := m.GetDatum()
+	d.Set(37, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", InfluxDBUDPHostPort: c.LocalAddr().String()})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	e.WriteMetrics()
+	b := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := c.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("couldn't read: %s", err)
+	}
+	if diff := pretty.Compare("foo,host=gunstar,prog=prog value=37i 1343124840\n", string(b[:n])); len(diff) > 0 {
+		t.Errorf("line didn't match:\n%s", diff)
+	}
+}
+
+func TestRemoteWritePush(t *testing.T) {
+	type series struct {
+		Labels    map[string]string
+		Value     float64
+		Timestamp int64
+	}
+	received := make(chan []series, 2)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers: %v", r.Header)
+		}
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			t.Errorf("bearer token not sent: %v", r.Header)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		b, err := snappy.Decode(nil, b)
+		if err != nil {
+			t.Errorf("couldn't decode snappy: %s", err)
+		}
+		var wr writeRequest
+		if err := proto.Unmarshal(b, &wr); err != nil {
+			t.Errorf("couldn't unmarshal write request: %s", err)
+		}
+		var req []series
+		for _, ts := range wr.Timeseries {
+			s := series{Labels: make(map[string]string)}
+			for _, l := range ts.Labels {
+				s.Labels[l.Name] = l.Value
+			}
+			if len(ts.Samples) != 1 {
+				t.Fatalf("got %d samples, want 1: %v", len(ts.Samples), ts)
+			}
+			s.Value, s.Timestamp = ts.Samples[0].Value, ts.Samples[0].Timestamp
+			req = append(req, s)
+		}
+		received <- req
+	}))
+	defer s.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Counter, "l")
+	for _, l := range []string{"a", "b", "c"} {
+		d, _ := m.GetDatum(l)
+		d.Set(37, time.Unix(1343124840, 0))
+	}
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", RemoteWriteURL: s.URL, RemoteWriteBearerToken: "s3cret", RemoteWriteBatchSize: 2})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	before := remoteWriteExportSuccess.Value()
+	e.WriteMetrics()
+	var got []series
+	for _, n := range []int{2, 1} {
+		req := <-received
+		if len(req) != n {
+			t.Errorf("batch of %d series, want %d", len(req), n)
+		}
+		got = append(got, req...)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Labels["l"] < got[j].Labels["l"] })
+	var expected []series
+	for _, l := range []string{"a", "b", "c"} {
+		expected = append(expected, series{map[string]string{"__name__": "foo", "instance": "gunstar", "l": l, "prog": "prog"}, 37, 1343124840000})
+	}
+	if diff := pretty.Compare(expected, got); len(diff) > 0 {
+		t.Errorf("series didn't match:\n%s", diff)
+	}
+	if sent := remoteWriteExportSuccess.Value() - before; sent != 3 {
+		t.Errorf("sent series not counted: got %d, want 3", sent)
+	}
+}
+
+// TestRemoteWriteEncoding tests that a write request is encoded as the
+// Prometheus remote write protocol's WriteRequest message.
+func TestRemoteWriteEncoding(t *testing.T) {
+	req := &writeRequest{Timeseries: []timeSeries{{
+		Labels:  []label{{Name: "a", Value: "b"}},
+		Samples: []sample{{Value: 1, Timestamp: 2}},
+	}}}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0x0a, 0x15, // timeseries
+		0x0a, 0x06, // labels
+		0x0a, 0x01, 'a', // name
+		0x12, 0x01, 'b', // value
+		0x12, 0x0b, // samples
+		0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, // value
+		0x10, 0x02, // timestamp
+	}
+	if !reflect.DeepEqual(expected, b) {
+		t.Errorf("write request encoding: got % x, want % x", b, expected)
+	}
+}
+
+func TestRemoteWritePushFailed(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer s.Close()
+
+	ms := metrics.NewStore()
+	m := metrics.NewMetric("foo", "prog", metrics.Gauge)
+	d, _ := m.GetDatum()
+	d.Set(37, time.Unix(1343124840, 0))
+	ms.Add(m)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", RemoteWriteURL: s.URL})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	failures, dropped := remoteWriteFailures.Value(), remoteWriteExportDropped.Value()
+	e.WriteMetrics()
+	if n := remoteWriteFailures.Value() - failures; n != 1 {
+		t.Errorf("failed writes: got %d, want 1", n)
+	}
+	if n := remoteWriteExportDropped.Value() - dropped; n != 1 {
+		t.Errorf("dropped series: got %d, want 1", n)
+	}
 }
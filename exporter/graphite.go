@@ -14,17 +14,48 @@ import (
 var (
 	graphiteHostPort = flag.String("graphite_host_port", "",
 		"Host:port to graphite carbon server to write metrics to.")
+	graphitePrefix = flag.String("graphite_prefix", "",
+		"Prefix for the path of each metric written to graphite.")
+	graphiteLabelSeparator = flag.String("graphite_label_separator", ".",
+		"Separator between the label keys and values flattened into graphite metric paths.")
+	graphitePushInterval = flag.Duration("graphite_push_interval", 0,
+		"Interval between metric pushes to graphite. Uses metric_push_interval_seconds if zero.")
 
 	graphiteExportTotal   = expvar.NewInt("graphite_export_total")
 	graphiteExportSuccess = expvar.NewInt("graphite_export_success")
+	graphiteExportDropped = expvar.NewInt("graphite_export_dropped")
 )
 
-func metricToGraphite(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
-	m.RLock()
-	defer m.RUnlock()
-	return fmt.Sprintf("%s.%s %v %v\n",
-		m.Program,
-		formatLabels(m.Name, l.Labels, ".", "."),
+// graphiteFormatter formats metrics in the carbon plaintext protocol, with the
+// labels flattened into the metric path.
+type graphiteFormatter struct {
+	prefix string // Prepended to each metric path, if not empty.
+	sep    string // Separates the label keys and values in the metric path.
+}
+
+// path returns the metric path for the series of a LabelSet.
+func (g *graphiteFormatter) path(m *metrics.Metric, suffix string, labels map[string]string) string {
+	p := m.Program + "." + formatLabels(m.ExportedName()+suffix, labels, g.sep, g.sep)
+	if g.prefix != "" {
+		p = g.prefix + "." + p
+	}
+	return p
+}
+
+func (g *graphiteFormatter) format(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	if m.Kind == metrics.Histogram {
+		var r string
+		for _, hs := range histogramToSeries(l.Datum) {
+			p := g.path(m, hs.suffix, l.Labels)
+			if hs.le != "" {
+				p += g.sep + "le" + g.sep + hs.le
+			}
+			r += fmt.Sprintf("%s %v %v\n", p, hs.value, l.Datum.Time/1e9)
+		}
+		return r
+	}
+	return fmt.Sprintf("%s %v %v\n",
+		g.path(m, "", l.Labels),
 		l.Datum.Get(),
 		l.Datum.Time/1e9)
 }
@@ -0,0 +1,88 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// httpPushAttempts is the number of times a push exporter posts a
+	// request before its metrics are dropped.
+	httpPushAttempts = 3
+	// httpPushTimeout is the longest a push request may take.
+	httpPushTimeout = 10 * time.Second
+)
+
+// httpPusher posts metrics to the HTTP endpoint of a push exporter.
+type httpPusher struct {
+	url         string
+	contentType string
+	header      http.Header   // Extra headers sent with each request.
+	retryDelay  time.Duration // Wait before posting a failed request again, doubled each attempt.
+	client      *http.Client
+}
+
+func newHTTPPusher(url, contentType string) *httpPusher {
+	return &httpPusher{
+		url:         url,
+		contentType: contentType,
+		header:      make(http.Header),
+		retryDelay:  time.Second,
+		client:      &http.Client{Timeout: httpPushTimeout},
+	}
+}
+
+// post posts the body, retrying after connection errors, server errors and
+// rate limiting.  Other errors, such as the metrics being rejected, aren't
+// retried as they'd fail again.  It reports whether the post succeeded.
+func (h *httpPusher) post(body string) bool {
+	delay := h.retryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := h.postOnce(body)
+		if err == nil {
+			return true
+		}
+		glog.Infof("push to %s failed, attempt %d: %s", h.url, attempt, err)
+		if !retry || attempt == httpPushAttempts {
+			return false
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postOnce posts the body, reporting whether a failure may succeed if
+// retried.
+func (h *httpPusher) postOnce(body string) (retry bool, err error) {
+	req, err := http.NewRequest("POST", h.url, strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range h.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", h.contentType)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("%s: %s", resp.Status, msg)
+	default:
+		return false, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+}
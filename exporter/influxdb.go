@@ -0,0 +1,123 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"expvar"
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/google/mtail/metrics"
+)
+
+var (
+	influxdbURL = flag.String("influxdb_url", "",
+		"Base URL of the InfluxDB server to write metrics to over HTTP, such as http://localhost:8086.")
+	influxdbUDPHostPort = flag.String("influxdb_udp_host_port", "",
+		"Host:port of an InfluxDB UDP listener to write metrics to.")
+	influxdbDatabase = flag.String("influxdb_database", "mtail",
+		"InfluxDB database, or bucket, to write metrics to over HTTP.")
+	influxdbPrecision = flag.String("influxdb_precision", "s",
+		"Precision of the timestamps written to InfluxDB: ns, u, ms or s.")
+	influxdbPushInterval = flag.Duration("influxdb_push_interval", 0,
+		"Interval between metric pushes to InfluxDB. Uses metric_push_interval_seconds if zero.")
+
+	influxdbExportTotal   = expvar.NewInt("influxdb_export_total")
+	influxdbExportSuccess = expvar.NewInt("influxdb_export_success")
+	influxdbExportDropped = expvar.NewInt("influxdb_export_dropped")
+)
+
+// influxDBPrecisions maps each timestamp precision to the nanoseconds in a
+// unit of it.
+var influxDBPrecisions = map[string]int64{
+	"ns": 1,
+	"u":  1e3,
+	"ms": 1e6,
+	"s":  1e9,
+}
+
+// influxDBFormatter formats metrics in the InfluxDB line protocol.  Each
+// metric is a measurement with the labels as tags, along with the host and
+// program, and the datum in the field "value".
+type influxDBFormatter struct {
+	unit int64 // Nanoseconds in a unit of the timestamp precision.
+}
+
+func newInfluxDBFormatter(precision string) (*influxDBFormatter, error) {
+	unit, ok := influxDBPrecisions[precision]
+	if !ok {
+		return nil, fmt.Errorf("unsupported InfluxDB precision %q, must be ns, u, ms or s", precision)
+	}
+	return &influxDBFormatter{unit}, nil
+}
+
+var (
+	influxDBMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxDBTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// line returns the line for a series of a LabelSet, with the extra tag le if
+// not empty.
+func (f *influxDBFormatter) line(hostname string, m *metrics.Metric, suffix string, labels map[string]string, le string, value, ts int64) string {
+	tags := map[string]string{"host": hostname, "prog": m.Program}
+	for k, v := range labels {
+		tags[k] = v
+	}
+	if le != "" {
+		tags["le"] = le
+	}
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		// The line protocol has no empty tag values.
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	b.WriteString(influxDBMeasurementEscaper.Replace(m.ExportedName() + suffix))
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s=%s", influxDBTagEscaper.Replace(k), influxDBTagEscaper.Replace(tags[k]))
+	}
+	fmt.Fprintf(&b, " value=%di %d\n", value, ts/f.unit)
+	return b.String()
+}
+
+func (f *influxDBFormatter) format(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	if m.Kind == metrics.Histogram {
+		var r string
+		for _, hs := range histogramToSeries(l.Datum) {
+			r += f.line(hostname, m, hs.suffix, l.Labels, hs.le, hs.value, l.Datum.Time)
+		}
+		return r
+	}
+	return f.line(hostname, m, "", l.Labels, "", l.Datum.Get(), l.Datum.Time)
+}
+
+// influxDBPusher writes the lines formatted by influxDBFormatter to the
+// /write endpoint of an InfluxDB server.
+type influxDBPusher struct {
+	*httpPusher
+}
+
+func newInfluxDBPusher(baseURL, database, precision string) *influxDBPusher {
+	q := url.Values{"db": {database}, "precision": {precision}}
+	u := strings.TrimSuffix(baseURL, "/") + "/write?" + q.Encode()
+	return &influxDBPusher{newHTTPPusher(u, "text/plain; charset=utf-8")}
+}
+
+// send writes the lines in one request, retried as by httpPusher.post.
+func (p *influxDBPusher) send(lines []string) (sent, dropped int) {
+	if len(lines) == 0 {
+		return 0, 0
+	}
+	if p.post(strings.Join(lines, "")) {
+		return len(lines), 0
+	}
+	return 0, len(lines)
+}
@@ -7,6 +7,9 @@ import (
 	"encoding/json"
 	"expvar"
 	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
 
 	"github.com/golang/glog"
 )
@@ -17,10 +20,69 @@ var (
 
 // HandleJSON exports the metrics in JSON format via HTTP.
 func (e *Exporter) HandleJSON(w http.ResponseWriter, r *http.Request) {
-	e.store.RLock()
-	defer e.store.RUnlock()
+	b, err := json.MarshalIndent(e.exportedMetrics(), "", "  ")
+	if err != nil {
+		exportJSONErrors.Add(1)
+		glog.Info("error marshalling metrics into json:", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.Write(b)
+}
+
+// jsonMetric is a metric as exported by HandleMetricsJSON.
+type jsonMetric struct {
+	Name    string       `json:"name"`
+	Kind    string       `json:"kind"`
+	Help    string       `json:"help"`
+	Samples []jsonSample `json:"samples"`
+}
+
+// jsonSample is the value of one label set of a metric, timestamped in
+// nanoseconds since the unix epoch.  The value of a histogram or summary is
+// the sum of its observations.
+type jsonSample struct {
+	Labels    map[string]string `json:"labels"`
+	Value     int64             `json:"value"`
+	Timestamp int64             `json:"timestamp"`
 
-	b, err := json.MarshalIndent(e.store.Metrics, "", "  ")
+	key string // The label values in the order of the metric's keys, for sorting.
+}
+
+// HandleMetricsJSON exports every metric and its label sets as JSON via HTTP,
+// in a simpler form than HandleJSON's.  Metrics are ordered by name and then
+// program, and each metric's samples by their labels, so that successive
+// dumps can be diffed.
+func (e *Exporter) HandleMetricsJSON(w http.ResponseWriter, r *http.Request) {
+	ms := e.exportedMetrics()
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].ExportedName() != ms[j].ExportedName() {
+			return ms[i].ExportedName() < ms[j].ExportedName()
+		}
+		return ms[i].Program < ms[j].Program
+	})
+
+	jms := make([]jsonMetric, 0, len(ms))
+	for _, m := range ms {
+		metricExportTotal.Add(1)
+		jm := jsonMetric{
+			Name:    m.ExportedName(),
+			Kind:    strings.ToLower(m.Kind.String()),
+			Help:    metricHelp(m),
+			Samples: []jsonSample{},
+		}
+		for _, l := range m.LabelSets() {
+			var labels []string
+			for _, k := range m.Keys {
+				labels = append(labels, l.Labels[k])
+			}
+			jm.Samples = append(jm.Samples, jsonSample{l.Labels, l.Datum.Get(), atomic.LoadInt64(&l.Datum.Time), strings.Join(labels, "\x00")})
+		}
+		sort.Slice(jm.Samples, func(i, j int) bool { return jm.Samples[i].key < jm.Samples[j].key })
+		jms = append(jms, jm)
+	}
+	b, err := json.MarshalIndent(jms, "", "  ")
 	if err != nil {
 		exportJSONErrors.Add(1)
 		glog.Info("error marshalling metrics into json:", err.Error())
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/google/mtail/metrics"
 	"github.com/kylelemons/godebug/pretty"
@@ -22,6 +23,17 @@ var handleJSONTests = []struct {
 		[]*metrics.Metric{},
 		"[]",
 	},
+	{"hidden",
+		[]*metrics.Metric{
+			&metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Gauge,
+				Hidden:      true,
+				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{}, Value: &metrics.Datum{Value: 1}}}},
+		},
+		"[]",
+	},
 	{"single",
 		[]*metrics.Metric{
 			&metrics.Metric{
@@ -89,7 +101,7 @@ func TestHandleJSON(t *testing.T) {
 		for _, metric := range tc.metrics {
 			ms.Add(metric)
 		}
-		o := Options{ms, "gunstar"}
+		o := Options{Store: ms, Hostname: "gunstar"}
 		e, err := New(o)
 		if err != nil {
 			t.Fatalf("couldn't make exporter: %s", err)
@@ -109,3 +121,67 @@ func TestHandleJSON(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleMetricsJSON(t *testing.T) {
+	ms := metrics.NewStore()
+	requests := metrics.NewMetric("requests", "apache.mtail", metrics.Counter, "code")
+	requests.Help = "Requests served, by response code"
+	for _, code := range []string{"500", "200"} {
+		d, _ := requests.GetDatum(code)
+		d.Set(2, time.Unix(0, 1500000000000000000))
+	}
+	lineCount := metrics.NewMetric("line_count", "linecount.mtail", metrics.Counter)
+	d, _ := lineCount.GetDatum()
+	d.Set(3, time.Unix(0, 1500000000000000000))
+	hidden := metrics.NewMetric("hidden", "linecount.mtail", metrics.Gauge)
+	hidden.Hidden = true
+	ms.Add(requests, lineCount, hidden)
+
+	e, err := New(Options{Store: ms, Hostname: "gunstar"})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	response := httptest.NewRecorder()
+	e.HandleMetricsJSON(response, &http.Request{})
+	if response.Code != 200 {
+		t.Errorf("response code not 200: %d", response.Code)
+	}
+	expected := `[
+  {
+    "name": "line_count",
+    "kind": "counter",
+    "help": "line_count defined in linecount.mtail",
+    "samples": [
+      {
+        "labels": {},
+        "value": 3,
+        "timestamp": 1500000000000000000
+      }
+    ]
+  },
+  {
+    "name": "requests",
+    "kind": "counter",
+    "help": "Requests served, by response code",
+    "samples": [
+      {
+        "labels": {
+          "code": "200"
+        },
+        "value": 2,
+        "timestamp": 1500000000000000000
+      },
+      {
+        "labels": {
+          "code": "500"
+        },
+        "value": 2,
+        "timestamp": 1500000000000000000
+      }
+    ]
+  }
+]`
+	if diff := pretty.Compare(response.Body.String(), expected); len(diff) > 0 {
+		t.Errorf("response not expected:\n%s", diff)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"flag"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+)
+
+var (
+	opentsdbURL = flag.String("opentsdb_url", "",
+		"Base URL of the OpenTSDB server to put metrics to, such as http://localhost:4242.")
+	opentsdbBatchSize = flag.Int("opentsdb_batch_size", 50,
+		"Most data points put to OpenTSDB in one request.")
+	opentsdbPushInterval = flag.Duration("opentsdb_push_interval", 0,
+		"Interval between metric pushes to OpenTSDB. Uses metric_push_interval_seconds if zero.")
+
+	opentsdbExportTotal   = expvar.NewInt("opentsdb_export_total")
+	opentsdbExportSuccess = expvar.NewInt("opentsdb_export_success")
+	opentsdbExportDropped = expvar.NewInt("opentsdb_export_dropped")
+)
+
+// openTSDBPoint is a data point in the JSON format of OpenTSDB's /api/put.
+type openTSDBPoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"` // Milliseconds since the epoch.
+	Value     int64             `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// openTSDBName replaces the characters that OpenTSDB doesn't allow in metric
+// names and tags with underscores.
+func openTSDBName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '-', r == '_', r == '.', r == '/':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// openTSDBPoints returns the data points of a LabelSet, with the labels as
+// tags along with the host and program.  A histogram has a point for each of
+// its series.
+func openTSDBPoints(hostname string, m *metrics.Metric, l *metrics.LabelSet) []openTSDBPoint {
+	tags := func(le string) map[string]string {
+		t := map[string]string{"host": openTSDBName(hostname), "prog": openTSDBName(m.Program)}
+		for k, v := range l.Labels {
+			// OpenTSDB rejects empty tag values.
+			if v != "" {
+				t[openTSDBName(k)] = openTSDBName(v)
+			}
+		}
+		if le != "" {
+			t["le"] = openTSDBName(le)
+		}
+		return t
+	}
+	ts := l.Datum.Time / 1e6
+	if m.Kind == metrics.Histogram {
+		var r []openTSDBPoint
+		for _, hs := range histogramToSeries(l.Datum) {
+			r = append(r, openTSDBPoint{openTSDBName(m.ExportedName() + hs.suffix), ts, hs.value, tags(hs.le)})
+		}
+		return r
+	}
+	return []openTSDBPoint{{openTSDBName(m.ExportedName()), ts, l.Datum.Get(), tags("")}}
+}
+
+// openTSDBFormat formats the data points of a LabelSet as JSON objects, one
+// per line.
+func openTSDBFormat(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	var b bytes.Buffer
+	for _, p := range openTSDBPoints(hostname, m, l) {
+		j, err := json.Marshal(p)
+		if err != nil {
+			glog.Infof("error marshalling %s into json: %s", p.Metric, err)
+			continue
+		}
+		b.Write(j)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// openTSDBPusher puts the data points formatted by openTSDBFormat to an
+// OpenTSDB server in batches.
+type openTSDBPusher struct {
+	*httpPusher
+	batchSize int // Most data points put in one request.
+}
+
+func newOpenTSDBPusher(baseURL string, batchSize int) *openTSDBPusher {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &openTSDBPusher{
+		httpPusher: newHTTPPusher(strings.TrimSuffix(baseURL, "/")+"/api/put", "application/json"),
+		batchSize:  batchSize,
+	}
+}
+
+// send puts the data points of the lines, returning the number put and the
+// number dropped after a batch failed to be put.  A failed batch is retried
+// as by httpPusher.post.
+func (p *openTSDBPusher) send(lines []string) (sent, dropped int) {
+	var points []string
+	for _, l := range lines {
+		for _, point := range strings.Split(l, "\n") {
+			if point != "" {
+				points = append(points, point)
+			}
+		}
+	}
+	for len(points) > 0 {
+		n := p.batchSize
+		if n > len(points) {
+			n = len(points)
+		}
+		if p.post("[" + strings.Join(points[:n], ",") + "]") {
+			sent += n
+		} else {
+			dropped += n
+		}
+		points = points[n:]
+	}
+	return sent, dropped
+}
@@ -5,66 +5,223 @@ package exporter
 
 import (
 	"expvar"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/golang/glog"
 	"github.com/google/mtail/metrics"
 )
 
 var (
+	prometheusTimestamps = flag.Bool("prometheus_timestamps", false,
+		"Export the time each sample was last updated to Prometheus. Prometheus records the scrape time if omitted, which is preferred unless the samples are relayed.")
+
 	metricExportTotal = expvar.NewInt("metric_export_total")
 )
 
 const (
 	prometheusFormat = "%s{%s} %d\n"
+
+	// expvarPrefix is prepended to the names of mtail's internal expvars
+	// when they are exported, to keep them apart from program metrics.
+	expvarPrefix = "mtail_"
+)
+
+var (
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
 )
 
-func noHyphens(s string) string {
-	return strings.Replace(s, "-", "_", -1)
+// sanitizedNames holds the names that prometheusName has warned about, so
+// that each is only logged once.
+var sanitizedNames = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+// prometheusName returns s as a valid Prometheus metric or label name, as by
+// metrics.PrometheusName.  The first time a name is changed, a warning is
+// logged; programs can be held to valid names with the strict_metric_names
+// flag instead.
+func prometheusName(s string) string {
+	name := metrics.PrometheusName(s)
+	if name != s {
+		sanitizedNames.Lock()
+		if !sanitizedNames.m[s] {
+			sanitizedNames.m[s] = true
+			glog.Warningf("Name %q is not valid in Prometheus, exporting it as %q", s, name)
+		}
+		sanitizedNames.Unlock()
+	}
+	return name
+}
+
+// formatPrometheusLabels formats the labels of a LabelSet, followed by the
+// prog and instance labels, escaping each value.
+func formatPrometheusLabels(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	var s []string
+	for k, v := range l.Labels {
+		s = append(s, fmt.Sprintf("%s=\"%s\"", prometheusName(k), labelValueEscaper.Replace(v)))
+	}
+	sort.Strings(s)
+	s = append(s, fmt.Sprintf("prog=\"%s\"", labelValueEscaper.Replace(m.Program)))
+	s = append(s, fmt.Sprintf("instance=\"%s\"", labelValueEscaper.Replace(hostname)))
+	return strings.Join(s, ",")
 }
 
 // HandlePrometheusMetrics exports the metrics in a format readable by
 // Prometheus via HTTP.
 func (e *Exporter) HandlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
-	e.store.RLock()
-	defer e.store.RUnlock()
-
 	w.Header().Add("Content-type", "text/plain; version=0.0.4")
 
-	for _, m := range e.store.Metrics {
-		m.RLock()
+	for _, m := range e.exportedMetrics() {
 		metricExportTotal.Add(1)
 
+		fmt.Fprintf(w,
+			"# HELP %s %s\n",
+			prometheusName(m.ExportedName()),
+			helpEscaper.Replace(metricHelp(m)))
 		fmt.Fprintf(w,
 			"# TYPE %s %s\n",
-			noHyphens(m.Name),
+			prometheusName(m.ExportedName()),
 			kindToPrometheusType(m.Kind))
-		lc := make(chan *metrics.LabelSet)
-		go m.EmitLabelSets(lc)
-		for l := range lc {
-			line := metricToPrometheus(e.hostname, m, l)
+		var updated []*metrics.LabelSet
+		for _, l := range m.LabelSets() {
+			if m.ExportUpdated && !l.Updated.IsZero() {
+				updated = append(updated, l)
+			}
+			var line string
+			switch m.Kind {
+			case metrics.Histogram:
+				line = histogramToPrometheus(e.hostname, m, l)
+			case metrics.Summary:
+				line = summaryToPrometheus(e.hostname, m, l)
+			default:
+				line = metricToPrometheus(e.hostname, m, l)
+			}
+			if e.timestamps {
+				line = withPrometheusTimestamp(line, l.Datum)
+			}
 			fmt.Fprint(w, line)
 		}
-		m.RUnlock()
+		if m.ExportUpdated {
+			writePrometheusUpdated(w, e.hostname, m, updated)
+		}
+	}
+
+	if !e.omitExpvars {
+		writePrometheusExpvars(w)
 	}
 }
 
-func metricToPrometheus(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
-	var s []string
-	for k, v := range l.Labels {
-		s = append(s, fmt.Sprintf("%s=\"%s\"", k, v))
+// withPrometheusTimestamp appends the time d was last updated, in
+// milliseconds since the epoch, to each sample in lines.  Samples of a datum
+// that has never been updated are left without one.
+func withPrometheusTimestamp(lines string, d *metrics.Datum) string {
+	ns := atomic.LoadInt64(&d.Time)
+	if ns == 0 {
+		return lines
 	}
-	sort.Strings(s)
-	s = append(s, fmt.Sprintf("prog=\"%s\"", m.Program))
-	s = append(s, fmt.Sprintf("instance=\"%s\"", hostname))
+	return strings.Replace(lines, "\n", fmt.Sprintf(" %d\n", ns/1e6), -1)
+}
+
+// writePrometheusUpdated writes the companion gauge of a metric that exports
+// update times, with a series for each of its label sets carrying the time it
+// was last updated, in seconds since the epoch, for staleness alerts.
+func writePrometheusUpdated(w io.Writer, hostname string, m *metrics.Metric, ls []*metrics.LabelSet) {
+	name := prometheusName(m.ExportedName()) + "_updated_seconds"
+	fmt.Fprintf(w, "# HELP %s Time %s was last updated, in seconds since the epoch\n", name, m.ExportedName())
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	for _, l := range ls {
+		fmt.Fprintf(w, prometheusFormat, name, formatPrometheusLabels(hostname, m, l), l.Updated.Unix())
+	}
+}
+
+// writePrometheusExpvars writes the integer and float expvars, and maps of
+// them, that describe mtail itself.  Keys of maps become the "key" label.
+// Those created as gauges are typed so, and the rest are untyped.  Info
+// expvars are written as a gauge of 1 for each of their label sets.
+func writePrometheusExpvars(w io.Writer) {
+	expvar.Do(func(kv expvar.KeyValue) {
+		name := expvarPrefix + prometheusName(kv.Key)
+		typ := "untyped"
+		if metrics.IsGauge(kv.Key) {
+			typ = "gauge"
+		}
+		switch v := kv.Value.(type) {
+		case *expvar.Int, *expvar.Float:
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			fmt.Fprintf(w, "%s %s\n", name, v)
+		case *expvar.Map:
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+			v.Do(func(mkv expvar.KeyValue) {
+				switch mkv.Value.(type) {
+				case *expvar.Int, *expvar.Float:
+					fmt.Fprintf(w, "%s{key=\"%s\"} %s\n", name, labelValueEscaper.Replace(mkv.Key), mkv.Value)
+				}
+			})
+		case *metrics.Info:
+			fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+			v.Do(func(labels map[string]string) {
+				var s []string
+				for k, lv := range labels {
+					s = append(s, fmt.Sprintf("%s=\"%s\"", prometheusName(k), labelValueEscaper.Replace(lv)))
+				}
+				sort.Strings(s)
+				fmt.Fprintf(w, "%s{%s} 1\n", name, strings.Join(s, ","))
+			})
+		}
+	})
+}
+
+func metricToPrometheus(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
 	return fmt.Sprintf(prometheusFormat,
-		noHyphens(m.Name),
-		strings.Join(s, ","),
+		prometheusName(m.ExportedName()),
+		formatPrometheusLabels(hostname, m, l),
 		l.Datum.Get())
 }
 
+// histogramToPrometheus formats a histogram LabelSet as the cumulative
+// _bucket series, followed by the _sum and _count series.
+func histogramToPrometheus(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	labels := formatPrometheusLabels(hostname, m, l)
+
+	var r string
+	for _, hs := range histogramToSeries(l.Datum) {
+		ls := labels
+		if hs.le != "" {
+			ls += fmt.Sprintf(",le=\"%s\"", hs.le)
+		}
+		r += fmt.Sprintf(prometheusFormat, prometheusName(m.ExportedName())+hs.suffix, ls, hs.value)
+	}
+	return r
+}
+
+// summaryToPrometheus formats a summary LabelSet as a series for each quantile
+// estimated, followed by the _sum and _count series.  A quantile is NaN until
+// there are observations.
+func summaryToPrometheus(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	labels := formatPrometheusLabels(hostname, m, l)
+	name := prometheusName(m.ExportedName())
+
+	var r string
+	for _, q := range m.Quantiles {
+		r += fmt.Sprintf("%s{%s,quantile=\"%s\"} %s\n", name, labels,
+			strconv.FormatFloat(q, 'f', -1, 64),
+			strconv.FormatFloat(l.Datum.GetQuantile(q), 'g', -1, 64))
+	}
+	r += fmt.Sprintf(prometheusFormat, name+"_sum", labels, l.Datum.Get())
+	r += fmt.Sprintf(prometheusFormat, name+"_count", labels, l.Datum.GetCount())
+	return r
+}
+
 func kindToPrometheusType(kind metrics.Kind) string {
 	if kind != metrics.Timer {
 		return strings.ToLower(kind.String())
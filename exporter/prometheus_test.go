@@ -7,8 +7,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/mtail/clock"
 	"github.com/google/mtail/metrics"
 	"github.com/kylelemons/godebug/pretty"
 )
@@ -22,6 +25,17 @@ var handlePrometheusTests = []struct {
 		[]*metrics.Metric{},
 		"",
 	},
+	{"hidden",
+		[]*metrics.Metric{
+			&metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Gauge,
+				Hidden:      true,
+				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{}, Value: &metrics.Datum{Value: 1}}}},
+		},
+		"",
+	},
 	{"single",
 		[]*metrics.Metric{
 			&metrics.Metric{
@@ -30,8 +44,23 @@ var handlePrometheusTests = []struct {
 				Kind:        metrics.Counter,
 				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{}, Value: &metrics.Datum{Value: 1}}}},
 		},
-		`# TYPE foo counter
+		`# HELP foo foo defined in test
+# TYPE foo counter
 foo{prog="test",instance="gunstar"} 1
+`,
+	},
+	{"help",
+		[]*metrics.Metric{
+			&metrics.Metric{
+				Name:        "errors",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				Help:        "Total application errors\nin C:\\app",
+				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{}, Value: &metrics.Datum{Value: 1}}}},
+		},
+		`# HELP errors Total application errors\nin C:\\app
+# TYPE errors counter
+errors{prog="test",instance="gunstar"} 1
 `,
 	},
 	{"dimensioned",
@@ -44,7 +73,8 @@ foo{prog="test",instance="gunstar"} 1
 				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{"1", "2"}, Value: &metrics.Datum{Value: 1}}},
 			},
 		},
-		`# TYPE foo counter
+		`# HELP foo foo defined in test
+# TYPE foo counter
 foo{a="1",b="2",prog="test",instance="gunstar"} 1
 `,
 	},
@@ -56,7 +86,8 @@ foo{a="1",b="2",prog="test",instance="gunstar"} 1
 				Kind:        metrics.Gauge,
 				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{}, Value: &metrics.Datum{Value: 1}}}},
 		},
-		`# TYPE foo gauge
+		`# HELP foo foo defined in test
+# TYPE foo gauge
 foo{prog="test",instance="gunstar"} 1
 `,
 	},
@@ -68,10 +99,93 @@ foo{prog="test",instance="gunstar"} 1
 				Kind:        metrics.Timer,
 				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{}, Value: &metrics.Datum{Value: 1}}}},
 		},
-		`# TYPE foo gauge
+		`# HELP foo foo defined in test
+# TYPE foo gauge
 foo{prog="test",instance="gunstar"} 1
 `,
 	},
+	{"escaped label values",
+		[]*metrics.Metric{
+			&metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				Keys:        []string{"a"},
+				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{"say \"hi\"\\\n"}, Value: &metrics.Datum{Value: 1}}},
+			},
+		},
+		`# HELP foo foo defined in test
+# TYPE foo counter
+foo{a="say \"hi\"\\\n",prog="test",instance="gunstar"} 1
+`,
+	},
+	{"sanitized names",
+		[]*metrics.Metric{
+			&metrics.Metric{
+				Name:        "5xx.requests-total",
+				Program:     "test",
+				Kind:        metrics.Counter,
+				Keys:        []string{"status-code"},
+				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{"503"}, Value: &metrics.Datum{Value: 1}}},
+			},
+		},
+		`# HELP x5xx_requests_total 5xx.requests-total defined in test
+# TYPE x5xx_requests_total counter
+x5xx_requests_total{status_code="503",prog="test",instance="gunstar"} 1
+`,
+	},
+	{"histogram",
+		[]*metrics.Metric{
+			&metrics.Metric{
+				Name:    "foo",
+				Program: "test",
+				Kind:    metrics.Histogram,
+				Buckets: []int64{10, 100},
+				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{},
+					Value: &metrics.Datum{Value: 221, Count: 3,
+						Buckets: []metrics.Bucket{{UpperBound: 10, Count: 1}, {UpperBound: 100, Count: 2}}}}}},
+		},
+		`# HELP foo foo defined in test
+# TYPE foo histogram
+foo_bucket{prog="test",instance="gunstar",le="10"} 1
+foo_bucket{prog="test",instance="gunstar",le="100"} 2
+foo_bucket{prog="test",instance="gunstar",le="+Inf"} 3
+foo_sum{prog="test",instance="gunstar"} 221
+foo_count{prog="test",instance="gunstar"} 3
+`,
+	},
+	{"summary",
+		[]*metrics.Metric{summaryMetric(1, 2, 3)},
+		`# HELP foo foo defined in test
+# TYPE foo summary
+foo{prog="test",instance="gunstar",quantile="0.5"} 2
+foo{prog="test",instance="gunstar",quantile="0.99"} 3
+foo_sum{prog="test",instance="gunstar"} 6
+foo_count{prog="test",instance="gunstar"} 3
+`,
+	},
+	{"summary without observations",
+		[]*metrics.Metric{summaryMetric()},
+		`# HELP foo foo defined in test
+# TYPE foo summary
+foo{prog="test",instance="gunstar",quantile="0.5"} NaN
+foo{prog="test",instance="gunstar",quantile="0.99"} NaN
+foo_sum{prog="test",instance="gunstar"} 0
+foo_count{prog="test",instance="gunstar"} 0
+`,
+	},
+}
+
+// summaryMetric returns a summary of the median and 99th percentile, with the
+// values observed.
+func summaryMetric(values ...int64) *metrics.Metric {
+	m := metrics.NewMetric("foo", "test", metrics.Summary)
+	m.Quantiles = []float64{0.5, 0.99}
+	d, _ := m.GetDatum()
+	for _, v := range values {
+		d.Observe(v, time.Unix(0, 0))
+	}
+	return m
 }
 
 func TestHandlePrometheus(t *testing.T) {
@@ -80,7 +194,7 @@ func TestHandlePrometheus(t *testing.T) {
 		for _, metric := range tc.metrics {
 			ms.Add(metric)
 		}
-		o := Options{ms, "gunstar"}
+		o := Options{Store: ms, Hostname: "gunstar", OmitInternalMetrics: true}
 		e, err := New(o)
 		if err != nil {
 			t.Fatalf("couldn't make exporter: %s", err)
@@ -100,3 +214,131 @@ func TestHandlePrometheus(t *testing.T) {
 		}
 	}
 }
+
+var testDepth = metrics.NewGaugeInt("exporter_test_depth")
+
+func TestHandlePrometheusExpvars(t *testing.T) {
+	testDepth.Set(3)
+	o := Options{Store: metrics.NewStore(), Hostname: "gunstar"}
+	e, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	response := httptest.NewRecorder()
+	e.HandlePrometheusMetrics(response, &http.Request{})
+	b, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %s", err)
+	}
+	for _, expected := range []string{
+		"# TYPE mtail_metric_export_total untyped\nmtail_metric_export_total ",
+		"# TYPE mtail_exporter_test_depth gauge\nmtail_exporter_test_depth 3\n",
+	} {
+		if !strings.Contains(string(b), expected) {
+			t.Errorf("response doesn't contain %q:\n%s", expected, b)
+		}
+	}
+}
+
+// TestHandlePrometheusUpdated tests that a metric that exports update times
+// has a companion series per label set, which advances when it's written.
+func TestHandlePrometheusUpdated(t *testing.T) {
+	ms := metrics.NewStore()
+	c := clock.NewFakeClock(time.Unix(1500000000, 0))
+	ms.SetClock(c)
+	requests := metrics.NewMetric("requests", "test", metrics.Counter, "code")
+	requests.ExportUpdated = true
+	ms.Add(requests)
+	e, err := New(Options{Store: ms, Hostname: "gunstar", OmitInternalMetrics: true})
+	if err != nil {
+		t.Fatalf("couldn't make exporter: %s", err)
+	}
+	updated := func() string {
+		response := httptest.NewRecorder()
+		e.HandlePrometheusMetrics(response, &http.Request{})
+		for _, line := range strings.Split(response.Body.String(), "\n") {
+			if strings.HasPrefix(line, "requests_updated_seconds{") {
+				return line
+			}
+		}
+		t.Fatalf("no companion series in response:\n%s", response.Body)
+		return ""
+	}
+
+	d, _ := requests.GetDatum("200")
+	d.IncBy(1, c.Now())
+	expected := `requests_updated_seconds{code="200",prog="test",instance="gunstar"} 1500000000`
+	if got := updated(); got != expected {
+		t.Errorf("update time: got %q, want %q", got, expected)
+	}
+	c.Advance(time.Minute)
+	d, _ = requests.GetDatum("200")
+	d.IncBy(1, c.Now())
+	expected = `requests_updated_seconds{code="200",prog="test",instance="gunstar"} 1500000060`
+	if got := updated(); got != expected {
+		t.Errorf("update time after a write: got %q, want %q", got, expected)
+	}
+}
+
+// TestHandlePrometheusTimestamps tests that samples carry the time they were
+// last updated, in milliseconds, only when timestamps are enabled.
+func TestHandlePrometheusTimestamps(t *testing.T) {
+	for _, tc := range []struct {
+		timestamps bool
+		expected   string
+	}{
+		{false, `# HELP foo foo defined in test
+# TYPE foo histogram
+foo_bucket{prog="test",instance="gunstar",le="1"} 0
+foo_bucket{prog="test",instance="gunstar",le="+Inf"} 1
+foo_sum{prog="test",instance="gunstar"} 3
+foo_count{prog="test",instance="gunstar"} 1
+`},
+		{true, `# HELP foo foo defined in test
+# TYPE foo histogram
+foo_bucket{prog="test",instance="gunstar",le="1"} 0 1500000000123
+foo_bucket{prog="test",instance="gunstar",le="+Inf"} 1 1500000000123
+foo_sum{prog="test",instance="gunstar"} 3 1500000000123
+foo_count{prog="test",instance="gunstar"} 1 1500000000123
+`},
+	} {
+		ms := metrics.NewStore()
+		m := metrics.NewMetric("foo", "test", metrics.Histogram)
+		m.Buckets = []int64{1}
+		d, _ := m.GetDatum()
+		d.Observe(3, time.Unix(1500000000, 123456789))
+		ms.Add(m)
+		e, err := New(Options{Store: ms, Hostname: "gunstar", OmitInternalMetrics: true, PrometheusTimestamps: tc.timestamps})
+		if err != nil {
+			t.Fatalf("couldn't make exporter: %s", err)
+		}
+		response := httptest.NewRecorder()
+		e.HandlePrometheusMetrics(response, &http.Request{})
+		if diff := pretty.Compare(response.Body.String(), tc.expected); len(diff) > 0 {
+			t.Errorf("timestamps %v: response not expected:\n%s", tc.timestamps, diff)
+		}
+	}
+}
+
+var prometheusNameTests = []struct {
+	name     string
+	expected string
+}{
+	{"foo_bar", "foo_bar"},
+	{"foo-bar", "foo_bar"},
+	{"foo.bar.baz", "foo_bar_baz"},
+	{"5xx_responses", "x5xx_responses"},
+	{"9.x-y", "x9_x_y"},
+	{"_foo", "_foo"},
+	{"__foo", "x__foo"},
+	{"..foo", "x__foo"},
+	{"", "x"},
+}
+
+func TestPrometheusName(t *testing.T) {
+	for _, tc := range prometheusNameTests {
+		if got := prometheusName(tc.name); got != tc.expected {
+			t.Errorf("prometheusName(%q): got %q, want %q", tc.name, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package exporter
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/glog"
+	"github.com/golang/snappy"
+	"github.com/google/mtail/metrics"
+)
+
+var (
+	remoteWriteURL = flag.String("remote_write_url", "",
+		"URL of a Prometheus remote write endpoint to push metrics to, such as http://localhost:19291/api/v1/receive.")
+	remoteWriteBearerTokenFile = flag.String("remote_write_bearer_token_file", "",
+		"File containing the bearer token sent with each remote write request. No token is sent if empty.")
+	remoteWriteBatchSize = flag.Int("remote_write_batch_size", 500,
+		"Most series sent in one remote write request.")
+	remoteWritePushInterval = flag.Duration("remote_write_push_interval", 0,
+		"Interval between metric pushes to the remote write endpoint. Uses metric_push_interval_seconds if zero.")
+
+	remoteWriteExportTotal   = expvar.NewInt("remote_write_export_total")
+	remoteWriteExportSuccess = expvar.NewInt("remote_write_export_success")
+	remoteWriteExportDropped = expvar.NewInt("remote_write_export_dropped")
+	// remoteWriteFailures counts the remote write requests that failed after
+	// being retried, whose series were dropped.
+	remoteWriteFailures = expvar.NewInt("remote_write_export_failures")
+)
+
+// writeRequest, timeSeries, label and sample are the messages of the remote
+// write protocol that mtail sends, as defined by prompb/types.proto and
+// prompb/remote.proto in the Prometheus repository.  They're encoded by
+// reflection on the struct tags, so as not to depend on all of Prometheus.
+type writeRequest struct {
+	Timeseries []timeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3"`
+}
+
+func (r *writeRequest) Reset()         { *r = writeRequest{} }
+func (r *writeRequest) String() string { return proto.CompactTextString(r) }
+func (*writeRequest) ProtoMessage()    {}
+
+type timeSeries struct {
+	Labels  []label  `protobuf:"bytes,1,rep,name=labels,proto3"`
+	Samples []sample `protobuf:"bytes,2,rep,name=samples,proto3"`
+}
+
+func (ts *timeSeries) Reset()         { *ts = timeSeries{} }
+func (ts *timeSeries) String() string { return proto.CompactTextString(ts) }
+func (*timeSeries) ProtoMessage()     {}
+
+type label struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (l *label) Reset()         { *l = label{} }
+func (l *label) String() string { return proto.CompactTextString(l) }
+func (*label) ProtoMessage()    {}
+
+type sample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"` // Milliseconds since the unix epoch.
+}
+
+func (s *sample) Reset()         { *s = sample{} }
+func (s *sample) String() string { return proto.CompactTextString(s) }
+func (*sample) ProtoMessage()    {}
+
+// remoteWriteSeries returns the remote write series of a LabelSet, labelled
+// with its labels, prog and instance like the Prometheus exporter, and sorted
+// by name as the protocol requires.  Samples are timestamped in milliseconds.
+func remoteWriteSeries(hostname string, m *metrics.Metric, l *metrics.LabelSet) []timeSeries {
+	series := func(name, le string, value int64) timeSeries {
+		labels := []label{{Name: "__name__", Value: name}, {Name: "prog", Value: m.Program}, {Name: "instance", Value: hostname}}
+		for k, v := range l.Labels {
+			labels = append(labels, label{Name: prometheusName(k), Value: v})
+		}
+		if le != "" {
+			labels = append(labels, label{Name: "le", Value: le})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+		return timeSeries{
+			Labels:  labels,
+			Samples: []sample{{Value: float64(value), Timestamp: l.Datum.Time / 1e6}},
+		}
+	}
+	name := prometheusName(m.ExportedName())
+	if m.Kind == metrics.Histogram {
+		var r []timeSeries
+		for _, hs := range histogramToSeries(l.Datum) {
+			r = append(r, series(name+hs.suffix, hs.le, hs.value))
+		}
+		return r
+	}
+	return []timeSeries{series(name, "", l.Datum.Get())}
+}
+
+// remoteWriteMetrics returns the remote write series of each LabelSet in the
+// store.
+func (e *Exporter) remoteWriteMetrics(exportTotal *expvar.Int) []timeSeries {
+	var series []timeSeries
+	e.visitLabelSets(exportTotal, func(m *metrics.Metric, l *metrics.LabelSet) {
+		series = append(series, remoteWriteSeries(e.hostname, m, l)...)
+	})
+	return series
+}
+
+// remoteWritePusher posts series to a remote write endpoint in batches.
+type remoteWritePusher struct {
+	*httpPusher
+	batchSize int // Most series sent in one request.
+}
+
+func newRemoteWritePusher(url, bearerToken string, batchSize int) *remoteWritePusher {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	p := &remoteWritePusher{
+		httpPusher: newHTTPPusher(url, "application/x-protobuf"),
+		batchSize:  batchSize,
+	}
+	p.header.Set("Content-Encoding", "snappy")
+	p.header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if bearerToken != "" {
+		p.header.Set("Authorization", "Bearer "+bearerToken)
+	}
+	return p
+}
+
+// send posts the series, returning the number sent and the number dropped
+// after a batch failed to be written.  A failed batch is retried as by
+// httpPusher.post.
+func (p *remoteWritePusher) send(series []timeSeries) (sent, dropped int) {
+	for len(series) > 0 {
+		n := p.batchSize
+		if n > len(series) {
+			n = len(series)
+		}
+		b, err := proto.Marshal(&writeRequest{Timeseries: series[:n]})
+		if err != nil {
+			glog.Infof("Failed to encode remote write request: %s", err)
+		}
+		if err == nil && p.post(string(snappy.Encode(nil, b))) {
+			sent += n
+		} else {
+			remoteWriteFailures.Add(1)
+			dropped += n
+		}
+		series = series[n:]
+	}
+	return sent, dropped
+}
+
+// readBearerToken returns the bearer token in the file, less surrounding
+// whitespace.
+func readBearerToken(pathname string) (string, error) {
+	b, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read bearer token: %s", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
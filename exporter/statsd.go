@@ -7,6 +7,9 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/google/mtail/metrics"
 )
@@ -14,25 +17,88 @@ import (
 var (
 	statsdHostPort = flag.String("statsd_hostport", "",
 		"Host:port to statsd server to write metrics to.")
+	statsdTags = flag.Bool("statsd_tags", false,
+		"Send labels to statsd as Datadog-style tags, instead of in the metric name.")
+	statsdPushInterval = flag.Duration("statsd_push_interval", 0,
+		"Interval between metric pushes to statsd. Uses metric_push_interval_seconds if zero.")
 
 	statsdExportTotal   = expvar.NewInt("statsd_export_total")
 	statsdExportSuccess = expvar.NewInt("statsd_export_success")
+	statsdExportDropped = expvar.NewInt("statsd_export_dropped")
 )
 
-func metricToStatsd(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
-	m.RLock()
-	defer m.RUnlock()
+// statsdFormatter formats metrics in the StatsD line format.  StatsD counters
+// are added together by the server, so it remembers the last value sent for
+// each counter in order to send only the change since then.
+type statsdFormatter struct {
+	tags bool // Send labels as Datadog-style tags.
+
+	lastMu sync.Mutex
+	last   map[string]int64 // Last value sent for each counter series.
+}
+
+func newStatsdFormatter(tags bool) *statsdFormatter {
+	return &statsdFormatter{tags: tags, last: make(map[string]int64)}
+}
+
+// name returns the metric name and tag suffix for the series of a LabelSet,
+// with the extra label le if not empty.
+func (s *statsdFormatter) name(m *metrics.Metric, suffix string, labels map[string]string, le string) (name, tags string) {
+	if !s.tags {
+		name = m.Program + "." + formatLabels(m.ExportedName()+suffix, labels, ".", ".")
+		if le != "" {
+			name += ".le." + le
+		}
+		return name, ""
+	}
+	var t []string
+	for k, v := range labels {
+		t = append(t, k+":"+v)
+	}
+	sort.Strings(t)
+	if le != "" {
+		t = append(t, "le:"+le)
+	}
+	if len(t) > 0 {
+		tags = "|#" + strings.Join(t, ",")
+	}
+	return m.Program + "." + m.ExportedName() + suffix, tags
+}
+
+// delta returns the change in a counter series since it was last sent.  A
+// counter that has gone backwards has been reset, so its whole value is sent.
+func (s *statsdFormatter) delta(key string, value int64) int64 {
+	s.lastMu.Lock()
+	defer s.lastMu.Unlock()
+	d := value - s.last[key]
+	if d < 0 {
+		d = value
+	}
+	s.last[key] = value
+	return d
+}
+
+func (s *statsdFormatter) format(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
+	if m.Kind == metrics.Histogram {
+		// StatsD has no cumulative type, so each series is sent as a gauge.
+		var r []string
+		for _, hs := range histogramToSeries(l.Datum) {
+			name, tags := s.name(m, hs.suffix, l.Labels, hs.le)
+			r = append(r, fmt.Sprintf("%s:%d|g%s", name, hs.value, tags))
+		}
+		return strings.Join(r, "\n")
+	}
+	name, tags := s.name(m, "", l.Labels, "")
+	value := l.Datum.Get()
 	var t string
 	switch m.Kind {
 	case metrics.Counter:
 		t = "c" // StatsD Counter
+		value = s.delta(name+tags, value)
 	case metrics.Gauge:
 		t = "g" // StatsD Gauge
 	case metrics.Timer:
 		t = "ms" // StatsD Timer
 	}
-	return fmt.Sprintf("%s.%s:%d|%s",
-		m.Program,
-		formatLabels(m.Name, l.Labels, ".", "."),
-		l.Datum.Get(), t)
+	return fmt.Sprintf("%s:%d|%s%s", name, value, t, tags)
 }
@@ -21,22 +21,11 @@ const varzFormat = "%s{%s} %d\n"
 
 // HandleVarz exports the metrics in Varz format via HTTP.
 func (e *Exporter) HandleVarz(w http.ResponseWriter, r *http.Request) {
-	e.store.RLock()
-	defer e.store.RUnlock()
-
 	w.Header().Add("Content-type", "text/plain")
 
-	for _, m := range e.store.Metrics {
-		m.RLock()
-		exportVarzTotal.Add(1)
-		lc := make(chan *metrics.LabelSet)
-		go m.EmitLabelSets(lc)
-		for l := range lc {
-			line := metricToVarz(e.hostname, m, l)
-			fmt.Fprint(w, line)
-		}
-		m.RUnlock()
-	}
+	e.visitLabelSets(exportVarzTotal, func(m *metrics.Metric, l *metrics.LabelSet) {
+		fmt.Fprint(w, metricToVarz(e.hostname, m, l))
+	})
 }
 
 func metricToVarz(hostname string, m *metrics.Metric, l *metrics.LabelSet) string {
@@ -47,8 +36,20 @@ func metricToVarz(hostname string, m *metrics.Metric, l *metrics.LabelSet) strin
 	sort.Strings(s)
 	s = append(s, fmt.Sprintf("prog=%s", m.Program))
 	s = append(s, fmt.Sprintf("instance=%s", hostname))
+	if m.Kind == metrics.Histogram {
+		labels := strings.Join(s, ",")
+		var r string
+		for _, hs := range histogramToSeries(l.Datum) {
+			ls := labels
+			if hs.le != "" {
+				ls += ",le=" + hs.le
+			}
+			r += fmt.Sprintf(varzFormat, m.ExportedName()+hs.suffix, ls, hs.value)
+		}
+		return r
+	}
 	return fmt.Sprintf(varzFormat,
-		m.Name,
+		m.ExportedName(),
 		strings.Join(s, ","),
 		l.Datum.Get())
 }
@@ -22,6 +22,17 @@ var handleVarzTests = []struct {
 		[]*metrics.Metric{},
 		"",
 	},
+	{"hidden",
+		[]*metrics.Metric{
+			&metrics.Metric{
+				Name:        "foo",
+				Program:     "test",
+				Kind:        metrics.Gauge,
+				Hidden:      true,
+				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{}, Value: &metrics.Datum{Value: 1}}}},
+		},
+		"",
+	},
 	{"single",
 		[]*metrics.Metric{
 			&metrics.Metric{
@@ -45,6 +56,24 @@ var handleVarzTests = []struct {
 			},
 		},
 		`foo{a=1,b=2,prog=test,instance=gunstar} 1
+`,
+	},
+	{"histogram",
+		[]*metrics.Metric{
+			&metrics.Metric{
+				Name:    "foo",
+				Program: "test",
+				Kind:    metrics.Histogram,
+				Buckets: []int64{10, 100},
+				LabelValues: []*metrics.LabelValue{&metrics.LabelValue{Labels: []string{}, Value: &metrics.Datum{Value: 62, Count: 2, Time: 1397586900,
+					Buckets: []metrics.Bucket{{UpperBound: 10, Count: 1}, {UpperBound: 100, Count: 2}}}}},
+			},
+		},
+		`foo_bucket{prog=test,instance=gunstar,le=10} 1
+foo_bucket{prog=test,instance=gunstar,le=100} 2
+foo_bucket{prog=test,instance=gunstar,le=+Inf} 2
+foo_sum{prog=test,instance=gunstar} 62
+foo_count{prog=test,instance=gunstar} 2
 `,
 	},
 }
@@ -55,7 +84,7 @@ func TestHandleVarz(t *testing.T) {
 		for _, metric := range tc.metrics {
 			ms.Add(metric)
 		}
-		o := Options{ms, "gunstar"}
+		o := Options{Store: ms, Hostname: "gunstar"}
 		e, err := New(o)
 		if err != nil {
 			t.Fatalf("couldn't make exporter: %s", err)
@@ -0,0 +1,21 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package logline contains the definition of a line read from a log, as
+// passed from the tailer to the virtual machines.
+package logline
+
+import "time"
+
+// LogLine contains all the information about a line just read from a log.
+type LogLine struct {
+	Filename string    // The log filename that this line was read from.
+	Line     string    // The text of the log line itself, without the newline.
+	Time     time.Time // When the line was logged, if the log format records it, or else zero.
+	Stream   string    // The stream the line was written to, such as "stdout" or "stderr" in a Docker log, if known.
+}
+
+// New creates a LogLine read from the named file.
+func New(filename string, line string) *LogLine {
+	return &LogLine{Filename: filename, Line: line}
+}
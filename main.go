@@ -5,27 +5,89 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"github.com/golang/glog"
 	"github.com/google/mtail/mtail"
-
-	_ "net/http/pprof"
+	"github.com/google/mtail/tailer"
+	"github.com/google/mtail/vm"
 )
 
+// Version is the version of mtail, exported in the mtail_build_info metric.
+// It's set when building, with -ldflags "-X main.Version=...".
+var Version = "unknown"
+
 var (
 	port   = flag.String("port", "3903", "HTTP port to listen on.")
-	logs   = flag.String("logs", "", "List of files to monitor.")
+	logs   = flag.String("logs", "", "List of files to monitor; glob patterns are expanded, and files created later that match are tailed too. Use - to read from standard input.")
 	logFds = flag.String("logfds", "", "List of file descriptors to monitor.")
-	progs  = flag.String("progs", "", "Directory containing programs")
+	progs  = flag.String("progs", "", "Directories containing programs, or glob patterns selecting programs such as progs/prod_*.mtail, separated by commas. Program names must be unique across the directories.")
+
+	logManifest = flag.String("log_manifest", "", "File listing more log paths to tail, one per line, such as one written by a script at boot. It's reread on SIGHUP, tailing the paths added and no longer tailing those removed.")
+
+	listenAddress = flag.String("listen_address", "", "Host and port to serve HTTP on, such as localhost:3903. Overrides -port if not empty.")
+	listenSocket  = flag.String("listen_socket", "", "Unix domain socket to serve HTTP on, as well as the port. Set -port to empty to serve only on the socket.")
+
+	logFilePattern = flag.String("log_file_pattern", "", "Glob pattern for the base names of files to tail in directories given in -logs, which are watched recursively. All files are tailed if empty.")
+	readFromStart  = flag.Bool("read_from_start", false, "Read the existing contents of log files when first tailed, instead of only lines appended later.")
+	syslogAddress  = flag.String("syslog_address", "", "Host and port to receive syslog messages on, such as :514. getfilename() returns the sender's address for these lines.")
+	syslogProtocol = flag.String("syslog_protocol", "udp", "Protocol to receive syslog messages over: udp, tcp or both.")
+	tcpListen      = flag.String("tcp_listen_address", "", "Host and port to accept TCP connections streaming newline-delimited log lines on, such as :5140. getfilename() returns the peer's address for these lines.")
+	tcpDial        = flag.String("tcp_dial_address", "", "Host and port of a TCP server streaming newline-delimited log lines to connect to, reconnecting whenever the connection is lost. getfilename() returns the server's address for these lines.")
+	statePath      = flag.String("state_path", "", "File to save the read offset of each log file in, so that tailing resumes from them after a restart.")
+	encoding       = flag.String("encoding", "", "Encoding of the logs, such as utf-16le or windows-1252, which are decoded to UTF-8.  A byte order mark overrides it.  UTF-8 if empty.")
+	logFormat      = flag.String("log_format", "", "Format of the tailed logs, whose lines are unwrapped before programs see them. With \"docker\", each line of a Docker json-file log is parsed, programs see the message logged, getstream() returns stdout or stderr, and the time logged is the line's timestamp. Lines are read as they are if empty.")
+	lineDelimiter  = flag.String("line_delimiter", `\n`, "Separator of the lines of logs, with Go string escapes such as \\x00 for NUL-separated records or \\r\\n.")
+	pollInterval   = flag.Duration("poll_interval", 0, "Poll log files and programs for changes at this interval instead of using inotify, e.g. on NFS mounts. inotify is used if zero, falling back to polling if it is unavailable.")
 
-	oneShot        = flag.Bool("one_shot", false, "Run on logs until EOF and exit.")
-	oneShotMetrics = flag.Bool("one_shot_metrics", false, "Dump metrics to stdout after one shot mode.")
+	oneShot        = flag.Bool("one_shot", false, "Run on logs until EOF and exit, printing how long each took to read. The metrics aren't dumped unless one_shot_metrics is also set.")
+	oneShotMetrics = flag.Bool("one_shot_metrics", false, "Dump the metrics to stdout as JSON after one shot mode, once every line has been processed, instead of the timings. Useful for testing programs against fixture logs.")
 	compileOnly    = flag.Bool("compile_only", false, "Compile programs only, do not load the virtual machine.")
 	dumpBytecode   = flag.Bool("dump_bytecode", false, "Dump bytecode of programs and exit.")
 
+	tlsCertFile     = flag.String("tls_cert_file", "", "Certificate file to serve HTTPS with. HTTP is served if empty.")
+	tlsKeyFile      = flag.String("tls_key_file", "", "Private key file of the certificate in -tls_cert_file.")
+	tlsMinVersion   = flag.String("tls_min_version", "", "Lowest TLS version accepted: 1.0, 1.1, 1.2 or 1.3. Go's default is used if empty.")
+	tlsClientCAFile = flag.String("tls_client_ca_file", "", "File of CA certificates that HTTPS clients must present a certificate signed by. Client certificates aren't required if empty.")
+
+	httpAuthUser           = flag.String("http_auth_user", "", "Require HTTP basic authentication as this user. Authentication isn't required if empty.")
+	httpAuthPasswordHash   = flag.String("http_auth_password_hash", "", "bcrypt hash of the password of -http_auth_user.")
+	httpAuthHtpasswdFile   = flag.String("http_auth_htpasswd_file", "", "htpasswd file of users allowed by HTTP basic authentication. Only bcrypt hashes are supported.")
+	httpAuthExcludeHealthz = flag.Bool("http_auth_exclude_healthz", false, "Serve /healthz without authentication, for load balancer health checks.")
+
+	enableQuitHandler   = flag.Bool("enable_quitquitquit", false, "Serve /quitquitquit, which shuts mtail down when POSTed to.")
+	enablePushHandler   = flag.Bool("enable_push", false, "Serve /push, which reads the lines of the body POSTed to it, gzip compressed or not. getfilename() is the origin query parameter, or the client's address if it's absent. Protect it with -http_auth_user or -http_auth_htpasswd_file.")
+	enableDebugHandlers = flag.Bool("enable_debug_handlers", false, "Serve profiles at /debug/pprof/ and expvars at /debug/vars.")
+
+	user  = flag.String("user", "", "User name or uid to switch to once the logs are opened and the HTTP port is bound. Linux only. Needs CAP_SETUID and CAP_SETGID, e.g. running as root. Logs opened later, after rotation, must be readable by this user.")
+	group = flag.String("group", "", "Group name or gid to switch to with -user. The user's primary group is used if empty.")
+
+	progRateLimits = flag.String("prog_rate_limits", "", "Most lines per second to send to each program, as a list of program=rate pairs such as apache.mtail=1000. Lines beyond the rate are dropped for that program only.")
+	ignoreLines    = flag.String("ignore_lines", "", "Regular expression matching lines to drop before they're sent to any program, such as health checks. Dropped lines are counted in lines_ignored_total. No lines are dropped if empty.")
+
+	namespaceFromProgram = flag.Bool("namespace_from_program", false, "Prefix the exported metric names of each program without a namespace statement with the program's file name, less the .mtail extension.")
+	warningsAsErrors     = flag.Bool("Werror", false, "Fail to load programs with compile warnings, such as capture groups that are never used or metrics that are never written, as errors. Useful with -compile_only in CI.")
+	progFlags            = flag.String("prog_flags", "", "Flags set for the #if directives of programs, separated by commas, such as staging. The lines between \"#if staging\" and \"#endif\" are only loaded when staging is set.")
+	strictMetricNames    = flag.Bool("strict_metric_names", false, "Fail to load programs with metric or key names that aren't valid in Prometheus, rather than exporting them with the invalid characters replaced by underscores.")
+
+	maxLineLength      = flag.Int("max_line_length", tailer.DefaultMaxLineLength, "Length in bytes beyond which lines read from logs are truncated, rather than buffered without bound.")
+	maxRecordSize      = flag.Int("max_record_size", vm.DefaultMaxRecordSize, "Size in bytes beyond which lines aren't added to a multi-line record, in programs that set a record start pattern.")
+	recordFlushTimeout = flag.Duration("record_flush_timeout", vm.DefaultRecordFlushTimeout, "Run an incomplete multi-line record after this long without a new line from its log.")
+	lineBuffer         = flag.Int("line_buffer", 0, "Number of lines buffered between reading the logs and sending them to the programs, to absorb bursts of lines. The lines waiting are exported as line_queue_depth.")
+	progLineBuffer     = flag.Int("prog_line_buffer", vm.DefaultProgLineBuffer, "Number of lines buffered for each program, so that a slow program doesn't hold up the others. The lines waiting are exported as prog_line_queue_depth.")
+	lineTimeout        = flag.Duration("line_timeout", 0, "Abandon a line that takes a program longer than this to run, such as a huge line against expensive patterns, and count it in prog_line_timeouts_total, so that the lines after it aren't held up. Lines are never abandoned if zero.")
+
+	snapshotPath     = flag.String("snapshot_path", "", "File to save the counters in every -snapshot_interval and on shutdown, so that they're restored after a restart or crash. Counters no longer declared by the programs are not restored.")
+	snapshotInterval = flag.Duration("snapshot_interval", mtail.DefaultSnapshotInterval, "How often the counters are saved to -snapshot_path.")
+
+	drainTimeout = flag.Duration("drain_timeout", mtail.DefaultDrainTimeout, "Longest to wait on shutdown for the remaining log lines to be processed and the metrics pushed, before exiting anyway.")
+
 	syslogUseCurrentYear = flag.Bool("syslog_use_current_year", true, "Patch yearless timestamps with the present year.")
+	timeLayouts          = flag.String("time_layouts", "", "Layouts of the timestamps that gettime() looks for at the start of each line, in Go's reference time format, separated by semicolons and tried in order, such as \"2006-01-02 15:04:05;Jan _2 15:04:05\". A list of common syslog, ISO 8601 and Apache layouts is used if empty.")
 )
 
 func main() {
@@ -33,8 +95,10 @@ func main() {
 	if *progs == "" {
 		glog.Exitf("No mtail program directory specified; use -progs")
 	}
-	if *logs == "" && *logFds == "" {
-		glog.Exitf("No logs specified to tail; use -logs or -logfds")
+	// Checking programs doesn't need any logs.
+	checkOnly := *compileOnly || *dumpBytecode
+	if *logs == "" && *logFds == "" && *logManifest == "" && *tcpListen == "" && *tcpDial == "" && !checkOnly {
+		glog.Exitf("No logs specified to tail; use -logs, -logfds, -log_manifest, -tcp_listen_address or -tcp_dial_address")
 	}
 	var logPathnames []string
 	for _, pathname := range strings.Split(*logs, ",") {
@@ -49,23 +113,128 @@ func main() {
 			logDescriptors = append(logDescriptors, fdNum)
 		}
 	}
-	if len(logPathnames) == 0 && len(logDescriptors) == 0 {
+	if len(logPathnames) == 0 && len(logDescriptors) == 0 && *logManifest == "" && *tcpListen == "" && *tcpDial == "" && !checkOnly {
 		glog.Exit("No logs to tail.")
 	}
+	rateLimits := make(map[string]int)
+	for _, limit := range strings.Split(*progRateLimits, ",") {
+		if limit == "" {
+			continue
+		}
+		kv := strings.SplitN(limit, "=", 2)
+		if len(kv) != 2 {
+			glog.Exitf("Rate limit %q must be program=rate", limit)
+		}
+		rate, err := strconv.Atoi(kv[1])
+		if err != nil || rate <= 0 {
+			glog.Exitf("Rate limit of program %s must be a positive number of lines per second, not %q", kv[0], kv[1])
+		}
+		rateLimits[kv[0]] = rate
+	}
+	var ignorePattern *regexp.Regexp
+	if *ignoreLines != "" {
+		var err error
+		if ignorePattern, err = regexp.Compile(*ignoreLines); err != nil {
+			glog.Exitf("Ignore pattern %q must be a regular expression: %s", *ignoreLines, err)
+		}
+	}
+	delimiter, err := strconv.Unquote(`"` + *lineDelimiter + `"`)
+	if err != nil || delimiter == "" {
+		glog.Exitf("Line delimiter %q must be a nonempty string with Go escapes", *lineDelimiter)
+	}
 	o := mtail.Options{
+		Version:              Version,
 		Progs:                *progs,
 		LogPaths:             logPathnames,
 		LogFds:               logDescriptors,
+		LogManifest:          *logManifest,
+		LogFilePattern:       *logFilePattern,
 		Port:                 *port,
+		ListenAddress:        *listenAddress,
+		ListenSocket:         *listenSocket,
 		OneShot:              *oneShot,
 		OneShotMetrics:       *oneShotMetrics,
 		CompileOnly:          *compileOnly,
 		DumpBytecode:         *dumpBytecode,
 		SyslogUseCurrentYear: *syslogUseCurrentYear,
+		PollInterval:         *pollInterval,
+		ReadFromStart:        *readFromStart,
+		StatePath:            *statePath,
+		SnapshotPath:         *snapshotPath,
+		SnapshotInterval:     *snapshotInterval,
+		Encoding:             *encoding,
+		LogFormat:            *logFormat,
+		SyslogAddress:        *syslogAddress,
+		SyslogProtocol:       *syslogProtocol,
+		TCPListenAddress:     *tcpListen,
+		TCPDialAddress:       *tcpDial,
+		MaxLineLength:        *maxLineLength,
+		LineDelimiter:        delimiter,
+		MaxRecordSize:        *maxRecordSize,
+		RecordFlushTimeout:   *recordFlushTimeout,
+		LineTimeout:          *lineTimeout,
+		LineBuffer:           *lineBuffer,
+		ProgLineBuffer:       *progLineBuffer,
+		TLSCertFile:          *tlsCertFile,
+		TLSKeyFile:           *tlsKeyFile,
+		TLSMinVersion:        *tlsMinVersion,
+		TLSClientCAFile:      *tlsClientCAFile,
+
+		HTTPAuthUser:           *httpAuthUser,
+		HTTPAuthPasswordHash:   *httpAuthPasswordHash,
+		HTTPAuthHtpasswdFile:   *httpAuthHtpasswdFile,
+		HTTPAuthExcludeHealthz: *httpAuthExcludeHealthz,
+
+		EnableQuitHandler:   *enableQuitHandler,
+		EnablePushHandler:   *enablePushHandler,
+		EnableDebugHandlers: *enableDebugHandlers,
+
+		ProgRateLimits: rateLimits,
+		IgnorePattern:  ignorePattern,
+
+		NamespaceFromProgram: *namespaceFromProgram,
+		TimeLayouts:          splitLayouts(*timeLayouts),
+		StrictMetricNames:    *strictMetricNames,
+		WarningsAsErrors:     *warningsAsErrors,
+		ProgFlags:            splitFlags(*progFlags),
+
+		DrainTimeout: *drainTimeout,
+
+		User:  *user,
+		Group: *group,
 	}
 	m, err := mtail.New(o)
 	if err != nil {
+		if *compileOnly {
+			// Print just the compile errors, for use as a presubmit check.
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		glog.Fatalf("couldn't start: %s", err)
 	}
 	m.Run()
 }
+
+// splitFlags returns the program flags separated by commas in s, or nil if
+// there are none.
+func splitFlags(s string) []string {
+	var flags []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			flags = append(flags, f)
+		}
+	}
+	return flags
+}
+
+// splitLayouts returns the time layouts separated by semicolons in s, or nil
+// if there are none.
+func splitLayouts(s string) []string {
+	var layouts []string
+	for _, l := range strings.Split(s, ";") {
+		if l != "" {
+			layouts = append(layouts, l)
+		}
+	}
+	return layouts
+}
@@ -5,14 +5,42 @@ package metrics
 
 import (
 	"fmt"
+	"math"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // Datum describes a LabelSet's or LabelValue's value at a given timestamp.
+// For a Histogram or Summary, Value is the sum of all observations.
 type Datum struct {
 	Value int64
 	Time  int64 // nanoseconds since unix epoch
+	Count int64 `json:",omitempty"` // Number of observations, for Histograms and Summaries.
+
+	lastWrite int64  // When the Datum was last written, in nanoseconds since the epoch by its Metric's clock, if the Metric has a TTL or exports update times.
+	writeSeq  uint64 // The count of writes when the Datum was last written, if its Metric evicts by LRU.
+
+	Buckets []Bucket `json:",omitempty"` // Cumulative bucket counts, for Histograms.
+
+	mu     sync.Mutex      // Held by Observe and reset, which write several fields, so that neither lands partway through the other.
+	stream *quantileStream // Estimates the quantiles of the observations, for Summaries.
+	update func(*Datum)    // Records each write to the Datum for the Metric holding it; nil if none does.
+}
+
+// Bucket counts the observations of a Histogram Datum that are less than or
+// equal to UpperBound.
+type Bucket struct {
+	UpperBound int64
+	Count      int64
+}
+
+// written records a write to the Datum for the Metric holding it, if there is
+// one.
+func (d *Datum) written() {
+	if d.update != nil {
+		d.update(d)
+	}
 }
 
 func (d *Datum) stamp(timestamp time.Time) {
@@ -27,12 +55,81 @@ func (d *Datum) stamp(timestamp time.Time) {
 func (d *Datum) Set(value int64, timestamp time.Time) {
 	atomic.StoreInt64(&d.Value, value)
 	d.stamp(timestamp)
+	d.written()
 }
 
 // IncBy implements the Incrementable interface for a Datum.
 func (d *Datum) IncBy(delta int64, timestamp time.Time) {
 	atomic.AddInt64(&d.Value, delta)
 	d.stamp(timestamp)
+	d.written()
+}
+
+// Observe implements the Observable interface for a Datum.  The value is
+// counted in every bucket whose upper bound it does not exceed, or added to
+// the quantile estimates of a Summary, and added to the sum.
+func (d *Datum) Observe(value int64, timestamp time.Time) {
+	d.mu.Lock()
+	if d.stream != nil {
+		d.stream.insert(float64(value))
+	}
+	for i := range d.Buckets {
+		if value <= d.Buckets[i].UpperBound {
+			atomic.AddInt64(&d.Buckets[i].Count, 1)
+		}
+	}
+	atomic.AddInt64(&d.Count, 1)
+	atomic.AddInt64(&d.Value, value)
+	d.stamp(timestamp)
+	d.mu.Unlock()
+	d.written()
+}
+
+// reset zeroes the Datum, and its buckets or quantile estimates.
+func (d *Datum) reset(timestamp time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range d.Buckets {
+		atomic.StoreInt64(&d.Buckets[i].Count, 0)
+	}
+	if d.stream != nil {
+		d.stream.reset()
+	}
+	atomic.StoreInt64(&d.Count, 0)
+	atomic.StoreInt64(&d.Value, 0)
+	d.stamp(timestamp)
+}
+
+// GetCount returns the number of observations recorded by the Datum.
+func (d *Datum) GetCount() int64 {
+	return atomic.LoadInt64(&d.Count)
+}
+
+// GetBuckets returns a copy of the cumulative bucket counts of the Datum.
+func (d *Datum) GetBuckets() []Bucket {
+	b := make([]Bucket, len(d.Buckets))
+	for i := range d.Buckets {
+		b[i] = Bucket{d.Buckets[i].UpperBound, atomic.LoadInt64(&d.Buckets[i].Count)}
+	}
+	return b
+}
+
+// GetObservations returns a copy of the cumulative bucket counts of the
+// Datum, and the count and sum of its observations, all as of the same
+// observation.
+func (d *Datum) GetObservations() (buckets []Bucket, count, sum int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.GetBuckets(), d.GetCount(), d.Get()
+}
+
+// GetQuantile returns the estimate of quantile q of the observations recorded
+// by a Summary Datum, or NaN if there are none.
+func (d *Datum) GetQuantile(q float64) float64 {
+	if d.stream == nil {
+		return math.NaN()
+	}
+	return d.stream.quantile(q)
 }
 
 // Get returns the value of the Datum.
@@ -0,0 +1,33 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"expvar"
+	"sync"
+)
+
+// gaugeExpvars holds the names of the expvars describing mtail itself that
+// go up and down, such as queue depths, rather than count.
+var gaugeExpvars sync.Map
+
+// NewGaugeInt creates an integer expvar that is exported as a gauge, and
+// publishes it under name.
+func NewGaugeInt(name string) *expvar.Int {
+	gaugeExpvars.Store(name, true)
+	return expvar.NewInt(name)
+}
+
+// NewGaugeMap creates a map expvar whose values are exported as a gauge, and
+// publishes it under name.
+func NewGaugeMap(name string) *expvar.Map {
+	gaugeExpvars.Store(name, true)
+	return expvar.NewMap(name)
+}
+
+// IsGauge returns whether the named expvar was created as a gauge.
+func IsGauge(name string) bool {
+	_, ok := gaugeExpvars.Load(name)
+	return ok
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"sort"
+	"sync"
+)
+
+// Info is an expvar holding sets of labels that describe mtail itself, such
+// as the version it was built from.  Each label set is exported as a gauge of
+// 1 labelled with them, in the style of Prometheus info metrics.
+type Info struct {
+	mu     sync.RWMutex
+	labels map[string]map[string]string // Label sets, by id.
+}
+
+// NewInfo creates an Info and publishes it as the named expvar.
+func NewInfo(name string) *Info {
+	i := &Info{labels: make(map[string]map[string]string)}
+	expvar.Publish(name, i)
+	return i
+}
+
+// Set sets the labels identified by id, replacing any set before.
+func (i *Info) Set(id string, labels map[string]string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.labels[id] = labels
+}
+
+// Delete removes the labels identified by id.
+func (i *Info) Delete(id string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.labels, id)
+}
+
+// Do calls f with each set of labels, in order of their ids.
+func (i *Info) Do(f func(labels map[string]string)) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	var ids []string
+	for id := range i.labels {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		f(i.labels[id])
+	}
+}
+
+// String implements the expvar.Var interface, formatting the label sets as
+// JSON.
+func (i *Info) String() string {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	b, err := json.Marshal(i.labels)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
@@ -0,0 +1,34 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+// lruHeap orders the LabelValues of a Metric that evicts by LRU, with the
+// least recently written first, as of when each was last ordered.  It
+// implements heap.Interface.
+type lruHeap []*LabelValue
+
+func (h lruHeap) Len() int { return len(h) }
+
+func (h lruHeap) Less(i, j int) bool { return h[i].lruKey < h[j].lruKey }
+
+func (h lruHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].lruIndex = i
+	h[j].lruIndex = j
+}
+
+func (h *lruHeap) Push(x interface{}) {
+	lv := x.(*LabelValue)
+	lv.lruIndex = len(*h)
+	*h = append(*h, lv)
+}
+
+func (h *lruHeap) Pop() interface{} {
+	old := *h
+	lv := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	lv.lruIndex = -1
+	return lv
+}
@@ -6,11 +6,32 @@
 package metrics
 
 import (
+	"container/heap"
+	"errors"
+	"expvar"
 	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/google/mtail/clock"
+)
+
+var (
+	// LabelSetDrops counts the new label sets not created because their
+	// metric had reached its limit, by program and metric, as prog/metric.
+	LabelSetDrops = expvar.NewMap("metric_label_set_drops_total")
+	// LabelSetEvictions counts the least recently written label sets removed
+	// to make room for new ones under a metric's limit, by program and
+	// metric, as prog/metric.
+	LabelSetEvictions = expvar.NewMap("metric_label_set_evictions_total")
 )
 
+// ErrLabelSetLimit is returned by GetDatum when a new label set would take a
+// Metric past its limit.
+var ErrLabelSetLimit = errors.New("label set limit reached")
+
 // Kind enumerates the types of metrics supported.
 type Kind int
 
@@ -26,8 +47,20 @@ const (
 	// intervals, such as latency and durations.  It enables certain behaviour
 	// in exporters that handle time intervals such as StatsD.
 	Timer
+	// Histogram is a Kind that records a distribution of observed values
+	// into buckets, along with the count and sum of the observations.
+	Histogram
+	// Summary is a Kind that records a distribution of observed values as
+	// estimates of its quantiles, along with the count and sum of the
+	// observations.
+	Summary
 )
 
+// DefaultBuckets are the bucket upper bounds used by a Histogram when none are
+// given in the program.  They are the Prometheus client defaults, scaled to
+// integer milliseconds.
+var DefaultBuckets = []int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
 func (m Kind) String() string {
 	switch m {
 	case Counter:
@@ -36,6 +69,10 @@ func (m Kind) String() string {
 		return "Gauge"
 	case Timer:
 		return "Timer"
+	case Histogram:
+		return "Histogram"
+	case Summary:
+		return "Summary"
 	}
 	return "Unknown"
 }
@@ -52,11 +89,20 @@ type Settable interface {
 	Set(value int64, ts time.Time)
 }
 
+// Observable describes an interface for Histogram and Summary Kinds, that
+// record each value into a distribution.
+type Observable interface {
+	Observe(value int64, ts time.Time)
+}
+
 // LabelValue is an object that names a Datum value with a list of label
 // strings.
 type LabelValue struct {
 	Labels []string `json:",omitempty"`
 	Value  *Datum
+
+	lruKey   uint64 // The Datum's count of writes as of when it was last ordered in the Metric's LRU heap, if the Metric evicts by LRU.
+	lruIndex int    // Index in the Metric's LRU heap, if the Metric evicts by LRU; -1 once removed from the Metric.
 }
 
 // Metric is an object that describes a metric, with its name, the creator and
@@ -65,11 +111,55 @@ type LabelValue struct {
 // labels in each dimension of the Keys.
 type Metric struct {
 	sync.RWMutex
-	Name        string // Name
-	Program     string // Instantiating program
-	Kind        Kind
-	Keys        []string      `json:",omitempty"`
-	LabelValues []*LabelValue `json:",omitempty"`
+	Name          string // Name
+	Program       string // Instantiating program
+	Kind          Kind
+	Keys          []string      `json:",omitempty"`
+	LabelValues   []*LabelValue `json:",omitempty"`
+	Buckets       []int64       `json:",omitempty"` // Bucket upper bounds, for Histograms.
+	Quantiles     []float64     `json:",omitempty"` // Quantiles estimated, for Summaries.
+	TTL           time.Duration `json:",omitempty"` // Time after its last update that a LabelValue expires.
+	Hidden        bool          `json:",omitempty"` // Used only by the program, and not exported.
+	Namespace     string        `json:",omitempty"` // Prefix of the exported name, to keep it apart from other programs' metrics.
+	Limit         int           `json:",omitempty"` // Maximum number of LabelValues, or unlimited if zero.
+	EvictLRU      bool          `json:",omitempty"` // At the limit, evict the least recently used LabelValue rather than drop the new one.
+	Reset         time.Duration `json:",omitempty"` // Interval at the end of which every LabelValue is zeroed, if non-zero.
+	Help          string        `json:",omitempty"` // Description of the metric declared by the program, or empty if none.
+	ExportUpdated bool          `json:",omitempty"` // Export the time each LabelValue was last updated, as a companion series.
+
+	lru         lruHeap     // The LabelValues by when they were last written, if the Metric evicts by LRU.
+	resetPeriod time.Time   // Start of the reset interval the values were last zeroed in, or first checked in.
+	timeSource  clock.Clock // Tells the time LabelValues are updated, for expiry and update times; the system clock if nil.
+}
+
+// ExportedName returns the name the metric is exported as, which is prefixed
+// with its namespace and an underscore if it has one.
+func (m *Metric) ExportedName() string {
+	if m.Namespace == "" {
+		return m.Name
+	}
+	return m.Namespace + "_" + m.Name
+}
+
+// PrometheusName returns s as a valid Prometheus metric or label name, with
+// each character other than a letter, digit or underscore replaced by an
+// underscore.  If it then starts with a digit, or with the two underscores
+// that Prometheus reserves for its own labels, an x is prepended, as is a
+// letter rather than an underscore.
+func PrometheusName(s string) string {
+	r := []rune(s)
+	for i, c := range r {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+		default:
+			r[i] = '_'
+		}
+	}
+	name := string(r)
+	if len(name) == 0 || (name[0] >= '0' && name[0] <= '9') || strings.HasPrefix(name, "__") {
+		name = "x" + name
+	}
+	return name
 }
 
 // NewMetric returns a new empty metric of dimension len(keys).
@@ -95,27 +185,243 @@ Loop:
 }
 
 // GetDatum returns the datum named by a sequence of string label values from a
-// Metric.
+// Metric.  If the Metric has a limit and it has been reached, the least
+// recently written datum is evicted to make room for a new one if the Metric
+// evicts by LRU.  Otherwise the new datum is dropped: it's returned with
+// ErrLabelSetLimit so that the caller can update it without effect, but it
+// isn't stored in the Metric.
 func (m *Metric) GetDatum(labelvalues ...string) (d *Datum, err error) {
 	if len(labelvalues) != len(m.Keys) {
 		return nil, fmt.Errorf("Label values requested (%q) not same length as keys for metric %q", labelvalues, m)
 	}
+	m.RLock()
+	lv := m.findLabelValueOrNil(labelvalues)
+	m.RUnlock()
+	if lv != nil {
+		return lv.Value, nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	lv = m.findLabelValueOrNil(labelvalues)
+	if lv == nil {
+		if m.Limit > 0 && len(m.LabelValues) >= m.Limit {
+			if !m.EvictLRU {
+				LabelSetDrops.Add(m.expvarKey(), 1)
+				return m.newDatum(), ErrLabelSetLimit
+			}
+			m.evictLeastRecentlyUsed()
+		}
+		lv = m.newLabelValue(labelvalues)
+		m.LabelValues = append(m.LabelValues, lv)
+		m.written(lv.Value)
+		if m.EvictLRU {
+			lv.lruKey = atomic.LoadUint64(&lv.Value.writeSeq)
+			heap.Push(&m.lru, lv)
+		}
+	}
+	return lv.Value, nil
+}
+
+// newLabelValue returns a new LabelValue named by labelvalues, whose Datum
+// records its writes with the Metric.
+func (m *Metric) newLabelValue(labelvalues []string) *LabelValue {
+	lv := &LabelValue{Labels: labelvalues, Value: m.newDatum()}
+	lv.Value.update = m.written
+	return lv
+}
+
+// writeCount counts the writes to the Datums of the Metrics that evict by LRU,
+// to order them.
+var writeCount uint64
+
+// written records that d was written, which sets its update time, pushing
+// back its expiry, and makes it the most recently used.  Writes don't take
+// the Metric's lock, so that exporting the Metric can't hold them up, and so
+// this only writes to d atomically.
+func (m *Metric) written(d *Datum) {
+	if m.TTL > 0 || m.ExportUpdated {
+		atomic.StoreInt64(&d.lastWrite, m.now().UnixNano())
+	}
+	if m.EvictLRU {
+		atomic.StoreUint64(&d.writeSeq, atomic.AddUint64(&writeCount, 1))
+	}
+}
+
+// updated returns when lv was last written, or the zero time if it hasn't
+// been written since the Metric began recording it.
+func (lv *LabelValue) updated() time.Time {
+	ns := atomic.LoadInt64(&lv.Value.lastWrite)
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// expvarKey returns the key of the Metric in the expvar maps counted by
+// metric, which is qualified by its program as metrics of the same name in
+// different programs are distinct.
+func (m *Metric) expvarKey() string {
+	return m.Program + "/" + m.Name
+}
+
+// setClock sets the clock that tells the time for the Metric.
+func (m *Metric) setClock(c clock.Clock) {
+	m.Lock()
+	defer m.Unlock()
+	m.timeSource = c
+}
+
+// now returns the current time by the Metric's clock.
+func (m *Metric) now() time.Time {
+	if m.timeSource == nil {
+		return time.Now()
+	}
+	return m.timeSource.Now()
+}
+
+// evictLeastRecentlyUsed removes the LabelValue that was written longest ago.
+// The Metric must be locked.
+func (m *Metric) evictLeastRecentlyUsed() {
+	for len(m.lru) > 0 {
+		// The heap is ordered by the writes as of when each LabelValue was
+		// last ordered, as writes don't take the Metric's lock.  Writes only
+		// move a LabelValue later, so once the first is up to date, it's
+		// the least recently written.
+		lv := m.lru[0]
+		if w := atomic.LoadUint64(&lv.Value.writeSeq); w != lv.lruKey {
+			lv.lruKey = w
+			heap.Fix(&m.lru, 0)
+			continue
+		}
+		m.removeLabelValue(heap.Pop(&m.lru).(*LabelValue))
+		LabelSetEvictions.Add(m.expvarKey(), 1)
+		return
+	}
+}
+
+// removeLabelValue removes lv from the LabelValues.  The Metric must be
+// locked.
+func (m *Metric) removeLabelValue(lv *LabelValue) {
+	for i := range m.LabelValues {
+		if m.LabelValues[i] == lv {
+			m.LabelValues = append(m.LabelValues[:i], m.LabelValues[i+1:]...)
+			return
+		}
+	}
+}
+
+// RemoveDatum removes the datum named by a sequence of string label values
+// from a Metric, if it has one.
+func (m *Metric) RemoveDatum(labelvalues ...string) error {
+	if len(labelvalues) != len(m.Keys) {
+		return fmt.Errorf("Label values requested (%q) not same length as keys for metric %q", labelvalues, m)
+	}
+	m.Lock()
+	defer m.Unlock()
+Loop:
+	for i, lv := range m.LabelValues {
+		for j := 0; j < len(lv.Labels); j++ {
+			if lv.Labels[j] != labelvalues[j] {
+				continue Loop
+			}
+		}
+		m.LabelValues = append(m.LabelValues[:i], m.LabelValues[i+1:]...)
+		if m.EvictLRU {
+			heap.Remove(&m.lru, lv.lruIndex)
+		}
+		break
+	}
+	return nil
+}
+
+// RemoveAll removes all the data from a Metric.
+func (m *Metric) RemoveAll() {
 	m.Lock()
 	defer m.Unlock()
-	if lv := m.findLabelValueOrNil(labelvalues); lv != nil {
-		d = lv.Value
-	} else {
-		d = &Datum{}
-		m.LabelValues = append(m.LabelValues, &LabelValue{labelvalues, d})
+	for _, lv := range m.lru {
+		lv.lruIndex = -1
 	}
-	return d, nil
+	m.LabelValues = make([]*LabelValue, 0)
+	m.lru = nil
+}
+
+// ResetIfDue zeroes every LabelValue if a new reset interval has begun by the
+// given time since they were last checked.  Intervals are aligned to
+// multiples of the interval since the zero time, so that a metric reset every
+// minute covers each wall clock minute.  The values are zeroed in place.  A
+// concurrent Set or IncBy is a single atomic write, and Observe holds the same
+// lock on the Datum as its reset, so each write lands wholly before or after
+// the reset.
+func (m *Metric) ResetIfDue(now time.Time) {
+	if m.Reset <= 0 {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	period := now.Truncate(m.Reset)
+	if m.resetPeriod.IsZero() {
+		m.resetPeriod = period
+		return
+	}
+	if !period.After(m.resetPeriod) {
+		return
+	}
+	m.resetPeriod = period
+	for _, lv := range m.LabelValues {
+		lv.Value.reset(now)
+	}
+}
+
+// RemoveExpired removes the LabelValues that have expired by the given time.
+func (m *Metric) RemoveExpired(now time.Time) {
+	if m.TTL <= 0 {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	lvs := m.LabelValues[:0]
+	for _, lv := range m.LabelValues {
+		if !m.expired(lv, now) {
+			lvs = append(lvs, lv)
+		} else if m.EvictLRU {
+			heap.Remove(&m.lru, lv.lruIndex)
+		}
+	}
+	m.LabelValues = lvs
+}
+
+// expired returns whether lv hasn't been written for the Metric's TTL by the
+// given time.
+func (m *Metric) expired(lv *LabelValue, now time.Time) bool {
+	if m.TTL <= 0 {
+		return false
+	}
+	updated := lv.updated()
+	return !updated.IsZero() && now.After(updated.Add(m.TTL))
+}
+
+// newDatum returns a new zero Datum, with storage for each bucket if this Metric
+// is a Histogram, and a quantile estimator if it is a Summary.
+func (m *Metric) newDatum() *Datum {
+	d := &Datum{}
+	switch m.Kind {
+	case Histogram:
+		d.Buckets = make([]Bucket, len(m.Buckets))
+		for i, b := range m.Buckets {
+			d.Buckets[i].UpperBound = b
+		}
+	case Summary:
+		d.stream = &quantileStream{}
+	}
+	return d
 }
 
 // LabelSet is an object that maps the keys of a Metric to the labels naming a
 // Datum, for use when enumerating Datums from a Metric.
 type LabelSet struct {
-	Labels map[string]string
-	Datum  *Datum
+	Labels  map[string]string
+	Datum   *Datum
+	Updated time.Time // When the Datum was last updated, if the Metric has a TTL or exports update times.
 }
 
 func zip(keys []string, values []string) map[string]string {
@@ -126,12 +432,29 @@ func zip(keys []string, values []string) map[string]string {
 	return r
 }
 
+// LabelSets returns the LabelSets corresponding to the LabelValues of a
+// Metric.  The Metric is only locked while they're copied, so that the caller
+// can export them without holding up writes to it.  LabelValues that have
+// expired but not yet been removed are skipped.
+func (m *Metric) LabelSets() []*LabelSet {
+	now := m.now()
+	m.RLock()
+	defer m.RUnlock()
+	ls := make([]*LabelSet, 0, len(m.LabelValues))
+	for _, lv := range m.LabelValues {
+		if m.expired(lv, now) {
+			continue
+		}
+		ls = append(ls, &LabelSet{zip(m.Keys, lv.Labels), lv.Value, lv.updated()})
+	}
+	return ls
+}
+
 // EmitLabelSets enumerates the LabelSets corresponding to the LabelValues of a
 // Metric.  It emits them onto the provided channel, then closes the channel to
 // signal completion.
 func (m *Metric) EmitLabelSets(c chan *LabelSet) {
-	for _, lv := range m.LabelValues {
-		ls := &LabelSet{zip(m.Keys, lv.Labels), lv.Value}
+	for _, ls := range m.LabelSets() {
 		c <- ls
 	}
 	close(c)
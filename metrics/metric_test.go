@@ -5,12 +5,14 @@ package metrics
 
 import (
 	"encoding/json"
+	"expvar"
 	"math/rand"
 	"reflect"
 	"testing"
 	"testing/quick"
 	"time"
 
+	"github.com/google/mtail/clock"
 	"github.com/kylelemons/godebug/pretty"
 )
 
@@ -215,3 +217,266 @@ func TestTimer(t *testing.T) {
 		t.Errorf("value not 1")
 	}
 }
+
+func TestHistogram(t *testing.T) {
+	m := NewMetric("test", "prog", Histogram)
+	m.Buckets = []int64{10, 100}
+	d, _ := m.GetDatum()
+	ts := time.Now().UTC()
+	for _, v := range []int64{1, 20, 200} {
+		d.Observe(v, ts)
+	}
+	expected := &Datum{Value: 221, Time: ts.UnixNano(), Count: 3,
+		Buckets: []Bucket{{UpperBound: 10, Count: 1}, {UpperBound: 100, Count: 2}}}
+	diff := pretty.Compare(d, expected)
+	if len(diff) > 0 {
+		t.Errorf("Histogram datum not expected:\n%s", diff)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	m := NewMetric("test", "prog", Counter, "user")
+	m.TTL = time.Hour
+	c := clock.NewFakeClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	m.setClock(c)
+	m.GetDatum("a")
+	c.Advance(2 * time.Minute)
+	m.GetDatum("b")
+	c.Advance(59 * time.Minute)
+
+	ch := make(chan *LabelSet)
+	go m.EmitLabelSets(ch)
+	var labels []string
+	for l := range ch {
+		labels = append(labels, l.Labels["user"])
+	}
+	if diff := pretty.Compare([]string{"b"}, labels); len(diff) > 0 {
+		t.Errorf("expired label set emitted:\n%s", diff)
+	}
+
+	m.RemoveExpired(c.Now())
+	if len(m.LabelValues) != 1 || m.LabelValues[0].Labels[0] != "b" {
+		t.Errorf("expired label value not removed: %v", m.LabelValues)
+	}
+
+	// Reading the datum leaves its expiry alone, and writing it pushes the
+	// expiry back.
+	c.Advance(2 * time.Minute)
+	d, _ := m.GetDatum("b")
+	d.Get()
+	if !m.expired(m.LabelValues[0], c.Now()) {
+		t.Errorf("expiry updated by a read: updated %s", m.LabelValues[0].updated())
+	}
+	d.IncBy(1, c.Now())
+	if m.expired(m.LabelValues[0], c.Now()) {
+		t.Errorf("expiry not updated: updated %s", m.LabelValues[0].updated())
+	}
+	m.RemoveExpired(c.Now().Add(2 * time.Hour))
+	if len(m.LabelValues) != 0 {
+		t.Errorf("label value not expired after TTL: %v", m.LabelValues)
+	}
+}
+
+func TestUpdatedOnlyByWrites(t *testing.T) {
+	m := NewMetric("test", "prog", Counter, "user")
+	m.ExportUpdated = true
+	c := clock.NewFakeClock(time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC))
+	m.setClock(c)
+	d, _ := m.GetDatum("a")
+	d.IncBy(1, c.Now())
+	written := c.Now()
+
+	c.Advance(time.Minute)
+	d, _ = m.GetDatum("a")
+	d.Get()
+	if !m.LabelValues[0].updated().Equal(written) {
+		t.Errorf("update time changed by a read: was %s, now %s", written, m.LabelValues[0].updated())
+	}
+	d.IncBy(1, c.Now())
+	if !m.LabelValues[0].updated().Equal(c.Now()) {
+		t.Errorf("update time not changed by a write: was %s, now %s", written, m.LabelValues[0].updated())
+	}
+}
+
+func TestResetIfDue(t *testing.T) {
+	m := NewMetric("test", "prog", Counter, "user")
+	m.Reset = time.Minute
+	// A fake clock, starting partway through a minute.
+	now := time.Date(2017, 6, 1, 12, 0, 30, 0, time.UTC)
+	m.ResetIfDue(now)
+	for _, u := range []string{"a", "b"} {
+		d, _ := m.GetDatum(u)
+		d.IncBy(3, now)
+	}
+
+	now = now.Add(29 * time.Second)
+	m.ResetIfDue(now)
+	for _, lv := range m.LabelValues {
+		if lv.Value.Get() != 3 {
+			t.Errorf("%v reset before the end of the minute: %d", lv.Labels, lv.Value.Get())
+		}
+	}
+
+	now = now.Add(2 * time.Second)
+	m.ResetIfDue(now)
+	if len(m.LabelValues) != 2 {
+		t.Fatalf("label sets removed by reset: %v", m.LabelValues)
+	}
+	for _, lv := range m.LabelValues {
+		if lv.Value.Get() != 0 || lv.Value.Time != now.UnixNano() {
+			t.Errorf("%v not reset at the end of the minute: %d at %d", lv.Labels, lv.Value.Get(), lv.Value.Time)
+		}
+	}
+
+	// Updates after the reset count towards the next minute.
+	d, _ := m.GetDatum("a")
+	d.IncBy(1, now)
+	m.ResetIfDue(now.Add(30 * time.Second))
+	if d.Get() != 1 {
+		t.Errorf("a reset twice in one minute: %d", d.Get())
+	}
+}
+
+// TestResetIfDueExcludesWrites tests that an observation waits for the lock
+// on its Datum, which ResetIfDue holds while it zeroes the values, so that a
+// reset can't land partway through the observation.
+func TestResetIfDueExcludesWrites(t *testing.T) {
+	m := NewMetric("test", "prog", Histogram)
+	m.Buckets = []int64{1}
+	m.Reset = time.Minute
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	m.ResetIfDue(now)
+	d, err := m.GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.mu.Lock()
+	written := make(chan struct{})
+	go func() {
+		d.Observe(1, now)
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("write didn't wait for the Datum's lock")
+	case <-time.After(10 * time.Millisecond):
+	}
+	d.mu.Unlock()
+	<-written
+
+	m.ResetIfDue(now.Add(time.Minute))
+	d.Observe(1, now)
+	if d.Get() != 1 || d.GetCount() != 1 || d.GetBuckets()[0].Count != 1 {
+		t.Errorf("write after reset: sum %d, count %d, buckets %v", d.Get(), d.GetCount(), d.GetBuckets())
+	}
+}
+
+// TestWritesDontLockMetric tests that writes to a Datum don't wait for the
+// lock on its Metric, so that a slow export can't hold up the programs.
+func TestWritesDontLockMetric(t *testing.T) {
+	m := NewMetric("test", "prog", Counter, "user")
+	m.TTL = time.Hour
+	m.EvictLRU = true
+	d, err := m.GetDatum("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	written := make(chan struct{})
+	go func() {
+		d.IncBy(1, time.Now())
+		d.Set(2, time.Now())
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("write waited for the Metric's lock")
+	}
+}
+
+func TestLimitRejectsNewLabelSets(t *testing.T) {
+	m := NewMetric("limited", "prog", Counter, "request")
+	m.Limit = 2
+	before := expvarValue(LabelSetDrops, "prog/limited")
+	for _, r := range []string{"a", "b", "c", "d", "a"} {
+		d, err := m.GetDatum(r)
+		if r == "c" || r == "d" {
+			if err != ErrLabelSetLimit {
+				t.Errorf("GetDatum(%q): got %v, want ErrLabelSetLimit", r, err)
+			}
+		} else if err != nil {
+			t.Fatalf("GetDatum(%q) failed: %s", r, err)
+		}
+		d.IncBy(1, time.Now())
+	}
+	if len(m.LabelValues) != 2 {
+		t.Fatalf("label values not capped at 2: %v", m.LabelValues)
+	}
+	if m.findLabelValueOrNil([]string{"a"}).Value.Get() != 2 {
+		t.Errorf("a not incremented twice: %v", m.LabelValues)
+	}
+	if m.findLabelValueOrNil([]string{"c"}) != nil {
+		t.Errorf("c not dropped: %v", m.LabelValues)
+	}
+	if drops := expvarValue(LabelSetDrops, "prog/limited") - before; drops != 2 {
+		t.Errorf("drops: got %d, want 2", drops)
+	}
+}
+
+func TestLimitEvictsLeastRecentlyUsed(t *testing.T) {
+	m := NewMetric("lru", "prog", Counter, "request")
+	m.Limit = 2
+	m.EvictLRU = true
+	before := expvarValue(LabelSetEvictions, "prog/lru")
+	datums := map[string]*Datum{}
+	for _, r := range []string{"a", "b"} {
+		d, err := m.GetDatum(r)
+		if err != nil {
+			t.Fatalf("GetDatum(%q) failed: %s", r, err)
+		}
+		datums[r] = d
+	}
+	// Writes count as uses, but fetches don't.
+	datums["a"].IncBy(1, time.Now())
+	if _, err := m.GetDatum("b"); err != nil {
+		t.Fatalf("GetDatum(%q) failed: %s", "b", err)
+	}
+	if _, err := m.GetDatum("c"); err != nil {
+		t.Fatalf("GetDatum(%q) failed: %s", "c", err)
+	}
+	if len(m.LabelValues) != 2 {
+		t.Fatalf("label values not capped at 2: %v", m.LabelValues)
+	}
+	if m.findLabelValueOrNil([]string{"b"}) != nil {
+		t.Errorf("least recently written b not evicted: %v", m.LabelValues)
+	}
+	if m.findLabelValueOrNil([]string{"a"}) == nil || m.findLabelValueOrNil([]string{"c"}) == nil {
+		t.Errorf("a and c not kept: %v", m.LabelValues)
+	}
+	if evictions := expvarValue(LabelSetEvictions, "prog/lru") - before; evictions != 1 {
+		t.Errorf("evictions: got %d, want 1", evictions)
+	}
+
+	// A write to an evicted datum doesn't bring it back.
+	datums["b"].IncBy(1, time.Now())
+	if err := m.RemoveDatum("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetDatum("d"); err != nil {
+		t.Fatalf("GetDatum(%q) failed: %s", "d", err)
+	}
+	if len(m.LabelValues) != 2 || len(m.lru) != 2 {
+		t.Errorf("c and d not kept: %v, %v", m.LabelValues, m.lru)
+	}
+}
+
+func expvarValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
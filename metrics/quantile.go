@@ -0,0 +1,144 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+// DefaultQuantiles are the quantiles estimated by a Summary when none are
+// given in the program.
+var DefaultQuantiles = []float64{0.5, 0.9, 0.99}
+
+// summaryCompression bounds the number of centroids kept by the quantile
+// estimator of each Summary label set, and so its memory and accuracy.  The
+// estimator keeps at most this many centroids, and buffers up to
+// summaryBufferSize observations before merging them in.
+const (
+	summaryCompression = 100
+	summaryBufferSize  = 5 * summaryCompression
+)
+
+// centroid is the mean of a run of neighbouring observations, weighted by how
+// many there were.
+type centroid struct {
+	mean  float64
+	count float64
+}
+
+// quantileStream estimates the quantiles of a stream of observations in
+// bounded memory, with a merging t-digest.  Observations are buffered, and
+// then merged into centroids that are sized by their quantile: small near
+// the extremes and large near the median, so the tail quantiles that matter
+// most for latency are the most accurate.
+type quantileStream struct {
+	mu        sync.Mutex
+	centroids []centroid // Sorted by mean.
+	count     float64    // Total weight of the centroids.
+	buffer    []float64  // Observations not yet merged into the centroids.
+	min, max  float64
+}
+
+// insert adds an observation to the stream.
+func (s *quantileStream) insert(v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.count == 0 && len(s.buffer) == 0 || v < s.min {
+		s.min = v
+	}
+	if s.count == 0 && len(s.buffer) == 0 || v > s.max {
+		s.max = v
+	}
+	s.buffer = append(s.buffer, v)
+	if len(s.buffer) >= summaryBufferSize {
+		s.merge()
+	}
+}
+
+// reset discards the observations.
+func (s *quantileStream) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.centroids = nil
+	s.count = 0
+	s.buffer = s.buffer[:0]
+}
+
+// scale maps a quantile to the t-digest scale, on which each centroid spans at
+// most 1.  The scale is steepest at the extremes, which keeps the centroids
+// there small.
+func scale(q float64) float64 {
+	return summaryCompression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+// merge merges the buffered observations into the centroids, and then
+// combines neighbouring centroids while they stay within the size allowed at
+// their quantile.
+func (s *quantileStream) merge() {
+	if len(s.buffer) == 0 {
+		return
+	}
+	sort.Float64s(s.buffer)
+	all := make([]centroid, 0, len(s.centroids)+len(s.buffer))
+	i, j := 0, 0
+	for i < len(s.centroids) || j < len(s.buffer) {
+		if j == len(s.buffer) || i < len(s.centroids) && s.centroids[i].mean <= s.buffer[j] {
+			all = append(all, s.centroids[i])
+			i++
+		} else {
+			all = append(all, centroid{s.buffer[j], 1})
+			j++
+		}
+	}
+	total := s.count + float64(len(s.buffer))
+	s.buffer = s.buffer[:0]
+
+	merged := make([]centroid, 0, summaryCompression)
+	cur := all[0]
+	before := 0.0 // Weight of the centroids before cur.
+	for _, c := range all[1:] {
+		if scale((before+cur.count+c.count)/total)-scale(before/total) <= 1 {
+			cur.count += c.count
+			cur.mean += (c.mean - cur.mean) * c.count / cur.count
+			continue
+		}
+		merged = append(merged, cur)
+		before += cur.count
+		cur = c
+	}
+	s.centroids = append(merged, cur)
+	s.count = total
+}
+
+// quantile returns the estimate of quantile q of the observations, or NaN if
+// there are none.  The estimate is interpolated between the centroids either
+// side of q, taking each centroid's observations to be spread evenly around
+// its mean.
+func (s *quantileStream) quantile(q float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.merge()
+	if s.count == 0 {
+		return math.NaN()
+	}
+	target := q * s.count
+	// Interpolate from the minimum up to the middle of the first centroid.
+	prevMean, prevMid := s.min, 0.0
+	cum := 0.0
+	for _, c := range s.centroids {
+		mid := cum + c.count/2
+		if target < mid {
+			return prevMean + (c.mean-prevMean)*(target-prevMid)/(mid-prevMid)
+		}
+		prevMean, prevMid = c.mean, mid
+		cum += c.count
+	}
+	// And from the middle of the last centroid up to the maximum.
+	if cum == prevMid {
+		return s.max
+	}
+	return prevMean + (s.max-prevMean)*(target-prevMid)/(cum-prevMid)
+}
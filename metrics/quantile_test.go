@@ -0,0 +1,63 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package metrics
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSummaryQuantiles(t *testing.T) {
+	m := NewMetric("test", "prog", Summary)
+	m.Quantiles = []float64{0.01, 0.5, 0.9, 0.99, 0.999}
+	d, _ := m.GetDatum()
+	ts := time.Now().UTC()
+	// A uniform distribution of 1 to 100000, in a random order.
+	const n = 100000
+	sum := int64(0)
+	for _, v := range rand.New(rand.NewSource(1)).Perm(n) {
+		d.Observe(int64(v+1), ts)
+		sum += int64(v + 1)
+	}
+	if d.GetCount() != n || d.Get() != sum {
+		t.Errorf("count %d and sum %d, want %d and %d", d.GetCount(), d.Get(), n, sum)
+	}
+	for _, q := range m.Quantiles {
+		// Within 0.1% of the observations at the tails, and a little more
+		// towards the median.
+		got, want := d.GetQuantile(q), q*n
+		if tolerance := n * (0.001 + 0.02*math.Min(q, 1-q)); math.Abs(got-want) > tolerance {
+			t.Errorf("quantile %g: got %g, want %g within %g", q, got, want, tolerance)
+		}
+	}
+	// The estimator's memory is bounded however many values are observed.
+	if c := len(d.stream.centroids); c > summaryCompression {
+		t.Errorf("%d centroids kept, want at most %d", c, summaryCompression)
+	}
+	if b := cap(d.stream.buffer); b > 2*summaryBufferSize {
+		t.Errorf("buffer of %d observations, want at most %d", b, 2*summaryBufferSize)
+	}
+}
+
+func TestSummaryEdgeCases(t *testing.T) {
+	s := &quantileStream{}
+	if q := s.quantile(0.5); !math.IsNaN(q) {
+		t.Errorf("quantile of no observations: got %g, want NaN", q)
+	}
+	s.insert(7)
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		if got := s.quantile(q); got != 7 {
+			t.Errorf("quantile %g of one observation: got %g, want 7", q, got)
+		}
+	}
+	s.insert(-3)
+	if s.min != -3 || s.max != 7 {
+		t.Errorf("min and max: got %g and %g, want -3 and 7", s.min, s.max)
+	}
+	if got := s.quantile(0.001); got < -3 || got > 7 {
+		t.Errorf("quantile outside the observations: %g", got)
+	}
+}
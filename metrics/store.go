@@ -3,27 +3,140 @@
 
 package metrics
 
-import "sync"
+import (
+	"sync"
+	"time"
+
+	"github.com/google/mtail/clock"
+)
 
 // Store contains Metrics.
 type Store struct {
 	sync.RWMutex
 	Metrics []*Metric
+
+	clock clock.Clock // Tells the time for expiry and resets, and for the Metrics added.
+
+	quit chan struct{} // Closed to stop the expiry and reset loops.
 }
 
 func NewStore() (s *Store) {
-	s = &Store{}
+	s = &Store{clock: clock.Real, quit: make(chan struct{})}
 	s.ClearMetrics()
 	return
 }
 
+// SetClock sets the clock that tells the time for the Store and its Metrics,
+// such as a fake clock in tests.  It must be called before the expiry and
+// reset loops are started.
+func (ms *Store) SetClock(c clock.Clock) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.clock = c
+	for _, m := range ms.Metrics {
+		m.setClock(c)
+	}
+}
+
 // Add is used to add one or more metrics in the Store.
 func (ms *Store) Add(m ...*Metric) {
 	ms.Lock()
 	defer ms.Unlock()
+	for _, n := range m {
+		n.setClock(ms.clock)
+	}
 	ms.Metrics = append(ms.Metrics, m...)
 }
 
+// ReplaceProgramMetrics removes all the metrics exported by the named
+// program, and adds the metrics given in their place, in one step.
+func (ms *Store) ReplaceProgramMetrics(program string, m ...*Metric) {
+	ms.Lock()
+	defer ms.Unlock()
+	for _, n := range m {
+		n.setClock(ms.clock)
+	}
+	var r []*Metric
+	for _, old := range ms.Metrics {
+		if old.Program != program {
+			r = append(r, old)
+		}
+	}
+	ms.Metrics = append(r, m...)
+}
+
+// RemoveProgramMetrics removes all the metrics exported by the named program.
+func (ms *Store) RemoveProgramMetrics(program string) {
+	ms.ReplaceProgramMetrics(program)
+}
+
+// RemoveExpired removes the expired LabelValues of every Metric with a TTL.
+func (ms *Store) RemoveExpired() {
+	ms.RLock()
+	defer ms.RUnlock()
+	now := ms.clock.Now()
+	for _, m := range ms.Metrics {
+		m.RemoveExpired(now)
+	}
+}
+
+// StartExpiryLoop removes expired LabelValues from the store each interval,
+// in a background goroutine, until the Store is closed.
+func (ms *Store) StartExpiryLoop(interval time.Duration) {
+	go func() {
+		ticker := ms.clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ms.RemoveExpired()
+			case <-ms.quit:
+				return
+			}
+		}
+	}()
+}
+
+// ResetDue zeroes the LabelValues of every Metric with a reset interval that
+// has ended by the given time.
+func (ms *Store) ResetDue(now time.Time) {
+	ms.RLock()
+	defer ms.RUnlock()
+	for _, m := range ms.Metrics {
+		m.ResetIfDue(now)
+	}
+}
+
+// StartResetLoop checks the metrics with a reset interval each tick, in a
+// background goroutine, zeroing those whose interval has ended, until the
+// Store is closed.
+func (ms *Store) StartResetLoop(tick time.Duration) {
+	go func() {
+		ticker := ms.clock.NewTicker(tick)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				ms.ResetDue(now)
+			case <-ms.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the expiry and reset loops.  The metrics are kept, so that
+// they can still be exported.
+func (ms *Store) Close() {
+	ms.Lock()
+	defer ms.Unlock()
+	select {
+	case <-ms.quit:
+	default:
+		close(ms.quit)
+	}
+}
+
 // ClearMetrics empties the store of all metrics.
 func (ms *Store) ClearMetrics() {
 	ms.Lock()
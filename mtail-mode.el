@@ -40,11 +40,11 @@
   "All types in the mtail language.  Used for font locking.")
 
 (defconst mtail-mode-keywords
-  '("as" "by" "const" "hidden" "def" "next")
+  '("after" "as" "buckets" "by" "const" "hidden" "def" "del" "else" "every" "limit" "logs" "lru" "namespace" "next" "or" "quantiles" "record" "reset" "sample" "updated")
   "All keywords in the mtail language.  Used for font locking.")
 
 (defconst mtail-mode-builtins
-  '("len" "strptime" "timestamp")
+  '("getfilename" "len" "strptime" "timestamp" "tolower" "toupper" "int" "float" "split" "logfmt" "getjson" "substr" "subst" "strlen" "format" "cidr" "in_cidr" "starttimer" "elapsed" "getstream" "gettime" "getenv")
   "All builtins in the mtail language.  Used for font locking.")
 
 (defvar mtail-mode-font-lock-defaults
@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// healthzPath is the endpoint probed by load balancers, which can be left out
+// of authentication.
+const healthzPath = "/healthz"
+
+// basicAuth requires HTTP basic authentication with a password matching one
+// of the bcrypt hashes in users.
+type basicAuth struct {
+	users         map[string][]byte // bcrypt password hash by username
+	excludeHealth bool              // Don't require authentication for healthzPath.
+}
+
+// newBasicAuth builds the basic authentication of the HTTP endpoints from the
+// Options, or returns nil if no credentials are configured.
+func (o Options) newBasicAuth() (*basicAuth, error) {
+	if o.HTTPAuthUser == "" && o.HTTPAuthPasswordHash == "" && o.HTTPAuthHtpasswdFile == "" {
+		return nil, nil
+	}
+	a := &basicAuth{users: make(map[string][]byte), excludeHealth: o.HTTPAuthExcludeHealthz}
+	if o.HTTPAuthUser != "" || o.HTTPAuthPasswordHash != "" {
+		if o.HTTPAuthUser == "" || o.HTTPAuthPasswordHash == "" {
+			return nil, errors.New("both an HTTP auth user and password hash must be set")
+		}
+		if _, err := bcrypt.Cost([]byte(o.HTTPAuthPasswordHash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for HTTP auth user %q: %s", o.HTTPAuthUser, err)
+		}
+		a.users[o.HTTPAuthUser] = []byte(o.HTTPAuthPasswordHash)
+	}
+	if o.HTTPAuthHtpasswdFile != "" {
+		if err := a.loadHtpasswd(o.HTTPAuthHtpasswdFile); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// loadHtpasswd adds the users in an htpasswd file.  Only bcrypt hashes, as
+// written by htpasswd -B, are supported.
+func (a *basicAuth) loadHtpasswd(pathname string) error {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return fmt.Errorf("failed to open htpasswd file: %s", err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s:%d: expected user:hash", pathname, n)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return fmt.Errorf("%s:%d: invalid bcrypt hash for user %q: %s", pathname, n, parts[0], err)
+		}
+		a.users[parts[0]] = []byte(parts[1])
+	}
+	return s.Err()
+}
+
+// wrap returns a handler that responds with 401 Unauthorized to requests
+// without valid credentials, and passes the rest to h.
+func (a *basicAuth) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.excludeHealth && r.URL.Path == healthzPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if ok {
+			if hash, found := a.users[user]; found && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="mtail"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBasicAuth(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := path.Join(workdir, "htpasswd")
+	if err := ioutil.WriteFile(htpasswd, []byte("# users\nprom:"+string(other)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o := Options{
+		HTTPAuthUser:           "admin",
+		HTTPAuthPasswordHash:   string(hash),
+		HTTPAuthHtpasswdFile:   htpasswd,
+		HTTPAuthExcludeHealthz: true,
+	}
+	a, err := o.newBasicAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name     string
+		path     string
+		user     string
+		password string
+		status   int
+	}{
+		{"no credentials", "/metrics", "", "", http.StatusUnauthorized},
+		{"wrong password", "/metrics", "admin", "wrong", http.StatusUnauthorized},
+		{"unknown user", "/metrics", "nobody", "secret", http.StatusUnauthorized},
+		{"user", "/metrics", "admin", "secret", http.StatusOK},
+		{"htpasswd user", "/metrics", "prom", "hunter2", http.StatusOK},
+		{"healthz excluded", "/healthz", "", "", http.StatusOK},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.user != "" {
+			r.SetBasicAuth(tc.user, tc.password)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d, got %d", tc.name, tc.status, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tc.name)
+		}
+	}
+
+	o.HTTPAuthExcludeHealthz = false
+	a, err = o.newBasicAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	a.wrap(http.NotFoundHandler()).ServeHTTP(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("healthz not excluded: expected status 401, got %d", w.Code)
+	}
+}
+
+func TestInvalidBasicAuthOptions(t *testing.T) {
+	for _, o := range []Options{
+		{HTTPAuthUser: "admin"},
+		{HTTPAuthPasswordHash: "$2y$05$abc"},
+		{HTTPAuthUser: "admin", HTTPAuthPasswordHash: "plaintext"},
+		{HTTPAuthHtpasswdFile: "/nonexistent/htpasswd"},
+	} {
+		if _, err := o.newBasicAuth(); err == nil {
+			t.Errorf("expected error for %+v", o)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spf13/afero"
+)
+
+// readManifest returns the log paths listed in a manifest file on fs, one per
+// line.  Blank lines and lines starting with # are skipped.  Relative paths
+// are relative to the directory of the manifest.
+func readManifest(fs afero.Fs, pathname string) ([]string, error) {
+	f, err := fs.Open(pathname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log manifest: %s", err)
+	}
+	defer f.Close()
+	var paths []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(filepath.Dir(pathname), line)
+		}
+		paths = append(paths, normalizePath(line))
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read log manifest %q: %s", pathname, err)
+	}
+	return paths, nil
+}
+
+// normalizePath returns pathname made absolute and cleaned, so that the same
+// log given in different ways, such as relative to different directories or
+// through "..", is recognised as one.
+func normalizePath(pathname string) string {
+	if abs, err := filepath.Abs(pathname); err == nil {
+		return abs
+	}
+	return filepath.Clean(pathname)
+}
+
+// loadManifest tails the logs newly listed in the log manifest, and stops
+// tailing those no longer listed.  Logs also given in LogPaths are left
+// alone.
+func (m *Mtail) loadManifest() error {
+	paths, err := readManifest(m.fs(), m.o.LogManifest)
+	if err != nil {
+		return err
+	}
+	given := make(map[string]struct{})
+	for _, pathname := range m.o.LogPaths {
+		given[normalizePath(pathname)] = struct{}{}
+	}
+	listed := make(map[string]struct{})
+	for _, pathname := range paths {
+		listed[pathname] = struct{}{}
+		if _, ok := m.manifestLogs[pathname]; ok {
+			continue
+		}
+		if _, ok := given[pathname]; ok {
+			continue
+		}
+		glog.Infof("Tailing %s, listed in the log manifest", pathname)
+		m.t.Tail(pathname)
+		m.manifestLogs[pathname] = struct{}{}
+	}
+	for pathname := range m.manifestLogs {
+		if _, ok := listed[pathname]; !ok {
+			glog.Infof("Not tailing %s, no longer listed in the log manifest", pathname)
+			m.t.Untail(pathname)
+			delete(m.manifestLogs, pathname)
+		}
+	}
+	return nil
+}
@@ -5,22 +5,36 @@ package mtail
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/clock"
 	"github.com/google/mtail/exporter"
+	"github.com/google/mtail/logline"
 	"github.com/google/mtail/metrics"
+	"github.com/google/mtail/syslog"
 	"github.com/google/mtail/tailer"
+	"github.com/google/mtail/tcplog"
 	"github.com/google/mtail/vm"
 	"github.com/google/mtail/watcher"
 	"github.com/spf13/afero"
@@ -28,29 +42,64 @@ import (
 
 // Mtail contains the state of the main program object.
 type Mtail struct {
-	lines chan string    // Channel of lines from tailer to VM engine.
-	store *metrics.Store // Metrics storage.
+	lines chan *logline.LogLine // Channel of lines from tailer to VM engine.
+	store *metrics.Store        // Metrics storage.
 
 	t *tailer.Tailer     // t tails the watched files and feeds lines to the VMs.
+	s *syslog.Server     // s receives syslog messages and feeds them to the VMs, if enabled.
+	r *tcplog.Receiver   // r reads lines streamed over TCP and feeds them to the VMs, if enabled.
 	l *vm.Loader         // l loads programs and manages the VM lifecycle.
 	e *exporter.Exporter // e manages the export of metrics from the store.
 
 	webquit   chan struct{} // Channel to signal shutdown from web UI.
+	quitOnce  sync.Once     // Ensure webquit is closed only once.
+	stdinDone chan struct{} // Closed when reading from standard input has finished.
+	stdinQuit chan struct{} // Closed to stop reading from standard input.
 	closeOnce sync.Once     // Ensure shutdown happens only once.
+	ready     int32         // Set to 1 when tailing has started; accessed atomically.
 
-	o Options // Options passed in at creation time.
+	pushLock   sync.RWMutex // Held for reading while a pushed line is sent, and for writing to stop pushes.
+	pushClosed bool         // Set once pushed lines are refused, before the lines channel is closed.
+
+	o         Options     // Options passed in at creation time.
+	tlsConfig *tls.Config // Configuration of the HTTPS server, nil if serving HTTP.
+	auth      *basicAuth  // Authentication of the HTTP endpoints, nil if not required.
+
+	srv *http.Server // HTTP server, once serving.
+
+	manifestLogs map[string]struct{} // Log paths tailed because they're listed in the log manifest.
+
+	snapshotQuit chan struct{} // Closed to write the counters to the snapshot file a final time.
+	snapshotDone chan struct{} // Closed once the final snapshot is written.
+
+	addrLock sync.Mutex // protects `addr'
+	addr     net.Addr   // TCP address HTTP is served on, once listening.
 }
 
-// OneShot reads the contents of a log file into the lines channel from start to finish, terminating the program at the end.
+// OneShot reads the contents of a log file into the lines channel from start to finish, terminating the program at the end.  Gzip compressed log files are decompressed.
 func (m *Mtail) OneShot(logfile string, print bool) (count int64, err error) {
 	glog.Infof("Oneshot %q", logfile)
-	l, err := os.Open(logfile)
-	if err != nil {
-		return 0, fmt.Errorf("failed to open log file %q: %s", logfile, err)
+	l := os.Stdin
+	if logfile != StdinPath {
+		if logfile, err = filepath.Abs(logfile); err != nil {
+			return 0, fmt.Errorf("failed to find absolute path for %q: %s", logfile, err)
+		}
+		l, err = os.Open(logfile)
+		if err != nil {
+			return 0, fmt.Errorf("failed to open log file %q: %s", logfile, err)
+		}
+		defer l.Close()
 	}
-	defer l.Close()
 
-	r := bufio.NewReader(l)
+	zr, err := tailer.NewReader(l)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decompress %q: %s", logfile, err)
+	}
+	dr, err := tailer.NewDecodingReader(zr, m.o.Encoding)
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(dr)
 
 	if print {
 		fmt.Printf("%s: %d MAXPROCS, %d CPUs, ", logfile, runtime.GOMAXPROCS(-1), runtime.NumCPU())
@@ -58,17 +107,22 @@ func (m *Mtail) OneShot(logfile string, print bool) (count int64, err error) {
 
 	start := time.Now()
 
-Loop:
+	// Lines split on the default delimiter are sent without the "\r" of a
+	// "\r\n" ending too, so that patterns anchored with $ match them.
+	trimCR := m.o.LineDelimiter == "" || m.o.LineDelimiter == tailer.DefaultLineDelimiter
 	for {
-		line, err := r.ReadString('\n')
-		switch {
-		case err == io.EOF:
-			m.lines <- line
-			break Loop
-		case err != nil:
+		line, err := tailer.ReadLine(r, logfile, m.maxLineLength(), m.o.LineDelimiter)
+		if trimCR {
+			line = strings.TrimSuffix(line, "\r")
+		}
+		if line != "" || err == nil {
+			m.lines <- logline.New(logfile, line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
 			return 0, fmt.Errorf("failed to read from %q: %s", logfile, err)
-		default:
-			m.lines <- line
 		}
 	}
 	duration := time.Since(start)
@@ -84,9 +138,24 @@ Loop:
 }
 
 // StartTailing constructs a new Tailer and commences sending log lines into
-// the lines channel.
+// the lines channel.  If standard input is the log source, it is read instead
+// and no Tailer is created.
 func (m *Mtail) StartTailing() error {
-	o := tailer.Options{Lines: m.lines, W: m.o.W, FS: m.o.FS}
+	if m.readsStdin() {
+		if len(m.o.LogPaths) > 1 || len(m.o.LogFds) > 0 || m.o.LogManifest != "" || m.o.SyslogAddress != "" || m.o.TCPListenAddress != "" || m.o.TCPDialAddress != "" {
+			return fmt.Errorf("can't read from standard input and tail other logs at the same time")
+		}
+		r, err := tailer.NewDecodingReader(os.Stdin, m.o.Encoding)
+		if err != nil {
+			return err
+		}
+		m.stdinDone = make(chan struct{})
+		m.stdinQuit = make(chan struct{})
+		go m.readStdin(r)
+		atomic.StoreInt32(&m.ready, 1)
+		return nil
+	}
+	o := tailer.Options{Lines: m.lines, W: m.o.W, FS: m.o.FS, FilePattern: m.o.LogFilePattern, PollInterval: m.o.PollInterval, ReadFromStart: m.o.ReadFromStart, StatePath: m.o.StatePath, Encoding: m.o.Encoding, MaxLineLength: m.o.MaxLineLength, LineDelimiter: m.o.LineDelimiter, Format: m.o.LogFormat, Clock: m.o.Clock}
 	var err error
 	m.t, err = tailer.New(o)
 	if err != nil {
@@ -96,71 +165,303 @@ func (m *Mtail) StartTailing() error {
 	for _, pathname := range m.o.LogPaths {
 		m.t.Tail(pathname)
 	}
+	if m.o.LogManifest != "" {
+		m.manifestLogs = make(map[string]struct{})
+		if err := m.loadManifest(); err != nil {
+			return err
+		}
+	}
 	for _, fd := range m.o.LogFds {
+		// A pipe is read by a goroutine blocked until the next write, and
+		// only a non-blocking descriptor lets closing it interrupt the
+		// read, so that shutdown doesn't wait forever for the reader.
+		if err := syscall.SetNonblock(fd, true); err != nil {
+			return fmt.Errorf("couldn't make log file descriptor %d non-blocking: %s", fd, err)
+		}
 		f := os.NewFile(uintptr(fd), strconv.Itoa(fd))
 		m.t.TailFile(f)
 	}
+	if m.o.SyslogAddress != "" {
+		m.s, err = syslog.New(syslog.Options{Lines: m.lines, Address: m.o.SyslogAddress, Protocol: m.o.SyslogProtocol})
+		if err != nil {
+			return fmt.Errorf("couldn't receive syslog: %s", err)
+		}
+	}
+	if m.o.TCPListenAddress != "" || m.o.TCPDialAddress != "" {
+		m.r, err = tcplog.New(tcplog.Options{Lines: m.lines, ListenAddress: m.o.TCPListenAddress, DialAddress: m.o.TCPDialAddress, MaxLineLength: m.o.MaxLineLength, LineDelimiter: m.o.LineDelimiter, Clock: m.o.Clock})
+		if err != nil {
+			return fmt.Errorf("couldn't receive logs over tcp: %s", err)
+		}
+	}
+	atomic.StoreInt32(&m.ready, 1)
 	return nil
 }
 
+// readsStdin reports whether standard input was requested as the log source.
+func (m *Mtail) readsStdin() bool {
+	for _, pathname := range m.o.LogPaths {
+		if pathname == StdinPath {
+			return true
+		}
+	}
+	return false
+}
+
+// maxLineLength returns the length in bytes beyond which lines are truncated.
+func (m *Mtail) maxLineLength() int {
+	if m.o.MaxLineLength > 0 {
+		return m.o.MaxLineLength
+	}
+	return tailer.DefaultMaxLineLength
+}
+
+// readStdin sends each line read from f into the lines channel,
+// and closes the lines channel at EOF or when asked to stop by Close, after
+// refusing lines pushed to /push, which are sent to the same channel.  The
+// read itself happens in a separate goroutine, because closing os.Stdin
+// doesn't interrupt a blocked read on a pipe or terminal; that goroutine is
+// left to exit on its own.  The lines already read when asked to stop are
+// counted in stdinLinesDropped.
+func (m *Mtail) readStdin(f io.Reader) {
+	defer close(m.stdinDone)
+	defer func() {
+		m.closePush()
+		close(m.lines)
+	}()
+	in := make(chan string)
+	go func() {
+		defer close(in)
+		r := bufio.NewReader(f)
+		for {
+			line, err := tailer.ReadLine(r, StdinPath, m.maxLineLength(), m.o.LineDelimiter)
+			if line != "" || err == nil {
+				select {
+				case in <- line:
+				case <-m.stdinQuit:
+					// This line, and the whole lines read into the buffer
+					// after it, are dropped.
+					delim := m.o.LineDelimiter
+					if delim == "" {
+						delim = tailer.DefaultLineDelimiter
+					}
+					b, _ := r.Peek(r.Buffered())
+					stdinLinesDropped.Add(1 + int64(bytes.Count(b, []byte(delim))))
+					return
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					glog.Infof("Failed to read from standard input: %s", err)
+				}
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case line, ok := <-in:
+			if !ok {
+				return
+			}
+			select {
+			case m.lines <- logline.New(StdinPath, line):
+			case <-m.stdinQuit:
+				stdinLinesDropped.Add(1)
+				return
+			}
+		case <-m.stdinQuit:
+			return
+		}
+	}
+}
+
 // InitLoader constructs a new program loader and performs the inital load of program files in the program directory.
 func (m *Mtail) InitLoader() error {
-	o := vm.LoaderOptions{Store: m.store, Lines: m.lines, CompileOnly: m.o.CompileOnly, DumpBytecode: m.o.DumpBytecode, SyslogUseCurrentYear: m.o.SyslogUseCurrentYear, W: m.o.W, FS: m.o.FS}
+	o := vm.LoaderOptions{Store: m.store, Lines: m.lines, CompileOnly: m.o.CompileOnly, DumpBytecode: m.o.DumpBytecode, SyslogUseCurrentYear: m.o.SyslogUseCurrentYear, PollInterval: m.o.PollInterval, MaxRecordSize: m.o.MaxRecordSize, RecordFlushTimeout: m.o.RecordFlushTimeout, RateLimits: m.o.ProgRateLimits, IgnorePattern: m.o.IgnorePattern, NamespaceFromProgram: m.o.NamespaceFromProgram, StrictMetricNames: m.o.StrictMetricNames, WarningsAsErrors: m.o.WarningsAsErrors, ProgFlags: m.o.ProgFlags, LineTimeout: m.o.LineTimeout, ProgLineBuffer: m.o.ProgLineBuffer, TimeLayouts: m.o.TimeLayouts, W: m.o.W, FS: m.o.FS, Clock: m.o.Clock}
 	var err error
 	m.l, err = vm.NewLoader(o)
 	if err != nil {
 		return err
 	}
-	if m.o.Progs != "" {
-		errors := m.l.LoadProgs(m.o.Progs)
-		if errors != nil {
-			return fmt.Errorf("Compile encountered errors:\n%s", errors)
+	var errs []string
+	for _, p := range strings.Split(m.o.Progs, ",") {
+		if p == "" {
+			continue
+		}
+		if err := m.l.LoadProgs(p); err != nil {
+			errs = append(errs, err.Error())
 		}
 	}
+	if len(errs) > 0 {
+		return fmt.Errorf("Compile encountered errors:\n%s", strings.Join(errs, "\n"))
+	}
 	return nil
 }
 
 func (m *Mtail) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The index is served at /, which matches every path without a handler
+	// of its own.
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
 	w.WriteHeader(200)
-	w.Write([]byte(`<a href="/json">json</a>, <a href="/metrics">prometheus metrics</a>, <a href="/varz">varz</a>`))
+	w.Write([]byte(`<a href="/json">json</a>, <a href="/metrics.json">json samples</a>, <a href="/metrics">prometheus metrics</a>, <a href="/varz">varz</a>, <a href="/progz">programs</a>`))
 }
 
+// expiryInterval is how often metrics with a TTL are swept for expired label
+// sets.  Expired label sets are never exported, even before they're swept.
+const expiryInterval = time.Minute
+
+// resetCheckInterval is how often metrics with a reset interval are checked
+// for the end of the interval, and so how late after it they can be zeroed.
+const resetCheckInterval = time.Second
+
+// buildInfo is 1, labelled with the version of mtail and of Go it was built
+// with, so that the versions run across a fleet can be compared.
+var buildInfo = metrics.NewInfo("build_info")
+
+// up is 1 while mtail is running, so that its absence can be told apart from
+// its logs being idle.
+var up = metrics.NewGaugeInt("up")
+
+// stdinLinesDropped counts the lines read from standard input that weren't
+// sent to the programs because mtail was shutting down.
+var stdinLinesDropped = expvar.NewInt("stdin_lines_dropped_total")
+
+// DefaultDrainTimeout is how long Close waits for lines to be processed and
+// metrics to be pushed before closing anyway.
+const DefaultDrainTimeout = 10 * time.Second
+
+// StdinPath is the log path that instructs mtail to read from standard input
+// instead of tailing log files.
+const StdinPath = "-"
+
 // Options contains all the parameters necessary for constructing a new Mtail.
 type Options struct {
-	Progs                string
+	Version              string // Version of mtail, exported in the mtail_build_info metric; "unknown" if empty.
+	Progs                string // Directories, files or glob patterns of programs to load, separated by commas.
 	LogPaths             []string
 	LogFds               []int
+	LogManifest          string // File listing more log paths to tail, one per line, reread on SIGHUP, if not empty.
+	LogFilePattern       string // Base name pattern of files to tail in log directories.
 	Port                 string
+	ListenAddress        string // Host and port to listen on, such as localhost:3903, or :0 for any free port.  Overrides Port if not empty.
+	ListenSocket         string // Serve HTTP on this unix socket too, if not empty.  Port may then be empty to not listen on TCP.
 	OneShot              bool
 	OneShotMetrics       bool
 	CompileOnly          bool
 	DumpBytecode         bool
 	SyslogUseCurrentYear bool
+	PollInterval         time.Duration // Poll files for changes at this interval instead of using inotify, if non-zero.
+	ReadFromStart        bool          // Read the existing contents of log files when first tailed.
+	StatePath            string        // Save read offsets in this file, and resume from them on restart, if not empty.
+	SnapshotPath         string        // Save the counters in this file, and restore them on restart, if not empty.
+	SnapshotInterval     time.Duration // How often the counters are saved to SnapshotPath; DefaultSnapshotInterval if zero.
+	Encoding             string        // Decode logs from this encoding, such as utf-16le, if not empty; UTF-8 otherwise.
+	LogFormat            string        // Unwrap the lines of tailed logs written in this format, such as tailer.DockerFormat, if not empty.
+	MaxLineLength        int           // Length in bytes beyond which lines read are truncated; tailer.DefaultMaxLineLength if zero.
+	LineDelimiter        string        // Separator of the lines of logs, such as "\x00"; tailer.DefaultLineDelimiter if empty.
+	SyslogAddress        string        // Receive syslog messages on this host and port, if not empty.  getfilename() is the sender's address.
+	SyslogProtocol       string        // Receive syslog over "udp", "tcp" or "both"; "udp" if empty.
+	TCPListenAddress     string        // Read lines from the connections accepted on this host and port, if not empty.  getfilename() is the peer's address.
+	TCPDialAddress       string        // Read lines from a connection to this host and port, reconnecting when it's lost, if not empty.  getfilename() is the peer's address.
+	MaxRecordSize        int           // Size in bytes beyond which lines aren't added to a multi-line record; vm.DefaultMaxRecordSize if zero.
+	RecordFlushTimeout   time.Duration // Run an incomplete multi-line record after this long without a new line; vm.DefaultRecordFlushTimeout if zero.
+	LineTimeout          time.Duration // Abandon a line that takes a program longer than this to run, if non-zero.
+	LineBuffer           int           // Number of lines buffered between the log readers and the programs, to absorb bursts; unbuffered if zero.
+	ProgLineBuffer       int           // Number of lines buffered for each program; vm.DefaultProgLineBuffer if zero.
+	TLSCertFile          string        // Serve HTTPS with this certificate, if not empty.
+	TLSKeyFile           string        // Private key of TLSCertFile.
+	TLSMinVersion        string        // Lowest TLS version accepted, e.g. "1.2"; Go's default if empty.
+	TLSClientCAFile      string        // Require client certificates signed by a CA in this file, if not empty.
+
+	HTTPAuthUser           string // Require HTTP basic authentication as this user, if not empty.
+	HTTPAuthPasswordHash   string // bcrypt hash of the password of HTTPAuthUser.
+	HTTPAuthHtpasswdFile   string // Require HTTP basic authentication as one of the users in this htpasswd file, if not empty.
+	HTTPAuthExcludeHealthz bool   // Serve /healthz without authentication.
+
+	EnableQuitHandler   bool // Serve /quitquitquit, which shuts mtail down when POSTed to.
+	EnablePushHandler   bool // Serve /push, which reads the lines POSTed to it.  getfilename() is the origin parameter, or the client's address.
+	EnableDebugHandlers bool // Serve profiles at /debug/pprof/ and expvars at /debug/vars.
+
+	User  string // Switch to this user name or uid once the logs are opened and the HTTP port is bound, if not empty.
+	Group string // Switch to this group name or gid, or the primary group of User if empty.
+
+	ProgRateLimits map[string]int // Most lines per second sent to each program, by program file name; the excess is dropped.
+	IgnorePattern  *regexp.Regexp // Drop lines matching this before sending them to any program, if not nil.
+
+	NamespaceFromProgram bool // Prefix the metric names of programs without a namespace statement with the program name.
+	StrictMetricNames    bool // Fail to load programs with metric or key names that Prometheus rejects, rather than sanitizing them.
+	WarningsAsErrors     bool // Fail to load programs with compile warnings.
+
+	ProgFlags []string // Flags set for the #if directives of programs.
+
+	TimeLayouts []string // Layouts of the timestamps gettime looks for at the start of lines, in order; vm.DefaultTimeLayouts if empty.
+
+	DrainTimeout time.Duration // Longest Close waits to process the remaining lines and push the metrics; DefaultDrainTimeout if zero.
 
 	Store *metrics.Store
 
-	W  watcher.Watcher // Not required, will use watcher.LogWatcher if zero.
-	FS afero.Fs        // Not required, will use afero.OsFs if zero.
+	W     watcher.Watcher // Not required, will use watcher.New if zero.
+	FS    afero.Fs        // Not required, will use afero.OsFs if zero.
+	Clock clock.Clock     // Not required, will use clock.Real if zero.
 }
 
 // New creates an Mtail from the supplied Options.
 func New(o Options) (*Mtail, error) {
+	if o.Clock == nil {
+		o.Clock = clock.Real
+	}
 	store := o.Store
 	if store == nil {
 		store = metrics.NewStore()
 	}
+	store.SetClock(o.Clock)
 	m := &Mtail{
-		lines:   make(chan string),
+		lines:   make(chan *logline.LogLine, o.LineBuffer),
 		store:   store,
 		webquit: make(chan struct{}),
 		o:       o}
 
-	err := m.InitLoader()
+	var err error
+	m.tlsConfig, err = o.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	m.auth, err = o.newBasicAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	version := o.Version
+	if version == "" {
+		version = "unknown"
+	}
+	buildInfo.Set("mtail", map[string]string{"version": version, "go_version": runtime.Version()})
+	up.Set(1)
+
+	err = m.InitLoader()
 	if err != nil {
 		return nil, err
 	}
 
-	m.e, err = exporter.New(exporter.Options{Store: m.store})
+	if o.SnapshotPath != "" && !o.CompileOnly && !o.DumpBytecode {
+		// Restore the counters before any lines are read, so that the
+		// programs count on from the saved values.
+		if err := m.restoreSnapshot(); err != nil {
+			return nil, fmt.Errorf("Couldn't restore the snapshot from %q: %s", o.SnapshotPath, err)
+		}
+		interval := o.SnapshotInterval
+		if interval <= 0 {
+			interval = DefaultSnapshotInterval
+		}
+		m.snapshotQuit = make(chan struct{})
+		m.snapshotDone = make(chan struct{})
+		go m.snapshotCounters(interval)
+	}
+
+	m.e, err = exporter.New(exporter.Options{Store: m.store, Clock: o.Clock})
 	if err != nil {
 		return nil, err
 	}
@@ -169,7 +470,7 @@ func New(o Options) (*Mtail, error) {
 }
 
 // WriteMetrics dumps the current state of the metrics store in JSON format to
-// the io.Writer.
+// the io.Writer.  Hidden metrics are included, for debugging.
 func (m *Mtail) WriteMetrics(w io.Writer) error {
 	m.store.RLock()
 	b, err := json.MarshalIndent(m.store.Metrics, "", "  ")
@@ -183,49 +484,194 @@ func (m *Mtail) WriteMetrics(w io.Writer) error {
 
 // RunOneShot performs the work of the one_shot commandline flag; after compiling programs mtail will read all of the log files in full, once, dump the metric results at the end, and then exit.
 func (m *Mtail) RunOneShot() {
-	fmt.Println("Oneshot results:")
+	if err := m.runOneShot(os.Stdout); err != nil {
+		glog.Exit(err)
+	}
+}
+
+// runOneShot reads each of the log files in full, waits for the programs to
+// process every line, and then writes the metrics to w as JSON if
+// OneShotMetrics is set.  The timings of reading the logs are only printed
+// otherwise, so that the metrics can be parsed by tests of programs.
+func (m *Mtail) runOneShot(w io.Writer) error {
+	if !m.o.OneShotMetrics {
+		fmt.Println("Oneshot results:")
+	}
 	for _, pathname := range m.o.LogPaths {
-		_, err := m.OneShot(pathname, true)
+		_, err := m.OneShot(pathname, !m.o.OneShotMetrics)
 		if err != nil {
-			glog.Exitf("Failed one shot mode for %q: %s\n", pathname, err)
+			m.Close()
+			return fmt.Errorf("Failed one shot mode for %q: %s", pathname, err)
 		}
 	}
+	// The metrics are final once the programs have run on every line.
+	m.Close()
 	if m.o.OneShotMetrics {
-		fmt.Printf("Metrics store:")
-		if err := m.WriteMetrics(os.Stdout); err != nil {
-			glog.Exit(err)
-		}
+		return m.WriteMetrics(w)
 	}
-	m.Close()
+	return nil
 }
 
 // Serve begins the long-running mode of mtail, in which it watches the log
 // files for changes and sends any new lines found into the lines channel for
 // pick up by the virtual machines.  It will continue to do so until it is
-// signalled to exit.
+// signalled to exit.  The HTTP endpoints are served while tailing starts, with
+// /healthz reporting not ready until it has.
 func (m *Mtail) Serve() {
-	err := m.StartTailing()
+	listeners, err := m.listen()
 	if err != nil {
-		glog.Exitf("tailing failed: %s", err)
+		glog.Exit(err)
+	}
+	m.srv = m.newServer(m.handler())
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			glog.Infof("Listening on %s", l.Addr())
+			err := m.serveHTTP(l)
+			if err != nil && err != http.ErrServerClosed {
+				glog.Exit(err)
+			}
+		}(l)
 	}
 
-	http.Handle("/", m)
-	http.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
-	http.HandleFunc("/metrics", http.HandlerFunc(m.e.HandlePrometheusMetrics))
-	http.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
-	http.HandleFunc("/quitquitquit", http.HandlerFunc(m.handleQuit))
+	err = m.StartTailing()
+	if err != nil {
+		glog.Exitf("tailing failed: %s", err)
+	}
+	if err := m.dropPrivileges(); err != nil {
+		glog.Exitf("couldn't drop privileges: %s", err)
+	}
 	m.e.StartMetricPush()
+	m.store.StartExpiryLoop(expiryInterval)
+	m.store.StartResetLoop(resetCheckInterval)
 
-	go func() {
-		glog.Infof("Listening on port %s", m.o.Port)
-		err := http.ListenAndServe(":"+m.o.Port, nil)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go m.reopenHandler(hup)
+	m.shutdownHandler()
+}
+
+// handler returns the handler of the HTTP endpoints.  The debug endpoints are
+// only served if enabled, as profiles and expvars can reveal more about the
+// host than the metrics do.
+func (m *Mtail) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", m)
+	mux.HandleFunc("/json", http.HandlerFunc(m.e.HandleJSON))
+	mux.HandleFunc("/metrics.json", http.HandlerFunc(m.e.HandleMetricsJSON))
+	mux.HandleFunc("/metrics", http.HandlerFunc(m.e.HandlePrometheusMetrics))
+	mux.HandleFunc("/varz", http.HandlerFunc(m.e.HandleVarz))
+	mux.HandleFunc(healthzPath, http.HandlerFunc(m.handleHealthz))
+	mux.HandleFunc("/progz", http.HandlerFunc(m.handleProgz))
+	if m.o.EnableQuitHandler {
+		mux.HandleFunc("/quitquitquit", http.HandlerFunc(m.handleQuit))
+	}
+	if m.o.EnablePushHandler {
+		mux.HandleFunc("/push", http.HandlerFunc(m.handlePush))
+	}
+	if m.o.EnableDebugHandlers {
+		// The vm and tailer counters, such as line_count, are expvars.
+		mux.Handle("/debug/vars", expvar.Handler())
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// Addr returns the TCP address that HTTP is served on, which includes the port
+// chosen when listening on port 0.  It's nil until listening has started, or
+// if HTTP is only served on a unix socket.
+func (m *Mtail) Addr() net.Addr {
+	m.addrLock.Lock()
+	defer m.addrLock.Unlock()
+	return m.addr
+}
+
+// listen opens the TCP port and the unix socket that HTTP is served on.  The
+// port is opened if it or the listen address is set, or if there's no socket.
+func (m *Mtail) listen() ([]net.Listener, error) {
+	var listeners []net.Listener
+	if m.o.ListenAddress != "" || m.o.Port != "" || m.o.ListenSocket == "" {
+		addr := ":" + m.o.Port
+		if m.o.ListenAddress != "" {
+			addr = m.o.ListenAddress
+		}
+		l, err := net.Listen("tcp", addr)
 		if err != nil {
-			glog.Exit(err)
+			return nil, err
 		}
-	}()
-	m.shutdownHandler()
+		m.addrLock.Lock()
+		m.addr = l.Addr()
+		m.addrLock.Unlock()
+		listeners = append(listeners, l)
+	}
+	if m.o.ListenSocket != "" {
+		l, err := listenSocket(m.o.ListenSocket)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenSocket listens on the unix socket at path, first removing a stale
+// socket left by an mtail that didn't shut down cleanly.  The socket is
+// removed again when the listener is closed.
+func listenSocket(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("can't listen on %q: file exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("can't listen on %q: socket is in use", path)
+		}
+		glog.Infof("Removing stale socket %q", path)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// newServer returns the HTTP server of the handler, with authentication and
+// HTTPS if they're configured.
+func (m *Mtail) newServer(h http.Handler) *http.Server {
+	s := &http.Server{Handler: h, TLSConfig: m.tlsConfig}
+	if m.auth != nil {
+		s.Handler = m.auth.wrap(h)
+	}
+	return s
+}
+
+// serveHTTP serves the HTTP endpoints on the listener, over HTTPS if a
+// certificate is configured.
+func (m *Mtail) serveHTTP(l net.Listener) error {
+	if m.tlsConfig == nil {
+		return m.srv.Serve(l)
+	}
+	// The certificate was loaded by New.
+	return m.srv.ServeTLS(l, "", "")
 }
 
+// handleHealthz reports whether mtail is ready, for load balancer health
+// checks.  Programs are loaded by New, so mtail is ready once tailing starts.
+func (m *Mtail) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&m.ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleQuit shuts mtail down in the same way as a SIGTERM, writing the
+// metrics to the push exporters after tailing stops.
 func (m *Mtail) handleQuit(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		w.Header().Add("Allow", "POST")
@@ -233,7 +679,25 @@ func (m *Mtail) handleQuit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	fmt.Fprintf(w, "Exiting...")
-	close(m.webquit)
+	m.quitOnce.Do(func() { close(m.webquit) })
+}
+
+// reopenHandler reopens the logs on each SIGHUP received on n, which
+// logrotate can send after rotating them in case the rotation wasn't noticed.
+// The log manifest is reread first, if there is one.
+func (m *Mtail) reopenHandler(n <-chan os.Signal) {
+	for range n {
+		glog.Info("Received SIGHUP, reopening logs...")
+		if m.t == nil {
+			continue
+		}
+		if m.o.LogManifest != "" {
+			if err := m.loadManifest(); err != nil {
+				glog.Infof("Failed to reload the log manifest: %s", err)
+			}
+		}
+		m.t.Reopen()
+	}
 }
 
 // shutdownHandler handles external shutdown request events.
@@ -245,29 +709,102 @@ func (m *Mtail) shutdownHandler() {
 		glog.Info("Received SIGTERM, exiting...")
 	case <-m.webquit:
 		glog.Info("Received Quit from UI, exiting...")
+	case <-m.stdinDone:
+		glog.Info("Received EOF on standard input, exiting...")
 	}
 	m.Close()
 }
 
-// Close handles the graceful shutdown of this mtail instance, ensuring that it only occurs once.
+// Close shuts this mtail instance down gracefully, as Shutdown does, waiting
+// at most the drain timeout for the remaining lines to be processed.
 func (m *Mtail) Close() {
+	timeout := m.o.DrainTimeout
+	if timeout == 0 {
+		timeout = DefaultDrainTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		glog.Infof("Shutdown didn't finish draining: %s", err)
+	}
+}
+
+// Shutdown stops reading logs, and waits for the lines already written to
+// them to be processed by the programs, the counters to be snapshotted and
+// the metrics to be pushed to the push exporters a final time, and the read
+// offsets to be saved.  If ctx is done first, the lines the programs haven't
+// yet run are dropped and counted, the HTTP server is closed without waiting
+// any further, and the context's error is returned.  Only the first call
+// shuts down.
+func (m *Mtail) Shutdown(ctx context.Context) error {
+	var err error
 	m.closeOnce.Do(func() {
 		glog.Info("Shutdown requested.")
-		if m.t != nil {
-			m.t.Close()
-		} else {
-			glog.Info("Closing lines channel.")
-			close(m.lines)
+		drained := make(chan struct{})
+		go func() {
+			m.drain(ctx)
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
 		}
-		if m.l != nil {
-			<-m.l.VMsDone
+		if m.srv != nil {
+			// Closing the listeners also removes the unix socket.
+			m.srv.Close()
 		}
 		glog.Info("All done.")
 	})
+	return err
+}
+
+// drain closes the inputs, which closes the lines channel once they've been
+// read to the end, and waits for the programs to process the lines before
+// pushing the metrics.  If ctx is done before the programs have caught up,
+// they're stopped after the line they're running, and the rest are dropped.
+func (m *Mtail) drain(ctx context.Context) {
+	m.closePush()
+	if m.s != nil {
+		// Stop sending syslog messages before the tailer closes the lines
+		// channel.
+		m.s.Close()
+	}
+	if m.r != nil {
+		m.r.Close()
+	}
+	if m.t != nil {
+		m.t.Close()
+	} else if m.stdinQuit != nil {
+		// The standard input reader owns the lines channel and closes it.
+		close(m.stdinQuit)
+	} else {
+		glog.Info("Closing lines channel.")
+		close(m.lines)
+	}
+	if m.l != nil {
+		select {
+		case <-m.l.VMsDone:
+		case <-ctx.Done():
+			glog.Info("Timed out waiting for the programs, dropping the lines they haven't run.")
+			m.l.Abandon()
+			<-m.l.VMsDone
+		}
+	}
+	m.store.Close()
+	if m.snapshotQuit != nil {
+		close(m.snapshotQuit)
+		<-m.snapshotDone
+	}
+	m.e.Close()
 }
 
 // Run starts Mtail in the configuration supplied in Options at creation.
 func (m *Mtail) Run() {
+	if m.o.CompileOnly || m.o.DumpBytecode {
+		// The programs were compiled, and dumped, by New.
+		return
+	}
 	if m.o.OneShot {
 		m.RunOneShot()
 	} else {
@@ -4,17 +4,33 @@
 package mtail
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/signal"
 	"path"
+	"regexp"
 	"runtime"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
 	"github.com/google/mtail/vm"
+	"github.com/google/mtail/watcher"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/spf13/afero"
 )
 
 const testProgram = "/$/ { }\n"
@@ -245,3 +261,1144 @@ func TestHandleNewLogIgnored(t *testing.T) {
 		t.Errorf("Line count not increased\n\texpected: %s\n\treceived: %s", expected, vm.LineCount.String())
 	}
 }
+
+func TestReadStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	m := startMtail(t, []string{StdinPath}, "")
+	defer m.Close()
+
+	inputLines := []string{"hi", "hi2", "hi3"}
+	for _, x := range inputLines {
+		w.WriteString(x + "\n")
+	}
+	w.Close()
+
+	select {
+	case <-m.stdinDone:
+	case <-time.After(time.Second):
+		t.Fatal("reader didn't finish at EOF on standard input")
+	}
+	<-m.l.VMsDone
+	expected := fmt.Sprintf("%d", len(inputLines))
+	if vm.LineCount.String() != expected {
+		t.Errorf("Line count not increased\n\texpected: %s\n\treceived: %s", expected, vm.LineCount.String())
+	}
+}
+
+func TestCloseWhileReadingStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	m := startMtail(t, []string{StdinPath}, "")
+	w.WriteString("hi\n")
+
+	closed := make(chan struct{})
+	go func() {
+		m.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked while standard input is still open")
+	}
+}
+
+func TestOneShotCompressed(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+
+	logFilepath := path.Join(workdir, "log.1.gz")
+	logFile, err := os.Create(logFilepath)
+	if err != nil {
+		t.Fatalf("could not create log file: %s", err)
+	}
+	zw := gzip.NewWriter(logFile)
+	inputLines := []string{"hi", "hi2", "hi3"}
+	for _, x := range inputLines {
+		zw.Write([]byte(x + "\n"))
+	}
+	zw.Close()
+	logFile.Close()
+
+	m := startMtail(t, []string{}, "")
+	defer m.Close()
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatalf("OneShot failed: %s", err)
+	}
+	expected := fmt.Sprintf("%d", len(inputLines))
+	check := func() (bool, error) {
+		return vm.LineCount.String() == expected, nil
+	}
+	ok, err := doOrTimeout(check, 100*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Errorf("Line count not increased\n\texpected: %s\n\treceived: %s", expected, vm.LineCount.String())
+	}
+}
+
+// oneShotLines runs OneShot with the given options over a log of the given
+// contents, and returns the number of times each line was seen.
+func oneShotLines(t *testing.T, o Options, contents string) map[string]int64 {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(o)
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	prog := "counter lines by line\n/^(?P<line>.*)$/ {\n  lines[$line]++\n}\n"
+	if err := m.l.CompileAndRun("lines", strings.NewReader(prog)); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+	seen := map[string]int64{}
+	for _, metric := range m.store.Metrics {
+		for _, lv := range metric.LabelValues {
+			seen[lv.Labels[0]] = lv.Value.Get()
+		}
+	}
+	return seen
+}
+
+func TestOneShotTruncatesLongLines(t *testing.T) {
+	seen := oneShotLines(t, Options{MaxLineLength: 4}, "abcdefgh\r\nab\r\nabcdef")
+	expected := map[string]int64{"abcd": 2, "ab": 1}
+	if diff := pretty.Compare(expected, seen); len(diff) > 0 {
+		t.Errorf("lines not truncated:\n%s", diff)
+	}
+}
+
+func TestOneShotLineDelimiter(t *testing.T) {
+	// Only the delimiter is removed from the lines.
+	seen := oneShotLines(t, Options{LineDelimiter: "\x00"}, "a\x00b\r\x00c")
+	expected := map[string]int64{"a": 1, "b\r": 1, "c": 1}
+	if diff := pretty.Compare(expected, seen); len(diff) > 0 {
+		t.Errorf("lines not split on the delimiter:\n%s", diff)
+	}
+}
+
+func TestReadFromStart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte("hi\nhi2\nhi3\n"), 0600); err != nil {
+		t.Fatalf("could not write log file: %s", err)
+	}
+
+	m, err := New(Options{LogPaths: []string{logFilepath}, ReadFromStart: true})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+	if pErr := m.l.CompileAndRun("test", strings.NewReader(testProgram)); pErr != nil {
+		t.Errorf("Couldn't compile program: %s", pErr)
+	}
+	vm.LineCount.Set(0)
+	m.StartTailing()
+
+	for _, step := range []struct {
+		expected string
+		do       func()
+	}{
+		// The existing lines are read when the log is first tailed.
+		{"3", func() {}},
+		// Rotation is still handled after the catch-up read.
+		{"5", func() {
+			if err := os.Rename(logFilepath, logFilepath+".1"); err != nil {
+				t.Fatalf("could not rename log file: %s", err)
+			}
+			if err := ioutil.WriteFile(logFilepath, []byte("hi4\nhi5\n"), 0600); err != nil {
+				t.Fatalf("could not write log file: %s", err)
+			}
+		}},
+	} {
+		step.do()
+		check := func() (bool, error) {
+			return vm.LineCount.String() == step.expected, nil
+		}
+		ok, err := doOrTimeout(check, time.Second, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			t.Errorf("Line count not increased\n\texpected: %s\n\treceived: %s", step.expected, vm.LineCount.String())
+		}
+	}
+}
+
+func TestHealthzNotReadyUntilTailing(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	m, err := New(Options{LogPaths: []string{path.Join(workdir, "log")}})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+
+	w := httptest.NewRecorder()
+	m.handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected not ready before tailing, got status %d", w.Code)
+	}
+	if err := m.StartTailing(); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	m.handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected ready after tailing started, got status %d", w.Code)
+	}
+}
+
+func TestQuitHandler(t *testing.T) {
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+
+	w := httptest.NewRecorder()
+	m.handleQuit(w, httptest.NewRequest("GET", "/quitquitquit", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be refused, got status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	m.handleQuit(w, httptest.NewRequest("POST", "/quitquitquit", nil))
+	select {
+	case <-m.webquit:
+	default:
+		t.Errorf("POST didn't request shutdown")
+	}
+	// A second request while shutting down doesn't panic.
+	w = httptest.NewRecorder()
+	m.handleQuit(w, httptest.NewRequest("POST", "/quitquitquit", nil))
+}
+
+func TestPushHandler(t *testing.T) {
+	m, err := New(Options{EnablePushHandler: true})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	if pErr := m.l.CompileAndRun("test", strings.NewReader(testProgram)); pErr != nil {
+		t.Fatalf("Couldn't compile program: %s", pErr)
+	}
+	vm.LineCount.Set(0)
+	h := m.handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/push", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected GET to be refused, got status %d", w.Code)
+	}
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	// The last line is sent even without a newline.
+	zw.Write([]byte("line 1\nline 2\nline 3"))
+	zw.Close()
+	r := httptest.NewRequest("POST", "/push?origin=pushtest", &body)
+	r.Header.Set("Content-Encoding", "gzip")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("push failed with status %d: %s", w.Code, w.Body.String())
+	}
+	if got := pushLines.Get("pushtest"); got == nil || got.String() != "3" {
+		t.Errorf("expected 3 lines pushed from pushtest, got %v", got)
+	}
+
+	m.Close()
+	if vm.LineCount.String() != "3" {
+		t.Errorf("Line count not increased\n\texpected: 3\n\treceived: %s", vm.LineCount.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/push", strings.NewReader("late\n")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected push after close to be refused, got status %d", w.Code)
+	}
+}
+
+// TestHeartbeat tests that mtail_up is exported, and mtail_last_line_seconds
+// advances as lines are read.
+func TestHeartbeat(t *testing.T) {
+	c := clock.NewFakeClock(time.Unix(1500000000, 0))
+	m, err := New(Options{Clock: c})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+	h := m.handler()
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	if body := scrape(); !strings.Contains(body, "\nmtail_up 1\n") {
+		t.Errorf("mtail_up not exported:\n%s", body)
+	}
+
+	vm.LineCount.Set(0)
+	for i := 1; i <= 2; i++ {
+		m.lines <- logline.New("test", "line")
+		for j := 0; j < 100 && vm.LineCount.Value() < int64(i); j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		expected := fmt.Sprintf("\nmtail_last_line_seconds %d\n", c.Now().Unix())
+		if body := scrape(); !strings.Contains(body, expected) {
+			t.Errorf("line %d: expected %q in:\n%s", i, expected, body)
+		}
+		c.Advance(time.Minute)
+	}
+}
+
+func TestDebugHandlers(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		m, err := New(Options{EnableDebugHandlers: enabled})
+		if err != nil {
+			t.Fatalf("couldn't create mtail: %s", err)
+		}
+		h := m.handler()
+		for _, p := range []string{"/debug/pprof/", "/debug/vars"} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", p, nil))
+			switch {
+			case enabled && w.Code != http.StatusOK:
+				t.Errorf("%s: expected OK when enabled, got status %d", p, w.Code)
+			case !enabled && w.Code != http.StatusNotFound:
+				t.Errorf("%s: expected not found when disabled, got status %d", p, w.Code)
+			}
+			if enabled && p == "/debug/vars" && !strings.Contains(w.Body.String(), `"line_count"`) {
+				t.Errorf("vm expvars not exported:\n%s", w.Body.String())
+			}
+		}
+		m.Close()
+	}
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	socket := path.Join(workdir, "mtail.sock")
+	// Leave a stale socket behind, as a crashed mtail would.
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	m, err := New(Options{ListenSocket: socket})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	listeners, err := m.listen()
+	if err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+	if len(listeners) != 1 {
+		t.Fatalf("expected only the socket to be listened on, got %v", listeners)
+	}
+	m.srv = m.newServer(http.HandlerFunc(m.e.HandlePrometheusMetrics))
+	go m.serveHTTP(listeners[0])
+
+	c := http.Client{Transport: &http.Transport{
+		Dial: func(_, _ string) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		}}}
+	resp, err := c.Get("http://mtail/metrics")
+	if err != nil {
+		t.Fatalf("couldn't fetch metrics over the socket: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	m.Close()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on close: %v", err)
+	}
+}
+
+func TestServeOnEphemeralPort(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{ListenAddress: "localhost:0", LogPaths: []string{logFilepath}})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	if err := m.l.CompileAndRun("ephemeral", strings.NewReader("counter ephemeral_lines\n/$/ {\n  ephemeral_lines++\n}\n")); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		m.Serve()
+		close(served)
+	}()
+	defer func() {
+		close(m.webquit)
+		<-served
+	}()
+
+	if ok, err := doOrTimeout(func() (bool, error) { return m.Addr() != nil, nil }, 5*time.Second, 10*time.Millisecond); !ok {
+		t.Fatalf("mtail didn't start listening: %s", err)
+	}
+	addr := m.Addr().(*net.TCPAddr)
+	if addr.Port == 0 {
+		t.Fatalf("ephemeral port not resolved: %s", addr)
+	}
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	if err != nil {
+		t.Fatalf("couldn't scrape metrics: %s", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(b), "# TYPE ephemeral_lines counter") {
+		t.Errorf("unexpected scrape, status %d:\n%s", resp.StatusCode, b)
+	}
+}
+
+func TestCloseDrainsLines(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	logFile, err := os.Create(logFilepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logFile.Close()
+	statePath := path.Join(workdir, "state")
+	m, err := New(Options{LogPaths: []string{logFilepath}, StatePath: statePath})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	if err := m.l.CompileAndRun("drain", strings.NewReader("counter drained_lines\n/$/ {\n  drained_lines++\n}\n")); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+	if err := m.StartTailing(); err != nil {
+		t.Fatal(err)
+	}
+	// Close straight after writing, before the lines are likely to have
+	// been noticed.
+	const count = 100
+	for i := 0; i < count; i++ {
+		logFile.WriteString(fmt.Sprintf("line %d\n", i))
+	}
+	m.Close()
+
+	for _, metric := range m.store.Metrics {
+		if metric.Name != "drained_lines" {
+			continue
+		}
+		d, err := metric.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Value != count {
+			t.Errorf("got %d lines, want %d", d.Value, count)
+		}
+	}
+	b, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		t.Fatalf("state file not written: %s", err)
+	}
+	var offsets map[string]struct{ Offset int64 }
+	if err := json.Unmarshal(b, &offsets); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := logFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := offsets[logFilepath].Offset; o != fi.Size() {
+		t.Errorf("saved offset %d, want the end of the log at %d", o, fi.Size())
+	}
+}
+
+// TestCloseLogFdPipe tests that Close doesn't wait forever for the reader of a
+// pipe passed as a log file descriptor, which is blocked waiting for input.
+func TestCloseLogFdPipe(t *testing.T) {
+	var p [2]int
+	if err := syscall.Pipe(p[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(p[1])
+	m, err := New(Options{LogFds: []int{p[0]}})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	if err := m.StartTailing(); err != nil {
+		t.Fatal(err)
+	}
+	before := vm.LineCount.Value()
+	if _, err := syscall.Write(p[1], []byte("line\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Once the line is read, the reader blocks waiting for the next.
+	for i := 0; vm.LineCount.Value() == before; i++ {
+		if i > 100 {
+			t.Fatal("line not read from the pipe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	done := make(chan struct{})
+	go func() {
+		m.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return while the pipe was open")
+	}
+}
+
+// TestStdinLinesDropped tests that the lines read from standard input but not
+// sent when mtail stops are counted.
+func TestStdinLinesDropped(t *testing.T) {
+	m := &Mtail{lines: make(chan *logline.LogLine), stdinQuit: make(chan struct{}), stdinDone: make(chan struct{})}
+	r, w := io.Pipe()
+	defer w.Close()
+	before := stdinLinesDropped.Value()
+	go m.readStdin(r)
+	// Nothing reads the lines channel, so the first line is held waiting to
+	// be sent, the second waits to be handed over, and the third is left in
+	// the read buffer.
+	if _, err := w.Write([]byte("a\nb\nc\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(m.stdinQuit)
+	<-m.stdinDone
+	for i := 0; stdinLinesDropped.Value()-before != 3; i++ {
+		if i > 100 {
+			t.Fatalf("dropped lines: got %d, want 3", stdinLinesDropped.Value()-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPushWhileStdinCloses tests that lines pushed while standard input
+// reaches EOF are refused once the lines channel is closed, rather than sent
+// to it.
+func TestPushWhileStdinCloses(t *testing.T) {
+	m := &Mtail{lines: make(chan *logline.LogLine), stdinQuit: make(chan struct{}), stdinDone: make(chan struct{})}
+	r, w := io.Pipe()
+	go m.readStdin(r)
+	go func() {
+		for range m.lines {
+		}
+	}()
+	pushed := make(chan struct{})
+	go func() {
+		defer close(pushed)
+		for m.sendPushed(logline.New("test", "pushed")) {
+		}
+	}()
+	w.Close()
+	<-m.stdinDone
+	<-pushed
+	if m.sendPushed(logline.New("test", "late")) {
+		t.Error("line pushed after standard input closed the lines channel")
+	}
+}
+
+// TestOneShotMetrics tests that one shot mode runs a program over a fixture
+// log and dumps the final metrics as JSON, as when testing a program in CI.
+// The lines are matched without their endings, so patterns can be anchored.
+func TestOneShotMetrics(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	progPath := path.Join(workdir, "codes.mtail")
+	prog := "counter requests\ncounter responses by code\n" +
+		"/^(?P<method>[A-Z]+) (?P<code>\\d{3})$/ {\n  requests++\n  responses[$code]++\n}\n"
+	if err := ioutil.WriteFile(progPath, []byte(prog), 0600); err != nil {
+		t.Fatal(err)
+	}
+	logPath := path.Join(workdir, "fixture.log")
+	if err := ioutil.WriteFile(logPath, []byte("GET 200\nPOST 200\r\nunmatched\nGET 404"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{Progs: progPath, LogPaths: []string{logPath}, OneShot: true, OneShotMetrics: true})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	var b bytes.Buffer
+	if err := m.runOneShot(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	var dumped []struct {
+		Name        string
+		LabelValues []struct {
+			Labels []string
+			Value  struct{ Value int64 }
+		}
+	}
+	if err := json.Unmarshal(b.Bytes(), &dumped); err != nil {
+		t.Fatalf("metrics not dumped as JSON: %s\n%s", err, b.String())
+	}
+	got := map[string]int64{}
+	for _, metric := range dumped {
+		for _, lv := range metric.LabelValues {
+			got[strings.Join(append([]string{metric.Name}, lv.Labels...), " ")] = lv.Value.Value
+		}
+	}
+	expected := map[string]int64{"requests": 3, "responses 200": 2, "responses 404": 1}
+	if diff := pretty.Compare(expected, got); len(diff) > 0 {
+		t.Errorf("dumped counters not expected:\n%s", diff)
+	}
+}
+
+func TestCaptureGroupReferences(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte("GET 200\nPOST 200\nGET 404\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	prog := "counter responses by code\ncounter requests by method\n" +
+		"/(\\w+) (?P<code>\\d{3})/ {\n  responses[$code]++\n  requests[$1]++\n}\n"
+	if err := m.l.CompileAndRun("codes", strings.NewReader(prog)); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	expected := map[string]map[string]int64{
+		"responses": {"200": 2, "404": 1},
+		"requests":  {"GET": 2, "POST": 1},
+	}
+	for _, metric := range m.store.Metrics {
+		for label, want := range expected[metric.Name] {
+			d, err := metric.GetDatum(label)
+			if err != nil {
+				t.Fatalf("%s[%s]: %s", metric.Name, label, err)
+			}
+			if d.Value != want {
+				t.Errorf("%s[%s]: got %d, want %d", metric.Name, label, d.Value, want)
+			}
+		}
+		if len(metric.LabelValues) != len(expected[metric.Name]) {
+			t.Errorf("%s: unexpected label values %v", metric.Name, metric.LabelValues)
+		}
+	}
+}
+
+func TestNumericConditions(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte("GET latency=120\nGET latency=621\nPOST latency=910\nGET latency=-\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	prog := "counter slow_requests\ncounter very_slow_requests\ncounter odd_gets\n" +
+		"/latency=(?P<latency>\\d+)/ {\n" +
+		"  $latency > 500 {\n    slow_requests++\n  }\n" +
+		// Multiplication binds tighter than subtraction, so this is 710 > 700
+		// only for the last line.
+		"  $latency - 100 * 2 > 700 {\n    very_slow_requests++\n  }\n" +
+		"  /^GET/ {\n    $latency % 2 == 1 {\n      odd_gets++\n    }\n  }\n" +
+		"}\n"
+	if err := m.l.CompileAndRun("latency", strings.NewReader(prog)); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	expected := map[string]int64{"slow_requests": 2, "very_slow_requests": 1, "odd_gets": 1}
+	for _, metric := range m.store.Metrics {
+		want, ok := expected[metric.Name]
+		if !ok {
+			continue
+		}
+		d, err := metric.GetDatum()
+		if err != nil {
+			t.Fatalf("%s: %s", metric.Name, err)
+		}
+		if d.Value != want {
+			t.Errorf("%s: got %d, want %d", metric.Name, d.Value, want)
+		}
+		delete(expected, metric.Name)
+	}
+	for name := range expected {
+		t.Errorf("metric %s not found", name)
+	}
+}
+
+func TestFormatLabels(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte("GET /a 200\nGET /a 200\nPOST /b 500\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	prog := "counter requests by route\ncounter total\ngauge last by summary\n" +
+		"/(?P<method>\\w+) (?P<path>\\S+) (?P<code>\\d+)/ {\n" +
+		"  requests[format(\"%s %s\", $method, $path)]++\n" +
+		"  total++\n" +
+		"  last[format(\"%d after %d\", $code, total)] = 1\n" +
+		"}\n"
+	if err := m.l.CompileAndRun("format", strings.NewReader(prog)); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	expected := map[string]map[string]int64{
+		"requests": {"GET /a": 2, "POST /b": 1},
+		"last":     {"200 after 1": 1, "200 after 2": 1, "500 after 3": 1},
+	}
+	for _, metric := range m.store.Metrics {
+		want, ok := expected[metric.Name]
+		if !ok {
+			continue
+		}
+		for label, value := range want {
+			d, err := metric.GetDatum(label)
+			if err != nil {
+				t.Fatalf("%s: %s", metric.Name, err)
+			}
+			if d.Value != value {
+				t.Errorf("%s[%q]: got %d, want %d", metric.Name, label, d.Value, value)
+			}
+		}
+		if len(metric.LabelValues) != len(want) {
+			t.Errorf("%s: got %d label values, want %d", metric.Name, len(metric.LabelValues), len(want))
+		}
+		delete(expected, metric.Name)
+	}
+	for name := range expected {
+		t.Errorf("metric %s not found", name)
+	}
+}
+
+func TestCIDRBuiltins(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	log := "10.1.2.3 GET\n10.1.2.99 GET\n192.168.7.1 GET\n2001:db8::1 GET\n2001:db8::2 GET\nbogus GET\n"
+	if err := ioutil.WriteFile(logFilepath, []byte(log), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	prog := "counter requests by subnet\ncounter internal\n" +
+		"/^(?P<ip>\\S+) / {\n" +
+		"  requests[cidr($ip, \"/24\")]++\n" +
+		"  in_cidr($ip, \"10.0.0.0/8\") {\n    internal++\n  }\n" +
+		"}\n"
+	if err := m.l.CompileAndRun("cidr", strings.NewReader(prog)); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	expected := map[string]map[string]int64{
+		"requests": {"10.1.2.0/24": 2, "192.168.7.0/24": 1, "2001:d00::/24": 2, "": 1},
+		"internal": {"": 2},
+	}
+	for _, metric := range m.store.Metrics {
+		want, ok := expected[metric.Name]
+		if !ok {
+			continue
+		}
+		for label, value := range want {
+			var labels []string
+			if len(metric.Keys) > 0 {
+				labels = append(labels, label)
+			}
+			d, err := metric.GetDatum(labels...)
+			if err != nil {
+				t.Fatalf("%s: %s", metric.Name, err)
+			}
+			if d.Value != value {
+				t.Errorf("%s[%q]: got %d, want %d", metric.Name, label, d.Value, value)
+			}
+		}
+		delete(expected, metric.Name)
+	}
+	for name := range expected {
+		t.Errorf("metric %s not found", name)
+	}
+}
+
+func TestInitialLabelSetsExportedAtZero(t *testing.T) {
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+	prog := "counter errors by code = {\"500\", \"503\"}\n" +
+		"/status=(?P<code>5\\d\\d)/ {\n  errors[$code]++\n}\n"
+	if err := m.l.CompileAndRun("errors", strings.NewReader(prog)); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	m.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, code := range []string{"500", "503"} {
+		expected := regexp.MustCompile(`\nerrors\{code="` + code + `",prog="errors"[^}]*\} 0\n`)
+		if !expected.MatchString(w.Body.String()) {
+			t.Errorf("code %s not exported at zero before any line was processed:\n%s", code, w.Body.String())
+		}
+	}
+}
+
+func TestDelRemovesSeries(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte("open alice\nopen bob\nclose alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	prog := "gauge sessions by user\n" +
+		"/^open (?P<user>\\w+)/ {\n  sessions[$user] = 1\n}\n" +
+		"/^close (?P<user>\\w+)/ {\n  del sessions[$user]\n}\n"
+	if err := m.l.CompileAndRun("sessions", strings.NewReader(prog)); err != nil {
+		t.Fatalf("couldn't compile program: %s", err)
+	}
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	w := httptest.NewRecorder()
+	m.e.HandlePrometheusMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `sessions{user="bob",prog="sessions"`) {
+		t.Errorf("bob's session not exported:\n%s", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), `user="alice"`) {
+		t.Errorf("alice's deleted session still exported:\n%s", w.Body.String())
+	}
+}
+
+func TestNamespacesKeepMetricsApart(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	progs := map[string]string{
+		// Declares its namespace.
+		"a.mtail": "namespace \"teamA\"\ncounter requests\n/GET/ {\n  requests++\n}\n",
+		// Takes its namespace from the file name.
+		"team-b.mtail": "counter requests\n/POST|GET/ {\n  requests++\n}\n",
+	}
+	for name, prog := range progs {
+		if err := ioutil.WriteFile(path.Join(workdir, name), []byte(prog), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte("GET\nPOST\nGET\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{Progs: workdir, NamespaceFromProgram: true})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	w := httptest.NewRecorder()
+	m.handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, expected := range []*regexp.Regexp{
+		regexp.MustCompile(`\nteamA_requests\{prog="a.mtail"[^}]*\} 2\n`),
+		regexp.MustCompile(`\nteam_b_requests\{prog="team-b.mtail"[^}]*\} 3\n`),
+	} {
+		if !expected.MatchString(w.Body.String()) {
+			t.Errorf("%s not exported:\n%s", expected, w.Body.String())
+		}
+	}
+	if strings.Contains(w.Body.String(), "\nrequests{") {
+		t.Errorf("metric exported without its namespace:\n%s", w.Body.String())
+	}
+}
+
+// TestLogManifestReloadedOnHUP tests that a log newly listed in the log
+// manifest is tailed when mtail receives SIGHUP.
+func TestLogManifestReloadedOnHUP(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping test in short mode")
+	}
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	oldLog := path.Join(workdir, "old.log")
+	newLog := path.Join(workdir, "new.log")
+	for _, logfile := range []string{oldLog, newLog} {
+		if err := ioutil.WriteFile(logfile, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := path.Join(workdir, "manifest")
+	if err := ioutil.WriteFile(manifest, []byte("# Logs\nold.log\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := New(Options{LogManifest: manifest})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+	if err := m.l.CompileAndRun("test", strings.NewReader(testProgram)); err != nil {
+		t.Fatalf("Couldn't compile program: %s", err)
+	}
+	if err := m.StartTailing(); err != nil {
+		t.Fatal(err)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go m.reopenHandler(hup)
+
+	if err := ioutil.WriteFile(manifest, []byte("new.log\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	before := vm.LineCount.Value()
+	f, err := os.OpenFile(newLog, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	check := func() (bool, error) {
+		f.WriteString("line\n")
+		return vm.LineCount.Value() > before, nil
+	}
+	ok, err := doOrTimeout(check, time.Second, 10*time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("newly listed log not tailed: %v", err)
+	}
+}
+
+// TestLogManifestSkipsGivenLogs tests that the log manifest is read from the
+// filesystem in the options, and that a log it lists that's also given in
+// LogPaths is only tailed for LogPaths, however the paths are written.
+func TestLogManifestSkipsGivenLogs(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for _, logfile := range []string{"/logs/a.log", "/logs/b.log"} {
+		if err := afero.WriteFile(fs, logfile, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := afero.WriteFile(fs, "/logs/manifest", []byte("a.log\n./b.log\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{LogManifest: "/logs/manifest", LogPaths: []string{"/logs/../logs/a.log"}, FS: fs, W: watcher.NewFakeWatcher()})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+	if err := m.StartTailing(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]struct{}{"/logs/b.log": {}}
+	if diff := pretty.Compare(expected, m.manifestLogs); diff != "" {
+		t.Errorf("logs tailed for the manifest didn't match:\n%s", diff)
+	}
+}
+
+// TestSnapshotRestoresCounters tests that the counters saved to the snapshot
+// file on shutdown are restored by the next mtail, if they're still declared
+// with the same keys.
+func TestSnapshotRestoresCounters(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte("GET 200\nPOST 200\nGET 404\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	progdir := path.Join(workdir, "progs")
+	if err := os.Mkdir(progdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	progFilepath := path.Join(progdir, "codes.mtail")
+	snapshotFilepath := path.Join(workdir, "snapshot")
+
+	run := func(prog string) *Mtail {
+		if err := ioutil.WriteFile(progFilepath, []byte(prog), 0600); err != nil {
+			t.Fatal(err)
+		}
+		m, err := New(Options{Progs: progdir, SnapshotPath: snapshotFilepath})
+		if err != nil {
+			t.Fatalf("couldn't create mtail: %s", err)
+		}
+		if _, err := m.OneShot(logFilepath, false); err != nil {
+			t.Fatal(err)
+		}
+		m.Close()
+		return m
+	}
+	run("counter responses by code\ncounter requests by method\ncounter lines\n" +
+		"/(\\w+) (?P<code>\\d{3})/ {\n  responses[$code]++\n  requests[$1]++\n  lines++\n}\n")
+	if _, err := os.Stat(snapshotFilepath); err != nil {
+		t.Fatalf("snapshot not written: %s", err)
+	}
+
+	// requests is now keyed differently, and lines is no longer declared.
+	m := run("counter responses by code\ncounter requests by verb\n" +
+		"/(\\w+) (?P<code>\\d{3})/ {\n  responses[$code]++\n  requests[$1]++\n}\n")
+
+	expected := map[string]map[string]int64{
+		"responses": {"200": 4, "404": 2},
+		"requests":  {"GET": 2, "POST": 1},
+	}
+	if len(m.store.Metrics) != 2 {
+		t.Errorf("unexpected metrics restored: %v", m.store.Metrics)
+	}
+	for _, metric := range m.store.Metrics {
+		for label, want := range expected[metric.Name] {
+			d, err := metric.GetDatum(label)
+			if err != nil {
+				t.Fatalf("%s[%s]: %s", metric.Name, label, err)
+			}
+			if d.Get() != want {
+				t.Errorf("%s[%s]: got %d, want %d", metric.Name, label, d.Get(), want)
+			}
+		}
+	}
+}
+
+// TestMultipleProgramDirectories tests that the programs in every directory
+// given are loaded and run, and that a program name found in two of them is
+// an error.
+func TestMultipleProgramDirectories(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	dirs := []string{path.Join(workdir, "team-a"), path.Join(workdir, "team-b")}
+	progs := map[string]string{
+		path.Join(dirs[0], "gets.mtail"):  "counter gets\n/GET/ {\n  gets++\n}\n",
+		path.Join(dirs[1], "posts.mtail"): "counter posts\n/POST/ {\n  posts++\n}\n",
+	}
+	for _, dir := range dirs {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, prog := range progs {
+		if err := ioutil.WriteFile(name, []byte(prog), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logFilepath := path.Join(workdir, "log")
+	if err := ioutil.WriteFile(logFilepath, []byte("GET\nPOST\nGET\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{Progs: strings.Join(dirs, ",")})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	if _, err := m.OneShot(logFilepath, false); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	expected := map[string]int64{"gets": 2, "posts": 1}
+	if len(m.store.Metrics) != len(expected) {
+		t.Errorf("unexpected metrics: %v", m.store.Metrics)
+	}
+	for _, metric := range m.store.Metrics {
+		d, err := metric.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Get() != expected[metric.Name] {
+			t.Errorf("%s: got %d, want %d", metric.Name, d.Get(), expected[metric.Name])
+		}
+	}
+
+	duplicate := path.Join(dirs[1], "gets.mtail")
+	if err := ioutil.WriteFile(duplicate, []byte(progs[path.Join(dirs[0], "gets.mtail")]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = New(Options{Progs: strings.Join(dirs, ",")})
+	if err == nil || !strings.Contains(err.Error(), duplicate) {
+		t.Errorf("duplicate program name not reported: %v", err)
+	}
+}
+
+func TestBuildInfoMetrics(t *testing.T) {
+	m, err := New(Options{Version: "v1.2.3"})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+	if err := m.l.CompileAndRun("info.mtail", strings.NewReader(testProgram)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	m.e.HandlePrometheusMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	expected := []string{
+		fmt.Sprintf("mtail_build_info{go_version=\"%s\",version=\"v1.2.3\"} 1\n", runtime.Version()),
+		fmt.Sprintf("mtail_prog_hash{hash=\"%x\",prog=\"info.mtail\"} 1\n", sha256.Sum256([]byte(testProgram))),
+	}
+	for _, e := range expected {
+		if !strings.Contains(w.Body.String(), e) {
+			t.Errorf("/metrics didn't contain %q:\n%s", e, w.Body.String())
+		}
+	}
+}
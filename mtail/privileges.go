@@ -0,0 +1,55 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"os/user"
+	"strconv"
+)
+
+// Dropping privileges needs CAP_SETUID and CAP_SETGID, which root has.  Log
+// files opened before the drop remain readable, but files opened afterwards,
+// such as a rotated log, a new file matching a glob, a reloaded program or the
+// state file, must be accessible to the unprivileged user.  An alternative to
+// running as root is to grant mtail only CAP_DAC_READ_SEARCH, which lets it
+// read any file without being able to write to it.
+//
+// Privileges are only dropped on Linux, and only by binaries built with Go
+// 1.16 or later, as earlier releases changed the user of only the calling
+// thread rather than every thread of the process.
+
+// lookupUser returns the uid and primary gid of a user name or numeric uid.
+// The gid is -1 for a numeric uid that has no passwd entry, for which a group
+// must be given.
+func lookupUser(name string) (uid, gid int, err error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		u, err := user.LookupId(name)
+		if err != nil {
+			return id, -1, nil
+		}
+		gid, err := strconv.Atoi(u.Gid)
+		return id, gid, err
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, err
+	}
+	gid, err = strconv.Atoi(u.Gid)
+	return uid, gid, err
+}
+
+// lookupGroup returns the gid of a group name or numeric gid.
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
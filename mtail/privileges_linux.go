@@ -0,0 +1,71 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build linux && go1.16
+// +build linux,go1.16
+
+package mtail
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+// dropPrivileges changes the user and group of the process to those given in
+// the Options, if any.  The user's primary group is used if no group is
+// given, and supplementary groups are cleared.
+func (m *Mtail) dropPrivileges() error {
+	if m.o.User == "" && m.o.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	var err error
+	if m.o.User != "" {
+		if uid, gid, err = lookupUser(m.o.User); err != nil {
+			return fmt.Errorf("unknown user %q: %s", m.o.User, err)
+		}
+	}
+	if m.o.Group != "" {
+		if gid, err = lookupGroup(m.o.Group); err != nil {
+			return fmt.Errorf("unknown group %q: %s", m.o.Group, err)
+		}
+	}
+	// Otherwise the process would keep root's group.
+	if gid < 0 {
+		return fmt.Errorf("user %q has no passwd entry, so a group must be given", m.o.User)
+	}
+	// The groups must be changed while still privileged.
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("failed to clear supplementary groups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set group to %d: %s", gid, err)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("failed to set user to %d: %s", uid, err)
+		}
+	}
+	glog.Infof("Dropped privileges to uid %d gid %d", syscall.Getuid(), syscall.Getgid())
+	m.checkLogDirsReadable()
+	return nil
+}
+
+// checkLogDirsReadable warns about log directories that the unprivileged user
+// can't read, in which rotated or newly created logs couldn't be opened.
+func (m *Mtail) checkLogDirsReadable() {
+	for _, pathname := range m.o.LogPaths {
+		if pathname == StdinPath {
+			continue
+		}
+		dir := filepath.Dir(pathname)
+		// The directory must be listable and searchable.
+		if err := unix.Access(dir, unix.R_OK|unix.X_OK); err != nil {
+			glog.Warningf("Log directory %q is not readable after dropping privileges, new log files in it can't be opened: %s", dir, err)
+		}
+	}
+}
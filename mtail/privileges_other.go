@@ -0,0 +1,21 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !linux || !go1.16
+// +build !linux !go1.16
+
+package mtail
+
+import (
+	"errors"
+	"runtime"
+)
+
+// dropPrivileges refuses to run with a user or group given in the Options,
+// as the user and group of every thread can't be changed here.
+func (m *Mtail) dropPrivileges() error {
+	if m.o.User == "" && m.o.Group == "" {
+		return nil
+	}
+	return errors.New("dropping privileges is only supported on Linux, by mtail built with Go 1.16 or later, not " + runtime.GOOS + " " + runtime.Version())
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"os/user"
+	"testing"
+)
+
+func TestLookupUser(t *testing.T) {
+	for _, name := range []string{"root", "0"} {
+		uid, gid, err := lookupUser(name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if uid != 0 || gid != 0 {
+			t.Errorf("%s: expected uid 0 gid 0, got %d %d", name, uid, gid)
+		}
+	}
+	if _, _, err := lookupUser("no-such-user-mtail"); err == nil {
+		t.Errorf("expected error for unknown user")
+	}
+}
+
+func TestLookupGroup(t *testing.T) {
+	for _, name := range []string{"root", "0"} {
+		gid, err := lookupGroup(name)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if gid != 0 {
+			t.Errorf("%s: expected gid 0, got %d", name, gid)
+		}
+	}
+	if _, err := lookupGroup("no-such-group-mtail"); err == nil {
+		t.Errorf("expected error for unknown group")
+	}
+}
+
+func TestNoPrivilegesToDrop(t *testing.T) {
+	m := &Mtail{}
+	if err := m.dropPrivileges(); err != nil {
+		t.Errorf("dropPrivileges with no user or group: %s", err)
+	}
+}
+
+func TestDropPrivilegesNeedsGroup(t *testing.T) {
+	// A uid with no passwd entry has no primary group to drop to.
+	if _, err := user.LookupId("54321"); err == nil {
+		t.Skip("uid 54321 has a passwd entry")
+	}
+	m := &Mtail{o: Options{User: "54321"}}
+	if err := m.dropPrivileges(); err == nil {
+		t.Errorf("expected error for a uid with no passwd entry and no group")
+	}
+}
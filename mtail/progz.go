@@ -0,0 +1,46 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+var progzTemplate = template.Must(template.New("progz").Parse(`<html>
+<head><title>mtail programs</title></head>
+<body>
+<h1>Programs</h1>
+<table border=1>
+<tr><th>Name</th><th>Path</th><th>Status</th><th>Running</th><th>Loaded</th><th>Lines</th><th>Errors</th><th>Load error</th></tr>
+{{range .}}<tr><td>{{.Name}}</td><td>{{.Path}}</td><td>{{.Status}}</td><td>{{.Running}}</td><td>{{if not .LoadTime.IsZero}}{{.LoadTime.Format "2006-01-02T15:04:05Z07:00"}}{{end}}</td><td>{{.Lines}}</td><td>{{.Errors}}</td><td><pre>{{.LoadError}}</pre></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// handleProgz lists the programs loaded, with their source, status, last
+// load time and line and error counts, as HTML, or as JSON if the format
+// parameter is json.
+func (m *Mtail) handleProgz(w http.ResponseWriter, r *http.Request) {
+	statuses := m.l.ProgStatuses()
+	if r.FormValue("format") == "json" {
+		b, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			glog.Info("error marshalling program status into json:", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("content-type", "application/json")
+		w.Write(b)
+		return
+	}
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	if err := progzTemplate.Execute(w, statuses); err != nil {
+		glog.Infof("error rendering /progz: %s", err)
+	}
+}
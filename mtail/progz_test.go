@@ -0,0 +1,59 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/vm"
+)
+
+func TestProgzJSON(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	progpath := path.Join(workdir, "test.mtail")
+	if err := ioutil.WriteFile(progpath, []byte(testProgram), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(workdir, "bad.mtail"), []byte("/(/ {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(Options{Progs: workdir})
+	if err != nil {
+		t.Fatalf("couldn't create mtail: %s", err)
+	}
+	defer m.Close()
+
+	w := httptest.NewRecorder()
+	m.handler().ServeHTTP(w, httptest.NewRequest("GET", "/progz?format=json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected OK, got status %d", w.Code)
+	}
+	var statuses []vm.ProgStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("couldn't decode %q: %s", w.Body.String(), err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("expected 2 programs, got %+v", statuses)
+	}
+	bad, good := statuses[0], statuses[1]
+	if good.Name != "test.mtail" || good.Path != progpath || good.Status != "healthy" || !good.Running || good.LoadTime.IsZero() {
+		t.Errorf("test program not listed as healthy: %+v", good)
+	}
+	if bad.Name != "bad.mtail" || bad.Status != "load failed" || bad.Running || bad.LoadError == "" {
+		t.Errorf("bad program not listed as failed: %+v", bad)
+	}
+
+	w = httptest.NewRecorder()
+	m.handler().ServeHTTP(w, httptest.NewRequest("GET", "/progz", nil))
+	if !strings.Contains(w.Body.String(), "<td>test.mtail</td>") {
+		t.Errorf("test program not in HTML:\n%s", w.Body.String())
+	}
+}
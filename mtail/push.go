@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/tailer"
+)
+
+var (
+	// pushLines counts the lines received at /push, by origin.
+	pushLines = expvar.NewMap("push_lines_total")
+	// pushErrors counts the /push requests whose body couldn't be read, by
+	// origin.
+	pushErrors = expvar.NewMap("push_errors_total")
+)
+
+// handlePush sends each line of the body POSTed to it into the lines
+// channel, decompressing it first if it's gzip compressed.  The lines come
+// from the log named by the origin parameter, or else from the client's
+// address.
+func (m *Mtail) handlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// Compressed bodies are recognised by their header, so the encoding is
+	// only checked to refuse ones that can't be read.
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity", "gzip":
+	default:
+		http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	origin := r.FormValue("origin")
+	if origin == "" {
+		origin = r.RemoteAddr
+		if h, _, err := net.SplitHostPort(origin); err == nil {
+			origin = h
+		}
+	}
+	br, err := tailer.NewReader(r.Body)
+	if err != nil {
+		pushErrors.Add(origin, 1)
+		http.Error(w, fmt.Sprintf("failed to decompress body: %s", err), http.StatusBadRequest)
+		return
+	}
+	count := 0
+	for {
+		line, err := tailer.ReadLine(br, origin, m.maxLineLength(), m.o.LineDelimiter)
+		// A final line without a delimiter is sent too, as the body is
+		// complete.
+		if line != "" || err == nil {
+			if !m.sendPushed(logline.New(origin, line)) {
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			pushLines.Add(origin, 1)
+			count++
+		}
+		if err != nil {
+			if err != io.EOF {
+				glog.Infof("Failed to read pushed lines from %s: %s", origin, err)
+				pushErrors.Add(origin, 1)
+				http.Error(w, fmt.Sprintf("read %d lines, then failed: %s", count, err), http.StatusBadRequest)
+				return
+			}
+			break
+		}
+	}
+	fmt.Fprintf(w, "Read %d lines.\n", count)
+}
+
+// sendPushed sends l into the lines channel, unless pushes have been stopped
+// by closePush, in which case false is returned.
+func (m *Mtail) sendPushed(l *logline.LogLine) bool {
+	m.pushLock.RLock()
+	defer m.pushLock.RUnlock()
+	if m.pushClosed {
+		return false
+	}
+	m.lines <- l
+	return true
+}
+
+// closePush stops sending pushed lines, and waits for any being sent to the
+// lines channel to finish, so that it can be closed.
+func (m *Mtail) closePush() {
+	m.pushLock.Lock()
+	m.pushClosed = true
+	m.pushLock.Unlock()
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"encoding/json"
+	"expvar"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/metrics"
+	"github.com/spf13/afero"
+)
+
+// DefaultSnapshotInterval is how often the counters are saved to the snapshot
+// file, if there is one.
+const DefaultSnapshotInterval = time.Minute
+
+// snapshotErrors counts the failures to write the snapshot file.
+var snapshotErrors = expvar.NewInt("metric_snapshot_errors_total")
+
+// snapshotMetric is a counter as saved in the snapshot file.
+type snapshotMetric struct {
+	Program     string
+	Name        string
+	Keys        []string `json:",omitempty"`
+	LabelValues []snapshotValue
+}
+
+// snapshotValue is the value of one label set of a saved counter.
+type snapshotValue struct {
+	Labels []string `json:",omitempty"`
+	Value  int64
+	Time   int64 // nanoseconds since unix epoch
+}
+
+// takeSnapshot copies the values of every counter in the store.  Only
+// counters are saved, as gauges and histograms describe the recent log rather
+// than accumulate over its whole life.
+func (m *Mtail) takeSnapshot() []snapshotMetric {
+	m.store.RLock()
+	defer m.store.RUnlock()
+	var s []snapshotMetric
+	for _, sm := range m.store.Metrics {
+		if sm.Kind != metrics.Counter {
+			continue
+		}
+		c := snapshotMetric{Program: sm.Program, Name: sm.Name, Keys: sm.Keys}
+		sm.RLock()
+		for _, lv := range sm.LabelValues {
+			c.LabelValues = append(c.LabelValues, snapshotValue{
+				Labels: lv.Labels,
+				Value:  lv.Value.Get(),
+				Time:   atomic.LoadInt64(&lv.Value.Time)})
+		}
+		sm.RUnlock()
+		s = append(s, c)
+	}
+	return s
+}
+
+// writeSnapshot saves the counters to the snapshot file.  The snapshot is
+// written to a temporary file first, so that a crash can't leave a partial
+// snapshot.
+func (m *Mtail) writeSnapshot() error {
+	b, err := json.Marshal(m.takeSnapshot())
+	if err != nil {
+		return err
+	}
+	tmp := m.o.SnapshotPath + ".tmp"
+	if err := afero.WriteFile(m.fs(), tmp, b, 0600); err != nil {
+		return err
+	}
+	return m.fs().Rename(tmp, m.o.SnapshotPath)
+}
+
+// restoreSnapshot sets the counters of the loaded programs to the values in
+// the snapshot file, if it exists.  A saved counter is only restored to a
+// counter of the same name, program and keys, so the counters of programs
+// that have since been changed start again from zero, and saved counters no
+// longer declared are ignored.
+func (m *Mtail) restoreSnapshot() error {
+	b, err := afero.ReadFile(m.fs(), m.o.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s []snapshotMetric
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	declared := make(map[[2]string]*metrics.Metric)
+	m.store.RLock()
+	for _, sm := range m.store.Metrics {
+		if sm.Kind == metrics.Counter {
+			declared[[2]string{sm.Program, sm.Name}] = sm
+		}
+	}
+	m.store.RUnlock()
+	restored := 0
+	for _, c := range s {
+		sm, ok := declared[[2]string{c.Program, c.Name}]
+		if !ok || !sameKeys(sm.Keys, c.Keys) {
+			glog.V(1).Infof("Not restoring counter %s from %s, as it's no longer declared", c.Name, c.Program)
+			continue
+		}
+		for _, v := range c.LabelValues {
+			d, err := sm.GetDatum(v.Labels...)
+			if err != nil {
+				glog.V(1).Infof("Not restoring %s%q: %s", c.Name, v.Labels, err)
+				continue
+			}
+			d.Set(v.Value, time.Unix(0, v.Time))
+		}
+		restored++
+	}
+	glog.Infof("Restored %d counters from %s", restored, m.o.SnapshotPath)
+	return nil
+}
+
+// sameKeys reports whether a and b are the same keys, in the same order.
+func sameKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// snapshotCounters writes the snapshot file each interval, and a final time
+// once snapshotQuit is closed.
+func (m *Mtail) snapshotCounters(interval time.Duration) {
+	defer close(m.snapshotDone)
+	ticker := m.o.Clock.NewTicker(interval)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+		case <-m.snapshotQuit:
+			done = true
+		}
+		if err := m.writeSnapshot(); err != nil {
+			snapshotErrors.Add(1)
+			glog.Infof("Failed to write snapshot to %q: %s", m.o.SnapshotPath, err)
+		}
+	}
+}
+
+// fs returns the filesystem the snapshot and the log manifest are kept on.
+func (m *Mtail) fs() afero.Fs {
+	if m.o.FS != nil {
+		return m.o.FS
+	}
+	return &afero.OsFs{}
+}
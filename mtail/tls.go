@@ -0,0 +1,63 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// tlsVersions maps the names accepted for Options.TLSMinVersion to TLS
+// protocol versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig builds the TLS configuration of the HTTP server from the Options,
+// or returns nil if no certificate is configured and HTTP is to be served.
+func (o Options) tlsConfig() (*tls.Config, error) {
+	if o.TLSCertFile == "" && o.TLSKeyFile == "" {
+		if o.TLSClientCAFile != "" || o.TLSMinVersion != "" {
+			return nil, errors.New("TLS options need a certificate and key to be set")
+		}
+		return nil, nil
+	}
+	if o.TLSCertFile == "" || o.TLSKeyFile == "" {
+		return nil, errors.New("both a TLS certificate and key must be set")
+	}
+	c := &tls.Config{}
+	if o.TLSMinVersion != "" {
+		v, ok := tlsVersions[o.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q, must be one of 1.0, 1.1, 1.2 or 1.3", o.TLSMinVersion)
+		}
+		c.MinVersion = v
+	}
+	if o.TLSClientCAFile != "" {
+		b, err := ioutil.ReadFile(o.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS client CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in TLS client CA file %q", o.TLSClientCAFile)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	// Load the certificate now rather than when serving, as the files may not
+	// be readable once privileges are dropped.
+	cert, err := tls.LoadX509KeyPair(o.TLSCertFile, o.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %s", err)
+	}
+	c.Certificates = []tls.Certificate{cert}
+	return c, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package mtail
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key to
+// workdir, for use as both the server certificate and client CA.
+func writeTestCert(t *testing.T, workdir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mtail test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile = path.Join(workdir, "cert.pem")
+	keyFile = path.Join(workdir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+var invalidTLSOptions = []struct {
+	name string
+	o    Options
+}{
+	{"no key", Options{TLSCertFile: "cert.pem"}},
+	{"no cert", Options{TLSKeyFile: "key.pem"}},
+	{"version without cert", Options{TLSMinVersion: "1.2"}},
+	{"client ca without cert", Options{TLSClientCAFile: "ca.pem"}},
+	{"bad version", Options{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSMinVersion: "1.4"}},
+	{"missing client ca", Options{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSClientCAFile: "/nonexistent/ca.pem"}},
+}
+
+func TestInvalidTLSOptions(t *testing.T) {
+	for _, tc := range invalidTLSOptions {
+		if _, err := tc.o.tlsConfig(); err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestNoTLSOptions(t *testing.T) {
+	c, err := Options{}.tlsConfig()
+	if err != nil || c != nil {
+		t.Errorf("expected no TLS config, got %v, %v", c, err)
+	}
+}
+
+func TestTLSClientCertRequired(t *testing.T) {
+	workdir := makeTempDir(t)
+	defer removeTempDir(t, workdir)
+	certFile, keyFile := writeTestCert(t, workdir)
+
+	o := Options{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSMinVersion: "1.2", TLSClientCAFile: certFile}
+	c, err := o.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MinVersion != tls.VersionTLS12 {
+		t.Errorf("min version not set: %x", c.MinVersion)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.TLS = c
+	s.StartTLS()
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	b, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.AppendCertsFromPEM(b)
+
+	noCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if resp, err := noCert.Get(s.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("request without a client certificate succeeded")
+	}
+
+	withCert := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}}}
+	resp, err := withCert.Get(s.URL)
+	if err != nil {
+		t.Fatalf("request with a client certificate failed: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status %d", resp.StatusCode)
+	}
+}
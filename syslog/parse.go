@@ -0,0 +1,102 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package syslog
+
+import (
+	"strings"
+)
+
+// parseMessage returns the MSG part of an RFC5424 or RFC3164 syslog message,
+// without the priority and header.  For RFC3164 messages the MSG part begins
+// with the tag, such as "sshd[123]: ".  Text that doesn't look like either
+// format is returned as is, as RFC3164 asks relays to do.
+func parseMessage(s string) string {
+	s = strings.TrimRight(s, "\r\n\x00")
+	if !strings.HasPrefix(s, "<") {
+		return s
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 || !isDigits(s[1:end]) {
+		return s
+	}
+	rest := s[end+1:]
+	if i := strings.IndexByte(rest, ' '); i > 0 && isDigits(rest[:i]) {
+		return parse5424(rest[i+1:])
+	}
+	return parse3164(rest)
+}
+
+// parse5424 returns the MSG of an RFC5424 message after the version, by
+// skipping the TIMESTAMP HOSTNAME APP-NAME PROCID MSGID fields and the
+// STRUCTURED-DATA.
+func parse5424(s string) string {
+	for i := 0; i < 5; i++ {
+		sp := strings.IndexByte(s, ' ')
+		if sp < 0 {
+			return ""
+		}
+		s = s[sp+1:]
+	}
+	if strings.HasPrefix(s, "-") {
+		s = s[1:]
+	} else {
+		s = skipStructuredData(s)
+	}
+	s = strings.TrimPrefix(s, " ")
+	// Messages in UTF-8 may start with a byte order mark.
+	return strings.TrimPrefix(s, "\xef\xbb\xbf")
+}
+
+// skipStructuredData returns s after the SD-ELEMENTs at its start.  A ] in a
+// quoted parameter value doesn't end the element, and a backslash escapes the
+// character after it.
+func skipStructuredData(s string) string {
+	for strings.HasPrefix(s, "[") {
+		inQuote := false
+		i := 1
+	element:
+		for ; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				inQuote = !inQuote
+			case ']':
+				if !inQuote {
+					break element
+				}
+			}
+		}
+		if i >= len(s) {
+			return ""
+		}
+		s = s[i+1:]
+	}
+	return s
+}
+
+// parse3164 returns the MSG of an RFC3164 message after the priority, by
+// skipping the "Mmm dd hh:mm:ss" timestamp and hostname, if present.
+func parse3164(s string) string {
+	if len(s) < 16 || s[3] != ' ' || s[6] != ' ' || s[9] != ':' || s[12] != ':' || s[15] != ' ' {
+		return s
+	}
+	s = s[16:]
+	if sp := strings.IndexByte(s, ' '); sp >= 0 {
+		return s[sp+1:]
+	}
+	return ""
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
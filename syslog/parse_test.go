@@ -0,0 +1,50 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package syslog
+
+import (
+	"testing"
+)
+
+var parseMessageTests = []struct {
+	name     string
+	message  string
+	expected string
+}{
+	{"rfc3164",
+		"<34>Oct 11 22:14:15 mymachine su: 'su root' failed for lonvick on /dev/pts/8",
+		"su: 'su root' failed for lonvick on /dev/pts/8"},
+	{"rfc3164 single digit day",
+		"<13>Feb  5 17:32:18 10.0.0.99 sshd[4123]: Accepted publickey for jaq\n",
+		"sshd[4123]: Accepted publickey for jaq"},
+	{"rfc3164 without timestamp",
+		"<13>sshd[4123]: Accepted publickey for jaq",
+		"sshd[4123]: Accepted publickey for jaq"},
+	{"rfc5424 without structured data",
+		"<34>1 2003-10-11T22:14:15.003Z mymachine.example.com su - ID47 - \xef\xbb\xbf'su root' failed for lonvick on /dev/pts/8",
+		"'su root' failed for lonvick on /dev/pts/8"},
+	{"rfc5424 with structured data",
+		`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application"][examplePriority@32473 class="high"] An application event`,
+		"An application event"},
+	{"rfc5424 with escaped bracket in structured data",
+		`<165>1 2003-10-11T22:14:15.003Z host app 1234 - [id@1 text="a \] b" other="]"] the message`,
+		"the message"},
+	{"rfc5424 without message",
+		"<165>1 2003-10-11T22:14:15.003Z host app 1234 - -",
+		""},
+	{"no priority",
+		"just some text",
+		"just some text"},
+	{"bad priority",
+		"<abc>just some text",
+		"<abc>just some text"},
+}
+
+func TestParseMessage(t *testing.T) {
+	for _, tc := range parseMessageTests {
+		if r := parseMessage(tc.message); r != tc.expected {
+			t.Errorf("%s: got %q, want %q", tc.name, r, tc.expected)
+		}
+	}
+}
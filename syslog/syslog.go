@@ -0,0 +1,257 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package syslog provides a server that receives messages from the network in
+// the syslog protocol, and passes them to the virtual machines like lines read
+// from a log file.
+package syslog
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/tailer"
+)
+
+var (
+	// messages counts the messages received, by protocol.
+	messages = expvar.NewMap("syslog_messages_total")
+	// receiveErrors counts the failures to receive messages, by protocol.
+	receiveErrors = expvar.NewMap("syslog_errors_total")
+)
+
+// maxMessageSize is the largest message accepted.  RFC5424 receivers must
+// accept 480 bytes and should accept 2048, and larger UDP datagrams are rare.
+const maxMessageSize = 64 * 1024
+
+// Server receives syslog messages over UDP, TCP or both.  The origin of each
+// line is the address of the remote host that sent it, which getfilename()
+// returns.
+type Server struct {
+	lines chan<- *logline.LogLine
+
+	pc net.PacketConn // UDP socket, if listening on UDP.
+	l  net.Listener   // TCP listener, if listening on TCP.
+
+	conns     map[net.Conn]struct{} // TCP connections being read.
+	connsLock sync.Mutex            // protects `conns'
+
+	quit chan struct{}  // Closed to stop receiving.
+	wg   sync.WaitGroup // Tracks the goroutines receiving messages.
+}
+
+// Options configures a Server.
+type Options struct {
+	Lines    chan<- *logline.LogLine
+	Address  string // Host and port to listen on, such as ":514".
+	Protocol string // "udp", "tcp", or "both"; "udp" if empty.
+}
+
+// New creates a Server listening on the address in the Options, and starts
+// sending the messages it receives into the lines channel.
+func New(o Options) (*Server, error) {
+	if o.Lines == nil {
+		return nil, fmt.Errorf("syslog server needs a lines channel")
+	}
+	var udp, tcp bool
+	switch o.Protocol {
+	case "", "udp":
+		udp = true
+	case "tcp":
+		tcp = true
+	case "both":
+		udp, tcp = true, true
+	default:
+		return nil, fmt.Errorf("unknown syslog protocol %q, must be udp, tcp or both", o.Protocol)
+	}
+	s := &Server{
+		lines: o.Lines,
+		conns: make(map[net.Conn]struct{}),
+		quit:  make(chan struct{})}
+	var err error
+	if udp {
+		if s.pc, err = net.ListenPacket("udp", o.Address); err != nil {
+			return nil, err
+		}
+	}
+	if tcp {
+		if s.l, err = net.Listen("tcp", o.Address); err != nil {
+			if s.pc != nil {
+				s.pc.Close()
+			}
+			return nil, err
+		}
+	}
+	if s.pc != nil {
+		glog.Infof("Receiving syslog on udp %s", s.pc.LocalAddr())
+		s.wg.Add(1)
+		go s.readPackets()
+	}
+	if s.l != nil {
+		glog.Infof("Receiving syslog on tcp %s", s.l.Addr())
+		s.wg.Add(1)
+		go s.accept()
+	}
+	return s, nil
+}
+
+// send passes a received message to the virtual machines, returning false if
+// the server is closing.
+func (s *Server) send(protocol string, addr net.Addr, message string) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	messages.Add(protocol, 1)
+	select {
+	case s.lines <- logline.New(host, parseMessage(message)):
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+// readPackets receives one message in each UDP datagram.
+func (s *Server) readPackets() {
+	defer s.wg.Done()
+	b := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.pc.ReadFrom(b)
+		if err != nil {
+			select {
+			case <-s.quit:
+			default:
+				glog.Infof("Failed to read syslog datagram: %s", err)
+				receiveErrors.Add("udp", 1)
+			}
+			return
+		}
+		if !s.send("udp", addr, string(b[:n])) {
+			return
+		}
+	}
+}
+
+// accept reads messages from each TCP connection until the server is closed.
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+			default:
+				glog.Infof("Failed to accept syslog connection: %s", err)
+				receiveErrors.Add("tcp", 1)
+			}
+			return
+		}
+		s.connsLock.Lock()
+		select {
+		case <-s.quit:
+			// Close has already closed the connections it knows about.
+			s.connsLock.Unlock()
+			c.Close()
+			return
+		default:
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.connsLock.Unlock()
+		go s.readConn(c)
+	}
+}
+
+// readConn reads the messages sent on a TCP connection.  Messages are framed
+// as described in RFC6587, either by octet counting, where each message is
+// preceded by its length and a space, or by ending each message with a
+// newline.  The framing is decided by the first character of each message.
+func (s *Server) readConn(c net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.connsLock.Lock()
+		delete(s.conns, c)
+		s.connsLock.Unlock()
+		c.Close()
+	}()
+	origin := c.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(origin); err == nil {
+		origin = h
+	}
+	r := bufio.NewReader(c)
+	for {
+		message, err := readFrame(r, origin)
+		if message != "" {
+			if !s.send("tcp", c.RemoteAddr(), message) {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case <-s.quit:
+				default:
+					glog.Infof("Failed to read syslog message from %s: %s", c.RemoteAddr(), err)
+					receiveErrors.Add("tcp", 1)
+				}
+			}
+			return
+		}
+	}
+}
+
+// readFrame reads one message from a TCP stream from origin.  A message
+// framed by a newline is truncated to maxMessageSize, like a long line in a
+// log, so that a sender that never sends a newline can't fill the memory.
+func readFrame(r *bufio.Reader, origin string) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] < '0' || b[0] > '9' {
+		return tailer.ReadLine(r, origin, maxMessageSize, "\n")
+	}
+	// The length is read the same way, so that a longer run of digits is
+	// cut to a number too large, and refused.  RFC6587 lengths have no
+	// leading zeros, which could otherwise hide the digits cut off.
+	length, err := tailer.ReadLine(r, origin, len(strconv.Itoa(maxMessageSize))+1, " ")
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil || n > maxMessageSize || length[0] == '0' {
+		return "", fmt.Errorf("bad message length %q", length)
+	}
+	message := make([]byte, n)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+// Close stops receiving messages, and waits for any being sent to the lines
+// channel to finish.  The lines channel isn't closed.
+func (s *Server) Close() error {
+	close(s.quit)
+	if s.pc != nil {
+		s.pc.Close()
+	}
+	if s.l != nil {
+		s.l.Close()
+	}
+	s.connsLock.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.connsLock.Unlock()
+	s.wg.Wait()
+	return nil
+}
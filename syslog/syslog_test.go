@@ -0,0 +1,115 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package syslog
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/logline"
+)
+
+// expectLine reads a line from the lines channel and compares it to expected.
+func expectLine(t *testing.T, lines <-chan *logline.LogLine, expected string) {
+	select {
+	case l := <-lines:
+		if l.Line != expected {
+			t.Errorf("got line %q, want %q", l.Line, expected)
+		}
+		if l.Filename != "127.0.0.1" {
+			t.Errorf("got origin %q, want the sender's address", l.Filename)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", expected)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	s, err := New(Options{Lines: lines, Address: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.l != nil {
+		t.Errorf("listening on TCP by default")
+	}
+
+	c, err := net.Dial("udp", s.pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprint(c, "<34>Oct 11 22:14:15 mymachine su: 'su root' failed\n")
+	expectLine(t, lines, "su: 'su root' failed")
+	fmt.Fprint(c, "<34>1 2003-10-11T22:14:15.003Z mymachine su - ID47 - 'su root' failed")
+	expectLine(t, lines, "'su root' failed")
+}
+
+func TestTCP(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	s, err := New(Options{Lines: lines, Address: "127.0.0.1:0", Protocol: "tcp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.pc != nil {
+		t.Errorf("listening on UDP with protocol tcp")
+	}
+
+	c, err := net.Dial("tcp", s.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Newline framing, then octet counting, which allows newlines in the
+	// message.
+	fmt.Fprint(c, "<13>Feb  5 17:32:18 host sshd[1]: first\n")
+	second := "<13>1 2017-02-05T17:32:18Z host sshd 1 - - second\nline"
+	fmt.Fprintf(c, "%d %s", len(second), second)
+	fmt.Fprint(c, "<13>Feb  5 17:32:18 host sshd[1]: third\n")
+	expectLine(t, lines, "sshd[1]: first")
+	expectLine(t, lines, "second\nline")
+	expectLine(t, lines, "sshd[1]: third")
+
+	// Close must return with the connection still open.
+	done := make(chan struct{})
+	go func() {
+		s.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return")
+	}
+}
+
+func TestReadFrameTruncatesLongMessages(t *testing.T) {
+	long := strings.Repeat("x", 2*maxMessageSize)
+	r := bufio.NewReader(strings.NewReader(long + "\nnext\n1234567 " + long))
+	message, err := readFrame(r, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(message) != maxMessageSize {
+		t.Errorf("long message not truncated: got %d bytes, want %d", len(message), maxMessageSize)
+	}
+	if message, err := readFrame(r, "test"); err != nil || message != "next" {
+		t.Errorf("message after the long one: got %q, %v", message, err)
+	}
+	if _, err := readFrame(r, "test"); err == nil {
+		t.Errorf("long length not refused")
+	}
+}
+
+func TestUnknownProtocol(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	if _, err := New(Options{Lines: lines, Address: "127.0.0.1:0", Protocol: "sctp"}); err == nil {
+		t.Error("expected an error for an unknown protocol")
+	}
+}
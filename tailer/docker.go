@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/logline"
+)
+
+// DockerFormat is the log format of Docker's json-file logging driver, in
+// which each line of a container's output is written as a JSON object, such
+// as {"log":"GET /\n","stream":"stdout","time":"2017-03-01T02:00:00.5Z"}.
+const DockerFormat = "docker"
+
+// dockerLineErrors counts the lines of Docker logs that couldn't be parsed,
+// and were dropped, by log file.
+var dockerLineErrors = expvar.NewMap("docker_line_errors_total")
+
+// checkFormat returns an error if format isn't a log format the tailer can
+// read.  Lines are read as they are if format is empty.
+func checkFormat(format string) error {
+	switch format {
+	case "", DockerFormat:
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q", format)
+}
+
+// dockerEntry is a line of a Docker json-file log.
+type dockerEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// dockerPartial is the start of a message split across the lines of a Docker
+// log.
+type dockerPartial struct {
+	msg       string
+	truncated bool // The message is longer than the maximum line length, so the rest of it is dropped.
+}
+
+// sendDockerLine unwraps a line of a Docker log, and sends the message it
+// contains for processing, with the stream it was written to and the time it
+// was written.  Docker splits long messages across many entries, of which
+// only the last ends with a newline, so the message is only sent once its
+// last entry is read.  Like any other line, a message longer than the maximum
+// line length is cut short, so that one never ended isn't held in full.
+func (t *Tailer) sendDockerLine(pathname, line string) {
+	var e dockerEntry
+	if err := json.Unmarshal([]byte(line), &e); err != nil {
+		dockerLineErrors.Add(pathname, 1)
+		glog.V(1).Infof("Dropped unparseable line from Docker log %s: %s", pathname, err)
+		return
+	}
+	key := pathname + "\x00" + e.Stream
+	t.dockerPartialsLock.Lock()
+	p := t.dockerPartials[key]
+	if !p.truncated {
+		p.msg += strings.TrimSuffix(e.Log, "\n")
+		if len(p.msg) > t.maxLineLength {
+			b := []byte(p.msg[:t.maxLineLength])
+			p.msg = string(b[:len(b)-incompleteRune(b)])
+			p.truncated = true
+			lineTruncations.Add(pathname, 1)
+		}
+	}
+	if !strings.HasSuffix(e.Log, "\n") {
+		t.dockerPartials[key] = p
+		t.dockerPartialsLock.Unlock()
+		return
+	}
+	delete(t.dockerPartials, key)
+	t.dockerPartialsLock.Unlock()
+
+	l := logline.New(pathname, p.msg)
+	l.Stream = e.Stream
+	l.Time = e.Time
+	t.lines <- l
+}
+
+// forgetDockerPartials discards the unfinished messages of the Docker log at
+// pathname, as when it's closed.
+func (t *Tailer) forgetDockerPartials(pathname string) {
+	t.dockerPartialsLock.Lock()
+	defer t.dockerPartialsLock.Unlock()
+	for key := range t.dockerPartials {
+		if strings.HasPrefix(key, pathname+"\x00") {
+			delete(t.dockerPartials, key)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/spf13/afero"
+)
+
+const dockerLog = `{"log":"GET /index.html 200\n","stream":"stdout","time":"2017-03-01T02:00:00.123456789Z"}
+{"log":"warning: cache miss\n","stream":"stderr","time":"2017-03-01T02:00:01Z"}
+not json
+{"log":"a long ","stream":"stdout","time":"2017-03-01T02:00:02Z"}
+{"log":"error\n","stream":"stderr","time":"2017-03-01T02:00:03Z"}
+{"log":"message\n","stream":"stdout","time":"2017-03-01T02:00:04Z"}
+`
+
+func TestTailDockerLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 4)
+	ta, err := New(Options{Lines: lines, W: w, FS: fs, ReadFromStart: true, Format: DockerFormat})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logfile := "/var/lib/docker/containers/abc/abc-json.log"
+	if err := afero.WriteFile(fs, logfile, []byte(dockerLog), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ta.Tail(logfile)
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "GET /index.html 200", Stream: "stdout", Time: time.Date(2017, 3, 1, 2, 0, 0, 123456789, time.UTC)},
+		{Filename: logfile, Line: "warning: cache miss", Stream: "stderr", Time: time.Date(2017, 3, 1, 2, 0, 1, 0, time.UTC)},
+		{Filename: logfile, Line: "error", Stream: "stderr", Time: time.Date(2017, 3, 1, 2, 0, 3, 0, time.UTC)},
+		{Filename: logfile, Line: "a long message", Stream: "stdout", Time: time.Date(2017, 3, 1, 2, 0, 4, 0, time.UTC)},
+	}
+	result := []*logline.LogLine{<-lines, <-lines, <-lines, <-lines}
+	for _, l := range result {
+		l.Time = l.Time.UTC()
+	}
+	if diff := pretty.Compare(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if dockerLineErrors.Get(logfile) == nil {
+		t.Error("unparseable line not counted")
+	}
+}
+
+// TestDockerMessageTruncated tests that a message split across many lines of a
+// Docker log is cut short at the maximum line length, rather than held in
+// full, and that an unfinished message is forgotten when the log is closed.
+func TestDockerMessageTruncated(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	// The maximum applies to the lines of the log too, which hold the JSON.
+	ta, err := New(Options{Lines: lines, W: w, FS: fs, ReadFromStart: true, Format: DockerFormat, MaxLineLength: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logfile := "/var/lib/docker/containers/abc/abc-json.log"
+	var log string
+	for _, part := range []string{"aaaaaaaaaa", "bbbbbbbbbb", "cccccccccc", "dddddddddd", "eeeeeeeeee\\n", "ffff"} {
+		log += `{"log":"` + part + `","stream":"stdout"}` + "\n"
+	}
+	if err := afero.WriteFile(fs, logfile, []byte(log), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ta.Tail(logfile)
+	expected := "aaaaaaaaaabbbbbbbbbbccccccccccdddddddddd"
+	if l := <-lines; l.Line != expected {
+		t.Errorf("line not expected: got %q, want %q", l.Line, expected)
+	}
+	if n := lineTruncations.Get(logfile); n == nil || n.String() != "1" {
+		t.Errorf("truncations: got %v, want 1", n)
+	}
+	if len(ta.dockerPartials) != 1 {
+		t.Errorf("unfinished message not held: %v", ta.dockerPartials)
+	}
+	ta.filesLock.Lock()
+	fd := ta.files[logfile]
+	ta.filesLock.Unlock()
+	ta.closeLog(logfile, fd)
+	if len(ta.dockerPartials) != 0 {
+		t.Errorf("unfinished message not forgotten: %v", ta.dockerPartials)
+	}
+}
+
+func TestNewUnknownFormat(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	_, err := New(Options{Lines: lines, W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), Format: "cri"})
+	if err == nil {
+		t.Error("expected error for unknown log format")
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// newTransformer returns the transformer that decodes logs in the named
+// encoding to UTF-8, or nil for UTF-8 logs, which are read as they are.  The
+// names are those of the WHATWG Encoding Standard, such as "utf-16le" or
+// "windows-1252".  A byte order mark at the start of a log overrides the
+// encoding, and is removed.
+func newTransformer(name string) (transform.Transformer, error) {
+	switch strings.ToLower(name) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	}
+	e, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding %q: %s", name, err)
+	}
+	return unicode.BOMOverride(e.NewDecoder()), nil
+}
+
+// NewDecodingReader returns a reader of r that decodes it from the named
+// encoding to UTF-8.  It's for reading a log to the end once, rather than
+// tailing it.
+func NewDecodingReader(r io.Reader, encoding string) (io.Reader, error) {
+	t, err := newTransformer(encoding)
+	if err != nil || t == nil {
+		return r, err
+	}
+	return transform.NewReader(r, t), nil
+}
+
+// decoder decodes the blocks read from a log to UTF-8.  A character split
+// between blocks is held back until the rest of it is read, as the log
+// hasn't ended when a read reaches the end of the file.
+type decoder struct {
+	t       transform.Transformer // Decodes to UTF-8, nil if the log is UTF-8.
+	pending []byte                // Bytes of an incomplete character at the end of the last block.
+
+	offset  int64 // Offset in the log of the bytes decoded from the last block, including those pending from the one before.
+	decoded int   // Bytes of the log decoded from the last block.
+	ends    []int // For each byte decoded from the last block, the bytes of the log decoded up to the end of its character; nil if the log is UTF-8.
+	sent    int64 // Offset in the log just past the last line sent.
+
+	truncating bool   // The line being read is too long, so the rest of it is dropped.
+	held       []byte // Bytes read that may be the start of a line delimiter.
+}
+
+// newDecoder returns a decoder of a log in the tailer's encoding.
+func (t *Tailer) newDecoder() *decoder {
+	// The encoding was checked in New.
+	tr, _ := newTransformer(t.encoding)
+	return &decoder{t: tr}
+}
+
+// seek sets the offset in the log of the next block read.
+func (d *decoder) seek(offset int64) {
+	d.offset, d.sent = offset, offset
+	d.decoded = 0
+	d.pending = nil
+}
+
+// decode returns the complete UTF-8 characters read so far, including the
+// pending bytes of the last block.  A log in another encoding is decoded a
+// character at a time, to learn the bytes of the log each is decoded from.
+func (d *decoder) decode(b []byte) []byte {
+	d.offset += int64(d.decoded)
+	src := b
+	if len(d.pending) > 0 {
+		src = append(d.pending, b...)
+		d.pending = nil
+	}
+	if d.t == nil {
+		n := len(src) - incompleteRune(src)
+		d.pending = append(d.pending, src[n:]...)
+		d.decoded = n
+		return src[:n]
+	}
+	var out []byte
+	d.ends = d.ends[:0]
+	d.decoded = 0
+	buf := make([]byte, 4096)
+	for k := 1; k <= len(src); k++ {
+		nDst, nSrc, err := d.t.Transform(buf, src[:k], false)
+		if err != nil && err != transform.ErrShortSrc {
+			// Drop the rest of the block rather than read it again.
+			d.decoded += len(src)
+			return out
+		}
+		if nSrc == 0 {
+			continue
+		}
+		d.decoded += nSrc
+		for i := 0; i < nDst; i++ {
+			d.ends = append(d.ends, d.decoded)
+		}
+		out = append(out, buf[:nDst]...)
+		src, k = src[nSrc:], 0
+	}
+	d.pending = append(d.pending, src...)
+	return out
+}
+
+// end returns the offset in the log just past the character ending with byte
+// i of the last block decoded.
+func (d *decoder) end(i int) int64 {
+	if d.t == nil {
+		return d.offset + int64(i) + 1
+	}
+	return d.offset + int64(d.ends[i])
+}
+
+// incompleteRune returns the length of the incomplete UTF-8 character at the
+// end of b, or 0 if b ends with a complete or invalid character.
+func incompleteRune(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if utf8.FullRune(b[len(b)-i:]) {
+				return 0
+			}
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"os"
+	"testing"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/spf13/afero"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestTailUTF16(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(Options{Lines: lines, W: w, FS: fs, ReadFromStart: true, Encoding: "utf-16le"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().Bytes([]byte("café\nnaïve\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logfile := "/tmp/log"
+	if err := afero.WriteFile(fs, logfile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ta.Tail(logfile)
+	expected := []*logline.LogLine{
+		logline.New(logfile, "café"),
+		logline.New(logfile, "naïve"),
+	}
+	result := []*logline.LogLine{<-lines, <-lines}
+	if diff := pretty.Compare(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+// TestTailUTF16ResumesFromSavedOffset tests that the offset saved is that of
+// the log as read, so that a restart reads the whole of a partial line that's
+// shorter once decoded.
+func TestTailUTF16ResumesFromSavedOffset(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	logfile := "/tmp/log"
+	statefile := "/tmp/state"
+	encode := func(s string) []byte {
+		b, err := unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM).NewEncoder().Bytes([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tail := func(readFromStart bool) string {
+		lines := make(chan *logline.LogLine, 1)
+		ta, err := New(Options{Lines: lines, W: watcher.NewFakeWatcher(), FS: fs, ReadFromStart: readFromStart, StatePath: statefile, Encoding: "utf-16le"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ta.Tail(logfile)
+		l := <-lines
+		ta.Close()
+		return l.Line
+	}
+
+	if err := afero.WriteFile(fs, logfile, append([]byte("\xff\xfe"), encode("café\nnaï")...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l := tail(true); l != "café" {
+		t.Errorf("line not expected: got %q, want %q", l, "café")
+	}
+	f, err := fs.OpenFile(logfile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(encode("ve\n"))
+	f.Close()
+	if l := tail(false); l != "naïve" {
+		t.Errorf("line not expected: got %q, want %q", l, "naïve")
+	}
+}
+
+func TestNewUnknownEncoding(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	_, err := New(Options{Lines: lines, W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), Encoding: "klingon"})
+	if err == nil {
+		t.Error("expected error for unknown encoding")
+	}
+}
+
+var decodeTests = []struct {
+	name     string
+	encoding string
+	blocks   []string
+	expected []string
+}{
+	{"utf-8", "", []string{"caf\xc3", "\xa9\n"}, []string{"caf", "é\n"}},
+	{"utf-8 three blocks", "utf-8", []string{"\xe2", "\x82", "\xac"}, []string{"", "", "€"}},
+	{"utf-8 invalid", "", []string{"a\xff", "b"}, []string{"a\xff", "b"}},
+	{"utf-16le", "utf-16le", []string{"a\x00\x00", "\x01\n\x00"}, []string{"a", "Ā\n"}},
+	{"utf-16le surrogate pair", "utf-16le", []string{"\x3d\xd8", "\x00\xde"}, []string{"", "😀"}},
+	{"utf-16 bom", "utf-16le", []string{"\xfe\xff\x00", "a"}, []string{"", "a"}},
+	{"windows-1252", "windows-1252", []string{"caf\xe9"}, []string{"café"}},
+}
+
+func TestDecodeSplitCharacters(t *testing.T) {
+	for _, tc := range decodeTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			ta := &Tailer{encoding: tc.encoding}
+			d := ta.newDecoder()
+			var result []string
+			for _, b := range tc.blocks {
+				result = append(result, string(d.decode([]byte(b))))
+			}
+			if diff := pretty.Compare(tc.expected, result); diff != "" {
+				t.Errorf("decoded blocks didn't match:\n%s", diff)
+			}
+		})
+	}
+}
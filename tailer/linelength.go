@@ -0,0 +1,62 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+)
+
+// DefaultMaxLineLength is the length in bytes beyond which lines are
+// truncated.
+const DefaultMaxLineLength = 1024 * 1024
+
+// DefaultLineDelimiter is the separator of the lines of logs.
+const DefaultLineDelimiter = "\n"
+
+// lineTruncations counts the lines truncated for being longer than the
+// maximum line length, by log file.
+var lineTruncations = expvar.NewMap("log_line_truncations_total")
+
+// ReadLine reads a line from r, without the delimiter that ends it, which is
+// DefaultLineDelimiter if empty.  A line longer than max bytes is cut short at
+// a character boundary, the rest of it is discarded, and the truncation is
+// counted against pathname; at most max bytes and the delimiter are buffered.
+// The line may be incomplete when err is not nil.
+func ReadLine(r *bufio.Reader, pathname string, max int, delim string) (line string, err error) {
+	if delim == "" {
+		delim = DefaultLineDelimiter
+	}
+	var b []byte    // The start of the line.
+	var tail []byte // The last bytes read, which end with delim at the end of the line.
+	n := 0          // The length of the line read so far.
+	for {
+		s, err := r.ReadSlice(delim[len(delim)-1])
+		n += len(s)
+		tail = append(tail, s...)
+		if len(tail) > len(delim) {
+			tail = tail[len(tail)-len(delim):]
+		}
+		if room := max + len(delim) - len(b); len(s) > room {
+			s = s[:room]
+		}
+		b = append(b, s...)
+		if err == bufio.ErrBufferFull || err == nil && !bytes.HasSuffix(tail, []byte(delim)) {
+			continue
+		}
+		if err == nil {
+			n -= len(delim)
+		}
+		if len(b) > n {
+			b = b[:n]
+		}
+		if n > max {
+			b = b[:max]
+			b = b[:len(b)-incompleteRune(b)]
+			lineTruncations.Add(pathname, 1)
+		}
+		return string(b), err
+	}
+}
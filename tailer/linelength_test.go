@@ -0,0 +1,100 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bufio"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/watcher"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/spf13/afero"
+)
+
+func TestTailHugeLine(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(Options{Lines: lines, W: w, FS: fs, ReadFromStart: true, MaxLineLength: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logfile := "/tmp/huge.log"
+	huge := strings.Repeat("x", 32*1024*1024)
+	if err := afero.WriteFile(fs, logfile, []byte(huge+"\nshort\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	huge = ""
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	ta.Tail(logfile)
+	runtime.ReadMemStats(&after)
+
+	expected := []*logline.LogLine{
+		logline.New(logfile, strings.Repeat("x", 1024)),
+		logline.New(logfile, "short"),
+	}
+	result := []*logline.LogLine{<-lines, <-lines}
+	if diff := pretty.Compare(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	// Reading the line shouldn't allocate anywhere near its size.
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 4*1024*1024 {
+		t.Errorf("reading a 32MB line allocated %d bytes", alloc)
+	}
+	if n := lineTruncations.Get(logfile); n == nil || n.String() != "1" {
+		t.Errorf("line truncations of %s: got %v, want 1", logfile, n)
+	}
+}
+
+var readLineTests = []struct {
+	name     string
+	input    string
+	max      int
+	delim    string
+	expected []string
+}{
+	{"short", "ab\ncd\n", 4, "", []string{"ab", "cd"}},
+	{"exact", "abcd\n", 4, "", []string{"abcd"}},
+	{"long", "abcdefghijklmnopqrstuvwxyz\nab\n", 4, "", []string{"abcd", "ab"}},
+	{"character boundary", "aé\n", 2, "", []string{"a"}},
+	{"no newline", "abcdef", 4, "", []string{"abcd"}},
+	{"empty lines", "\n\n", 4, "", []string{"", ""}},
+	{"nul", "ab\x00cd\x00", 4, "\x00", []string{"ab", "cd"}},
+	{"crlf", "ab\r\ncd\ref\r\n", 8, "\r\n", []string{"ab", "cd\ref"}},
+	{"crlf long", "abcdefghijklmnopqrstuvwxyz\r\nab\r\n", 4, "\r\n", []string{"abcd", "ab"}},
+	{"crlf exact", "abcd\r\n", 4, "\r\n", []string{"abcd"}},
+}
+
+func TestReadLine(t *testing.T) {
+	for _, tc := range readLineTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			// The smallest buffer, so that long lines are read in pieces.
+			r := bufio.NewReaderSize(strings.NewReader(tc.input), 16)
+			var result []string
+			for {
+				line, err := ReadLine(r, "test", tc.max, tc.delim)
+				if line != "" || err == nil {
+					result = append(result, line)
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if diff := pretty.Compare(tc.expected, result); diff != "" {
+				t.Errorf("lines didn't match:\n%s", diff)
+			}
+		})
+	}
+}
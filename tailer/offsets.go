@@ -0,0 +1,139 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/spf13/afero"
+)
+
+// offsetFlushInterval is how often the read offsets are written to the state
+// file, if there is one.
+const offsetFlushInterval = 10 * time.Second
+
+// offset is the position reached in a log file, identified by its inode so
+// that a file replaced while mtail wasn't running is read from the start.
+type offset struct {
+	Inode  uint64
+	Offset int64
+}
+
+// loadOffsets reads the offsets saved in the state file, if it exists.
+func (t *Tailer) loadOffsets() error {
+	b, err := afero.ReadFile(t.fs, t.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &t.offsets)
+}
+
+// writeOffsets saves the offsets to the state file.  The state is written to
+// a temporary file first, so that a crash can't leave a partial state file.
+func (t *Tailer) writeOffsets() error {
+	t.offsetsLock.Lock()
+	b, err := json.Marshal(t.offsets)
+	t.offsetsLock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := t.statePath + ".tmp"
+	if err := afero.WriteFile(t.fs, tmp, b, 0600); err != nil {
+		return err
+	}
+	return t.fs.Rename(tmp, t.statePath)
+}
+
+// flushOffsets writes the offsets to the state file each interval, until
+// flushQuit is closed.
+func (t *Tailer) flushOffsets(interval time.Duration) {
+	ticker := t.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := t.writeOffsets(); err != nil {
+				glog.Infof("Failed to write offsets to %q: %s", t.statePath, err)
+			}
+		case <-t.flushQuit:
+			return
+		}
+	}
+}
+
+// seekSavedOffset seeks the newly opened file to the offset saved for it, and
+// reports whether there was one.  If the file has been truncated below the
+// saved offset, or replaced by a file with a different inode, it seeks to the
+// start instead.
+func (t *Tailer) seekSavedOffset(f afero.File, fi os.FileInfo) bool {
+	if t.statePath == "" {
+		return false
+	}
+	t.offsetsLock.Lock()
+	o, ok := t.offsets[f.Name()]
+	t.offsetsLock.Unlock()
+	if !ok {
+		return false
+	}
+	pos := o.Offset
+	if o.Inode != inode(fi) || pos > fi.Size() {
+		glog.Infof("Saved offset %d for %s is no longer valid, reading from the start", pos, f.Name())
+		pos = 0
+	}
+	if _, err := f.Seek(pos, io.SeekStart); err != nil {
+		glog.Infof("Failed to seek to saved offset %d in %s: %s", pos, f.Name(), err)
+	}
+	return true
+}
+
+// trackOffset starts recording the offset reached in the newly opened file.
+func (t *Tailer) trackOffset(f afero.File, fi os.FileInfo) {
+	if t.statePath == "" {
+		return
+	}
+	pos, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return
+	}
+	t.decoder(f.Name()).seek(pos)
+	t.offsetsLock.Lock()
+	defer t.offsetsLock.Unlock()
+	t.offsets[f.Name()] = offset{Inode: inode(fi), Offset: pos}
+}
+
+// recordOffset records the offset in the file just past the last line sent,
+// so that a restart reads the whole of the partial line after it.  That's
+// counted in bytes of the log as they were read, before decoding, as the
+// partial line is neither the same length once decoded nor the whole of what
+// was read after the last line: a long line is cut short, and the start of a
+// character or delimiter may be held back.
+func (t *Tailer) recordOffset(f afero.File) {
+	if t.statePath == "" {
+		return
+	}
+	sent := t.decoder(f.Name()).sent
+	t.offsetsLock.Lock()
+	defer t.offsetsLock.Unlock()
+	if o, ok := t.offsets[f.Name()]; ok {
+		o.Offset = sent
+		t.offsets[f.Name()] = o
+	}
+}
+
+// forgetOffset stops recording the offset of a log file that has gone away.
+func (t *Tailer) forgetOffset(pathname string) {
+	if t.statePath == "" {
+		return
+	}
+	t.offsetsLock.Lock()
+	defer t.offsetsLock.Unlock()
+	delete(t.offsets, pathname)
+}
@@ -0,0 +1,100 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"expvar"
+	"io"
+	"sort"
+
+	"github.com/golang/glog"
+)
+
+// logTruncations counts the logs found to have shrunk when reopened, such as
+// by logrotate's copytruncate, by log file.
+var logTruncations = expvar.NewMap("log_truncations_total")
+
+// Reopen checks every open log against its path, and reopens the logs that
+// have been rotated and rewinds the logs that have been truncated.  Rotations
+// are normally noticed by the watcher, but its events can be delayed or
+// dropped, so logrotate can signal mtail to reopen the logs after rotating
+// them.  Reopen returns once the logs have been checked.
+func (t *Tailer) Reopen() {
+	done := make(chan struct{})
+	select {
+	case t.reopen <- done:
+		<-done
+	case <-t.runDone:
+	}
+}
+
+// reopenLogs checks each open log for rotation or truncation, and then reads
+// any lines written since it was last read.
+func (t *Tailer) reopenLogs() {
+	for _, pathname := range t.openLogs() {
+		t.filesLock.Lock()
+		fd := t.files[pathname]
+		t.filesLock.Unlock()
+		s1, err := fd.Stat()
+		if err != nil {
+			glog.Infof("Stat failed on %q: %s", pathname, err)
+			continue
+		}
+		s2, err := t.fs.Stat(pathname)
+		if err != nil {
+			// A missing log is picked up again when it's recreated.
+			glog.Infof("Stat failed on %q: %s", pathname, err)
+			continue
+		}
+		if inode(s1) != inode(s2) {
+			// Rotated by a move and create, so handle it like the create
+			// event that would have been seen.
+			t.handleLogCreate(pathname)
+			continue
+		}
+		pos, err := fd.Seek(0, io.SeekCurrent)
+		if err != nil {
+			glog.Infof("Seek failed on %q: %s", pathname, err)
+			continue
+		}
+		if s2.Size() < pos {
+			logTruncations.Add(pathname, 1)
+			glog.Infof("Seek to start on truncated %s", pathname)
+			if _, err := fd.Seek(0, io.SeekStart); err != nil {
+				glog.Infof("Seek failed on %q: %s", pathname, err)
+				continue
+			}
+			delete(t.partials, pathname)
+			t.resetDecoder(pathname)
+		}
+		t.handleLogUpdate(pathname)
+	}
+}
+
+// readLogs reads any lines written since each open log was last read.
+func (t *Tailer) readLogs() {
+	for _, pathname := range t.openLogs() {
+		t.handleLogUpdate(pathname)
+	}
+}
+
+// openLogs returns the sorted pathnames of the open regular files.  Pipes are
+// left out, as they're read continuously and can't be rotated.
+func (t *Tailer) openLogs() []string {
+	t.filesLock.Lock()
+	defer t.filesLock.Unlock()
+	var pathnames []string
+	for pathname, fd := range t.files {
+		fi, err := fd.Stat()
+		if err != nil {
+			glog.Infof("Stat failed on %q: %s", pathname, err)
+			continue
+		}
+		if fi.Mode().IsRegular() {
+			pathnames = append(pathnames, pathname)
+		}
+	}
+	sort.Strings(pathnames)
+	return pathnames
+}
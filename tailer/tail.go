@@ -11,6 +11,9 @@ package tailer
 // directory.
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"errors"
 	"expvar"
 	"fmt"
@@ -18,12 +21,15 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
-	"unicode/utf8"
+	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
 	"github.com/google/mtail/watcher"
 
 	"github.com/spf13/afero"
@@ -33,6 +39,11 @@ var (
 	logCount     = expvar.NewInt("log_count")
 	logErrors    = expvar.NewMap("log_errors_total")
 	logRotations = expvar.NewMap("log_rotations_total")
+	// logLines counts the lines read, by log file.
+	logLines = expvar.NewMap("log_lines_total")
+	// watchErrors counts the paths that couldn't be watched, such as when the
+	// inotify watch limit is reached.
+	watchErrors = expvar.NewInt("log_watch_errors_total")
 )
 
 // Tailer receives notification of changes from a Watcher and extracts new log
@@ -41,21 +52,68 @@ var (
 type Tailer struct {
 	w watcher.Watcher
 
-	watched     map[string]struct{}   // Names of logs being watched.
-	watchedLock sync.RWMutex          // protects `watched'
-	lines       chan<- string         // Logfile lines being emitted.
-	files       map[string]afero.File // File handles for each pathname.
-	filesLock   sync.Mutex            // protects `files'
-	partials    map[string]string     // Accumulator for the currently read line for each pathname.
+	watched     map[string]struct{}     // Names of logs being watched.
+	named       map[string]struct{}     // Logs given to Tail by name, rather than by pattern or directory.
+	watchedLock sync.RWMutex            // protects `watched' and `named'
+	patterns    map[string]struct{}     // Glob patterns of logs to tail when they appear.
+	patternLock sync.RWMutex            // protects `patterns'
+	dirs        map[string]struct{}     // Directories being tailed recursively.
+	dirsLock    sync.RWMutex            // protects `dirs'
+	filePattern string                  // Base name pattern of files to tail in dirs.
+	lines       chan<- *logline.LogLine // Logfile lines being emitted.
+	files       map[string]afero.File   // File handles for each pathname.
+	filesLock   sync.Mutex              // protects `files'
+	partials    map[string]string       // Accumulator for the currently read line for each pathname.
 
-	fs afero.Fs // mockable filesystem interface
+	encoding     string              // Encoding of the logs; UTF-8 if empty.
+	decoders     map[string]*decoder // Decoder of each log, holding any incomplete character read.
+	decodersLock sync.Mutex          // protects `decoders'
+
+	maxLineLength int    // Length in bytes beyond which lines are truncated.
+	delimiter     []byte // Separator of the lines of the logs.
+
+	format             string                   // Format of the lines of the logs, such as DockerFormat; read as they are if empty.
+	dockerPartials     map[string]dockerPartial // Messages split across the lines of Docker logs, by pathname and stream.
+	dockerPartialsLock sync.Mutex               // protects `dockerPartials'
+
+	readFromStart bool // Read files from the start when first tailed.
+
+	statePath   string            // File the read offsets are saved in, if not empty.
+	offsets     map[string]offset // Offset reached in each log file, by pathname.
+	offsetsLock sync.Mutex        // protects `offsets'
+	flushQuit   chan struct{}     // Closed to stop writing the offsets.
+
+	reopen  chan chan struct{} // Requests to reopen the logs, closed when done.
+	untail  chan untailRequest // Requests to stop tailing paths.
+	runDone chan struct{}      // Closed when the event loop exits.
+
+	pipeReaders sync.WaitGroup // Goroutines reading pipes, which send lines until the pipe is closed.
+
+	fs    afero.Fs    // mockable filesystem interface
+	clock clock.Clock // mockable clock, which times the offset flushes
 }
 
 // Options configures a Tailer
 type Options struct {
-	Lines chan<- string
-	W     watcher.Watcher // Not required, will use watcher.LogWatcher if it is zero.
+	Lines chan<- *logline.LogLine
+	W     watcher.Watcher // Not required, will use watcher.New if it is zero.
 	FS    afero.Fs        // Not required, will use afero.OsFs if it is zero.
+	Clock clock.Clock     // Not required, will use clock.Real if it is zero.
+
+	FilePattern  string        // Not required; only files whose base names match are tailed in directories.
+	PollInterval time.Duration // Not required; if set, files are polled at this interval instead of watched with inotify.
+
+	ReadFromStart bool // Read files from the start when first tailed, instead of only lines appended later.
+
+	StatePath string // Not required; if set, read offsets are saved in this file and resumed from on restart.
+
+	Encoding string // Not required; the encoding of the logs, such as utf-16le, which are decoded to UTF-8.  UTF-8 if empty.
+
+	MaxLineLength int // Not required; DefaultMaxLineLength is used if zero.
+
+	LineDelimiter string // Not required; the separator of the lines of the logs, such as "\x00" or "\r\n".  DefaultLineDelimiter is used if empty.
+
+	Format string // Not required; the format of the lines of the logs, such as DockerFormat, which are unwrapped into the messages they contain.  Lines are read as they are if empty.
 }
 
 // New returns a new Tailer, configured with the supplied Options
@@ -63,25 +121,69 @@ func New(o Options) (*Tailer, error) {
 	if o.Lines == nil {
 		return nil, errors.New("tailer needs lines")
 	}
+	if _, err := newTransformer(o.Encoding); err != nil {
+		return nil, err
+	}
+	if err := checkFormat(o.Format); err != nil {
+		return nil, err
+	}
 	fs := o.FS
 	if fs == nil {
 		fs = &afero.OsFs{}
 	}
+	c := o.Clock
+	if c == nil {
+		c = clock.Real
+	}
 	w := o.W
 	if w == nil {
-		var err error
-		w, err = watcher.NewLogWatcher()
-		if err != nil {
-			return nil, fmt.Errorf("Couldn't create a watcher for tailer: %s", err)
-		}
+		w = watcher.New(fs, c, o.PollInterval)
+	}
+	maxLineLength := o.MaxLineLength
+	if maxLineLength <= 0 {
+		maxLineLength = DefaultMaxLineLength
+	}
+	delimiter := o.LineDelimiter
+	if delimiter == "" {
+		delimiter = DefaultLineDelimiter
 	}
 	t := &Tailer{
 		w:        w,
 		watched:  make(map[string]struct{}),
+		named:    make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		dirs:     make(map[string]struct{}),
 		lines:    o.Lines,
 		files:    make(map[string]afero.File),
-		partials: make(map[string]string),
-		fs:       fs,
+
+		filePattern:   o.FilePattern,
+		readFromStart: o.ReadFromStart,
+		partials:      make(map[string]string),
+		fs:            fs,
+		clock:         c,
+
+		encoding: o.Encoding,
+		decoders: make(map[string]*decoder),
+
+		maxLineLength: maxLineLength,
+		delimiter:     []byte(delimiter),
+
+		format:         o.Format,
+		dockerPartials: make(map[string]dockerPartial),
+
+		statePath: o.StatePath,
+		offsets:   make(map[string]offset),
+		flushQuit: make(chan struct{}),
+
+		reopen:  make(chan chan struct{}),
+		untail:  make(chan untailRequest),
+		runDone: make(chan struct{}),
+	}
+	if t.statePath != "" {
+		if err := t.loadOffsets(); err != nil {
+			return nil, fmt.Errorf("Couldn't load offsets from %q: %s", t.statePath, err)
+		}
+		go t.flushOffsets(offsetFlushInterval)
 	}
 	go t.run()
 	return t, nil
@@ -94,6 +196,13 @@ func (t *Tailer) addWatched(path string) {
 	t.watched[path] = struct{}{}
 }
 
+// removeWatched removes a path from the list of watched items.
+func (t *Tailer) removeWatched(path string) {
+	t.watchedLock.Lock()
+	defer t.watchedLock.Unlock()
+	delete(t.watched, path)
+}
+
 // isWatching indicates if the path is being watched. It includes both
 // filenames and directories.
 func (t *Tailer) isWatching(path string) bool {
@@ -103,24 +212,216 @@ func (t *Tailer) isWatching(path string) bool {
 	return ok
 }
 
-// Tail registers a file path to be tailed.
+// Tail registers a file path to be tailed.  Only lines appended to the file
+// afterwards are read, unless the Tailer was created with ReadFromStart.
+//
+// If the path contains glob metacharacters (as understood by filepath.Match)
+// then every file matching the pattern is tailed.  Every directory that could
+// contain a match is watched, starting from the longest directory prefix
+// without metacharacters, so files created later whose names match are also
+// tailed, from their start, even if the pattern matched nothing at first.
+// Directories created later that match a directory component of the pattern
+// are watched when they appear.  Files matched by a pattern stop being tailed
+// when they are removed.
+//
+// If the path is a directory, it is tailed recursively: see tailDir.
 func (t *Tailer) Tail(pathname string) {
 	fullpath, err := filepath.Abs(pathname)
 	if err != nil {
 		glog.Infof("Failed to find absolute path for %q: %s\n", pathname, err)
 		return
 	}
+	if hasMeta(fullpath) {
+		t.tailPattern(fullpath)
+		return
+	}
+	if fi, err := t.fs.Stat(fullpath); err == nil && fi.IsDir() {
+		t.tailDir(fullpath, t.readFromStart)
+		return
+	}
+	t.watchedLock.Lock()
+	t.named[fullpath] = struct{}{}
+	t.watchedLock.Unlock()
 	if !t.isWatching(fullpath) {
 		t.addWatched(fullpath)
 		logCount.Add(1)
-		t.openLogPath(fullpath, false)
+		t.openLogPath(fullpath, t.readFromStart)
+	}
+}
+
+// tailDir watches the directory d and every directory below it, and tails
+// each file in them whose base name matches the file pattern, seeking to the
+// start of the files if seekStart is set.  Subdirectories created later are
+// tailed the same way, from the start of their files.
+func (t *Tailer) tailDir(d string, seekStart bool) {
+	err := afero.Walk(t.fs, d, func(pathname string, fi os.FileInfo, err error) error {
+		if err != nil {
+			glog.Infof("Failed to walk %q: %s", pathname, err)
+			return nil
+		}
+		if fi.IsDir() {
+			t.dirsLock.Lock()
+			t.dirs[pathname] = struct{}{}
+			t.dirsLock.Unlock()
+			t.watchDir(pathname)
+			return nil
+		}
+		if fi.Mode().IsRegular() && t.matchesFilePattern(pathname) && !t.isWatching(pathname) {
+			t.addWatched(pathname)
+			logCount.Add(1)
+			t.openLogPath(pathname, seekStart)
+		}
+		return nil
+	})
+	if err != nil {
+		glog.Infof("Failed to walk %q: %s", d, err)
+	}
+}
+
+// inTailedDir indicates if the path is directly inside a directory being
+// tailed recursively.
+func (t *Tailer) inTailedDir(pathname string) bool {
+	t.dirsLock.RLock()
+	defer t.dirsLock.RUnlock()
+	_, ok := t.dirs[path.Dir(pathname)]
+	return ok
+}
+
+// matchesFilePattern indicates if the base name of the path matches the file
+// pattern, or if there is no file pattern.
+func (t *Tailer) matchesFilePattern(pathname string) bool {
+	if t.filePattern == "" {
+		return true
+	}
+	ok, _ := filepath.Match(t.filePattern, path.Base(pathname))
+	return ok
+}
+
+// handleTailedDirCreate tails a file or directory created inside a directory
+// being tailed recursively.
+func (t *Tailer) handleTailedDirCreate(pathname string) {
+	fi, err := t.fs.Stat(pathname)
+	if err != nil {
+		glog.Infof("Stat failed on %q: %s", pathname, err)
+		return
+	}
+	if fi.IsDir() {
+		t.tailDir(pathname, true)
+		return
+	}
+	if fi.Mode().IsRegular() && t.matchesFilePattern(pathname) {
+		t.addWatched(pathname)
+		logCount.Add(1)
+		t.openLogPath(pathname, true)
+	}
+}
+
+// tailPattern tails all files matching the glob pattern, and registers the
+// pattern so that matching files are tailed when created.
+func (t *Tailer) tailPattern(pattern string) {
+	t.patternLock.Lock()
+	t.patterns[pattern] = struct{}{}
+	t.patternLock.Unlock()
+	t.watchPatternDirs(pattern)
+	t.tailMatches(pattern, t.readFromStart)
+}
+
+// tailMatches tails each file matching the pattern that isn't already being
+// tailed, seeking to the start of the new files if seekStart is set.
+func (t *Tailer) tailMatches(pattern string, seekStart bool) {
+	matches, err := afero.Glob(t.fs, pattern)
+	if err != nil {
+		glog.Infof("Failed to expand glob pattern %q: %s", pattern, err)
+		return
+	}
+	for _, pathname := range matches {
+		if !t.isWatching(pathname) {
+			t.addWatched(pathname)
+			logCount.Add(1)
+			t.openLogPath(pathname, seekStart)
+		}
 	}
 }
 
+// watchPatternDirs watches the longest directory prefix of the pattern that
+// has no metacharacters, and every existing directory below it that matches
+// the corresponding directory components of the pattern.
+func (t *Tailer) watchPatternDirs(pattern string) {
+	for d := path.Dir(pattern); ; d = path.Dir(d) {
+		if !hasMeta(d) {
+			t.watchDir(d)
+			return
+		}
+		matches, err := afero.Glob(t.fs, d)
+		if err != nil {
+			glog.Infof("Failed to expand glob pattern %q: %s", d, err)
+			continue
+		}
+		for _, m := range matches {
+			if fi, err := t.fs.Stat(m); err == nil && fi.IsDir() {
+				t.watchDir(m)
+			}
+		}
+	}
+}
+
+// matchesPatternDir indicates if the path matches a directory component of
+// any of the registered glob patterns, and so may contain matching files.
+func (t *Tailer) matchesPatternDir(pathname string) bool {
+	t.patternLock.RLock()
+	defer t.patternLock.RUnlock()
+	for pattern := range t.patterns {
+		for d := path.Dir(pattern); hasMeta(d); d = path.Dir(d) {
+			if ok, _ := filepath.Match(d, pathname); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleDirCreate watches a newly created directory that may contain files
+// matching a glob pattern, and tails any matching files already in it.
+func (t *Tailer) handleDirCreate(pathname string) {
+	fi, err := t.fs.Stat(pathname)
+	if err != nil || !fi.IsDir() {
+		return
+	}
+	t.patternLock.RLock()
+	var patterns []string
+	for pattern := range t.patterns {
+		patterns = append(patterns, pattern)
+	}
+	t.patternLock.RUnlock()
+	for _, pattern := range patterns {
+		t.watchPatternDirs(pattern)
+		t.tailMatches(pattern, true)
+	}
+}
+
+// matchesPattern indicates if the path matches any of the registered glob
+// patterns.
+func (t *Tailer) matchesPattern(pathname string) bool {
+	t.patternLock.RLock()
+	defer t.patternLock.RUnlock()
+	for pattern := range t.patterns {
+		if ok, _ := filepath.Match(pattern, pathname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMeta reports whether path contains any of the magic characters recognized
+// by filepath.Match.
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
 // TailFile registers a file descriptor to be tailed.
 func (t *Tailer) TailFile(f afero.File) error {
 	logCount.Add(1)
-	return t.startNewFile(f, false)
+	return t.startNewFile(f, t.readFromStart)
 }
 
 // handleLogUpdate reads all available bytes from an already opened file
@@ -135,36 +436,158 @@ func (t *Tailer) handleLogUpdate(pathname string) {
 	}
 	var err error
 	t.partials[pathname], err = t.read(fd, t.partials[pathname])
+	t.recordOffset(fd)
 	if err != nil && err != io.EOF {
 		glog.Info(err)
 	}
 }
 
 // read reads blocks of 4096 bytes from the File, sending lines to the
-// channel as it encounters newlines.  If EOF is encountered, the partial line
-// is returned to be concatenated with on the next call.
+// channel as it encounters line delimiters.  If EOF is encountered, the
+// partial line is returned to be concatenated with on the next call.  The
+// bytes that may be the start of a delimiter split between blocks are held in
+// the decoder until the next block shows whether they are.
 func (t *Tailer) read(f afero.File, partialIn string) (partialOut string, err error) {
 	partial := partialIn
-	b := make([]byte, 0, 4096)
+	d := t.decoder(f.Name())
+	buf := make([]byte, 4096)
+	var line []byte // Bytes of the line read from the current block.
 	for {
-		n, err := f.Read(b[:cap(b)])
-		b = b[:n]
+		n, err := f.Read(buf)
 		if err != nil {
 			return partial, err
 		}
+		b := d.decode(buf[:n])
 
-		for i, width := 0, 0; i < len(b) && i < n; i += width {
-			var rune rune
-			rune, width = utf8.DecodeRune(b[i:])
-			switch {
-			case rune != '\n':
-				partial += string(rune)
-			default:
-				// send off line for processing
-				t.lines <- partial
-				// reset accumulator
-				partial = ""
+		line = line[:0]
+		for i, c := range b {
+			d.held = append(d.held, c)
+			if bytes.HasPrefix(t.delimiter, d.held) {
+				if len(d.held) == len(t.delimiter) {
+					// send off line for processing
+					t.sendLine(f.Name(), t.appendLine(d, f.Name(), partial, line))
+					// reset accumulator
+					partial, line, d.held = "", line[:0], d.held[:0]
+					d.truncating = false
+					d.sent = d.end(i)
+				}
+				continue
 			}
+			// The held bytes aren't a delimiter, so they're part of the line,
+			// but for any at the end that may yet start one.
+			k := 1
+			for !bytes.HasPrefix(t.delimiter, d.held[k:]) {
+				k++
+			}
+			if !d.truncating {
+				line = append(line, d.held[:k]...)
+			}
+			d.held = append(d.held[:0], d.held[k:]...)
+		}
+		partial = t.appendLine(d, f.Name(), partial, line)
+	}
+}
+
+// appendLine returns the partial line with b added, unless that makes it
+// longer than the maximum line length, in which case it's cut short at a
+// character boundary and the rest of the line is dropped.
+func (t *Tailer) appendLine(d *decoder, pathname, partial string, b []byte) string {
+	if d.truncating || len(b) == 0 {
+		return partial
+	}
+	if room := t.maxLineLength - len(partial); len(b) > room {
+		// Drop the rest of the line rather than buffer it.
+		b = b[:room]
+		b = b[:len(b)-incompleteRune(b)]
+		lineTruncations.Add(pathname, 1)
+		d.truncating = true
+	}
+	return partial + string(b)
+}
+
+// decoder returns the decoder of the log at pathname.
+func (t *Tailer) decoder(pathname string) *decoder {
+	t.decodersLock.Lock()
+	defer t.decodersLock.Unlock()
+	d, ok := t.decoders[pathname]
+	if !ok {
+		d = t.newDecoder()
+		t.decoders[pathname] = d
+	}
+	return d
+}
+
+// resetDecoder discards any incomplete character read from the log at
+// pathname, as when it has been replaced or truncated.
+func (t *Tailer) resetDecoder(pathname string) {
+	t.decodersLock.Lock()
+	defer t.decodersLock.Unlock()
+	t.decoders[pathname] = t.newDecoder()
+}
+
+// sendLine counts a line read from the log file, and sends it for processing.
+func (t *Tailer) sendLine(pathname, line string) {
+	logLines.Add(pathname, 1)
+	if t.format == DockerFormat {
+		t.sendDockerLine(pathname, line)
+		return
+	}
+	t.lines <- logline.New(pathname, line)
+}
+
+// gzipMagic is the header that begins every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// NewReader returns a buffered reader of r.  If r begins with the gzip magic
+// bytes, its contents are transparently decompressed.
+func NewReader(r io.Reader) (*bufio.Reader, error) {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(len(gzipMagic)); err != nil || !bytes.Equal(b, gzipMagic) {
+		return br, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(zr), nil
+}
+
+// isCompressed indicates if the file begins with the gzip magic bytes.
+func isCompressed(f afero.File) bool {
+	b := make([]byte, len(gzipMagic))
+	n, _ := f.ReadAt(b, 0)
+	return n == len(b) && bytes.Equal(b, gzipMagic)
+}
+
+// readCompressed sends every line of the compressed file to the lines channel,
+// and then closes it.  Compressed logs are complete once written, so they are
+// read from the start and not watched for updates.
+func (t *Tailer) readCompressed(f afero.File) error {
+	defer f.Close()
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		logErrors.Add(f.Name(), 1)
+		return fmt.Errorf("Failed to seek in %q: %s", f.Name(), err)
+	}
+	zr, err := NewReader(f)
+	if err != nil {
+		logErrors.Add(f.Name(), 1)
+		return fmt.Errorf("Failed to decompress %q: %s", f.Name(), err)
+	}
+	// The encoding was checked in New.
+	dr, _ := NewDecodingReader(zr, t.encoding)
+	r := bufio.NewReader(dr)
+	glog.Infof("Reading compressed %s", f.Name())
+	for {
+		line, err := ReadLine(r, f.Name(), t.maxLineLength, string(t.delimiter))
+		if line != "" || err == nil {
+			t.sendLine(f.Name(), line)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			logErrors.Add(f.Name(), 1)
+			return fmt.Errorf("Failed to read %q: %s", f.Name(), err)
 		}
 	}
 }
@@ -183,6 +606,16 @@ func inode(f os.FileInfo) uint64 {
 	}
 }
 
+// links returns the number of hard links to a file, or 0 if it isn't known,
+// as for files that aren't on an operating system filesystem.  A file that's
+// open after being deleted has no links.
+func links(f os.FileInfo) uint64 {
+	if s, ok := f.Sys().(*syscall.Stat_t); ok {
+		return uint64(s.Nlink)
+	}
+	return 0
+}
+
 // handleLogCreate handles both new and rotated log files.
 func (t *Tailer) handleLogCreate(pathname string) {
 	t.filesLock.Lock()
@@ -201,9 +634,15 @@ func (t *Tailer) handleLogCreate(pathname string) {
 		}
 		if inode(s1) != inode(s2) {
 			logRotations.Add(pathname, 1)
-			// flush the old log, pathname is still an index into t.files with the old inode.
+			// Read the old log to the end before switching to the new one, as
+			// lines may have been written just before it was moved without
+			// an update being seen.  pathname is still an index into t.files
+			// with the old inode.  Nothing more is appended to the old log's
+			// last line once the new log exists, so it's sent even if it's
+			// unterminated.
 			t.handleLogUpdate(pathname)
-			fd.Close()
+			t.flushPartial(pathname)
+			t.closeLog(pathname, fd)
 			err := t.w.Remove(pathname)
 			if err != nil {
 				glog.Info("Failed removing watches on", pathname)
@@ -221,20 +660,85 @@ func (t *Tailer) handleLogCreate(pathname string) {
 	}
 }
 
-// openLogPath opens a new log file at pathname, and optionally seeks to the
-// start or end of the file. Rotated logs should read from the start, but logs
-// opened for the first time read from the end.
-func (t *Tailer) openLogPath(pathname string, seekStart bool) {
-	d := path.Dir(pathname)
+// handleLogDelete stops tailing a log file that has been removed, reading any
+// remaining lines first.  Files matched by a glob pattern are forgotten, but
+// explicitly named files stay watched so that they are tailed again if
+// recreated.  A log that was moved rather than deleted is still being written
+// to until it's replaced by a new log at the path, so it's kept open.
+func (t *Tailer) handleLogDelete(pathname string) {
+	t.filesLock.Lock()
+	fd, ok := t.files[pathname]
+	t.filesLock.Unlock()
+	if !ok {
+		return
+	}
+	t.handleLogUpdate(pathname)
+	if fi, err := fd.Stat(); err == nil && links(fi) > 0 {
+		glog.V(1).Infof("Log %s moved, tailing it until replaced", pathname)
+		return
+	}
+	t.closeLog(pathname, fd)
+	// The watch on a deleted file is removed by the watcher itself.
+	if t.matchesPattern(pathname) || t.inTailedDir(pathname) {
+		t.removeWatched(pathname)
+		logCount.Add(-1)
+	}
+	glog.Infof("Stopped tailing deleted log %s", pathname)
+}
+
+// flushPartial sends the partial line read from the log at pathname as a
+// line, as when the log has been rotated and the line won't be finished.
+func (t *Tailer) flushPartial(pathname string) {
+	if p := t.partials[pathname]; p != "" {
+		t.sendLine(pathname, p)
+	}
+	delete(t.partials, pathname)
+}
+
+// closeLog closes the log file open at pathname, and forgets its partial line,
+// unfinished Docker messages, decoder and read offset.
+func (t *Tailer) closeLog(pathname string, fd afero.File) {
+	t.filesLock.Lock()
+	delete(t.files, pathname)
+	t.filesLock.Unlock()
+	fd.Close()
+	delete(t.partials, pathname)
+	t.decodersLock.Lock()
+	delete(t.decoders, pathname)
+	t.decodersLock.Unlock()
+	t.forgetDockerPartials(pathname)
+	t.forgetOffset(pathname)
+}
+
+// watchDir adds a watch on the directory d if it is not already watched, so
+// that files created in it are noticed.
+func (t *Tailer) watchDir(d string) {
 	if !t.isWatching(d) {
 		err := t.w.Add(d)
 		if err != nil {
-			glog.Infof("Adding a create watch failed on %q: %s", d, err)
+			watchError(d, err)
 		}
 		t.addWatched(d)
 	}
+}
+
+// watchError logs and counts a failure to add a watch on the path.
+func watchError(pathname string, err error) {
+	watchErrors.Add(1)
+	if err == syscall.ENOSPC {
+		glog.Errorf("Adding a watch failed on %q: the inotify watch limit has been reached; raise fs.inotify.max_user_watches", pathname)
+		return
+	}
+	glog.Infof("Adding a watch failed on %q: %s", pathname, err)
+}
 
-	f, err := t.fs.Open(pathname)
+// openLogPath opens a new log file at pathname, and optionally seeks to the
+// start or end of the file. Rotated logs should read from the start, but logs
+// opened for the first time read from the end.
+func (t *Tailer) openLogPath(pathname string, seekStart bool) {
+	t.watchDir(path.Dir(pathname))
+
+	f, err := t.openLog(pathname)
 	if err != nil {
 		// Doesn't exist yet. We're watching the directory, so we'll pick it up
 		// again on create; return successfully.
@@ -251,6 +755,21 @@ func (t *Tailer) openLogPath(pathname string, seekStart bool) {
 	}
 }
 
+// openLog opens the log file at pathname for reading.  A named pipe is opened
+// for writing too, which doesn't wait for a writer to open it, and keeps it
+// open when writers close it so that reads block until the next writer
+// rather than returning EOF.  mtail must have write permission on the pipe.
+func (t *Tailer) openLog(pathname string) (afero.File, error) {
+	fi, err := t.fs.Stat(pathname)
+	if err != nil {
+		return nil, err
+	}
+	if fi.Mode()&os.ModeNamedPipe != 0 {
+		return t.fs.OpenFile(pathname, os.O_RDWR, 0)
+	}
+	return t.fs.Open(pathname)
+}
+
 func (t *Tailer) startNewFile(f afero.File, seekStart bool) error {
 	fi, err := f.Stat()
 	if err != nil {
@@ -258,20 +777,29 @@ func (t *Tailer) startNewFile(f afero.File, seekStart bool) error {
 		logErrors.Add(f.Name(), 1)
 		return fmt.Errorf("Failed to stat %q: %s", f.Name(), err)
 	}
+	t.resetDecoder(f.Name())
 	switch m := fi.Mode(); {
 	case m&os.ModeType == 0:
-		if seekStart {
-			f.Seek(0, os.SEEK_SET)
-		} else {
-			f.Seek(0, os.SEEK_END)
+		if !t.seekSavedOffset(f, fi) {
+			if seekStart {
+				f.Seek(0, os.SEEK_SET)
+			} else {
+				f.Seek(0, os.SEEK_END)
+			}
 		}
 		err = t.w.Add(f.Name())
 		if err != nil {
+			watchError(f.Name(), err)
 			return fmt.Errorf("Adding a change watch failed on %q: %s", f.Name(), err)
 		}
+		if isCompressed(f) {
+			return t.readCompressed(f)
+		}
+		t.trackOffset(f, fi)
 		// In case the new log has been written to already, attempt to read the
 		// first lines.
 		t.partials[f.Name()], err = t.read(f, "")
+		t.recordOffset(f)
 		if err != nil {
 			if err == io.EOF {
 				// Don't worry about EOF on first read, that's expected.
@@ -280,6 +808,7 @@ func (t *Tailer) startNewFile(f afero.File, seekStart bool) error {
 			return err
 		}
 	case m&os.ModeType == os.ModeNamedPipe:
+		t.pipeReaders.Add(1)
 		go t.readForever(f)
 	default:
 		return fmt.Errorf("Can't open files with mode %v: %s", m&os.ModeType, f.Name())
@@ -294,27 +823,67 @@ func (t *Tailer) startNewFile(f afero.File, seekStart bool) error {
 
 // start is the main event loop for the Tailer.
 // It receives notification of log file changes from the watcher channel, and
-// handles them.
+// handles them.  Requests to reopen the logs are handled in the same loop, so
+// they don't race with the events.
 func (t *Tailer) run() {
-	for e := range t.w.Events() {
-		switch e := e.(type) {
-		case watcher.UpdateEvent:
-			if t.isWatching(e.Pathname) {
-				t.handleLogUpdate(e.Pathname)
-			}
-		case watcher.CreateEvent:
-			if t.isWatching(e.Pathname) {
-				t.handleLogCreate(e.Pathname)
+	defer close(t.runDone)
+	events := t.w.Events()
+	for {
+		select {
+		case done := <-t.reopen:
+			t.reopenLogs()
+			close(done)
+		case r := <-t.untail:
+			t.untailPath(r.pathname)
+			close(r.done)
+		case e, ok := <-events:
+			if !ok {
+				glog.Infof("Shutting down tailer.")
+				// Events for lines written just before shutdown may not have
+				// been delivered, so read to the end of each log.
+				t.readLogs()
+				t.closePipes()
+				close(t.lines)
+				return
 			}
-		default:
-			glog.Infof("Unexpected event %q", e)
+			t.handleEvent(e)
+		}
+	}
+}
+
+// handleEvent handles a notification from the watcher.
+func (t *Tailer) handleEvent(e watcher.Event) {
+	switch e := e.(type) {
+	case watcher.UpdateEvent:
+		if t.isWatching(e.Pathname) {
+			t.handleLogUpdate(e.Pathname)
+		}
+	case watcher.CreateEvent:
+		if t.isWatching(e.Pathname) {
+			t.handleLogCreate(e.Pathname)
+		} else if t.matchesPattern(e.Pathname) {
+			t.addWatched(e.Pathname)
+			logCount.Add(1)
+			t.openLogPath(e.Pathname, true)
+		} else if t.matchesPatternDir(e.Pathname) {
+			t.handleDirCreate(e.Pathname)
+		} else if t.inTailedDir(e.Pathname) {
+			t.handleTailedDirCreate(e.Pathname)
+		}
+	case watcher.DeleteEvent:
+		if t.isWatching(e.Pathname) {
+			t.handleLogDelete(e.Pathname)
 		}
+	default:
+		glog.Infof("Unexpected event %q", e)
 	}
-	glog.Infof("Shutting down tailer.")
-	close(t.lines)
 }
 
+// readForever reads lines from a pipe as they're written, blocking between
+// writes.  It returns at EOF, when the writers of an unnamed pipe have closed
+// it, or when the tailer closes the pipe.
 func (t *Tailer) readForever(f afero.File) {
+	defer t.pipeReaders.Done()
 	var err error
 	partial := ""
 	for {
@@ -327,7 +896,33 @@ func (t *Tailer) readForever(f afero.File) {
 	}
 }
 
-// Close signals termination to the watcher.
+// closePipes closes the pipes being read, and waits for their readers to
+// stop sending lines.  Closing a pipe only interrupts a read blocked on it if
+// the pipe is non-blocking, as os.OpenFile opens named pipes, and as mtail
+// makes the pipes passed to it as file descriptors.
+func (t *Tailer) closePipes() {
+	t.filesLock.Lock()
+	for pathname, fd := range t.files {
+		fi, err := fd.Stat()
+		if err != nil || fi.Mode()&os.ModeNamedPipe == 0 {
+			continue
+		}
+		fd.Close()
+		delete(t.files, pathname)
+	}
+	t.filesLock.Unlock()
+	t.pipeReaders.Wait()
+}
+
+// Close signals termination to the watcher, and waits for the logs to be read
+// to the end before saving the read offsets if there is a state file.
 func (t *Tailer) Close() {
 	t.w.Close()
+	<-t.runDone
+	if t.statePath != "" {
+		close(t.flushQuit)
+		if err := t.writeOffsets(); err != nil {
+			glog.Infof("Failed to write offsets to %q: %s", t.statePath, err)
+		}
+	}
 }
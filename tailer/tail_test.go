@@ -4,23 +4,32 @@
 package tailer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
 	"github.com/google/mtail/watcher"
 	"github.com/kylelemons/godebug/pretty"
 
 	"github.com/spf13/afero"
 )
 
-func makeTestTail(t *testing.T) (*Tailer, chan string, *watcher.FakeWatcher, afero.Fs) {
+func makeTestTail(t *testing.T) (*Tailer, chan *logline.LogLine, *watcher.FakeWatcher, afero.Fs) {
 	fs := afero.NewMemMapFs()
 	w := watcher.NewFakeWatcher()
-	lines := make(chan string, 1)
-	o := Options{lines, w, fs}
+	lines := make(chan *logline.LogLine, 1)
+	o := Options{Lines: lines, W: w, FS: fs}
 	ta, err := New(o)
 	if err != nil {
 		t.Fatal(err)
@@ -60,12 +69,12 @@ func TestHandleLogUpdate(t *testing.T) {
 		t.Fatalf("err: %s", err)
 	}
 
-	result := []string{}
+	result := []*logline.LogLine{}
 	done := make(chan struct{})
 	wg := sync.WaitGroup{}
 	go func() {
 		for line := range lines {
-			glog.Infof("line: %q\n", line)
+			glog.Infof("line: %q\n", line.Line)
 			result = append(result, line)
 			wg.Done()
 		}
@@ -87,7 +96,12 @@ func TestHandleLogUpdate(t *testing.T) {
 	w.Close()
 	<-done
 
-	expected := []string{"a", "b", "c", "d"}
+	expected := []*logline.LogLine{
+		logline.New(logfile, "a"),
+		logline.New(logfile, "b"),
+		logline.New(logfile, "c"),
+		logline.New(logfile, "d"),
+	}
 	diff := pretty.Compare(result, expected)
 	if len(diff) > 0 {
 		t.Errorf("result didn't match:\n%s", diff)
@@ -113,8 +127,8 @@ func TestHandleLogUpdatePartialLine(t *testing.T) {
 	wg.Add(1)
 	go func() {
 		for line := range lines {
-			glog.Infof("line: %q\n", line)
-			result = append(result, line)
+			glog.Infof("line: %q\n", line.Line)
+			result = append(result, line.Line)
 			wg.Done()
 		}
 		close(done)
@@ -189,8 +203,8 @@ func TestReadPartial(t *testing.T) {
 	f.Seek(-1, os.SEEK_END)
 	p, err = ta.read(f, "ohi")
 	l := <-lines
-	if l != "ohi" {
-		t.Errorf("line emitted not ohi: %q", l)
+	if l.Line != "ohi" {
+		t.Errorf("line emitted not ohi: %q", l.Line)
 	}
 	if p != "" {
 		t.Errorf("partial not empty: %q", p)
@@ -200,6 +214,53 @@ func TestReadPartial(t *testing.T) {
 	}
 }
 
+var readDelimiterTests = []struct {
+	name      string
+	delimiter string
+	blocks    []string
+	expected  []string
+}{
+	{"nul", "\x00", []string{"a\x00b\nc\x00", "d\x00"}, []string{"a", "b\nc", "d"}},
+	{"crlf", "\r\n", []string{"a\r\nb\rc\nd\r\n"}, []string{"a", "b\rc\nd"}},
+	{"crlf split", "\r\n", []string{"a\r", "\nb\r", "c\r", "\r", "\n"}, []string{"a", "b\rc\r"}},
+	{"overlapping", "aab", []string{"xaaab", "aa", "aabyaab"}, []string{"xa", "aa", "y"}},
+}
+
+func TestReadDelimiters(t *testing.T) {
+	for _, tc := range readDelimiterTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			w := watcher.NewFakeWatcher()
+			defer w.Close()
+			lines := make(chan *logline.LogLine, len(tc.expected))
+			ta, err := New(Options{Lines: lines, W: w, FS: fs, LineDelimiter: tc.delimiter})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := fs.Create("log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			partial := ""
+			for _, b := range tc.blocks {
+				f.WriteString(b)
+				f.Seek(int64(-len(b)), io.SeekEnd)
+				if partial, err = ta.read(f, partial); err != io.EOF {
+					t.Fatalf("error returned not EOF: %v", err)
+				}
+			}
+			var result []string
+			for len(lines) > 0 {
+				result = append(result, (<-lines).Line)
+			}
+			if diff := pretty.Compare(tc.expected, result); diff != "" {
+				t.Errorf("lines didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestReadPipe(t *testing.T) {
 	ta, lines, wa, _ := makeTestTail(t)
 	defer wa.Close()
@@ -221,7 +282,667 @@ func TestReadPipe(t *testing.T) {
 		t.Fatalf("Didn't write enough bytes: %d", n)
 	}
 	l := <-lines
-	if l != "hi" {
-		t.Errorf("line not expected: %q", l)
+	if l.Line != "hi" {
+		t.Errorf("line not expected: %q", l.Line)
+	}
+}
+
+// TestReadNamedPipe tests that a named pipe is read as it's written, and that
+// reading carries on when its writer closes it and another opens it.
+func TestReadNamedPipe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Skipf("can't make a named pipe: %s", err)
+	}
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: &afero.OsFs{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tailing the pipe doesn't wait for a writer.
+	ta.Tail(fifo)
+
+	for _, line := range []string{"first writer", "second writer"} {
+		f, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(line + "\n")
+		f.Close()
+		if l := <-lines; l.Filename != fifo || l.Line != line {
+			t.Errorf("line not expected: %+v", l)
+		}
+	}
+	// Closing stops the reader blocked on the pipe.
+	ta.Close()
+	if _, ok := <-lines; ok {
+		t.Errorf("lines channel not closed")
+	}
+}
+
+func TestTailPattern(t *testing.T) {
+	ta, lines, w, fs := makeTestTail(t)
+	defer w.Close()
+
+	err := fs.Mkdir("/tail_test", os.ModePerm)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f, err := fs.Create("/tail_test/a.log")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	if _, err := fs.Create("/tail_test/a.txt"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	ta.Tail("/tail_test/*.log")
+	ta.Tail("/tail_test/*/app.log")
+	if !ta.isWatching("/tail_test/a.log") {
+		t.Errorf("matching file not tailed")
+	}
+	if ta.isWatching("/tail_test/a.txt") {
+		t.Errorf("non-matching file tailed")
+	}
+
+	// createLog creates a log containing a line, and injects its creation.
+	// Reading the line back synchronises the test with the tailer's event loop.
+	createLog := func(logfile string) {
+		g, err := fs.Create(logfile)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		defer g.Close()
+		g.WriteString("line\n")
+		w.InjectCreate(logfile)
+		if l := <-lines; l.Line != "line" || l.Filename != logfile {
+			t.Errorf("line not expected: %+v", l)
+		}
+	}
+
+	// A file created after startup that matches is tailed from its start.
+	createLog("/tail_test/b.log")
+	if !ta.isWatching("/tail_test/b.log") {
+		t.Errorf("new matching file not tailed")
+	}
+
+	// Removed files stop being tailed, and are no longer counted.
+	count := logCount.String()
+	fs.Remove("/tail_test/b.log")
+	w.InjectDelete("/tail_test/b.log")
+	createLog("/tail_test/c.log")
+	if ta.isWatching("/tail_test/b.log") {
+		t.Errorf("removed file still tailed")
+	}
+	if logCount.String() != count {
+		t.Errorf("log count changed: was %s, now %s", count, logCount.String())
+	}
+
+	// A pattern with a wildcard directory that matched nothing at startup
+	// picks up a matching file in a directory created later.
+	if err := fs.Mkdir("/tail_test/sub", os.ModePerm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	g, err := fs.Create("/tail_test/sub/app.log")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer g.Close()
+	g.WriteString("line\n")
+	w.InjectCreate("/tail_test/sub")
+	if l := <-lines; l.Line != "line" {
+		t.Errorf("line not expected: %q", l.Line)
+	}
+	if !ta.isWatching("/tail_test/sub/app.log") {
+		t.Errorf("file in new directory not tailed")
+	}
+}
+
+// TestHandleLogRotate tests that lines read after a log is rotated, and the
+// same path refers to a new inode, still carry the log's path.
+func TestHandleLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: &afero.OsFs{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logfile := filepath.Join(dir, "log")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.Tail(logfile)
+	f.WriteString("a\n")
+	w.InjectUpdate(logfile)
+	if l := <-lines; l.Filename != logfile || l.Line != "a" {
+		t.Errorf("line before rotation not expected: %+v", l)
+	}
+	f.Close()
+
+	if err := os.Rename(logfile, logfile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("b\n")
+	w.InjectCreate(logfile)
+	if l := <-lines; l.Filename != logfile || l.Line != "b" {
+		t.Errorf("line after rotation not expected: %+v", l)
+	}
+}
+
+// TestHandleLogRotateDrainsOldLog tests that lines written to a log just
+// before it's rotated, without an update being seen, are read from the old
+// log before the new one, including an unterminated last line.
+func TestHandleLogRotateDrainsOldLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: &afero.OsFs{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logfile := filepath.Join(dir, "log")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.Tail(logfile)
+	f.WriteString("last\nunterminated")
+	f.Close()
+	if err := os.Rename(logfile, logfile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("new\n")
+	w.InjectCreate(logfile)
+	for _, expected := range []string{"last", "unterminated", "new"} {
+		if l := <-lines; l.Filename != logfile || l.Line != expected {
+			t.Errorf("line not expected: got %+v, want %q", l, expected)
+		}
+	}
+	if n := logLines.Get(logfile); n == nil || n.String() != "3" {
+		t.Errorf("lines of %s: got %v, want 3", logfile, n)
+	}
+}
+
+// TestHandleLogRotatePolled tests that a rotation noticed by polling is
+// followed, with the polls driven by a fake clock rather than by sleeping.
+func TestHandleLogRotatePolled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := clock.NewFakeClock(time.Now())
+	w := watcher.NewPollWatcher(&afero.OsFs{}, c, time.Second)
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: &afero.OsFs{}, Clock: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logfile := filepath.Join(dir, "log")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.Tail(logfile)
+	f.WriteString("a\n")
+	f.Close()
+	c.Advance(time.Second)
+	if l := <-lines; l.Filename != logfile || l.Line != "a" {
+		t.Errorf("line before rotation not expected: %+v", l)
+	}
+
+	if err := os.Rename(logfile, logfile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("b\n")
+	c.Advance(time.Second)
+	if l := <-lines; l.Filename != logfile || l.Line != "b" {
+		t.Errorf("line after rotation not expected: %+v", l)
+	}
+}
+
+// TestReopenCopyTruncate tests that reopening notices a log truncated in
+// place, as by logrotate's copytruncate, and reads it from the start.
+func TestReopenCopyTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: &afero.OsFs{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logfile := filepath.Join(dir, "log")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ta.Tail(logfile)
+	f.WriteString("before rotation\n")
+	w.InjectUpdate(logfile)
+	if l := <-lines; l.Line != "before rotation" {
+		t.Errorf("line before rotation not expected: %+v", l)
+	}
+
+	// Copy and truncate the log, and write to it, without any events.
+	b, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(logfile+".1", b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("after\n")
+	ta.Reopen()
+	if l := <-lines; l.Filename != logfile || l.Line != "after" {
+		t.Errorf("line after truncation not expected: %+v", l)
+	}
+	if logTruncations.Get(logfile) == nil {
+		t.Errorf("truncation not counted")
+	}
+}
+
+// TestReopenMovedLog tests that reopening notices a log that has been moved
+// and recreated when the create event was missed.
+func TestReopenMovedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: &afero.OsFs{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logfile := filepath.Join(dir, "log")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.Tail(logfile)
+	f.Close()
+	if err := os.Rename(logfile, logfile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	f, err = os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("new\n")
+	ta.Reopen()
+	if l := <-lines; l.Filename != logfile || l.Line != "new" {
+		t.Errorf("line after rotation not expected: %+v", l)
+	}
+}
+
+func TestDeleteAndRecreateLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: &afero.OsFs{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logfile := filepath.Join(dir, "log")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.Tail(logfile)
+	f.WriteString("before\n")
+	f.Close()
+	w.InjectUpdate(logfile)
+	if l := <-lines; l.Line != "before" {
+		t.Errorf("line not expected: %+v", l)
+	}
+
+	if err := os.Remove(logfile); err != nil {
+		t.Fatal(err)
+	}
+	w.InjectDelete(logfile)
+	// Reopen returns once the tailer has handled the delete.
+	ta.Reopen()
+	ta.filesLock.Lock()
+	_, ok := ta.files[logfile]
+	ta.filesLock.Unlock()
+	if ok {
+		t.Errorf("deleted log still open")
+	}
+
+	f, err = os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.WriteString("after\n")
+	w.InjectCreate(logfile)
+	if l := <-lines; l.Filename != logfile || l.Line != "after" {
+		t.Errorf("line after recreate not expected: %+v", l)
+	}
+	if n := logLines.Get(logfile); n == nil || n.String() != "2" {
+		t.Errorf("lines of %s: got %v, want 2", logfile, n)
+	}
+}
+
+func TestMovedLogKeptOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tail_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: &afero.OsFs{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logfile := filepath.Join(dir, "log")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	ta.Tail(logfile)
+	if err := os.Rename(logfile, logfile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	w.InjectDelete(logfile)
+	// Lines written before the writer reopens the log are still read.
+	f.WriteString("late\n")
+	w.InjectUpdate(logfile)
+	if l := <-lines; l.Filename != logfile || l.Line != "late" {
+		t.Errorf("line written after move not expected: %+v", l)
+	}
+}
+
+func TestTailDir(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(Options{Lines: lines, W: w, FS: fs, FilePattern: "*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.MkdirAll("/tail_test/a", os.ModePerm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, name := range []string{"/tail_test/top.log", "/tail_test/a/nested.log", "/tail_test/a/ignored.txt"} {
+		if _, err := fs.Create(name); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	ta.Tail("/tail_test")
+	for _, name := range []string{"/tail_test", "/tail_test/a", "/tail_test/top.log", "/tail_test/a/nested.log"} {
+		if !ta.isWatching(name) {
+			t.Errorf("%s not watched", name)
+		}
+	}
+	if ta.isWatching("/tail_test/a/ignored.txt") {
+		t.Errorf("file not matching pattern tailed")
+	}
+
+	// A subdirectory created later is watched, and its files tailed from the
+	// start.
+	if err := fs.Mkdir("/tail_test/b", os.ModePerm); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	f, err := fs.Create("/tail_test/b/new.log")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer f.Close()
+	f.WriteString("line\n")
+	w.InjectCreate("/tail_test/b")
+	if l := <-lines; l.Filename != "/tail_test/b/new.log" || l.Line != "line" {
+		t.Errorf("line not expected: %+v", l)
+	}
+
+	// A file created later in a watched directory is tailed.
+	g, err := fs.Create("/tail_test/a/later.log")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer g.Close()
+	g.WriteString("line\n")
+	w.InjectCreate("/tail_test/a/later.log")
+	if l := <-lines; l.Filename != "/tail_test/a/later.log" || l.Line != "line" {
+		t.Errorf("line not expected: %+v", l)
+	}
+}
+
+func TestTailCompressed(t *testing.T) {
+	ta, lines, w, fs := makeTestTail(t)
+	defer w.Close()
+
+	// The long line spans several buffers of the decompressing reader.
+	long := strings.Repeat("x", 10000)
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte("line 1\n" + long + "\nline 3"))
+	zw.Close()
+	logfile := "/tmp/log.1.gz"
+	if err := afero.WriteFile(fs, logfile, b.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result := []*logline.LogLine{}
+	done := make(chan struct{})
+	go func() {
+		for line := range lines {
+			result = append(result, line)
+			if len(result) == 3 {
+				close(done)
+			}
+		}
+	}()
+
+	ta.Tail(logfile)
+	<-done
+	expected := []*logline.LogLine{
+		logline.New(logfile, "line 1"),
+		logline.New(logfile, long),
+		logline.New(logfile, "line 3"),
+	}
+	if diff := pretty.Compare(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if _, ok := ta.files[logfile]; ok {
+		t.Errorf("compressed log in files map: %+#v", ta.files)
+	}
+	if l := logLines.Get(logfile); l == nil || l.String() != "3" {
+		t.Errorf("lines read not counted: %v", l)
+	}
+}
+
+func TestTailReadFromStart(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	defer w.Close()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(Options{Lines: lines, W: w, FS: fs, ReadFromStart: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logfile := "/tmp/log"
+	if err := afero.WriteFile(fs, logfile, []byte("a\nb\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ta.Tail(logfile)
+	expected := []*logline.LogLine{
+		logline.New(logfile, "a"),
+		logline.New(logfile, "b"),
+	}
+	result := []*logline.LogLine{<-lines, <-lines}
+	if diff := pretty.Compare(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestTailResumesFromSavedOffset(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	logfile := "/tmp/log"
+	statefile := "/tmp/state"
+	newTailer := func(readFromStart bool) (*Tailer, chan *logline.LogLine) {
+		lines := make(chan *logline.LogLine, 10)
+		o := Options{Lines: lines, W: watcher.NewFakeWatcher(), FS: fs, ReadFromStart: readFromStart, StatePath: statefile}
+		ta, err := New(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ta, lines
+	}
+	expectLines := func(lines chan *logline.LogLine, expected ...string) {
+		for _, e := range expected {
+			if l := <-lines; l.Line != e {
+				t.Errorf("line not expected: got %q, want %q", l.Line, e)
+			}
+		}
+		select {
+		case l := <-lines:
+			t.Errorf("unexpected line %q", l.Line)
+		default:
+		}
+	}
+
+	if err := afero.WriteFile(fs, logfile, []byte("a\nb\nc"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ta, lines := newTailer(true)
+	ta.Tail(logfile)
+	expectLines(lines, "a", "b")
+	// The offset saved excludes the partial line.
+	ta.Close()
+
+	f, err := fs.OpenFile(logfile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("d\ne\n")
+	f.Close()
+	ta, lines = newTailer(false)
+	ta.Tail(logfile)
+	expectLines(lines, "cd", "e")
+	ta.Close()
+
+	// A saved offset beyond the end of the truncated file resets to the start.
+	if err := afero.WriteFile(fs, logfile, []byte("f\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ta, lines = newTailer(false)
+	ta.Tail(logfile)
+	expectLines(lines, "f")
+	ta.Close()
+}
+
+// TestUntail tests that Untail reads the remaining lines of a log before
+// closing it, and keeps logs that another tailed path still matches.
+func TestUntail(t *testing.T) {
+	ta, lines, w, fs := makeTestTail(t)
+	defer w.Close()
+	if err := fs.Mkdir("/tail_test", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for _, logfile := range []string{"/tail_test/a.log", "/tail_test/b.log"} {
+		if _, err := fs.Create(logfile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ta.Tail("/tail_test/a.log")
+	ta.Tail("/tail_test/b.log")
+	ta.Tail("/tail_test/*.log")
+
+	ta.Untail("/tail_test/a.log")
+	if !ta.isWatching("/tail_test/a.log") {
+		t.Errorf("log matched by a pattern no longer tailed")
+	}
+
+	f, err := fs.OpenFile("/tail_test/a.log", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("last\n")
+	f.Close()
+	ta.Untail("/tail_test/*.log")
+	if l := <-lines; l.Line != "last" {
+		t.Errorf("remaining line not read: %+v", l)
+	}
+	if ta.isWatching("/tail_test/a.log") {
+		t.Errorf("log not named or matched still tailed")
+	}
+	ta.filesLock.Lock()
+	_, ok := ta.files["/tail_test/a.log"]
+	ta.filesLock.Unlock()
+	if ok {
+		t.Errorf("log not named or matched still open")
+	}
+	if !ta.isWatching("/tail_test/b.log") {
+		t.Errorf("named log no longer tailed")
 	}
 }
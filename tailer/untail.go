@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// untailRequest asks the event loop to stop tailing a path, and is closed when
+// it's done.
+type untailRequest struct {
+	pathname string
+	done     chan struct{}
+}
+
+// Untail stops tailing a path given to Tail, reading the lines written to the
+// logs it named before closing them.  If the path is a glob pattern or a
+// directory, the logs it matched are closed, except those still named or
+// matched by another path being tailed.  Untail returns once the logs have
+// been closed.
+func (t *Tailer) Untail(pathname string) {
+	fullpath, err := filepath.Abs(pathname)
+	if err != nil {
+		glog.Infof("Failed to find absolute path for %q: %s\n", pathname, err)
+		return
+	}
+	r := untailRequest{fullpath, make(chan struct{})}
+	select {
+	case t.untail <- r:
+		<-r.done
+	case <-t.runDone:
+	}
+}
+
+// untailPath forgets the path, and closes the logs that no other path being
+// tailed names or matches.
+func (t *Tailer) untailPath(fullpath string) {
+	switch {
+	case hasMeta(fullpath):
+		t.patternLock.Lock()
+		delete(t.patterns, fullpath)
+		t.patternLock.Unlock()
+	case t.isTailedDir(fullpath):
+		t.dirsLock.Lock()
+		for d := range t.dirs {
+			if d == fullpath || strings.HasPrefix(d, fullpath+"/") {
+				delete(t.dirs, d)
+			}
+		}
+		t.dirsLock.Unlock()
+	default:
+		t.watchedLock.Lock()
+		delete(t.named, fullpath)
+		t.watchedLock.Unlock()
+	}
+
+	t.filesLock.Lock()
+	pathnames := []string{fullpath}
+	for pathname := range t.files {
+		if pathname != fullpath {
+			pathnames = append(pathnames, pathname)
+		}
+	}
+	t.filesLock.Unlock()
+	for _, pathname := range pathnames {
+		if t.isWatching(pathname) && !t.isWanted(pathname) {
+			t.stopTailing(pathname)
+		}
+	}
+}
+
+// isTailedDir indicates if the path is a directory being tailed recursively.
+func (t *Tailer) isTailedDir(pathname string) bool {
+	t.dirsLock.RLock()
+	defer t.dirsLock.RUnlock()
+	_, ok := t.dirs[pathname]
+	return ok
+}
+
+// isWanted indicates if the log is named, or matched by a pattern or
+// directory, by a path being tailed.
+func (t *Tailer) isWanted(pathname string) bool {
+	t.watchedLock.RLock()
+	_, ok := t.named[pathname]
+	t.watchedLock.RUnlock()
+	return ok || t.matchesPattern(pathname) || t.inTailedDir(pathname)
+}
+
+// stopTailing reads the remaining lines of the log at pathname if it's open,
+// then closes it and stops watching it.
+func (t *Tailer) stopTailing(pathname string) {
+	t.filesLock.Lock()
+	fd, ok := t.files[pathname]
+	t.filesLock.Unlock()
+	if ok {
+		if fi, err := fd.Stat(); err == nil && fi.Mode().IsRegular() {
+			t.handleLogUpdate(pathname)
+		}
+		t.closeLog(pathname, fd)
+		if err := t.w.Remove(pathname); err != nil {
+			glog.V(1).Infof("Removing the watch on %q failed: %s", pathname, err)
+		}
+	}
+	t.removeWatched(pathname)
+	logCount.Add(-1)
+	glog.Infof("Stopped tailing %s", pathname)
+}
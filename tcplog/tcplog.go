@@ -0,0 +1,273 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package tcplog provides a receiver that reads lines streamed over TCP
+// connections, either accepted from senders or dialled out to a log server,
+// and passes them to the virtual machines like lines read from a log file.
+package tcplog
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/tailer"
+)
+
+var (
+	// lines counts the lines received, by the peer's address.
+	lines = expvar.NewMap("tcp_log_lines_total")
+	// receiveErrors counts the failures to accept, dial and read connections.
+	receiveErrors = expvar.NewMap("tcp_log_errors_total")
+	// connectionsLost counts the times the connection to the dialled address
+	// was closed or failed, and so was dialled again.
+	connectionsLost = expvar.NewInt("tcp_log_connections_lost_total")
+)
+
+const (
+	// DefaultRedialDelay is the wait before connecting to the dialled address
+	// again after the connection is lost or fails.  It doubles after each
+	// failure, up to maxRedialDelay.
+	DefaultRedialDelay = time.Second
+	maxRedialDelay     = time.Minute
+)
+
+// Receiver reads newline-delimited lines from TCP connections.  The origin of
+// each line is the address of the host at the other end of its connection,
+// which getfilename() returns.
+type Receiver struct {
+	lines         chan<- *logline.LogLine
+	maxLineLength int
+	delimiter     string
+	clock         clock.Clock
+
+	l net.Listener // Accepts connections, if listening.
+
+	conns     map[net.Conn]struct{} // Connections being read.
+	connsLock sync.Mutex            // protects `conns'
+
+	quit   chan struct{}      // Closed to stop receiving.
+	cancel context.CancelFunc // Cancels a dial in progress.
+	wg     sync.WaitGroup     // Tracks the goroutines receiving lines.
+}
+
+// Options configures a Receiver.  At least one of ListenAddress and
+// DialAddress must be set.
+type Options struct {
+	Lines         chan<- *logline.LogLine
+	ListenAddress string        // Not required; the host and port to accept connections on, such as ":5140".
+	DialAddress   string        // Not required; the host and port to connect to and read from, connecting again whenever the connection is lost.
+	RedialDelay   time.Duration // Not required; DefaultRedialDelay is used if zero.
+	MaxLineLength int           // Not required; tailer.DefaultMaxLineLength is used if zero.
+	LineDelimiter string        // Not required; tailer.DefaultLineDelimiter is used if empty.
+	Clock         clock.Clock   // Not required, will use clock.Real if zero.
+}
+
+// New creates a Receiver listening on or dialling the addresses in the
+// Options, and starts sending the lines it reads into the lines channel.
+func New(o Options) (*Receiver, error) {
+	if o.Lines == nil {
+		return nil, fmt.Errorf("tcp log receiver needs a lines channel")
+	}
+	if o.ListenAddress == "" && o.DialAddress == "" {
+		return nil, fmt.Errorf("tcp log receiver needs an address to listen on or dial")
+	}
+	maxLineLength := o.MaxLineLength
+	if maxLineLength <= 0 {
+		maxLineLength = tailer.DefaultMaxLineLength
+	}
+	c := o.Clock
+	if c == nil {
+		c = clock.Real
+	}
+	redialDelay := o.RedialDelay
+	if redialDelay <= 0 {
+		redialDelay = DefaultRedialDelay
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Receiver{
+		lines:         o.Lines,
+		maxLineLength: maxLineLength,
+		delimiter:     o.LineDelimiter,
+		clock:         c,
+		conns:         make(map[net.Conn]struct{}),
+		quit:          make(chan struct{}),
+		cancel:        cancel}
+	if o.ListenAddress != "" {
+		var err error
+		if r.l, err = net.Listen("tcp", o.ListenAddress); err != nil {
+			cancel()
+			return nil, err
+		}
+		glog.Infof("Receiving logs on tcp %s", r.l.Addr())
+		r.wg.Add(1)
+		go r.accept()
+	}
+	if o.DialAddress != "" {
+		glog.Infof("Receiving logs from tcp %s", o.DialAddress)
+		r.wg.Add(1)
+		go r.dial(ctx, o.DialAddress, redialDelay)
+	}
+	return r, nil
+}
+
+// Addr returns the address the Receiver accepts connections on, or nil if it
+// isn't listening.
+func (r *Receiver) Addr() net.Addr {
+	if r.l == nil {
+		return nil
+	}
+	return r.l.Addr()
+}
+
+// accept reads lines from each connection accepted until the receiver is
+// closed.
+func (r *Receiver) accept() {
+	defer r.wg.Done()
+	for {
+		c, err := r.l.Accept()
+		if err != nil {
+			select {
+			case <-r.quit:
+			default:
+				glog.Infof("Failed to accept log connection: %s", err)
+				receiveErrors.Add("accept", 1)
+			}
+			return
+		}
+		if !r.track(c) {
+			c.Close()
+			return
+		}
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.readConn(c)
+		}()
+	}
+}
+
+// dial connects to addr and reads lines from it, connecting again after a
+// delay whenever the connection fails or is closed by the other end, until
+// the receiver is closed.  The delay doubles after each failure to connect.
+func (r *Receiver) dial(ctx context.Context, addr string, redialDelay time.Duration) {
+	defer r.wg.Done()
+	var d net.Dialer
+	delay := redialDelay
+	for {
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			select {
+			case <-r.quit:
+				return
+			default:
+			}
+			glog.Infof("Failed to connect to log server %s, trying again in %s: %s", addr, delay, err)
+			receiveErrors.Add("dial", 1)
+		} else if r.track(c) {
+			delay = redialDelay
+			r.readConn(c)
+			select {
+			case <-r.quit:
+				return
+			default:
+			}
+			connectionsLost.Add(1)
+		} else {
+			c.Close()
+			return
+		}
+		select {
+		case <-r.clock.After(delay):
+		case <-r.quit:
+			return
+		}
+		if err != nil {
+			delay *= 2
+			if delay > maxRedialDelay {
+				delay = maxRedialDelay
+			}
+		}
+	}
+}
+
+// track adds c to the connections closed by Close, returning false if the
+// receiver is closing.
+func (r *Receiver) track(c net.Conn) bool {
+	r.connsLock.Lock()
+	defer r.connsLock.Unlock()
+	select {
+	case <-r.quit:
+		// Close has already closed the connections it knows about.
+		return false
+	default:
+	}
+	r.conns[c] = struct{}{}
+	return true
+}
+
+// readConn sends the lines read from c until it's closed, then stops
+// tracking it.
+func (r *Receiver) readConn(c net.Conn) {
+	defer func() {
+		r.connsLock.Lock()
+		delete(r.conns, c)
+		r.connsLock.Unlock()
+		c.Close()
+	}()
+	origin := c.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(origin); err == nil {
+		origin = h
+	}
+	br := bufio.NewReader(c)
+	for {
+		line, err := tailer.ReadLine(br, origin, r.maxLineLength, r.delimiter)
+		// A final line without a delimiter is sent too, as the sender has
+		// finished it by closing the connection.
+		if line != "" || err == nil {
+			lines.Add(origin, 1)
+			select {
+			case r.lines <- logline.New(origin, line):
+			case <-r.quit:
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				select {
+				case <-r.quit:
+				default:
+					glog.Infof("Failed to read log line from %s: %s", c.RemoteAddr(), err)
+					receiveErrors.Add("read", 1)
+				}
+			}
+			return
+		}
+	}
+}
+
+// Close stops receiving lines, and waits for any being sent to the lines
+// channel to finish.  The lines channel isn't closed.
+func (r *Receiver) Close() error {
+	close(r.quit)
+	r.cancel()
+	if r.l != nil {
+		r.l.Close()
+	}
+	r.connsLock.Lock()
+	for c := range r.conns {
+		c.Close()
+	}
+	r.connsLock.Unlock()
+	r.wg.Wait()
+	return nil
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tcplog
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
+)
+
+// expectLine reads a line from the lines channel and compares it to expected.
+func expectLine(t *testing.T, lines <-chan *logline.LogLine, expected string) {
+	select {
+	case l := <-lines:
+		if l.Line != expected {
+			t.Errorf("got line %q, want %q", l.Line, expected)
+		}
+		if l.Filename != "127.0.0.1" {
+			t.Errorf("got origin %q, want the peer's address", l.Filename)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for %q", expected)
+	}
+}
+
+func TestListen(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	r, err := New(Options{Lines: lines, ListenAddress: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Lines are read from each connection while the others are open.
+	c1, err := net.Dial("tcp", r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := net.Dial("tcp", r.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(c1, "first 1\n")
+	expectLine(t, lines, "first 1")
+	fmt.Fprint(c2, "second 1\nsecond 2\n")
+	expectLine(t, lines, "second 1")
+	expectLine(t, lines, "second 2")
+	fmt.Fprint(c1, "first 2\n")
+	expectLine(t, lines, "first 2")
+
+	// A last line without a newline is sent when the connection closes.
+	fmt.Fprint(c2, "second 3")
+	c2.Close()
+	expectLine(t, lines, "second 3")
+}
+
+func TestDialReconnects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan *logline.LogLine)
+	c := clock.NewFakeClock(time.Now())
+	r, err := New(Options{Lines: lines, DialAddress: l.Addr().String(), Clock: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(s, "before\n")
+	expectLine(t, lines, "before")
+	lost := connectionsLost.Value()
+	s.Close()
+
+	// The receiver waits a redial delay before connecting again.
+	c.BlockUntil(1)
+	if got := connectionsLost.Value() - lost; got != 1 {
+		t.Errorf("connections lost: got %d, want 1", got)
+	}
+	c.Advance(DefaultRedialDelay)
+	s, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	fmt.Fprint(s, "after\n")
+	expectLine(t, lines, "after")
+}
+
+func TestNeedsAddress(t *testing.T) {
+	if _, err := New(Options{Lines: make(chan *logline.LogLine)}); err == nil {
+		t.Errorf("receiver created without an address")
+	}
+}
@@ -13,7 +13,7 @@ import (
 	"github.com/google/mtail/metrics"
 )
 
-var var_re = regexp.MustCompile(`^(counter|gauge|timer) ([^ ]+)(?: {([^}]+)})?(?: (\d+))?(?: (.+))?`)
+var var_re = regexp.MustCompile(`^(hidden )?(counter|gauge|timer) ([^ ]+)(?: {([^}]+)})?(?: (\d+))?(?: (.+))?`)
 
 // Find a metric in a store
 func FindMetricOrNil(store *metrics.Store, name string) *metrics.Metric {
@@ -38,8 +38,8 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 			continue
 		}
 		var keys, vals []string
-		if match[3] != "" {
-			for _, pair := range strings.Split(match[3], ",") {
+		if match[4] != "" {
+			for _, pair := range strings.Split(match[4], ",") {
 				glog.V(2).Infof("pair: %s\n", pair)
 				kv := strings.Split(pair, "=")
 				keys = append(keys, kv[0])
@@ -48,10 +48,10 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 				}
 			}
 		}
-		m := FindMetricOrNil(store, match[2])
+		m := FindMetricOrNil(store, match[3])
 		if m == nil {
 			var kind metrics.Kind
-			switch match[1] {
+			switch match[2] {
 			case "counter":
 				kind = metrics.Counter
 			case "gauge":
@@ -59,23 +59,24 @@ func ReadTestData(file io.Reader, programfile string, store *metrics.Store) {
 			case "timer":
 				kind = metrics.Timer
 			}
-			m = metrics.NewMetric(match[2], prog, kind, keys...)
+			m = metrics.NewMetric(match[3], prog, kind, keys...)
+			m.Hidden = match[1] != ""
 			glog.V(2).Infof("making a new %v\n", m)
 			store.Add(m)
 		} else {
 			glog.V(2).Infof("found %v\n", m)
 		}
 		if len(keys) == len(vals) {
-			if match[4] != "" {
-				val, err := strconv.ParseInt(match[4], 10, 64)
+			if match[5] != "" {
+				val, err := strconv.ParseInt(match[5], 10, 64)
 				if err != nil {
-					glog.Fatalf("parse failed for '%s': %s", match[4], err)
+					glog.Fatalf("parse failed for '%s': %s", match[5], err)
 				}
 
 				var timestamp time.Time
-				glog.V(2).Infof("match 5: %q\n", match[5])
-				if match[5] != "" {
-					timestamp, _ = time.Parse(time.RFC3339, match[5])
+				glog.V(2).Infof("match 6: %q\n", match[6])
+				if match[6] != "" {
+					timestamp, _ = time.Parse(time.RFC3339, match[6])
 				}
 				glog.V(2).Infof("timestamp is %s which is %v in unix\n", timestamp.Format(time.RFC3339), timestamp.Unix())
 
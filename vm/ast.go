@@ -5,6 +5,7 @@ package vm
 
 import (
 	"regexp"
+	"time"
 
 	"github.com/google/mtail/metrics"
 )
@@ -24,12 +25,22 @@ type exprlistNode struct {
 type condNode struct {
 	cond     node
 	children []node
+	elseNode node // Run when the condition doesn't match; may be nil.
 }
 
 type regexNode struct {
 	pattern string
-	addr    int
-	re      *regexp.Regexp
+	addr    int            // Index in the program's regex table, or -1 until compiled.
+	re      *regexp.Regexp // Compiled by the parser.
+	parts   []patternPart  // Where the parts of the pattern start in the source, for warnings.
+}
+
+// patternPart records where a part of a pattern, which is concatenated from
+// regex literals and constants, starts in the source.
+type patternPart struct {
+	offset  int      // Offset of the part in the pattern.
+	pos     position // Position of the part's first character, if it's a literal.
+	literal bool     // The part is a regex literal rather than a constant.
 }
 
 type stringNode struct {
@@ -70,6 +81,20 @@ type declNode struct {
 	keys         []string
 	kind         metrics.Kind
 	exportedName string
+	buckets      []int64
+	bucketsPos   position // Position of the buckets keyword, for errors.
+	quantiles    []float64
+	quantilesPos position // Position of the quantiles keyword, for errors.
+	labelSets    [][]string
+	labelSetsPos position // Position of the initial label sets, for errors.
+	ttl          time.Duration
+	reset        time.Duration // Interval at the end of which the label sets are zeroed, if non-zero.
+	help         string        // Description of the metric for the exporters, if not empty.
+	updated      bool          // Export the time each label set was last updated.
+	limit        int64         // Maximum number of label sets, or unlimited if zero.
+	evictLRU     bool          // At the limit, evict the least recently used label set.
+	hidden       bool          // Not exported, only used by the program.
+	pos          position      // Position of the name, for warnings.
 	m            *metrics.Metric
 	sym          *symbol
 }
@@ -84,6 +109,7 @@ type defNode struct {
 	name     string
 	children []node
 	sym      *symbol
+	caprefs  []*symbol // Capture groups visible to the decorated block.
 }
 
 type decoNode struct {
@@ -94,3 +120,34 @@ type decoNode struct {
 
 type nextNode struct {
 }
+
+// delNode removes the datum of a metric named by the keys of its indexed
+// expression, or all of its data if it isn't indexed.
+type delNode struct {
+	n node
+}
+
+// recordNode sets the pattern that matches the first line of each record, for
+// programs whose log records span many lines.
+type recordNode struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// namespaceNode sets the prefix of the exported names of the program's
+// metrics.
+type namespaceNode struct {
+	name string
+}
+
+// logsNode restricts the program to the lines of the logs whose path matches
+// the pattern.
+type logsNode struct {
+	pattern string
+}
+
+// sampleNode sets the number of events each line of the program's logs
+// stands for, which is what increments count by default.
+type sampleNode struct {
+	rate int64
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseIP parses an IPv4 or IPv6 address, returning IPv4 addresses in their
+// 4 byte form so that prefix lengths count the bits of the IPv4 address.
+func parseIP(s string) (net.IP, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, nil
+	}
+	return ip, nil
+}
+
+// networkOf returns the network of the address ip with the prefix length
+// given as "/24" or "24", in CIDR notation such as "10.1.2.0/24".
+func networkOf(ip, prefix string) (string, error) {
+	addr, err := parseIP(ip)
+	if err != nil {
+		return "", err
+	}
+	ones, err := strconv.Atoi(strings.TrimPrefix(prefix, "/"))
+	if err != nil || ones < 0 || ones > len(addr)*8 {
+		return "", fmt.Errorf("invalid prefix length %q for %s", prefix, ip)
+	}
+	n := net.IPNet{IP: addr, Mask: net.CIDRMask(ones, len(addr)*8)}
+	n.IP = addr.Mask(n.Mask)
+	return n.String(), nil
+}
+
+// inCIDR reports whether the address ip is in the network given in CIDR
+// notation.  An address is never in a network of the other family.
+func inCIDR(ip, network string) (bool, error) {
+	addr, err := parseIP(ip)
+	if err != nil {
+		return false, err
+	}
+	_, n, err := net.ParseCIDR(network)
+	if err != nil {
+		return false, fmt.Errorf("invalid network %q", network)
+	}
+	if len(addr) != len(n.IP) {
+		return false, nil
+	}
+	return n.Contains(addr), nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+)
+
+var networkOfTests = []struct {
+	ip, prefix string
+	expected   string
+	err        bool
+}{
+	{"10.1.2.3", "/24", "10.1.2.0/24", false},
+	{"10.1.2.3", "16", "10.1.0.0/16", false},
+	{"10.1.2.3", "/32", "10.1.2.3/32", false},
+	{"::ffff:10.1.2.3", "/8", "10.0.0.0/8", false},
+	{"2001:db8:abcd:12::1", "/64", "2001:db8:abcd:12::/64", false},
+	{"2001:db8::1", "/24", "2001:d00::/24", false},
+	{"10.1.2.3", "/33", "", true},
+	{"2001:db8::1", "/129", "", true},
+	{"10.1.2.3", "/x", "", true},
+	{"not an ip", "/24", "", true},
+	{"", "/24", "", true},
+}
+
+func TestNetworkOf(t *testing.T) {
+	for _, tc := range networkOfTests {
+		r, err := networkOf(tc.ip, tc.prefix)
+		if tc.err != (err != nil) {
+			t.Errorf("networkOf(%q, %q): unexpected error state %v", tc.ip, tc.prefix, err)
+		}
+		if r != tc.expected {
+			t.Errorf("networkOf(%q, %q): got %q, want %q", tc.ip, tc.prefix, r, tc.expected)
+		}
+	}
+}
+
+var inCIDRTests = []struct {
+	ip, network string
+	expected    bool
+	err         bool
+}{
+	{"10.1.2.3", "10.0.0.0/8", true, false},
+	{"11.1.2.3", "10.0.0.0/8", false, false},
+	{"::ffff:10.1.2.3", "10.0.0.0/8", true, false},
+	{"2001:db8::1", "2001:db8::/32", true, false},
+	{"2001:db9::1", "2001:db8::/32", false, false},
+	// Addresses are never in a network of the other family.
+	{"10.1.2.3", "::/0", false, false},
+	{"2001:db8::1", "0.0.0.0/0", false, false},
+	{"10.1.2.300", "10.0.0.0/8", false, true},
+	{"10.1.2.3", "10.0.0.0", false, true},
+}
+
+func TestInCIDR(t *testing.T) {
+	for _, tc := range inCIDRTests {
+		r, err := inCIDR(tc.ip, tc.network)
+		if tc.err != (err != nil) {
+			t.Errorf("inCIDR(%q, %q): unexpected error state %v", tc.ip, tc.network, err)
+		}
+		if r != tc.expected {
+			t.Errorf("inCIDR(%q, %q): got %v, want %v", tc.ip, tc.network, r, tc.expected)
+		}
+	}
+}
+
+// TestInvalidIPCounted tests that an invalid address is counted, and doesn't
+// end the program for the line.
+func TestInvalidIPCounted(t *testing.T) {
+	for _, op := range []opcode{cidr, incidr} {
+		v := New("invalidip", nil, nil, nil, []instr{instr{op, 2}}, true)
+		v.t = new(thread)
+		v.t.stack = []interface{}{"bogus", "/24"}
+		v.t.match = true
+		v.execute(v.t, instr{op, 2})
+		if v.terminate {
+			t.Errorf("%s: program terminated", opNames[op])
+		}
+		if op == cidr && (len(v.t.stack) != 1 || v.t.stack[0] != "") {
+			t.Errorf("%s: expected empty network, got %v", opNames[op], v.t.stack)
+		}
+		if op == incidr && v.t.match {
+			t.Errorf("%s: invalid address matched", opNames[op])
+		}
+	}
+	if IPErrors.Get("invalidip").String() != "2" {
+		t.Errorf("expected 2 errors, got %s", IPErrors.Get("invalidip"))
+	}
+}
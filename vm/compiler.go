@@ -2,19 +2,30 @@
 // This file is available under the Apache license.
 
 // Build the parser:
-//go:generate go tool yacc -v y.output -o parser.go -p mtail parser.y
+//go:generate goyacc -v y.output -o parser.go -p mtail parser.y
 
 package vm
 
 import (
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 
 	"github.com/google/mtail/metrics"
 )
 
+// validNamespace matches the namespaces that can prefix metric names in every
+// exporter.
+var validNamespace = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validName matches the metric and key names allowed by the
+// strict_metric_names flag, which are exported unchanged to Prometheus.  A
+// name can't start with two underscores, as Prometheus reserves those.
+var validName = regexp.MustCompile(`^(?:[a-zA-Z]|_[a-zA-Z0-9])[a-zA-Z0-9_]*$`)
+
 type compiler struct {
 	name string // Name of the program.
 
@@ -26,30 +37,72 @@ type compiler struct {
 
 	decos []*decoNode // Decorator stack to unwind
 
-	symtab *scope
+	recordStart *regexp.Regexp // Pattern matching the first line of each record, if records span lines.
+	namespace   string         // Prefix of the exported names of the program's metrics, if not empty.
+	logs        []string       // Patterns of the log paths whose lines the program reads, or all logs if empty.
+	sampleRate  int64          // Events each line stands for, counted by increments without an amount; 1 if zero.
+
+	symtab  *scope
+	regexes []*regexp.Regexp // References to the shared regex cache, released when the VM stops.
+
+	warnings   ErrorList                   // Compile warnings, which don't stop the program loading.
+	patterns   []*regexNode                // The patterns compiled, in order.
+	usedGroups map[*regexNode]map[int]bool // Capture groups referred to, by pattern and group number.
+	decls      []*declNode                 // The metrics declared, in order.
+	written    map[*metrics.Metric]bool    // Metrics written by the program.
 }
 
 // Compile compiles a program from the input into a virtual machine or a list
 // of compile errors.  It takes the program's name and the metric store as
 // additional arguments to build the virtual machine.
 func Compile(name string, input io.Reader, ms *metrics.Store, compileOnly bool, syslogUseCurrentYear bool) (*VM, error) {
+	v, _, err := compileProgram(name, input, ms, compileOnly, syslogUseCurrentYear, false)
+	return v, err
+}
+
+// compileProgram compiles a program like Compile, and also returns the
+// warnings about likely mistakes in it, such as capture groups that are never
+// used.  If warningsAsErrors is set, any warnings are returned as the errors
+// too, and no virtual machine is built.
+func compileProgram(name string, input io.Reader, ms *metrics.Store, compileOnly, syslogUseCurrentYear, warningsAsErrors bool) (*VM, ErrorList, error) {
 	name = filepath.Base(name)
 	p := newParser(name, input, ms)
 	r := mtailParse(p)
 	if r != 0 || p == nil || p.errors != nil {
-		return nil, p.errors
+		regexes.release(p.regexes)
+		return nil, nil, p.errors
 	}
-	c := &compiler{name: name, symtab: p.s}
+	c := &compiler{name: name, symtab: p.s, regexes: p.regexes,
+		usedGroups: make(map[*regexNode]map[int]bool),
+		written:    make(map[*metrics.Metric]bool)}
 	c.compile(p.root)
 	if len(c.errors) > 0 {
-		return nil, c.errors
+		regexes.release(c.regexes)
+		return nil, nil, c.errors
+	}
+	c.checkUnused()
+	if warningsAsErrors && len(c.warnings) > 0 {
+		regexes.release(c.regexes)
+		return nil, c.warnings, c.warnings
 	}
 	if compileOnly {
-		return nil, nil
+		regexes.release(c.regexes)
+		return nil, c.warnings, nil
+	}
+	if c.namespace != "" {
+		for _, m := range ms.Metrics {
+			if m.Program == name {
+				m.Namespace = c.namespace
+			}
+		}
 	}
 
 	vm := New(name, c.re, c.str, c.m, c.prog, syslogUseCurrentYear)
-	return vm, nil
+	vm.recordStart = c.recordStart
+	vm.logs = c.logs
+	vm.sampleRate = c.sampleRate
+	vm.regexes = c.regexes
+	return vm, c.warnings, nil
 }
 
 func (c *compiler) errorf(format string, args ...interface{}) {
@@ -57,10 +110,235 @@ func (c *compiler) errorf(format string, args ...interface{}) {
 	c.errors.Add(position{filename: c.name}, e)
 }
 
+func (c *compiler) warnf(pos position, format string, args ...interface{}) {
+	c.warnings.Add(pos, fmt.Sprintf(format, args...))
+}
+
+// checkUnused warns about the capture groups of the compiled patterns that
+// are never referred to, and the declared metrics that are never written,
+// which are likely mistakes in the program.
+func (c *compiler) checkUnused() {
+	for _, n := range c.patterns {
+		names := n.re.SubexpNames()
+		offsets := groupOffsets(n.pattern)
+		for i := 1; i < len(names); i++ {
+			if c.usedGroups[n][i] {
+				continue
+			}
+			group := fmt.Sprintf("$%d", i)
+			if names[i] != "" {
+				group = "$" + names[i]
+			}
+			pos := n.parts[0].pos
+			if len(offsets) == len(names) {
+				pos = n.groupPos(offsets[i])
+			}
+			c.warnf(pos, "Capture group %s of /%s/ is never used.", group, n.pattern)
+		}
+	}
+	for _, d := range c.decls {
+		if !c.written[d.m] {
+			c.warnf(d.pos, "Metric %s is declared but never written.", d.name)
+		}
+	}
+}
+
+// groupOffsets returns the offsets in pattern of the parentheses opening its
+// capture groups, by group number.  The parentheses of other groups, and
+// those that are escaped or in a character class, are skipped.
+func groupOffsets(pattern string) []int {
+	offsets := []int{0}
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], `\Q`):
+			end := strings.Index(pattern[i:], `\E`)
+			if end < 0 {
+				return offsets
+			}
+			i += end + 1
+		case pattern[i] == '\\':
+			i++
+		case inClass && strings.HasPrefix(pattern[i:], "[:"):
+			if end := strings.Index(pattern[i:], ":]"); end > 0 {
+				i += end + 1
+			}
+		case inClass:
+			inClass = pattern[i] != ']'
+		case pattern[i] == '[':
+			inClass = true
+			// A ] first in the class is a literal.
+			if strings.HasPrefix(pattern[i+1:], "^") {
+				i++
+			}
+			if strings.HasPrefix(pattern[i+1:], "]") {
+				i++
+			}
+		case pattern[i] == '(':
+			if !strings.HasPrefix(pattern[i:], "(?") || strings.HasPrefix(pattern[i:], "(?P<") || strings.HasPrefix(pattern[i:], "(?<") {
+				offsets = append(offsets, i)
+			}
+		}
+	}
+	return offsets
+}
+
+// groupPos returns the position in the source of the character at offset in
+// the pattern.  A character in a constant is placed at the start of the
+// pattern.
+func (n *regexNode) groupPos(offset int) position {
+	part := n.parts[0]
+	for _, p := range n.parts[1:] {
+		if p.offset > offset {
+			break
+		}
+		part = p
+	}
+	if !part.literal {
+		return n.parts[0].pos
+	}
+	pos := part.pos
+	// Each slash in a regex literal was escaped in the source.
+	pos.startcol += offset - part.offset + strings.Count(n.pattern[part.offset:offset], "/")
+	pos.endcol = pos.startcol
+	return pos
+}
+
+// markWritten records that the metric referred to by the node, if any, is
+// written by the program.
+func (c *compiler) markWritten(n node) {
+	if m := boundMetric(n); m != nil {
+		c.written[m] = true
+	}
+}
+
 func (c *compiler) emit(i instr) {
 	c.prog = append(c.prog, i)
 }
 
+// returnsFields reports whether the builtin returns fields, which can only be
+// used by indexing them.
+func returnsFields(name string) bool {
+	return name == "split" || name == "logfmt"
+}
+
+// checkFormat reports whether a call to format has a format string, and that
+// a constant format string is valid and matches the number of arguments.  A
+// format string computed at runtime is checked when it's used.
+func (c *compiler) checkFormat(n *builtinNode) bool {
+	if n.args == nil {
+		c.errorf("format needs a format string.")
+		return false
+	}
+	args := n.args.(*exprlistNode).children
+	s, ok := args[0].(*stringNode)
+	if !ok {
+		return true
+	}
+	verbs, err := formatVerbs(s.text)
+	if err != nil {
+		c.errorf("Invalid format: %s.", err)
+		return false
+	}
+	if verbs != len(args)-1 {
+		c.errorf("Format string %q needs %d arguments, but %d were given.", s.text, verbs, len(args)-1)
+		return false
+	}
+	return true
+}
+
+// compileGetenv compiles a call to getenv into the value of the environment
+// variable when the program is loaded, as if it were a string literal, so that
+// the same program can be loaded on many hosts with per-host constants.  The
+// variable's name and default must be constant strings, and a variable that
+// isn't set is an error unless a default is given.
+func (c *compiler) compileGetenv(n *builtinNode) {
+	var args []node
+	if n.args != nil {
+		args = n.args.(*exprlistNode).children
+	}
+	if len(args) < 1 || len(args) > 2 {
+		c.errorf("getenv needs the name of an environment variable, and optionally a default.")
+		return
+	}
+	var s []string
+	for _, arg := range args {
+		a, ok := arg.(*stringNode)
+		if !ok {
+			c.errorf("The arguments given to getenv must be constant strings.")
+			return
+		}
+		s = append(s, a.text)
+	}
+	v, ok := os.LookupEnv(s[0])
+	if !ok {
+		if len(s) < 2 {
+			c.errorf("Environment variable %s is not set; use getenv(%q, \"default\") to give a default.", s[0], s[0])
+			return
+		}
+		v = s[1]
+	}
+	c.compile(&stringNode{v})
+}
+
+// compileSubst compiles a call to subst, whose pattern must be a constant
+// string so that it's compiled once when the program is loaded rather than for
+// each line.  It reports whether the arguments were valid.
+func (c *compiler) compileSubst(n *builtinNode) bool {
+	if n.args == nil || len(n.args.(*exprlistNode).children) != 3 {
+		c.errorf("subst needs a string, a pattern and a replacement.")
+		return false
+	}
+	args := n.args.(*exprlistNode).children
+	s, ok := args[1].(*stringNode)
+	if !ok {
+		c.errorf("The pattern given to subst must be a constant string.")
+		return false
+	}
+	re, err := regexes.compile(s.text)
+	if err != nil {
+		c.errorf("Invalid pattern %q given to subst: %s", s.text, regexError(err))
+		return false
+	}
+	c.regexes = append(c.regexes, re)
+	c.re = append(c.re, re)
+	c.compile(args[0])
+	c.compile(args[2])
+	c.emit(instr{subst, len(c.re) - 1})
+	return true
+}
+
+// compileMatchBuiltin compiles a builtin that sets the match register, and
+// the jump that skips the condition's block if it doesn't match.  It reports
+// whether the builtin's arguments were valid.
+func (c *compiler) compileMatchBuiltin(n *builtinNode) bool {
+	if n.args == nil || len(n.args.(*exprlistNode).children) != 2 {
+		c.errorf("%s needs an address and a network.", n.name)
+		return false
+	}
+	c.compile(n.args)
+	c.emit(instr{builtin[n.name], 2})
+	c.emit(instr{op: jnm})
+	return true
+}
+
+// isCondition reports whether the node emits the conditional jump that a
+// condNode needs, which only regular expressions, comparisons and in_cidr do.
+func isCondition(n node) bool {
+	switch n := n.(type) {
+	case *regexNode:
+		return true
+	case *builtinNode:
+		return n.name == "in_cidr"
+	case *binaryExprNode:
+		switch n.op {
+		case LT, GT, LE, GE, EQ, NE:
+			return true
+		}
+	}
+	return false
+}
+
 func (c *compiler) compile(untypedNode node) {
 	switch n := untypedNode.(type) {
 	case *stmtlistNode:
@@ -77,10 +355,23 @@ func (c *compiler) compile(untypedNode node) {
 		// Build the list of addressable metrics for this program, and set the symbol's address.
 		n.sym.addr = len(c.m)
 		c.m = append(c.m, n.sym.binding.(*metrics.Metric))
+		c.decls = append(c.decls, n)
 
 	case *condNode:
 		if n.cond != nil {
-			c.compile(n.cond)
+			if !isCondition(n.cond) {
+				c.errorf("Conditions must be a regular expression, a comparison or in_cidr.")
+				return
+			}
+			if b, ok := n.cond.(*builtinNode); ok {
+				// in_cidr sets the match register rather than returning a
+				// value, so it's only compiled as a condition.
+				if !c.compileMatchBuiltin(b) {
+					return
+				}
+			} else {
+				c.compile(n.cond)
+			}
 		}
 		// Save PC of previous jump instruction
 		// (see regexNode and relNode cases, which will emit a jump)
@@ -88,20 +379,25 @@ func (c *compiler) compile(untypedNode node) {
 		for _, child := range n.children {
 			c.compile(child)
 		}
-		// Rewrite jump target to jump to instruction after block.
+		if n.elseNode == nil {
+			// Rewrite jump target to jump to instruction after block.
+			c.prog[pc].opnd = len(c.prog)
+			break
+		}
+		// Skip the else block after running the block, and rewrite the
+		// condition's jump target to the start of the else block.
+		c.emit(instr{op: jmp})
+		elsePc := len(c.prog) - 1
 		c.prog[pc].opnd = len(c.prog)
+		c.compile(n.elseNode)
+		c.prog[elsePc].opnd = len(c.prog)
 
 	case *regexNode:
-		if n.re == nil {
-			re, err := regexp.Compile(n.pattern)
-			if err != nil {
-				c.errorf("%s", err)
-				return
-			}
-			c.re = append(c.re, re)
-			n.re = re
+		if n.addr < 0 {
+			c.re = append(c.re, n.re)
 			// Store the location of this regular expression in the regexNode
 			n.addr = len(c.re) - 1
+			c.patterns = append(c.patterns, n)
 		}
 		c.emit(instr{match, n.addr})
 		c.emit(instr{op: jnm})
@@ -136,16 +432,35 @@ func (c *compiler) compile(untypedNode node) {
 			c.emit(instr{op: mul})
 		case '/':
 			c.emit(instr{op: div})
+		case MOD:
+			c.emit(instr{op: mod})
 		case AND:
 			c.emit(instr{op: and})
 		case OR:
 			c.emit(instr{op: or})
 		case XOR:
 			c.emit(instr{op: xor})
+		case COALESCE:
+			c.emit(instr{op: coalesce})
 		case ASSIGN:
-			c.emit(instr{op: set})
+			c.markWritten(n.lhs)
+			if m := boundMetric(n.lhs); m != nil && (m.Kind == metrics.Histogram || m.Kind == metrics.Summary) {
+				c.emit(instr{op: observe})
+			} else {
+				c.emit(instr{op: set})
+			}
 		case ADD_ASSIGN:
-			c.emit(instr{inc, 1})
+			c.markWritten(n.lhs)
+			m := boundMetric(n.lhs)
+			switch {
+			case m == nil:
+				c.emit(instr{inc, 1})
+			case m.Kind == metrics.Histogram || m.Kind == metrics.Summary:
+				c.errorf("Can't add to %s %s; assign observations to it with =.", strings.ToLower(m.Kind.String()), m.Name)
+			default:
+				// The kind lets the VM reject negative increments of counters.
+				c.emit(instr{inc, m.Kind})
+			}
 		case SHL:
 			c.emit(instr{op: shl})
 		case SHR:
@@ -158,12 +473,29 @@ func (c *compiler) compile(untypedNode node) {
 		c.compile(n.lhs)
 		switch n.op {
 		case INC:
+			c.markWritten(n.lhs)
+			if m := boundMetric(n.lhs); m != nil && (m.Kind == metrics.Histogram || m.Kind == metrics.Summary) {
+				c.errorf("Can't increment %s %s; assign observations to it with =.", strings.ToLower(m.Kind.String()), m.Name)
+			}
 			c.emit(instr{op: inc})
 		case NOT:
 			c.emit(instr{op: not})
 		}
 
 	case *indexedExprNode:
+		if b, ok := n.lhs.(*builtinNode); ok {
+			// Indexing the fields returned by split or logfmt, rather than a
+			// metric.
+			if !returnsFields(b.name) {
+				c.errorf("Can't index the result of %s.", b.name)
+				return
+			}
+			c.compile(b.args)
+			c.emit(instr{builtin[b.name], len(b.args.(*exprlistNode).children)})
+			c.compile(n.index)
+			c.emit(instr{op: index})
+			break
+		}
 		c.compile(n.index)
 		c.compile(n.lhs)
 
@@ -185,12 +517,48 @@ func (c *compiler) compile(untypedNode node) {
 
 	case *caprefNode:
 		rn := n.sym.binding.(*regexNode)
+		if c.usedGroups[rn] == nil {
+			c.usedGroups[rn] = make(map[int]bool)
+		}
+		c.usedGroups[rn][n.sym.addr] = true
 		// rn.addr contains the index of the regular expression object,
 		// which correlates to storage on the re heap
 		c.emit(instr{push, rn.addr})
 		c.emit(instr{capref, n.sym.addr})
 
 	case *builtinNode:
+		if returnsFields(n.name) {
+			c.errorf("The fields returned by %s must be indexed, e.g. split($1, \",\")[0] or logfmt($1)[\"key\"].", n.name)
+			return
+		}
+		if n.name == "timestamp" && n.args != nil {
+			// timestamp(t) sets the time of the observations made by the
+			// rest of the program, rather than returning it.
+			c.compile(n.args)
+			c.emit(instr{settime, len(n.args.(*exprlistNode).children)})
+			break
+		}
+		if n.name == "format" {
+			if !c.checkFormat(n) {
+				return
+			}
+		}
+		if n.name == "in_cidr" {
+			c.errorf("in_cidr can only be used as a condition.")
+			return
+		}
+		if n.name == "subst" {
+			c.compileSubst(n)
+			break
+		}
+		if n.name == "getenv" {
+			c.compileGetenv(n)
+			break
+		}
+		if n.name == "gettime" && n.args != nil {
+			c.errorf("gettime takes no arguments; it parses the timestamp at the start of the line.")
+			return
+		}
 		if n.args != nil {
 			c.compile(n.args)
 			c.emit(instr{builtin[n.name], len(n.args.(*exprlistNode).children)})
@@ -211,14 +579,97 @@ func (c *compiler) compile(untypedNode node) {
 		// Pop the block off
 		c.decos = c.decos[:len(c.decos)-1]
 
+	case *recordNode:
+		if c.recordStart != nil {
+			c.errorf("Only one record start pattern can be set in a program.")
+			return
+		}
+		c.recordStart = n.re
+
+	case *namespaceNode:
+		if c.namespace != "" {
+			c.errorf("Only one namespace can be set in a program.")
+			return
+		}
+		if !validNamespace.MatchString(n.name) {
+			c.errorf("Invalid namespace %q: a namespace must be a letter or underscore followed by letters, digits and underscores.", n.name)
+			return
+		}
+		c.namespace = n.name
+
+	case *sampleNode:
+		if c.sampleRate != 0 {
+			c.errorf("Only one sample rate can be set in a program.")
+			return
+		}
+		c.sampleRate = n.rate
+
+	case *logsNode:
+		if _, err := filepath.Match(n.pattern, ""); err != nil {
+			c.errorf("Invalid log pattern %q: %s", n.pattern, err)
+			return
+		}
+		c.logs = append(c.logs, n.pattern)
+
+	case *delNode:
+		// Push the keys as for loading a datum, from the outermost index in.
+		keys := 0
+		lhs := n.n
+		for {
+			ix, ok := lhs.(*indexedExprNode)
+			if !ok {
+				break
+			}
+			c.compile(ix.index)
+			keys++
+			lhs = ix.lhs
+		}
+		id, ok := lhs.(*idNode)
+		if !ok {
+			c.errorf("Only metrics can be deleted.")
+			return
+		}
+		m, ok := id.sym.binding.(*metrics.Metric)
+		if !ok {
+			c.errorf("Only metrics can be deleted, not %s.", id.name)
+			return
+		}
+		if keys != 0 && keys != len(m.Keys) {
+			c.errorf("Metric %s has %d keys, but del was given %d.", m.Name, len(m.Keys), keys)
+			return
+		}
+		c.emit(instr{mload, id.sym.addr})
+		c.emit(instr{del, keys})
+
 	case *nextNode:
-		// Visit the 'next' block on the decorated block stack
+		if len(c.decos) == 0 {
+			c.errorf("next used outside of a decorator")
+			return
+		}
+		// Visit the 'next' block on the decorated block stack.  It's popped
+		// while compiling, as the block belongs to the enclosing decorator.
 		deco := c.decos[len(c.decos)-1]
+		c.decos = c.decos[:len(c.decos)-1]
 		for _, child := range deco.children {
 			c.compile(child)
 		}
+		c.decos = append(c.decos, deco)
 
 	default:
 		c.errorf("undefined node type %T (%q)6", untypedNode, untypedNode)
 	}
 }
+
+// boundMetric returns the metric referred to by the node, or nil if the node
+// does not refer to a metric.
+func boundMetric(n node) *metrics.Metric {
+	switch n := n.(type) {
+	case *idNode:
+		if m, ok := n.sym.binding.(*metrics.Metric); ok {
+			return m
+		}
+	case *indexedExprNode:
+		return boundMetric(n.lhs)
+	}
+	return nil
+}
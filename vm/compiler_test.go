@@ -39,6 +39,64 @@ var programs = []struct {
 			instr{mload, 0},
 			instr{dload, 0},
 			instr{inc, nil}}},
+	{"else",
+		"counter yes\ncounter no\n" +
+			"/a/ { yes++\n} else { no++\n}\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 6},
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{inc, nil},
+			instr{jmp, 9},
+			instr{mload, 1},
+			instr{dload, 0},
+			instr{inc, nil}}},
+	{"nested else",
+		"counter a\ncounter b\ncounter c\n" +
+			"/x/ {\n" +
+			"  /y/ { a++\n  } else { b++\n  }\n" +
+			"} else { c++\n}\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 12},
+			instr{match, 1},
+			instr{jnm, 8},
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{inc, nil},
+			instr{jmp, 11},
+			instr{mload, 1},
+			instr{dload, 0},
+			instr{inc, nil},
+			instr{jmp, 15},
+			instr{mload, 2},
+			instr{dload, 0},
+			instr{inc, nil}}},
+	{"getfilename as key",
+		"counter lines by filename\n" +
+			"/$/ { lines[getfilename()]++\n}\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 6},
+			instr{getfilename, nil},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"default for empty capref",
+		"counter paths by path\n" +
+			"/^GET(?: (\\S+))?$/ {\n" +
+			"  paths[$1 or \"-\"]++\n}\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 9},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{str, 0},
+			instr{coalesce, nil},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
 	{"strptime and capref",
 		"counter foo\n" +
 			"/(.*)/ { strptime($1, \"2006-01-02T15:04:05\")\n" +
@@ -47,12 +105,39 @@ var programs = []struct {
 			instr{match, 0},
 			instr{jnm, 9},
 			instr{push, 0},
-			instr{capref, 0},
+			instr{capref, 1},
 			instr{str, 0},
 			instr{strptime, 2},
 			instr{mload, 0},
 			instr{dload, 0},
 			instr{inc, nil}}},
+	{"named and numbered caprefs",
+		"counter responses by code\n" +
+			"/(\\w+) (?P<code>\\d{3})/ { responses[$code]++\n responses[$1]++\n}\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 12},
+			instr{push, 0},
+			instr{capref, 2},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"whole match capref",
+		"counter lines by line\n" +
+			"/\\w+ \\d+/ { lines[$0]++\n}\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 7},
+			instr{push, 0},
+			instr{capref, 0},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
 	{"strptime and named capref",
 		"counter foo\n" +
 			"/(?P<date>.*)/ { strptime($date, \"2006-01-02T15:04:05\")\n" +
@@ -67,6 +152,30 @@ var programs = []struct {
 			instr{mload, 0},
 			instr{dload, 0},
 			instr{inc, nil}}},
+	{"tolower as key",
+		"counter http_requests by method\n" +
+			"/(?P<method>\\w+)/ { http_requests[tolower($method)]++\n}\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 8},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{tolower, 1},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"int conversion",
+		"counter bytes_total\n" +
+			"/(?P<size>\\d+)/ { bytes_total += int($size)\n}\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 8},
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{toint, 1},
+			instr{inc, metrics.Counter}}},
 	{"inc by and set",
 		"counter foo\ncounter bar\n" +
 			"/(.*)/ {\n" +
@@ -79,12 +188,12 @@ var programs = []struct {
 			instr{mload, 0},
 			instr{dload, 0},
 			instr{push, 0},
-			instr{capref, 0},
-			instr{inc, 1},
+			instr{capref, 1},
+			instr{inc, metrics.Counter},
 			instr{mload, 1},
 			instr{dload, 0},
 			instr{push, 0},
-			instr{capref, 0},
+			instr{capref, 1},
 			instr{set, nil}}},
 	{"cond expr gt",
 		"counter foo\n" +
@@ -175,7 +284,7 @@ var programs = []struct {
 			instr{match, 0},
 			instr{jnm, 10},
 			instr{push, 0},
-			instr{capref, 0},
+			instr{capref, 1},
 			instr{push, 1},
 			instr{cmp, 1},
 			instr{jm, 10},
@@ -202,6 +311,52 @@ var programs = []struct {
 			instr{mload, 1},
 			instr{dload, 0},
 			instr{inc, nil}}},
+	{"deco capref",
+		"counter foo by a\n" +
+			"def foo {\n" +
+			"  /(?P<a>.*)/ {\n" +
+			"    next\n" +
+			"  }\n" +
+			"}\n" +
+			"@foo { foo[$a]++\n }\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 7},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"nested deco",
+		"counter foo by a\n" +
+			"def outer {\n" +
+			"  /(?P<a>a)/ {\n" +
+			"    next\n" +
+			"  }\n" +
+			"}\n" +
+			"def inner {\n" +
+			"  @outer {\n" +
+			"    /(?P<b>b)/ {\n" +
+			"      next\n" +
+			"    }\n" +
+			"  }\n" +
+			"}\n" +
+			"@inner { foo[$a]++\n foo[$b]++\n }\n",
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 14},
+			instr{match, 1},
+			instr{jnm, 14},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil},
+			instr{push, 1},
+			instr{capref, 1},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
 	{"length",
 		"len(\"foo\") > 0 {\n" +
 			"}\n",
@@ -242,6 +397,38 @@ a ** b
 			instr{mload, 1},
 			instr{dload, 0},
 			instr{pow, nil}}},
+	{"mod", `
+counter a
+counter b
+a % b
+`,
+		[]instr{
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{mload, 1},
+			instr{dload, 0},
+			instr{mod, nil}}},
+	{"cond arithmetic on capref", `
+counter slow
+/(?P<latency>\d+)/ {
+  $latency * 2 > 1000 {
+    slow++
+  }
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 12},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{push, int64(2)},
+			instr{mul, nil},
+			instr{push, int64(1000)},
+			instr{cmp, 1},
+			instr{jnm, 12},
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{inc, nil}}},
 	{"indexed expr", `
 counter a by b
 a["string"]++
@@ -258,6 +445,184 @@ strtol("deadbeef", 16)
 			instr{str, 0},
 			instr{push, 16},
 			instr{strtol, 2}}},
+	{"substr and strlen", `
+counter paths by prefix
+/(.*)/ {
+  strlen($1) > 3 {
+    paths[substr($1, 0, 4)]++
+  }
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 16},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{strlen, 1},
+			instr{push, 3},
+			instr{cmp, 1},
+			instr{jnm, 16},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{push, 0},
+			instr{push, 4},
+			instr{substr, 3},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"subst", `
+counter paths by path
+/(.*)/ {
+  paths[subst($1, "/(\d+)/", "/:id/")]++
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 9},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{str, 0},
+			instr{subst, 1},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"split index", `
+counter hosts by host
+/(.*)/ {
+  hosts[split($1, " ")[0]]++
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 11},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{str, 0},
+			instr{split, 2},
+			instr{push, 0},
+			instr{index, nil},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"logfmt index", `
+counter requests by user
+/(.*)/ {
+  requests[logfmt($1)["user"]]++
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 10},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{logfmt, 1},
+			instr{str, 0},
+			instr{index, nil},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"getjson", `
+counter latency_total
+/(.*)/ {
+  latency_total += getjson($1, "request.latency")
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 9},
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{str, 0},
+			instr{getjson, 2},
+			instr{inc, metrics.Counter}}},
+	{"del", `
+counter foo by a, b
+counter bar by a
+/(.*) (.*)/ {
+  del foo[$1][$2]
+  del bar
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 10},
+			instr{push, 0},
+			instr{capref, 2},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{mload, 0},
+			instr{del, 2},
+			instr{mload, 1},
+			instr{del, 0}}},
+	{"timestamp set", `
+counter foo
+/(\d+)/ {
+  timestamp($1)
+  foo++
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 8},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{settime, 1},
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{inc, nil}}},
+	{"histogram observe", `
+histogram a buckets 1, 10
+/(\d+)/ {
+  a = $1
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 7},
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{observe, nil}}},
+	{"format", `
+counter paths by path
+/(\w+) (\w+)/ {
+  paths[format("%s/%s", $1, $2)]++
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 11},
+			instr{str, 0},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{push, 0},
+			instr{capref, 2},
+			instr{sprintf, 3},
+			instr{mload, 0},
+			instr{dload, 1},
+			instr{inc, nil}}},
+	{"in_cidr", `
+counter internal
+/(\S+)/ {
+  in_cidr($1, "10.0.0.0/8") {
+    internal++
+  }
+}
+`,
+		[]instr{
+			instr{match, 0},
+			instr{jnm, 10},
+			instr{push, 0},
+			instr{capref, 1},
+			instr{str, 0},
+			instr{incidr, 2},
+			instr{jnm, 10},
+			instr{mload, 0},
+			instr{dload, 0},
+			instr{inc, nil}}},
 	{"float", `
 20.0
 `,
@@ -279,3 +644,149 @@ func TestCompile(t *testing.T) {
 		}
 	}
 }
+
+var invalidCompilePrograms = []struct {
+	name   string
+	source string
+	errors []string
+}{
+	{"histogram increment",
+		"histogram foo\n/$/ { foo++\n }\n",
+		[]string{"histogram increment:1:1: Can't increment histogram foo; assign observations to it with =."}},
+	{"histogram add assign",
+		"histogram foo\n/(\\d+)/ { foo += $1\n }\n",
+		[]string{"histogram add assign:1:1: Can't add to histogram foo; assign observations to it with =."}},
+	{"summary add assign",
+		"summary foo\n/(\\d+)/ { foo += $1\n }\n",
+		[]string{"summary add assign:1:1: Can't add to summary foo; assign observations to it with =."}},
+	{"next outside decorator",
+		"/$/ { next\n }\n",
+		[]string{"next outside decorator:1:1: next used outside of a decorator"}},
+	{"split not indexed",
+		"gauge foo\n/(.*)/ { foo = split($1, \",\")\n }\n",
+		[]string{"split not indexed:1:1: The fields returned by split must be indexed, e.g. split($1, \",\")[0] or logfmt($1)[\"key\"]."}},
+	{"del wrong keys",
+		"counter foo by a, b\n/(.*)/ { del foo[$1]\n }\n",
+		[]string{"del wrong keys:1:1: Metric foo has 2 keys, but del was given 1."}},
+	{"del not metric",
+		"/(.*)/ { del $1\n }\n",
+		[]string{"del not metric:1:1: Only metrics can be deleted."}},
+	{"index builtin",
+		"counter foo by a\n/(.*)/ { foo[tolower($1)[0]]++\n }\n",
+		[]string{"index builtin:1:1: Can't index the result of tolower."}},
+	{"record twice",
+		"record /^a/\nrecord /^b/\n",
+		[]string{"record twice:1:1: Only one record start pattern can be set in a program."}},
+	{"namespace twice",
+		"namespace \"a\"\nnamespace \"b\"\n",
+		[]string{"namespace twice:1:1: Only one namespace can be set in a program."}},
+	{"invalid namespace",
+		"namespace \"team-a\"\n",
+		[]string{"invalid namespace:1:1: Invalid namespace \"team-a\": a namespace must be a letter or underscore followed by letters, digits and underscores."}},
+	{"sample twice",
+		"sample 10\nsample 100\n",
+		[]string{"sample twice:1:1: Only one sample rate can be set in a program."}},
+	{"invalid logs",
+		"logs \"/var/log/[a\"\n",
+		[]string{"invalid logs:1:1: Invalid log pattern \"/var/log/[a\": syntax error in pattern"}},
+	{"arithmetic cond",
+		"counter foo\n/(\\d+)/ { $1 + 1 {\n foo++\n }\n }\n",
+		[]string{"arithmetic cond:1:1: Conditions must be a regular expression, a comparison or in_cidr."}},
+	{"in_cidr value",
+		"counter foo by a\n/(.*)/ {\n foo[in_cidr($1, \"10.0.0.0/8\")]++\n}\n",
+		[]string{"in_cidr value:1:1: in_cidr can only be used as a condition."}},
+	{"subst arguments",
+		"counter foo by a\n/(.*)/ {\n  foo[subst($1, \"x\")]++\n}\n",
+		[]string{"subst arguments:1:1: subst needs a string, a pattern and a replacement."}},
+	{"gettime arguments",
+		"gauge foo\n/(.*)/ {\n  foo = gettime($1)\n}\n",
+		[]string{"gettime arguments:1:1: gettime takes no arguments; it parses the timestamp at the start of the line."}},
+	{"subst pattern not constant",
+		"counter foo by a\n/(.*)/ {\n  foo[subst($1, $1, \"x\")]++\n}\n",
+		[]string{"subst pattern not constant:1:1: The pattern given to subst must be a constant string."}},
+	{"subst invalid pattern",
+		"counter foo by a\n/(.*)/ {\n  foo[subst($1, \"(\", \"x\")]++\n}\n",
+		[]string{"subst invalid pattern:1:1: Invalid pattern \"(\" given to subst: error parsing regexp: missing closing ): `(`"}},
+	{"getenv unset",
+		"counter foo by a\n/(.*)/ {\n  foo[getenv(\"MTAIL_TEST_UNSET\")]++\n}\n",
+		[]string{"getenv unset:1:1: Environment variable MTAIL_TEST_UNSET is not set; use getenv(\"MTAIL_TEST_UNSET\", \"default\") to give a default."}},
+	{"getenv not constant",
+		"counter foo by a\n/(.*)/ {\n  foo[getenv($1)]++\n}\n",
+		[]string{"getenv not constant:1:1: The arguments given to getenv must be constant strings."}},
+	{"getenv arguments",
+		"counter foo by a\n/(.*)/ {\n  foo[getenv()]++\n}\n",
+		[]string{"getenv arguments:1:1: getenv needs the name of an environment variable, and optionally a default."}},
+	{"in_cidr arguments",
+		"counter foo\n/(.*)/ {\n  in_cidr($1) {\n    foo++\n  }\n}\n",
+		[]string{"in_cidr arguments:1:1: in_cidr needs an address and a network."}},
+	{"format argument count",
+		"counter foo by a\n/(.*)/ {\n foo[format(\"%s-%d\", $1)]++\n}\n",
+		[]string{"format argument count:1:1: Format string \"%s-%d\" needs 2 arguments, but 1 were given."}},
+	{"format bad verb",
+		"counter foo by a\n/(.*)/ {\n foo[format(\"%x\", $1)]++\n}\n",
+		[]string{"format bad verb:1:1: Invalid format: format string \"%x\" has unsupported verb %x, only %s and %d are supported."}},
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, tc := range invalidCompilePrograms {
+		_, err := Compile(tc.name, strings.NewReader(tc.source), metrics.NewStore(), false, true)
+		if err == nil {
+			t.Errorf("%s: expected compile errors", tc.name)
+			continue
+		}
+		diff := pretty.Compare(
+			strings.Join(tc.errors, "\n"),        // want
+			strings.TrimRight(err.Error(), "\n")) // got
+		if len(diff) > 0 {
+			t.Errorf("%s: incorrect errors\n%s", tc.name, diff)
+		}
+	}
+}
+
+var compileWarningsTests = []struct {
+	name     string
+	prog     string
+	warnings []string
+}{
+	{"all used",
+		"counter foo by code\n/(?P<code>\\d+) (\\d+)/ {\n  foo[$code] += $2\n}\n",
+		nil},
+	{"unused group",
+		"counter foo\n/(\\w+) (\\d+)/ {\n  foo += $2\n}\n",
+		[]string{"unused group:2:2: Capture group $1 of /(\\w+) (\\d+)/ is never used."}},
+	{"unused named group",
+		"counter foo\n/(?P<method>\\w+) (?P<bytes>\\d+)/ {\n  foo += $2\n}\n",
+		[]string{"unused named group:2:2: Capture group $method of /(?P<method>\\w+) (?P<bytes>\\d+)/ is never used."}},
+	{"unused group after escaped slash",
+		"counter foo\n/\\/(x) (\\d+)/ {\n  foo += $2\n}\n",
+		[]string{"unused group after escaped slash:2:4: Capture group $1 of //(x) (\\d+)/ is never used."}},
+	{"unused group in concatenated pattern",
+		"counter foo\n/(\\d+) / +\n  /[(]([a-z]+)/ {\n  foo += $1\n}\n",
+		[]string{"unused group in concatenated pattern:3:7: Capture group $2 of /(\\d+) [(]([a-z]+)/ is never used."}},
+	{"group used in nested block",
+		"counter foo\n/(\\d+)/ {\n  /x/ {\n    foo += $1\n  }\n}\n",
+		nil},
+	{"metric never written",
+		"counter foo\ncounter bar\n/$/ {\n  foo++\n}\n",
+		[]string{"metric never written:2:9-11: Metric bar is declared but never written."}},
+	{"metric only read",
+		"counter foo\ngauge bar\n/$/ {\n  bar > 1 {\n    foo++\n  }\n}\n",
+		[]string{"metric only read:2:7-9: Metric bar is declared but never written."}},
+}
+
+func TestCompileWarnings(t *testing.T) {
+	for _, tc := range compileWarningsTests {
+		_, warnings, err := compileProgram(tc.name, strings.NewReader(tc.prog), metrics.NewStore(), true, true, false)
+		if err != nil {
+			t.Errorf("%s: compile errors: %s", tc.name, err)
+			continue
+		}
+		var got []string
+		for _, w := range warnings {
+			got = append(got, w.Error())
+		}
+		if diff := pretty.Compare(tc.warnings, got); diff != "" {
+			t.Errorf("%s: incorrect warnings\n%s", tc.name, diff)
+		}
+	}
+}
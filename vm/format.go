@@ -0,0 +1,93 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+
+	"github.com/google/mtail/metrics"
+)
+
+// formatVerbs returns the number of arguments that the format string f
+// consumes.  Only the %s and %d verbs are supported, and %% writes a percent
+// sign.
+func formatVerbs(f string) (int, error) {
+	n := 0
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			continue
+		}
+		i++
+		if i >= len(f) {
+			return 0, fmt.Errorf("format string %q ends with an incomplete verb", f)
+		}
+		switch f[i] {
+		case 's', 'd':
+			n++
+		case '%':
+		default:
+			return 0, fmt.Errorf("format string %q has unsupported verb %%%c, only %%s and %%d are supported", f, f[i])
+		}
+	}
+	return n, nil
+}
+
+// formatString formats the arguments according to the format string f, like
+// a fmt.Sprintf restricted to %s and %d.  %s formats any argument, with
+// numbers and metric values written in decimal.  %d requires an argument
+// that converts to an integer.
+func formatString(f string, args []interface{}) (string, error) {
+	n, err := formatVerbs(f)
+	if err != nil {
+		return "", err
+	}
+	if n != len(args) {
+		return "", fmt.Errorf("format string %q needs %d arguments, got %d", f, n, len(args))
+	}
+	var b bytes.Buffer
+	a := 0
+	for i := 0; i < len(f); i++ {
+		if f[i] != '%' {
+			b.WriteByte(f[i])
+			continue
+		}
+		i++
+		switch f[i] {
+		case 's':
+			b.WriteString(toString(args[a]))
+			a++
+		case 'd':
+			d, err := toInt(args[a])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(strconv.FormatInt(d, 10))
+			a++
+		case '%':
+			b.WriteByte('%')
+		}
+	}
+	return b.String(), nil
+}
+
+// toString formats a value from the stack as a string.  Numbers and metric
+// values are formatted in decimal.
+func toString(val interface{}) string {
+	switch n := val.(type) {
+	case string:
+		return n
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case int:
+		return strconv.Itoa(n)
+	case float64:
+		return strconv.FormatFloat(n, 'g', -1, 64)
+	case *metrics.Datum:
+		return strconv.FormatInt(n.Get(), 10)
+	default:
+		return fmt.Sprintf("%v", n)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/google/mtail/metrics"
+)
+
+var formatTests = []struct {
+	format   string
+	args     []interface{}
+	expected string
+	err      bool
+}{
+	{"%s/%s", []interface{}{"GET", "index.html"}, "GET/index.html", false},
+	{"%s=%d", []interface{}{"code", "200"}, "code=200", false},
+	{"%d%%", []interface{}{int64(50)}, "50%", false},
+	{"%s", []interface{}{1.5}, "1.5", false},
+	{"total %d", []interface{}{&metrics.Datum{Value: 37}}, "total 37", false},
+	{"no verbs", nil, "no verbs", false},
+	{"%d", []interface{}{"abc"}, "", true},
+	{"%s %s", []interface{}{"a"}, "", true},
+	{"%s", []interface{}{"a", "b"}, "", true},
+	{"%v", []interface{}{"a"}, "", true},
+	{"trailing %", nil, "", true},
+}
+
+func TestFormatString(t *testing.T) {
+	for _, tc := range formatTests {
+		r, err := formatString(tc.format, tc.args)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q %v: expected error, got %q", tc.format, tc.args, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %v: unexpected error %s", tc.format, tc.args, err)
+		}
+		if r != tc.expected {
+			t.Errorf("%q %v: got %q, want %q", tc.format, tc.args, r, tc.expected)
+		}
+	}
+}
+
+// TestFormatRuntimeError tests that a format string computed at runtime that
+// doesn't match its arguments is counted and ends the program for the line.
+func TestFormatRuntimeError(t *testing.T) {
+	v := New("formaterror", nil, nil, nil, []instr{instr{sprintf, 2}}, true)
+	v.t = new(thread)
+	v.t.stack = []interface{}{"%s %s", "a"}
+	v.execute(v.t, instr{sprintf, 2})
+	if !v.terminate {
+		t.Errorf("program not terminated")
+	}
+	if FormatErrors.Get("formaterror") == nil {
+		t.Errorf("format error not counted")
+	}
+}
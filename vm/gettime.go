@@ -0,0 +1,72 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DefaultTimeLayouts are the layouts of the timestamps that gettime looks for
+// at the start of a line, in the order they're tried.  Fractional seconds are
+// accepted after the seconds of each layout.
+var DefaultTimeLayouts = []string{
+	"2006-01-02T15:04:05Z07:00",    // ISO 8601 and RFC 3339
+	"2006-01-02T15:04:05",          // ISO 8601 without a zone
+	"2006-01-02 15:04:05Z07:00",    // ISO 8601 with a space
+	"2006-01-02 15:04:05",          // ISO 8601 with a space, without a zone
+	"Jan _2 15:04:05",              // RFC 3164 syslog
+	"Jan _2 2006 15:04:05",         // RFC 3164 syslog with a year
+	"[02/Jan/2006:15:04:05 -0700]", // Apache access logs
+	"[Mon Jan _2 15:04:05 2006]",   // Apache error logs
+}
+
+// GettimeMisses counts the lines that gettime found no timestamp at the start
+// of, by program.
+var GettimeMisses = expvar.NewMap("gettime_misses_total")
+
+// leadingFields returns the prefix of s holding its first n fields separated
+// by spaces, so that a layout like "Jan _2 15:04:05" is compared with the
+// same number of fields of the line, however the day is padded.
+func leadingFields(s string, n int) (string, bool) {
+	i := 0
+	for ; n > 0; n-- {
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i == len(s) {
+			return "", false
+		}
+		for i < len(s) && s[i] != ' ' {
+			i++
+		}
+	}
+	return s[:i], true
+}
+
+// parseLeadingTime parses the timestamp at the start of line with the first
+// of the layouts that matches it.  The layouts are always tried in order, so
+// that a more precise layout listed first wins over one that also matches a
+// prefix of the timestamp.
+func (v *VM) parseLeadingTime(line string) (time.Time, bool) {
+	line = strings.TrimLeftFunc(line, unicode.IsSpace)
+	for _, layout := range v.timeLayouts {
+		s, ok := leadingFields(line, len(strings.Fields(layout)))
+		if !ok {
+			continue
+		}
+		tm, err := time.Parse(layout, s)
+		if err != nil {
+			continue
+		}
+		if tm.Year() == 0 && v.syslogUseCurrentYear {
+			// No .UTC() as we use local time to match the local log.
+			tm = tm.AddDate(v.clock.Now().Year(), 0, 0)
+		}
+		return tm, true
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+)
+
+var leadingTimeTests = []struct {
+	name     string
+	line     string
+	expected time.Time
+	ok       bool
+}{
+	{"rfc3164", "Mar  1 02:00:00 host sshd[123]: Accepted publickey",
+		time.Date(0, 3, 1, 2, 0, 0, 0, time.UTC), true},
+	{"rfc3164 two digit day", "Mar 11 02:00:00 host cron[1]: ok",
+		time.Date(0, 3, 11, 2, 0, 0, 0, time.UTC), true},
+	{"rfc3164 with year", "Mar  1 2017 02:00:00 host app: ok",
+		time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC), true},
+	{"iso8601", "2017-03-01T02:00:00Z INFO started",
+		time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC), true},
+	{"iso8601 offset and fraction", "2017-03-01T02:00:00.250+01:00 INFO started",
+		time.Date(2017, 3, 1, 1, 0, 0, 250000000, time.UTC), true},
+	{"iso8601 space", "2017-03-01 02:00:00 INFO started",
+		time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC), true},
+	{"apache access", "[01/Mar/2017:02:00:00 -0800] \"GET / HTTP/1.1\" 200",
+		time.Date(2017, 3, 1, 10, 0, 0, 0, time.UTC), true},
+	{"apache error", "[Wed Mar  1 02:00:00 2017] [error] [client 10.0.0.1] File does not exist",
+		time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC), true},
+	{"apache 2.4 error", "[Wed Mar 01 02:00:00.123456 2017] [core:error] [pid 1] AH00126",
+		time.Date(2017, 3, 1, 2, 0, 0, 123456000, time.UTC), true},
+	{"no timestamp", "GET / HTTP/1.1 200", time.Time{}, false},
+	{"empty", "", time.Time{}, false},
+}
+
+func TestParseLeadingTime(t *testing.T) {
+	v := New("gettime", nil, nil, nil, nil, false)
+	for _, tc := range leadingTimeTests {
+		tm, ok := v.parseLeadingTime(tc.line)
+		if ok != tc.ok {
+			t.Errorf("%s: got ok %v, want %v", tc.name, ok, tc.ok)
+			continue
+		}
+		if !tm.Equal(tc.expected) {
+			t.Errorf("%s: got %s, want %s", tc.name, tm, tc.expected)
+		}
+	}
+}
+
+func TestGettimeLayouts(t *testing.T) {
+	v := New("gettime", nil, nil, nil, nil, false)
+	v.timeLayouts = []string{"01/02/2006 15:04"}
+	tm, ok := v.parseLeadingTime("03/01/2017 02:00 job done")
+	if !ok || !tm.Equal(time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)) {
+		t.Errorf("configured layout not used: got %s, %v", tm, ok)
+	}
+	if _, ok := v.parseLeadingTime("2017-03-01T02:00:00Z job done"); ok {
+		t.Error("default layout used when layouts are configured")
+	}
+}
+
+// TestGettimeLayoutOrder tests that the layouts are tried in order for each
+// line, whichever matched the last line.
+func TestGettimeLayoutOrder(t *testing.T) {
+	v := New("gettime", nil, nil, nil, nil, false)
+	v.timeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02"}
+	for _, tc := range []struct {
+		line     string
+		expected time.Time
+	}{
+		{"2017-03-01 02:00:00 job done", time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)},
+		{"2017-03-02 job done", time.Date(2017, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"2017-03-03 04:00:00 job done", time.Date(2017, 3, 3, 4, 0, 0, 0, time.UTC)},
+	} {
+		if tm, ok := v.parseLeadingTime(tc.line); !ok || !tm.Equal(tc.expected) {
+			t.Errorf("parseLeadingTime(%q): got %s, %v, want %s", tc.line, tm, ok, tc.expected)
+		}
+	}
+}
+
+// TestGettime tests that gettime sets the time of the line's observations,
+// and counts the lines without a timestamp.
+func TestGettime(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "gauge last_seen_timestamp\n/$/ {\n  last_seen_timestamp = gettime()\n}\n"
+	v, err := Compile("gettime_prog", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	lines <- logline.New("test", "2017-03-01T02:00:00Z first")
+	lines <- logline.New("test", "no timestamp")
+	lines <- logline.New("test", "2017-03-02T02:00:00Z second")
+	close(lines)
+	<-done
+
+	d, err := store.Metrics[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Date(2017, 3, 2, 2, 0, 0, 0, time.UTC)
+	if d.Get() != expected.Unix() || d.Time != expected.UnixNano() {
+		t.Errorf("got %s, want %d", d, expected.Unix())
+	}
+
+	if GettimeMisses.Get("gettime_prog").String() != "1" {
+		t.Errorf("expected 1 miss, got %s", GettimeMisses.Get("gettime_prog"))
+	}
+}
+
+// TestGettimeUsesClock tests that a line without a timestamp is observed at
+// the time by the VM's clock.
+func TestGettimeUsesClock(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "gauge last_seen_timestamp\n/$/ {\n  last_seen_timestamp = gettime()\n}\n"
+	v, err := Compile("gettime_clock_prog", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	now := time.Date(2017, 3, 3, 2, 0, 0, 0, time.UTC)
+	v.clock = clock.NewFakeClock(now)
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	lines <- logline.New("test", "no timestamp")
+	close(lines)
+	<-done
+
+	d, err := store.Metrics[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Get() != now.Unix() || d.Time != now.UnixNano() {
+		t.Errorf("got %s, want %d", d, now.Unix())
+	}
+}
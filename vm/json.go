@@ -0,0 +1,74 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// jsonDoc is the result of parsing a string as JSON, kept so that each string
+// is only parsed once per line.
+type jsonDoc struct {
+	v   interface{}
+	err error
+}
+
+// parseJSON parses s as JSON, reusing the result of an earlier parse of s on
+// this thread.
+func (t *thread) parseJSON(s string) (interface{}, error) {
+	if d, ok := t.json[s]; ok {
+		return d.v, d.err
+	}
+	if t.json == nil {
+		t.json = make(map[string]jsonDoc)
+	}
+	var v interface{}
+	dec := json.NewDecoder(strings.NewReader(s))
+	// Keep numbers as written, so integers aren't rounded through float64.
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	t.json[s] = jsonDoc{v, err}
+	return v, err
+}
+
+// jsonPath returns the value at the dotted path in the parsed JSON value v,
+// formatted as a string.  A path element indexes an object by key, or an array
+// by position counting from 0.  Strings are returned unquoted, numbers as
+// written, and objects and arrays as JSON.  A missing value or null yields
+// the empty string.
+func jsonPath(v interface{}, path string) string {
+	if path != "" {
+		for _, key := range strings.Split(path, ".") {
+			switch n := v.(type) {
+			case map[string]interface{}:
+				v = n[key]
+			case []interface{}:
+				i, err := strconv.Atoi(key)
+				if err != nil || i < 0 || i >= len(n) {
+					return ""
+				}
+				v = n[i]
+			default:
+				return ""
+			}
+		}
+	}
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return n
+	case json.Number:
+		return n.String()
+	case bool:
+		return strconv.FormatBool(n)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+)
+
+const testJSON = `{"a": {"b": {"c": "deep"}}, "n": 12345678901234567, "f": 1.5, "ok": true, "nil": null, "list": [1, {"x": "y"}], "obj": {"k": "v"}}`
+
+var getjsonTests = []struct {
+	path     string
+	expected string
+}{
+	{"a.b.c", "deep"},
+	{"n", "12345678901234567"},
+	{"f", "1.5"},
+	{"ok", "true"},
+	{"nil", ""},
+	{"list.0", "1"},
+	{"list.1.x", "y"},
+	{"list.2", ""},
+	{"list.x", ""},
+	{"obj", `{"k":"v"}`},
+	{"missing", ""},
+	{"a.b.c.d", ""},
+}
+
+func TestGetJSON(t *testing.T) {
+	v := New("getjson", nil, nil, nil, []instr{instr{getjson, 2}}, true)
+	v.t = new(thread)
+	for _, tc := range getjsonTests {
+		v.t.stack = []interface{}{testJSON, tc.path}
+		v.execute(v.t, instr{getjson, 2})
+		if len(v.t.stack) != 1 || v.t.stack[0] != tc.expected {
+			t.Errorf("%s: expected %q, got %v", tc.path, tc.expected, v.t.stack)
+		}
+	}
+	// Every lookup reused the one parse of the line.
+	if len(v.t.json) != 1 {
+		t.Errorf("expected one cached parse, got %d", len(v.t.json))
+	}
+}
+
+func TestGetJSONParseError(t *testing.T) {
+	v := New("badjson", nil, nil, nil, []instr{instr{getjson, 2}}, true)
+	v.t = new(thread)
+	v.t.stack = []interface{}{"not json", "a"}
+	v.execute(v.t, instr{getjson, 2})
+	if v.terminate {
+		t.Errorf("program terminated on parse error")
+	}
+	if len(v.t.stack) != 1 || v.t.stack[0] != "" {
+		t.Errorf("expected empty string, got %v", v.t.stack)
+	}
+	if e := JSONParseErrors.Get("badjson"); e == nil || e.String() != "1" {
+		t.Errorf("parse error not counted: %v", e)
+	}
+}
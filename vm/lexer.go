@@ -31,10 +31,12 @@ var lexemeName = map[lexeme]string{
 	MUL:        "MUL",
 	DIV:        "DIV",
 	POW:        "POW",
+	MOD:        "MOD",
 	SHL:        "SHL",
 	SHR:        "SHR",
 	AND:        "AND",
 	OR:         "OR",
+	COALESCE:   "COALESCE",
 	ADD_ASSIGN: "ADD_ASSIGN",
 	ASSIGN:     "ASSIGN",
 	LT:         "LT",
@@ -51,12 +53,28 @@ var lexemeName = map[lexeme]string{
 	COUNTER:    "COUNTER",
 	GAUGE:      "GAUGE",
 	TIMER:      "TIMER",
+	HISTOGRAM:  "HISTOGRAM",
+	SUMMARY:    "SUMMARY",
+	AFTER:      "AFTER",
 	AS:         "AS",
 	BY:         "BY",
+	BUCKETS:    "BUCKETS",
 	HIDDEN:     "HIDDEN",
 	DEF:        "DEF",
+	DEL:        "DEL",
+	RECORD:     "RECORD",
+	NAMESPACE:  "NAMESPACE",
+	LOGS:       "LOGS",
+	SAMPLE:     "SAMPLE",
+	LIMIT:      "LIMIT",
+	LRU:        "LRU",
+	ELSE:       "ELSE",
+	EVERY:      "EVERY",
+	RESET:      "RESET",
+	UPDATED:    "UPDATED",
 	DECO:       "DECO",
 	NEXT:       "NEXT",
+	QUANTILES:  "QUANTILES",
 	CONST:      "CONST",
 }
 
@@ -69,25 +87,60 @@ func (t lexeme) String() string {
 
 // List of keywords.  Keep this list sorted!
 var keywords = map[string]lexeme{
-	"as":      AS,
-	"by":      BY,
-	"const":   CONST,
-	"counter": COUNTER,
-	"def":     DEF,
-	"gauge":   GAUGE,
-	"hidden":  HIDDEN,
-	"next":    NEXT,
-	"timer":   TIMER,
+	"after":     AFTER,
+	"as":        AS,
+	"buckets":   BUCKETS,
+	"by":        BY,
+	"const":     CONST,
+	"counter":   COUNTER,
+	"def":       DEF,
+	"del":       DEL,
+	"else":      ELSE,
+	"every":     EVERY,
+	"gauge":     GAUGE,
+	"hidden":    HIDDEN,
+	"histogram": HISTOGRAM,
+	"limit":     LIMIT,
+	"logs":      LOGS,
+	"lru":       LRU,
+	"namespace": NAMESPACE,
+	"next":      NEXT,
+	"or":        COALESCE,
+	"quantiles": QUANTILES,
+	"record":    RECORD,
+	"reset":     RESET,
+	"sample":    SAMPLE,
+	"summary":   SUMMARY,
+	"timer":     TIMER,
+	"updated":   UPDATED,
 }
 
 // List of builtin functions.  Keep this list sorted!
 var builtins = []string{
+	"cidr",
+	"elapsed",
+	"float",
+	"format",
+	"getenv",
+	"getfilename",
+	"getjson",
+	"getstream",
+	"gettime",
+	"in_cidr",
+	"int",
 	"len",
+	"logfmt",
 	"settime",
+	"split",
+	"starttimer",
+	"strlen",
 	"strptime",
 	"strtol",
+	"subst",
+	"substr",
 	"timestamp",
 	"tolower",
+	"toupper",
 }
 
 // A position is the location in the source program that a token appears.
@@ -248,6 +301,11 @@ func lexProg(l *lexer) stateFn {
 	case r == '\n':
 		l.accept()
 		l.emit(NL)
+	case r == ';':
+		// A semicolon ends a statement like a newline, so that several
+		// statements can share a line.
+		l.accept()
+		l.emit(NL)
 	case r == '#':
 		return lexComment
 	case isSpace(r):
@@ -348,6 +406,9 @@ func lexProg(l *lexer) stateFn {
 	case r == '/':
 		l.accept()
 		l.emit(DIV)
+	case r == '%':
+		l.accept()
+		l.emit(MOD)
 	case r == '&':
 		l.accept()
 		l.emit(AND)
@@ -416,6 +477,23 @@ Loop:
 			}
 			kind = FLOATLITERAL
 			l.accept()
+		case (r == 'e' || r == 'E') && kind != DURATIONLITERAL:
+			// No duration unit starts with e, so this is a float's exponent.
+			kind = FLOATLITERAL
+			l.accept()
+			if r := l.next(); r == '+' || r == '-' {
+				l.accept()
+			} else {
+				l.backup()
+			}
+			if r := l.next(); !isDigit(r) {
+				return l.errorf("Missing exponent in float: %q", l.text)
+			}
+			l.accept()
+		case isAlpha(r):
+			// A number with units, like 1h30m, is a duration.
+			kind = DURATIONLITERAL
+			l.accept()
 		default:
 			l.backup()
 			break Loop
@@ -24,6 +24,11 @@ var lexerTests = []lexerTest{
 	{"newlines", "\n", []token{
 		token{NL, "\n", position{"newlines", 1, 0, -1}},
 		token{EOF, "", position{"newlines", 1, 0, 0}}}},
+	{"semicolons", "a;b", []token{
+		token{ID, "a", position{"semicolons", 0, 0, 0}},
+		token{NL, ";", position{"semicolons", 0, 1, 1}},
+		token{ID, "b", position{"semicolons", 0, 2, 2}},
+		token{EOF, "", position{"semicolons", 0, 3, 3}}}},
 	{"comment", "# comment", []token{
 		token{EOF, "", position{"comment", 0, 9, 9}}}},
 	{"comment not at col 1", "  # comment", []token{
@@ -37,7 +42,7 @@ var lexerTests = []lexerTest{
 		token{RSQUARE, "]", position{"punctuation", 0, 5, 5}},
 		token{COMMA, ",", position{"punctuation", 0, 6, 6}},
 		token{EOF, "", position{"punctuation", 0, 7, 7}}}},
-	{"operators", "- + = ++ += < > <= >= == != * / << >> & | ^ ~ **", []token{
+	{"operators", "- + = ++ += < > <= >= == != * / << >> & | ^ ~ ** %", []token{
 		token{MINUS, "-", position{"operators", 0, 0, 0}},
 		token{PLUS, "+", position{"operators", 0, 2, 2}},
 		token{ASSIGN, "=", position{"operators", 0, 4, 4}},
@@ -58,9 +63,10 @@ var lexerTests = []lexerTest{
 		token{XOR, "^", position{"operators", 0, 42, 42}},
 		token{NOT, "~", position{"operators", 0, 44, 44}},
 		token{POW, "**", position{"operators", 0, 46, 47}},
-		token{EOF, "", position{"operators", 0, 48, 48}}}},
+		token{MOD, "%", position{"operators", 0, 49, 49}},
+		token{EOF, "", position{"operators", 0, 50, 50}}}},
 	{"keywords",
-		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\n", []token{
+		"counter\ngauge\nas\nby\nhidden\ndef\nnext\nconst\ntimer\nelse\ndel\nrecord\nnamespace\nlimit\nlru\n", []token{
 			token{COUNTER, "counter", position{"keywords", 0, 0, 6}},
 			token{NL, "\n", position{"keywords", 1, 7, -1}},
 			token{GAUGE, "gauge", position{"keywords", 1, 0, 4}},
@@ -79,9 +85,21 @@ var lexerTests = []lexerTest{
 			token{NL, "\n", position{"keywords", 8, 5, -1}},
 			token{TIMER, "timer", position{"keywords", 8, 0, 4}},
 			token{NL, "\n", position{"keywords", 9, 5, -1}},
-			token{EOF, "", position{"keywords", 9, 0, 0}}}},
+			token{ELSE, "else", position{"keywords", 9, 0, 3}},
+			token{NL, "\n", position{"keywords", 10, 4, -1}},
+			token{DEL, "del", position{"keywords", 10, 0, 2}},
+			token{NL, "\n", position{"keywords", 11, 3, -1}},
+			token{RECORD, "record", position{"keywords", 11, 0, 5}},
+			token{NL, "\n", position{"keywords", 12, 6, -1}},
+			token{NAMESPACE, "namespace", position{"keywords", 12, 0, 8}},
+			token{NL, "\n", position{"keywords", 13, 9, -1}},
+			token{LIMIT, "limit", position{"keywords", 13, 0, 4}},
+			token{NL, "\n", position{"keywords", 14, 5, -1}},
+			token{LRU, "lru", position{"keywords", 14, 0, 2}},
+			token{NL, "\n", position{"keywords", 15, 3, -1}},
+			token{EOF, "", position{"keywords", 15, 0, 0}}}},
 	{"builtins",
-		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\n", []token{
+		"strptime\ntimestamp\ntolower\nlen\nstrtol\nsettime\ngetfilename\ntoupper\nint\nfloat\nsplit\nlogfmt\ngetjson\nsubstr\nstrlen\nformat\ncidr\nin_cidr\nsubst\nstarttimer\nelapsed\ngetstream\ngettime\n", []token{
 			token{BUILTIN, "strptime", position{"builtins", 0, 0, 7}},
 			token{NL, "\n", position{"builtins", 1, 8, -1}},
 			token{BUILTIN, "timestamp", position{"builtins", 1, 0, 8}},
@@ -94,13 +112,60 @@ var lexerTests = []lexerTest{
 			token{NL, "\n", position{"builtins", 5, 6, -1}},
 			token{BUILTIN, "settime", position{"builtins", 5, 0, 6}},
 			token{NL, "\n", position{"builtins", 6, 7, -1}},
-			token{EOF, "", position{"builtins", 6, 0, 0}}}},
+			token{BUILTIN, "getfilename", position{"builtins", 6, 0, 10}},
+			token{NL, "\n", position{"builtins", 7, 11, -1}},
+			token{BUILTIN, "toupper", position{"builtins", 7, 0, 6}},
+			token{NL, "\n", position{"builtins", 8, 7, -1}},
+			token{BUILTIN, "int", position{"builtins", 8, 0, 2}},
+			token{NL, "\n", position{"builtins", 9, 3, -1}},
+			token{BUILTIN, "float", position{"builtins", 9, 0, 4}},
+			token{NL, "\n", position{"builtins", 10, 5, -1}},
+			token{BUILTIN, "split", position{"builtins", 10, 0, 4}},
+			token{NL, "\n", position{"builtins", 11, 5, -1}},
+			token{BUILTIN, "logfmt", position{"builtins", 11, 0, 5}},
+			token{NL, "\n", position{"builtins", 12, 6, -1}},
+			token{BUILTIN, "getjson", position{"builtins", 12, 0, 6}},
+			token{NL, "\n", position{"builtins", 13, 7, -1}},
+			token{BUILTIN, "substr", position{"builtins", 13, 0, 5}},
+			token{NL, "\n", position{"builtins", 14, 6, -1}},
+			token{BUILTIN, "strlen", position{"builtins", 14, 0, 5}},
+			token{NL, "\n", position{"builtins", 15, 6, -1}},
+			token{BUILTIN, "format", position{"builtins", 15, 0, 5}},
+			token{NL, "\n", position{"builtins", 16, 6, -1}},
+			token{BUILTIN, "cidr", position{"builtins", 16, 0, 3}},
+			token{NL, "\n", position{"builtins", 17, 4, -1}},
+			token{BUILTIN, "in_cidr", position{"builtins", 17, 0, 6}},
+			token{NL, "\n", position{"builtins", 18, 7, -1}},
+			token{BUILTIN, "subst", position{"builtins", 18, 0, 4}},
+			token{NL, "\n", position{"builtins", 19, 5, -1}},
+			token{BUILTIN, "starttimer", position{"builtins", 19, 0, 9}},
+			token{NL, "\n", position{"builtins", 20, 10, -1}},
+			token{BUILTIN, "elapsed", position{"builtins", 20, 0, 6}},
+			token{NL, "\n", position{"builtins", 21, 7, -1}},
+			token{BUILTIN, "getstream", position{"builtins", 21, 0, 8}},
+			token{NL, "\n", position{"builtins", 22, 9, -1}},
+			token{BUILTIN, "gettime", position{"builtins", 22, 0, 6}},
+			token{NL, "\n", position{"builtins", 23, 7, -1}},
+			token{EOF, "", position{"builtins", 23, 0, 0}}}},
 	{"numeric", "1 23 3.14 1.61.1", []token{
 		token{INTLITERAL, "1", position{"numeric", 0, 0, 0}},
 		token{INTLITERAL, "23", position{"numeric", 0, 2, 3}},
 		token{FLOATLITERAL, "3.14", position{"numeric", 0, 5, 8}},
 		token{FLOATLITERAL, "1.61", position{"numeric", 0, 10, 13}},
 		token{INVALID, "Unexpected input: '.'", position{"numeric", 0, 14, 14}}}},
+	{"float exponent", "1e5 2.5E-3 1e+2", []token{
+		token{FLOATLITERAL, "1e5", position{"float exponent", 0, 0, 2}},
+		token{FLOATLITERAL, "2.5E-3", position{"float exponent", 0, 4, 9}},
+		token{FLOATLITERAL, "1e+2", position{"float exponent", 0, 11, 14}},
+		token{EOF, "", position{"float exponent", 0, 15, 15}}}},
+	{"missing exponent", "1e", []token{
+		token{INVALID, "Missing exponent in float: \"1e\"", position{"missing exponent", 0, 0, 1}}}},
+	{"duration", "after 1h 10s 1.5m", []token{
+		token{AFTER, "after", position{"duration", 0, 0, 4}},
+		token{DURATIONLITERAL, "1h", position{"duration", 0, 6, 7}},
+		token{DURATIONLITERAL, "10s", position{"duration", 0, 9, 11}},
+		token{DURATIONLITERAL, "1.5m", position{"duration", 0, 13, 16}},
+		token{EOF, "", position{"duration", 0, 17, 17}}}},
 	{"identifier", "a be foo\nquux line-count", []token{
 		token{ID, "a", position{"identifier", 0, 0, 0}},
 		token{ID, "be", position{"identifier", 0, 2, 3}},
@@ -119,6 +184,16 @@ var lexerTests = []lexerTest{
 		token{REGEX, `asdf/`, position{"regex with escape", 0, 1, 6}},
 		token{DIV, "/", position{"regex with escape", 0, 7, 7}},
 		token{EOF, "", position{"regex with escape", 0, 8, 8}}}},
+	{"regex with flags and escape", `/(?i)error\/warn/`, []token{
+		token{DIV, "/", position{"regex with flags and escape", 0, 0, 0}},
+		token{REGEX, `(?i)error/warn`, position{"regex with flags and escape", 0, 1, 15}},
+		token{DIV, "/", position{"regex with flags and escape", 0, 16, 16}},
+		token{EOF, "", position{"regex with flags and escape", 0, 17, 17}}}},
+	{"anchored regex with flag group", `/^(?i:foo)$/`, []token{
+		token{DIV, "/", position{"anchored regex with flag group", 0, 0, 0}},
+		token{REGEX, `^(?i:foo)$`, position{"anchored regex with flag group", 0, 1, 10}},
+		token{DIV, "/", position{"anchored regex with flag group", 0, 11, 11}},
+		token{EOF, "", position{"anchored regex with flag group", 0, 12, 12}}}},
 	{"regex with escape and special char", `/foo\d\//`, []token{
 		token{DIV, "/", position{"regex with escape and special char", 0, 0, 0}},
 		token{REGEX, `foo\d/`, position{"regex with escape and special char", 0, 1, 7}},
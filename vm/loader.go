@@ -10,6 +10,8 @@ package vm
 // moves.
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"errors"
 	"expvar"
 	"fmt"
@@ -18,11 +20,17 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/spf13/afero"
 
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
 	"github.com/google/mtail/metrics"
 	"github.com/google/mtail/watcher"
 )
@@ -32,11 +40,41 @@ var (
 	ProgLoads = expvar.NewMap("prog_loads_total")
 	// ProgLoadErrors counts the number of program load errors.
 	ProgLoadErrors = expvar.NewMap("prog_load_errors")
+	// ProgLoadWarnings counts the compile warnings of each program load, by
+	// program.
+	ProgLoadWarnings = expvar.NewMap("prog_load_warnings_total")
+	// ProgHealthy is 1 for each running program, and 0 once a program has
+	// been disabled by a runtime panic.
+	ProgHealthy = expvar.NewMap("prog_healthy")
+	// ProgLinesDropped counts the lines not sent to a program because it
+	// exceeded its rate limit, by program.
+	ProgLinesDropped = expvar.NewMap("prog_lines_dropped_total")
+	// ProgLines counts the lines sent to each program.
+	ProgLines = expvar.NewMap("prog_lines_total")
+	// ProgLineQueueDepth is the number of lines waiting in the buffer of each
+	// program, as of the last line sent to or taken by the program.
+	ProgLineQueueDepth = metrics.NewGaugeMap("prog_line_queue_depth")
+	// ProgLinesAbandoned counts the lines not run by each program because
+	// the shutdown stopped waiting for the programs to catch up, by program.
+	ProgLinesAbandoned = expvar.NewMap("prog_lines_abandoned_total")
+	// LinesIgnored counts the lines matching the ignore pattern, which are
+	// dropped before being sent to any program.
+	LinesIgnored = expvar.NewInt("lines_ignored_total")
+	// ProgHashes is 1 for each loaded program, labelled with the SHA-256 hash
+	// of its source, so the version of a program running can be checked.
+	ProgHashes = metrics.NewInfo("prog_hash")
 )
 
 var (
 	// LineCount counts the number of lines read by the virtual machine engine from the input channel.
 	LineCount = expvar.NewInt("line_count")
+	// LastLineSeconds is the time the last line was read from the input
+	// channel, in seconds since the epoch, so that mtail stalling can be
+	// alerted on.
+	LastLineSeconds = metrics.NewGaugeInt("last_line_seconds")
+	// LineQueueDepth is the number of lines waiting in the input channel, as
+	// of the last line taken from it.
+	LineQueueDepth = metrics.NewGaugeInt("line_queue_depth")
 )
 
 const (
@@ -44,9 +82,15 @@ const (
 )
 
 // LoadProgs loads all programs in a directory and starts watching the
-// directory for filesystem changes.  The total number of program errors is
-// returned.
+// directory for filesystem changes.  If programPath is a glob pattern, such
+// as progs/prod_*.mtail, only the programs matching it are loaded, from the
+// directory it names.  A program that fails to compile doesn't prevent
+// loading the others, but in compile only mode the errors of all the programs
+// that failed are returned.
 func (l *Loader) LoadProgs(programPath string) error {
+	if hasMeta(programPath) {
+		return l.loadProgPattern(programPath)
+	}
 	l.w.Add(programPath)
 
 	s, err := os.Stat(programPath)
@@ -60,18 +104,94 @@ func (l *Loader) LoadProgs(programPath string) error {
 			return fmt.Errorf("Failed to list programs in %q: %s", programPath, err)
 		}
 
+		var paths []string
 		for _, fi := range fis {
 			if fi.IsDir() {
 				continue
 			}
-			l.LoadProg(path.Join(programPath, fi.Name()))
+			paths = append(paths, path.Join(programPath, fi.Name()))
 		}
-		return nil
+		return l.loadProgList(paths)
 	default:
 		return l.LoadProg(programPath)
 	}
 }
 
+// loadProgPattern loads the programs matching the glob pattern, and watches
+// the directory they're in so that programs created later are loaded if they
+// match too.  Only the file name may contain glob metacharacters.
+func (l *Loader) loadProgPattern(pattern string) error {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Bad program pattern %q: %s", pattern, err)
+	}
+	dir := filepath.Dir(pattern)
+	if hasMeta(dir) {
+		return fmt.Errorf("Bad program pattern %q: only the file name may contain glob metacharacters", pattern)
+	}
+	l.handleMu.Lock()
+	l.progPatterns = append(l.progPatterns, pattern)
+	l.handleMu.Unlock()
+	l.w.Add(dir)
+
+	matches, err := afero.Glob(l.fs, pattern)
+	if err != nil {
+		return fmt.Errorf("Failed to list programs matching %q: %s", pattern, err)
+	}
+	var paths []string
+	for _, m := range matches {
+		if fi, err := l.fs.Stat(m); err == nil && !fi.IsDir() {
+			paths = append(paths, m)
+		}
+	}
+	return l.loadProgList(paths)
+}
+
+// loadProgList loads each of the programs at paths, returning the errors of
+// those that failed if they should stop mtail.
+func (l *Loader) loadProgList(paths []string) error {
+	var errs []string
+	for _, p := range paths {
+		if err := l.LoadProg(p); err != nil {
+			// A program of the same name in another directory is a mistake
+			// in the configuration, so it's always returned.
+			if _, ok := err.(*duplicateProgError); ok || l.compileOnly {
+				errs = append(errs, err.Error())
+			} else {
+				glog.Info(err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// hasMeta reports whether path contains any of the magic characters
+// recognized by filepath.Match.
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// selected reports whether the program at pathname is to be loaded when it
+// changes.  Programs in the directory of a glob pattern are only loaded if
+// they match one of the patterns for that directory.
+func (l *Loader) selected(pathname string) bool {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	restricted := false
+	for _, pattern := range l.progPatterns {
+		if filepath.Dir(pattern) != filepath.Dir(pathname) {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, pathname); ok {
+			return true
+		}
+		restricted = true
+	}
+	return !restricted
+}
+
 // LoadProg loads or reloads a program from the path specified.  The name of
 // the program is the basename of the file.
 func (l *Loader) LoadProg(programPath string) error {
@@ -80,30 +200,123 @@ func (l *Loader) LoadProg(programPath string) error {
 		glog.Infof("Skipping %s due to file extension.", programPath)
 		return nil
 	}
+	l.handleMu.Lock()
+	if loaded, ok := l.progPaths[name]; ok && loaded != programPath {
+		l.handleMu.Unlock()
+		ProgLoadErrors.Add(name, 1)
+		return &duplicateProgError{name, programPath, loaded}
+	}
+	l.progPaths[name] = programPath
+	l.handleMu.Unlock()
 	f, err := l.fs.Open(programPath)
 	if err != nil {
 		ProgLoadErrors.Add(name, 1)
-		return fmt.Errorf("Failed to read program %q: %s", programPath, err)
+		err = fmt.Errorf("Failed to read program %q: %s", programPath, err)
+		l.handleMu.Lock()
+		l.recordLoad(name, programPath, err)
+		l.handleMu.Unlock()
+		return err
 	}
 	defer f.Close()
-	return l.CompileAndRun(name, f)
+	return l.compileAndRun(name, programPath, f)
+}
+
+// duplicateProgError is returned when loading a program with the same name as
+// one already loaded from another directory.  Programs are known by their file
+// names, so only one of them can run.
+type duplicateProgError struct {
+	name   string
+	path   string // The program that wasn't loaded.
+	loaded string // The program already loaded.
+}
+
+func (e *duplicateProgError) Error() string {
+	return fmt.Sprintf("Program %s in %q has the same name as the program loaded from %q; program names must be unique across program directories", e.name, e.path, e.loaded)
 }
 
 // CompileAndRun compiles a program read from the input, starting execution if
 // it succeeds.  If an existing virtual machine of the same name already
 // exists, the previous virtual machine is terminated and the new loaded over
-// it.  If the new program fails to compile, any existing virtual machine with
-// the same name remains running.
+// it, and the metrics of the previous program are replaced by the new ones.
+// If the new program fails to compile, any existing virtual machine with the
+// same name remains running.
 func (l *Loader) CompileAndRun(name string, input io.Reader) error {
-	v, errs := Compile(name, input, l.ms, l.compileOnly, l.syslogUseCurrentYear)
+	return l.compileAndRun(name, "", input)
+}
+
+// compileAndRun compiles and runs the named program read from input, and
+// records its load against the source file path.
+func (l *Loader) compileAndRun(name, path string, input io.Reader) error {
+	// Compile into a scratch store so that a failed compile leaves the
+	// metrics of any running program untouched.
+	ms := metrics.NewStore()
+	hash := sha256.New()
+	src, errs := ioutil.ReadAll(io.TeeReader(input, hash))
+	if errs == nil {
+		src, errs = preprocess(name, src, l.progFlags)
+	}
+	var v *VM
+	var warnings ErrorList
+	if errs == nil {
+		v, warnings, errs = compileProgram(name, bytes.NewReader(src), ms, l.compileOnly, l.syslogUseCurrentYear, l.warningsAsErrors)
+	}
+	if len(warnings) > 0 {
+		ProgLoadWarnings.Add(name, int64(len(warnings)))
+		for _, w := range warnings {
+			glog.Warningf("warning: %s", w)
+		}
+	}
 	if errs != nil {
 		ProgLoadErrors.Add(name, 1)
-		return fmt.Errorf("compile failed for %s:\n%s", name, errs)
+		err := fmt.Errorf("compile failed for %s:\n%s", name, errs)
+		if !l.compileOnly {
+			l.handleMu.Lock()
+			l.recordLoad(name, path, err)
+			l.handleMu.Unlock()
+		}
+		return err
+	}
+	if err := checkMetricNames(ms, l.strictMetricNames); err != nil {
+		ProgLoadErrors.Add(name, 1)
+		err = fmt.Errorf("compile failed for %s:\n%s", name, err)
+		if !l.compileOnly {
+			l.handleMu.Lock()
+			l.recordLoad(name, path, err)
+			l.handleMu.Unlock()
+		}
+		return err
+	}
+	if l.compileOnly {
+		return nil
+	}
+	if l.namespaceFromProgram {
+		ns := programNamespace(name)
+		for _, m := range ms.Metrics {
+			if m.Namespace == "" {
+				m.Namespace = ns
+			}
+		}
 	}
+	if l.maxRecordSize > 0 {
+		v.maxRecordSize = l.maxRecordSize
+	}
+	if l.recordFlushTimeout > 0 {
+		v.recordFlushTimeout = l.recordFlushTimeout
+	}
+	if len(l.timeLayouts) > 0 {
+		v.timeLayouts = l.timeLayouts
+	}
+	v.workers = l.workers
+	v.clock = l.clock
+	v.lineTimeout = l.lineTimeout
+	depth := new(expvar.Int)
+	ProgLineQueueDepth.Set(name, depth)
+	v.queueDepth = depth
 	if l.dumpBytecode {
-		v.DumpByteCode(name)
+		v.DumpByteCode(name, l.dumpWriter)
 	}
 	ProgLoads.Add(name, 1)
+	ProgHashes.Set(name, map[string]string{"prog": name, "hash": fmt.Sprintf("%x", hash.Sum(nil))})
 	glog.Infof("Loaded program %s", name)
 
 	l.handleMu.Lock()
@@ -113,7 +326,14 @@ func (l *Loader) CompileAndRun(name string, input io.Reader) error {
 		close(handle.lines)
 		<-handle.done
 	}
-	l.handles[name] = &vmHandle{make(chan string), make(chan struct{})}
+	l.ms.ReplaceProgramMetrics(name, ms.Metrics...)
+	h := &vmHandle{lines: make(chan *logline.LogLine, l.progLineBuffer), done: make(chan struct{}), depth: depth, logs: v.logs}
+	if rate, ok := l.rateLimits[name]; ok && rate > 0 {
+		h.limiter = newTokenBucket(rate, l.clock.Now())
+	}
+	l.handles[name] = h
+	l.recordLoad(name, path, nil)
+	setHealthy(name, true)
 	go v.Run(l.handles[name].lines, l.handles[name].done)
 	return nil
 }
@@ -127,28 +347,75 @@ type Loader struct {
 	fs afero.Fs        // filesystem interface
 	ms *metrics.Store  // pointer to store to pass to compiler
 
+	clock clock.Clock // Tells the time for the rate limits and the VMs.
+
 	handles  map[string]*vmHandle // map of program names to virtual machines
-	handleMu sync.RWMutex         // guards accesses to handles
+	handleMu sync.RWMutex         // guards accesses to handles and progs
+
+	progs     map[string]*progRecord // Load history of each program, by name.
+	progPaths map[string]string      // Source file of each program loaded from a file, by name.
+
+	progPatterns []string // Glob patterns selecting the programs to load from their directories.
 
 	watcherDone chan struct{} // Synchronise shutdown of the watcher and lines handlers.
 	VMsDone     chan struct{} // Notify mtail when all running VMs are shutdown.
+	abandon     chan struct{} // Closed to drop the lines not yet run, rather than wait for them.
+	abandonOnce sync.Once
 
 	compileOnly          bool // Only compile programs and report errors, do not load VMs.
-	dumpBytecode         bool // Instructs the loader to dump to stdout the compiled program after compilation.
+	dumpBytecode         bool // Instructs the loader to dump the compiled program to dumpWriter after compilation.
 	syslogUseCurrentYear bool // Instructs the VM to overwrite zero years with the current year in a strptime instruction.
+
+	dumpWriter io.Writer // Where the bytecode is dumped.
+
+	maxRecordSize      int           // Size in bytes beyond which lines aren't added to a multi-line record, if non-zero.
+	recordFlushTimeout time.Duration // Run incomplete multi-line records after this long without a new line, if non-zero.
+	lineTimeout        time.Duration // Abandon lines that take a program longer than this to run, if non-zero.
+
+	progLineBuffer int // Number of lines buffered for each program.
+
+	rateLimits map[string]int // Most lines per second sent to each program, by program name.
+
+	workers chan struct{} // Semaphore of the programs running a line at once.
+
+	namespaceFromProgram bool // Namespace the metrics of programs without a namespace by the program name.
+	strictMetricNames    bool // Fail to load programs whose metric or key names aren't valid in every exporter.
+
+	timeLayouts []string // Layouts of the timestamps gettime looks for, if not the defaults.
+
+	warningsAsErrors bool // Fail to load programs with compile warnings.
+
+	ignorePattern *regexp.Regexp // Lines matching this are dropped before reaching any program, if not nil.
+
+	progFlags map[string]bool // Flags set for the #if directives of programs.
 }
 
 // LoaderOptions contains the required and optional parameters for creating a
 // new Loader.
 type LoaderOptions struct {
 	Store *metrics.Store
-	Lines <-chan string
-	W     watcher.Watcher // Not required, will use watcher.LogWatcher if zero.
+	Lines <-chan *logline.LogLine
+	W     watcher.Watcher // Not required, will use watcher.New if zero.
 	FS    afero.Fs        // Not required, will use afero.OsFs if zero.
+	Clock clock.Clock     // Not required, will use clock.Real if zero.
 
 	CompileOnly          bool
 	DumpBytecode         bool
 	SyslogUseCurrentYear bool
+	PollInterval         time.Duration  // Not required; if set, programs are polled for changes instead of watched with inotify.
+	MaxRecordSize        int            // Not required; DefaultMaxRecordSize is used if zero.
+	RecordFlushTimeout   time.Duration  // Not required; DefaultRecordFlushTimeout is used if zero.
+	RateLimits           map[string]int // Not required; the most lines per second sent to each program named, with the rest dropped.
+	DumpWriter           io.Writer      // Not required; the bytecode is dumped to os.Stdout if nil.
+	Workers              int            // Not required; the most programs run at once, runtime.GOMAXPROCS if zero.
+	NamespaceFromProgram bool           // Not required; if set, programs without a namespace statement use their file name, less the extension, as their namespace.
+	StrictMetricNames    bool           // Not required; if set, programs with metric or key names that Prometheus rejects fail to compile, rather than having the names sanitized when exported.
+	TimeLayouts          []string       // Not required; the layouts of the timestamps gettime looks for at the start of lines, in order.  DefaultTimeLayouts are used if empty.
+	WarningsAsErrors     bool           // Not required; if set, programs with compile warnings, such as unused capture groups, fail to load.
+	IgnorePattern        *regexp.Regexp // Not required; if set, lines matching it are dropped before being sent to any program, such as health checks.
+	ProgFlags            []string       // Not required; the flags set for the #if directives of programs, which keep the blocks naming only these flags.
+	LineTimeout          time.Duration  // Not required; if set, a program that takes longer than this to run on a line abandons the line, so that it can't hold up the lines after it.
+	ProgLineBuffer       int            // Not required; the number of lines buffered for each program, DefaultProgLineBuffer if zero.
 }
 
 // NewLoader creates a new program loader.  It takes a filesystem watcher
@@ -162,33 +429,89 @@ func NewLoader(o LoaderOptions) (*Loader, error) {
 	if fs == nil {
 		fs = &afero.OsFs{}
 	}
+	c := o.Clock
+	if c == nil {
+		c = clock.Real
+	}
 	w := o.W
 	if w == nil {
-		var err error
-		w, err = watcher.NewLogWatcher()
-		if err != nil {
-			return nil, fmt.Errorf("Couldn't create a watcher for loader: %s", err)
-		}
+		w = watcher.New(fs, c, o.PollInterval)
+	}
+	dumpWriter := o.DumpWriter
+	if dumpWriter == nil {
+		dumpWriter = os.Stdout
+	}
+	progLineBuffer := o.ProgLineBuffer
+	if progLineBuffer <= 0 {
+		progLineBuffer = DefaultProgLineBuffer
+	}
+	workers := o.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	progFlags := make(map[string]bool)
+	for _, f := range o.ProgFlags {
+		progFlags[f] = true
 	}
 	l := &Loader{
 		w:                    w,
 		ms:                   o.Store,
 		fs:                   fs,
+		clock:                c,
 		handles:              make(map[string]*vmHandle),
+		progs:                make(map[string]*progRecord),
+		progPaths:            make(map[string]string),
 		watcherDone:          make(chan struct{}),
 		VMsDone:              make(chan struct{}),
+		abandon:              make(chan struct{}),
 		compileOnly:          o.CompileOnly,
 		dumpBytecode:         o.DumpBytecode,
-		syslogUseCurrentYear: o.SyslogUseCurrentYear}
+		dumpWriter:           dumpWriter,
+		syslogUseCurrentYear: o.SyslogUseCurrentYear,
+		maxRecordSize:        o.MaxRecordSize,
+		recordFlushTimeout:   o.RecordFlushTimeout,
+		lineTimeout:          o.LineTimeout,
+		progLineBuffer:       progLineBuffer,
+		rateLimits:           o.RateLimits,
+		workers:              make(chan struct{}, workers),
+		namespaceFromProgram: o.NamespaceFromProgram,
+		strictMetricNames:    o.StrictMetricNames,
+		timeLayouts:          o.TimeLayouts,
+		warningsAsErrors:     o.WarningsAsErrors,
+		ignorePattern:        o.IgnorePattern,
+		progFlags:            progFlags}
 
 	go l.processEvents()
 	go l.processLines(o.Lines)
 	return l, nil
 }
 
+// DefaultProgLineBuffer is the number of lines buffered for each program,
+// unless set in the LoaderOptions.  Each program runs in its own goroutine and
+// receives lines in order, and the buffer lets the other programs carry on
+// with later lines while a slow program catches up.
+const DefaultProgLineBuffer = 100
+
 type vmHandle struct {
-	lines chan string
-	done  chan struct{}
+	lines   chan *logline.LogLine
+	done    chan struct{}
+	limiter *tokenBucket // Limits the rate of lines sent to the program, if not nil.
+	depth   *expvar.Int  // Number of lines waiting in lines.
+	logs    []string     // Patterns of the log paths whose lines are sent to the program, or all logs if empty.
+}
+
+// reads returns true if the lines of the log at pathname are sent to the
+// program.
+func (h *vmHandle) reads(pathname string) bool {
+	if len(h.logs) == 0 {
+		return true
+	}
+	for _, p := range h.logs {
+		if ok, _ := filepath.Match(p, pathname); ok {
+			return true
+		}
+	}
+	return false
 }
 
 // processEvents manages program lifecycle triggered by events from the
@@ -201,10 +524,26 @@ func (l *Loader) processEvents() {
 			glog.Infof("delete prog %s", event.Pathname)
 			l.UnloadProgram(event.Pathname)
 		case watcher.UpdateEvent:
+			if !l.selected(event.Pathname) {
+				glog.V(1).Infof("Skipping %s, which doesn't match the program patterns", event.Pathname)
+				continue
+			}
 			glog.Infof("update prog %s", event.Pathname)
-			l.LoadProg(event.Pathname)
+			if err := l.LoadProg(event.Pathname); err != nil {
+				glog.Info(err)
+			}
 		case watcher.CreateEvent:
+			// Programs installed by an atomic rename won't see an update
+			// event, so load them now too.
+			if !l.selected(event.Pathname) {
+				glog.V(1).Infof("Skipping %s, which doesn't match the program patterns", event.Pathname)
+				continue
+			}
+			glog.Infof("create prog %s", event.Pathname)
 			l.w.Add(event.Pathname)
+			if err := l.LoadProg(event.Pathname); err != nil {
+				glog.Info(err)
+			}
 		default:
 			glog.V(1).Infof("Unexected event type %+#v", event)
 		}
@@ -212,14 +551,53 @@ func (l *Loader) processEvents() {
 }
 
 // processLines provides fanout of the input log lines to each virtual machine
-// running.  Upon close of the incoming lines channel, it also communicates
-// shutdown to the target VMs via channel close.
-func (l *Loader) processLines(lines <-chan string) {
+// running.  Lines beyond a program's rate limit are dropped for that program
+// only, so that it doesn't hold up the others.  Upon close of the incoming
+// lines channel, it also communicates shutdown to the target VMs via channel
+// close.
+func (l *Loader) processLines(lines <-chan *logline.LogLine) {
 	for line := range lines {
+		now := l.clock.Now()
+		LastLineSeconds.Set(now.Unix())
 		LineCount.Add(1)
+		LineQueueDepth.Set(int64(len(lines)))
+		if l.ignorePattern != nil && l.ignorePattern.MatchString(line.Line) {
+			LinesIgnored.Add(1)
+			continue
+		}
 		l.handleMu.RLock()
-		for prog := range l.handles {
-			l.handles[prog].lines <- line
+		// Send the line to each program with room for it first, and only
+		// then wait for the programs whose buffers are full, so that a slow
+		// program doesn't keep the line from the others.
+		var full []string
+		for prog, h := range l.handles {
+			if !h.reads(line.Filename) {
+				continue
+			}
+			if h.limiter != nil && !h.limiter.allow(now) {
+				ProgLinesDropped.Add(prog, 1)
+				continue
+			}
+			select {
+			case <-l.abandon:
+				ProgLinesAbandoned.Add(prog, 1)
+				continue
+			default:
+			}
+			select {
+			case h.lines <- line:
+				l.sent(prog, h)
+			default:
+				full = append(full, prog)
+			}
+		}
+		for _, prog := range full {
+			h := l.handles[prog]
+			if !l.send(h, line) {
+				ProgLinesAbandoned.Add(prog, 1)
+				continue
+			}
+			l.sent(prog, h)
 		}
 		l.handleMu.RUnlock()
 	}
@@ -228,14 +606,59 @@ func (l *Loader) processLines(lines <-chan string) {
 	<-l.watcherDone
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
-	for prog := range l.handles {
-		close(l.handles[prog].lines)
-		<-l.handles[prog].done
+	for prog, h := range l.handles {
+		select {
+		case <-l.abandon:
+			// Take the lines the program hasn't got to yet, so that it stops
+			// after the line it's running.
+			for n := len(h.lines); n > 0; n-- {
+				select {
+				case <-h.lines:
+					ProgLinesAbandoned.Add(prog, 1)
+				default:
+				}
+			}
+		default:
+		}
+		close(h.lines)
+		<-h.done
 		delete(l.handles, prog)
 	}
 	close(l.VMsDone)
 }
 
+// Abandon stops the programs from running the lines still to come on the
+// lines channel and those buffered for them, counting each in
+// ProgLinesAbandoned, so that VMsDone is closed soon after the lines channel
+// is.  It's for a shutdown that can't wait for the programs to catch up.
+func (l *Loader) Abandon() {
+	l.abandonOnce.Do(func() {
+		close(l.abandon)
+	})
+}
+
+// sent counts a line sent to the program of h.
+func (l *Loader) sent(prog string, h *vmHandle) {
+	ProgLines.Add(prog, 1)
+	h.depth.Set(int64(len(h.lines)))
+}
+
+// send sends line to the program of h, and returns false if the lines have
+// been abandoned instead.
+func (l *Loader) send(h *vmHandle, line *logline.LogLine) bool {
+	select {
+	case <-l.abandon:
+		return false
+	default:
+	}
+	select {
+	case h.lines <- line:
+		return true
+	case <-l.abandon:
+		return false
+	}
+}
+
 // UnloadProgram removes the named program from the watcher to prevent future
 // updates, and terminates any currently running VM goroutine.
 func (l *Loader) UnloadProgram(pathname string) {
@@ -245,9 +668,72 @@ func (l *Loader) UnloadProgram(pathname string) {
 	name := filepath.Base(pathname)
 	l.handleMu.Lock()
 	defer l.handleMu.Unlock()
+	if loaded, ok := l.progPaths[name]; ok && loaded != pathname {
+		// A duplicate of the program that was never loaded.
+		return
+	}
+	delete(l.progPaths, name)
 	if handle, ok := l.handles[name]; ok {
 		close(handle.lines)
 		<-handle.done
 		delete(l.handles, name)
+		ProgHealthy.Delete(name)
+		ProgLineQueueDepth.Delete(name)
+	}
+	ProgHashes.Delete(name)
+	delete(l.progs, name)
+	l.ms.RemoveProgramMetrics(name)
+}
+
+// programNamespace returns the namespace derived from a program name, which
+// is the file name without its extension, with the characters not valid in a
+// namespace replaced by underscores.
+func programNamespace(name string) string {
+	ns := []rune(strings.TrimSuffix(name, filepath.Ext(name)))
+	for i, r := range ns {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			ns[i] = '_'
+		}
+	}
+	return string(ns)
+}
+
+// checkMetricNames returns an error listing the keys in ms that would be
+// exported to Prometheus as the same label name, and if strict, the metric and
+// key names that aren't valid Prometheus names, or nil if there are none.
+func checkMetricNames(ms *metrics.Store, strict bool) error {
+	var errs []string
+	for _, m := range ms.Metrics {
+		if strict && !validName.MatchString(m.Name) {
+			errs = append(errs, fmt.Sprintf("Invalid metric name %q: a metric name must be letters, digits and underscores, starting with a letter or a single underscore.", m.Name))
+		}
+		exported := make(map[string]string)
+		for _, k := range m.Keys {
+			if strict && !validName.MatchString(k) {
+				errs = append(errs, fmt.Sprintf("Invalid key %q of metric %s: a key must be letters, digits and underscores, starting with a letter or a single underscore.", k, m.Name))
+			}
+			name := metrics.PrometheusName(k)
+			if other, ok := exported[name]; ok {
+				errs = append(errs, fmt.Sprintf("Keys %q and %q of metric %s are both exported as %q.", other, k, m.Name, name))
+				continue
+			}
+			exported[name] = k
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// setHealthy records whether the named program is processing lines.
+func setHealthy(name string, healthy bool) {
+	v := new(expvar.Int)
+	if healthy {
+		v.Set(1)
 	}
+	ProgHealthy.Set(name, v)
 }
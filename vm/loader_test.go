@@ -4,9 +4,19 @@
 package vm
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/mtail/logline"
 	"github.com/google/mtail/metrics"
 	"github.com/google/mtail/watcher"
 	"github.com/kylelemons/godebug/pretty"
@@ -16,16 +26,16 @@ import (
 func TestNewLoader(t *testing.T) {
 	w := watcher.NewFakeWatcher()
 	store := metrics.NewStore()
-	inLines := make(chan string)
+	inLines := make(chan *logline.LogLine)
 	fs := afero.NewMemMapFs()
-	o := LoaderOptions{store, inLines, w, fs, false, false, true}
+	o := LoaderOptions{Store: store, Lines: inLines, W: w, FS: fs, SyslogUseCurrentYear: true}
 	l, err := NewLoader(o)
 	if err != nil {
 		t.Fatalf("couldn't create loader: %s", err)
 	}
 	done := make(chan struct{})
-	outLines := make(chan string)
-	handle := &vmHandle{outLines, done}
+	outLines := make(chan *logline.LogLine)
+	handle := &vmHandle{lines: outLines, done: done}
 	l.handleMu.Lock()
 	l.handles["test"] = handle
 	l.handleMu.Unlock()
@@ -41,10 +51,10 @@ func TestNewLoader(t *testing.T) {
 func TestCompileAndRun(t *testing.T) {
 	var testProgram = "/$/ {}\n"
 	store := metrics.NewStore()
-	lines := make(chan string)
+	lines := make(chan *logline.LogLine)
 	w := watcher.NewFakeWatcher()
 	fs := afero.NewMemMapFs()
-	o := LoaderOptions{store, lines, w, fs, false, false, true}
+	o := LoaderOptions{Store: store, Lines: lines, W: w, FS: fs, SyslogUseCurrentYear: true}
 	l, err := NewLoader(o)
 	if err != nil {
 		t.Fatalf("couldn't create loader: %s", err)
@@ -74,6 +84,338 @@ func TestCompileAndRun(t *testing.T) {
 	}
 }
 
+// The dump of testProgram, as compiled by CompileAndRun.
+const expectedDump = `Prog dump
+Metrics
+REs
+        0 /$/
+Strings
+ disasm l    op opnd
+        0 match    0 /$/
+        1   jnm    2 -> 2
+`
+
+func TestDumpBytecode(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	var b bytes.Buffer
+	o := LoaderOptions{Store: store, Lines: lines, W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), DumpBytecode: true, DumpWriter: &b}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("dump", strings.NewReader("/$/ { }\n")); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	close(lines)
+	<-l.VMsDone
+	if diff := pretty.Compare(expectedDump, b.String()); len(diff) > 0 {
+		t.Errorf("dump doesn't match:\n%s\ngot:\n%s", diff, b.String())
+	}
+}
+
+func TestLoadProgsCompileOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtail_progs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	o := LoaderOptions{Store: metrics.NewStore(), Lines: make(chan *logline.LogLine), W: watcher.NewFakeWatcher(), CompileOnly: true}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.LoadProgs(dir); err != nil {
+		t.Errorf("empty program directory returned error: %s", err)
+	}
+
+	programs := map[string]string{
+		"good.mtail":  "counter lines\n/$/ {\n  lines++\n}\n",
+		"bad.mtail":   "counter lines\n/$/ {\n  lines++\n",
+		"worse.mtail": "counter lines\n\n/$/ {\n  $1++\n}\n",
+	}
+	for name, program := range programs {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(program), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = l.LoadProgs(dir)
+	if err == nil {
+		t.Fatal("expected errors from the broken programs")
+	}
+	for _, expected := range []string{"bad.mtail:4:", "worse.mtail:4:"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error doesn't contain %q: %s", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "good.mtail") {
+		t.Errorf("error contains the good program: %s", err)
+	}
+}
+
+// TestLoadProgsPattern tests that only the programs matching a glob pattern
+// are loaded, including those created after the pattern is loaded.
+func TestLoadProgsPattern(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	w := watcher.NewFakeWatcher()
+	for _, p := range []string{"/progs/prod_apache.mtail", "/progs/exp_apache.mtail", "/progs/prod_rsyncd.mtail"} {
+		if err := afero.WriteFile(fs, p, []byte(testProgram), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := NewLoader(LoaderOptions{Store: metrics.NewStore(), Lines: make(chan *logline.LogLine), W: w, FS: fs})
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.LoadProgs("/progs/prod_*.mtail"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/progs/prod_ntpd.mtail", "/progs/exp_ntpd.mtail"} {
+		if err := afero.WriteFile(fs, p, []byte(testProgram), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w.InjectCreate(p)
+	}
+	w.Close()
+	<-l.watcherDone
+
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	var programs []string
+	for program := range l.handles {
+		programs = append(programs, program)
+	}
+	sort.Strings(programs)
+	expected := []string{"prod_apache.mtail", "prod_ntpd.mtail", "prod_rsyncd.mtail"}
+	if diff := pretty.Compare(expected, programs); len(diff) > 0 {
+		t.Errorf("loaded programs don't match:\n%s", diff)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	w := watcher.NewFakeWatcher()
+	o := LoaderOptions{Store: store, Lines: lines, W: w, FS: afero.NewMemMapFs(), RateLimits: map[string]int{"limited": 10}}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	for _, name := range []string{"limited", "unlimited"} {
+		if err := l.CompileAndRun(name, strings.NewReader("counter lines\n/$/ {\n  lines++\n}\n")); err != nil {
+			t.Fatalf("CompileAndRun returned error: %s", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		lines <- logline.New("log", "line")
+	}
+	close(lines)
+	<-l.VMsDone
+
+	counts := make(map[string]int64)
+	for _, m := range store.Metrics {
+		d, err := m.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[m.Program] = d.Value
+	}
+	if counts["unlimited"] != 100 {
+		t.Errorf("unlimited program got %d lines, want all 100", counts["unlimited"])
+	}
+	// The burst is 10 lines, and a few more may be allowed while the lines
+	// are sent.
+	if counts["limited"] < 10 || counts["limited"] > 20 {
+		t.Errorf("limited program got %d lines, want about 10", counts["limited"])
+	}
+	if d := ProgLinesDropped.Get("limited"); d == nil || d.String() != fmt.Sprintf("%d", 100-counts["limited"]) {
+		t.Errorf("dropped lines not counted: %v", d)
+	}
+}
+
+// TestAbandon tests that the lines sent after the loader is told to abandon
+// them aren't run, and are counted.
+func TestAbandon(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	o := LoaderOptions{Store: store, Lines: lines, W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs()}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("abandoned", strings.NewReader("counter lines\n/$/ {\n  lines++\n}\n")); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	l.Abandon()
+	for i := 0; i < 10; i++ {
+		lines <- logline.New("log", "line")
+	}
+	close(lines)
+	<-l.VMsDone
+
+	d, err := store.Metrics[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Get() != 0 {
+		t.Errorf("abandoned lines run: got %d", d.Get())
+	}
+	if a := ProgLinesAbandoned.Get("abandoned"); a == nil || a.String() != "10" {
+		t.Errorf("abandoned lines not counted: %v", a)
+	}
+}
+
+// TestProgramLogs tests that each program only reads the lines of the logs
+// matching its log patterns, while every line is still counted.
+func TestProgramLogs(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	o := LoaderOptions{Store: store, Lines: lines, W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs()}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	for name, logs := range map[string]string{"a": "/var/log/a/*", "b": "/var/log/b/*"} {
+		prog := fmt.Sprintf("logs %q\ncounter lines by log\n/$/ {\n  lines[getfilename()]++\n}\n", logs)
+		if err := l.CompileAndRun(name, strings.NewReader(prog)); err != nil {
+			t.Fatalf("CompileAndRun returned error: %s", err)
+		}
+	}
+	LineCount.Set(0)
+	for _, pathname := range []string{"/var/log/a/access.log", "/var/log/b/access.log", "/var/log/b/access.log", "/var/log/c/access.log"} {
+		lines <- logline.New(pathname, "line")
+	}
+	close(lines)
+	<-l.VMsDone
+
+	counts := make(map[string]map[string]int64)
+	for _, m := range store.Metrics {
+		counts[m.Program] = make(map[string]int64)
+		lc := make(chan *metrics.LabelSet)
+		go m.EmitLabelSets(lc)
+		for ls := range lc {
+			counts[m.Program][ls.Labels["log"]] = ls.Datum.Get()
+		}
+	}
+	expected := map[string]map[string]int64{
+		"a": {"/var/log/a/access.log": 1},
+		"b": {"/var/log/b/access.log": 2},
+	}
+	if diff := pretty.Compare(expected, counts); len(diff) > 0 {
+		t.Errorf("lines read by programs don't match:\n%s", diff)
+	}
+	if LineCount.String() != "4" {
+		t.Errorf("expected every line counted, got %s", LineCount.String())
+	}
+}
+
+func TestIgnorePattern(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	o := LoaderOptions{Store: store, Lines: lines, W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), IgnorePattern: regexp.MustCompile(`GET /healthz`)}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("prog", strings.NewReader("counter lines\n/$/ {\n  lines++\n}\n")); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	LinesIgnored.Set(0)
+	for _, line := range []string{"GET /index.html", "GET /healthz", "GET /healthz", "POST /login"} {
+		lines <- logline.New("log", line)
+	}
+	close(lines)
+	<-l.VMsDone
+
+	d, err := store.Metrics[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Value != 2 {
+		t.Errorf("program got %d lines, want the 2 not ignored", d.Value)
+	}
+	if n := LinesIgnored.Value(); n != 2 {
+		t.Errorf("ignored lines: got %d, want 2", n)
+	}
+}
+
+func TestLoadProgGetenv(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader(LoaderOptions{Store: store, Lines: lines, W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs()})
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	os.Setenv("MTAIL_TEST_DC", "dc1")
+	defer os.Unsetenv("MTAIL_TEST_DC")
+	prog := "counter lines by dc, rack\n/$/ {\n  lines[getenv(\"MTAIL_TEST_DC\")][getenv(\"MTAIL_TEST_UNSET\", \"r0\")]++\n}\n"
+	if err := l.CompileAndRun("env", strings.NewReader(prog)); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	// A ${name} in a string is left alone, for subst to refer to a group.
+	prog = "counter paths by path\n/(.*)/ {\n  paths[subst($1, \"(?P<id>\\d+)\", \"<${id}>\")]++\n}\n"
+	if err := l.CompileAndRun("subst", strings.NewReader(prog)); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	lines <- logline.New("log", "/user/123")
+	close(lines)
+	<-l.VMsDone
+
+	if d, err := store.Metrics[0].GetDatum("dc1", "r0"); err != nil || d.Get() != 1 {
+		t.Errorf("line not counted against the environment's labels: %v %v", d, err)
+	}
+	if d, err := store.Metrics[1].GetDatum("/user/<123>"); err != nil || d.Get() != 1 {
+		t.Errorf("line not counted against its path: %v %v", d, err)
+	}
+	if err := l.CompileAndRun("unset", strings.NewReader("counter a by dc\n/x/ {\n  a[getenv(\"MTAIL_TEST_UNSET\")]++\n}\n")); err == nil {
+		t.Error("unset variable didn't fail to compile")
+	}
+}
+
+func TestProgFlags(t *testing.T) {
+	prog := "counter lines\n" +
+		"#if staging\n" +
+		"counter staging_lines\n" +
+		"#endif\n" +
+		"/$/ {\n" +
+		"  lines++\n" +
+		"#if staging\n" +
+		"  staging_lines++\n" +
+		"#endif\n" +
+		"}\n"
+	for _, tc := range []struct {
+		flags    []string
+		expected []string
+	}{
+		{nil, []string{"lines"}},
+		{[]string{"staging"}, []string{"lines", "staging_lines"}},
+	} {
+		store := metrics.NewStore()
+		lines := make(chan *logline.LogLine)
+		l, err := NewLoader(LoaderOptions{Store: store, Lines: lines, W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), ProgFlags: tc.flags})
+		if err != nil {
+			t.Fatalf("couldn't create loader: %s", err)
+		}
+		if err := l.CompileAndRun("flags", strings.NewReader(prog)); err != nil {
+			t.Fatalf("flags %q: CompileAndRun returned error: %s", tc.flags, err)
+		}
+		lines <- logline.New("log", "line")
+		close(lines)
+		<-l.VMsDone
+
+		var result []string
+		for _, m := range store.Metrics {
+			if d, err := m.GetDatum(); err != nil || d.Get() != 1 {
+				t.Errorf("flags %q: %s not incremented: %v %v", tc.flags, m.Name, d, err)
+			}
+			result = append(result, m.Name)
+		}
+		if diff := pretty.Compare(tc.expected, result); diff != "" {
+			t.Errorf("flags %q: metrics didn't match:\n%s", tc.flags, diff)
+		}
+	}
+}
+
 var testProcessEvents = []struct {
 	name             string
 	events           []watcher.Event
@@ -115,9 +457,9 @@ func TestProcessEvents(t *testing.T) {
 		w := watcher.NewFakeWatcher()
 		w.Add(".")
 		store := metrics.NewStore()
-		lines := make(chan string)
+		lines := make(chan *logline.LogLine)
 		fs := afero.NewMemMapFs()
-		o := LoaderOptions{store, lines, w, fs, false, false, true}
+		o := LoaderOptions{Store: store, Lines: lines, W: w, FS: fs, SyslogUseCurrentYear: true}
 		l, err := NewLoader(o)
 		if err != nil {
 			t.Fatalf("couldn't create loader: %s", err)
@@ -173,3 +515,344 @@ func TestProcessEvents(t *testing.T) {
 
 	}
 }
+
+func TestReloadReplacesMetrics(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	w := watcher.NewFakeWatcher()
+	fs := afero.NewMemMapFs()
+	o := LoaderOptions{Store: store, Lines: lines, W: w, FS: fs, SyslogUseCurrentYear: true}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	defer close(lines)
+	metricNames := func() []string {
+		store.RLock()
+		defer store.RUnlock()
+		names := []string{}
+		for _, m := range store.Metrics {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+
+	if err := l.CompileAndRun("reload.mtail", strings.NewReader("counter foo\n")); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	if diff := pretty.Compare([]string{"foo"}, metricNames()); len(diff) > 0 {
+		t.Errorf("metrics after load don't match:\n%s", diff)
+	}
+
+	if err := l.CompileAndRun("reload.mtail", strings.NewReader("counter bar\n/(/ {}\n")); err == nil {
+		t.Errorf("CompileAndRun of a bad program succeeded")
+	}
+	if diff := pretty.Compare([]string{"foo"}, metricNames()); len(diff) > 0 {
+		t.Errorf("metrics after failed reload don't match:\n%s", diff)
+	}
+	l.handleMu.RLock()
+	if _, ok := l.handles["reload.mtail"]; !ok {
+		t.Errorf("program not running after failed reload")
+	}
+	l.handleMu.RUnlock()
+
+	if err := l.CompileAndRun("reload.mtail", strings.NewReader("counter bar\n")); err != nil {
+		t.Fatalf("CompileAndRun returned error: %s", err)
+	}
+	if diff := pretty.Compare([]string{"bar"}, metricNames()); len(diff) > 0 {
+		t.Errorf("metrics after reload don't match:\n%s", diff)
+	}
+
+	l.UnloadProgram("reload.mtail")
+	if diff := pretty.Compare([]string{}, metricNames()); len(diff) > 0 {
+		t.Errorf("metrics after unload don't match:\n%s", diff)
+	}
+}
+
+// parallelProgram counts its lines, and keeps the number on the last line it
+// ran, which is the last line sent if the program saw the lines in order.
+const parallelProgram = "counter lines_total\ngauge last\n/(\\d+)/ {\n  lines_total++\n  last = $1\n}\n"
+
+// TestParallelPrograms tests that programs run concurrently each see every
+// line in order.  Run with -race to check that they share no state.
+func TestParallelPrograms(t *testing.T) {
+	store := metrics.NewStore()
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader(LoaderOptions{Store: store, Lines: lines, W: watcher.NewFakeWatcher(), Workers: 2})
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	const programs, count = 8, 1000
+	for i := 0; i < programs; i++ {
+		if err := l.CompileAndRun(fmt.Sprintf("prog%d", i), strings.NewReader(parallelProgram)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		lines <- logline.New("test", fmt.Sprintf("line %d", i))
+	}
+	close(lines)
+	<-l.VMsDone
+
+	expected := map[string]int64{"lines_total": count, "last": count - 1}
+	seen := 0
+	for _, m := range store.Metrics {
+		d, err := m.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Value != expected[m.Name] {
+			t.Errorf("%s %s: got %d, want %d", m.Program, m.Name, d.Value, expected[m.Name])
+		}
+		seen++
+	}
+	if seen != programs*len(expected) {
+		t.Errorf("expected %d metrics, got %d", programs*len(expected), seen)
+	}
+}
+
+// BenchmarkParallelPrograms measures the line throughput of many programs as
+// the number of workers running them grows.
+func BenchmarkParallelPrograms(b *testing.B) {
+	prog := "counter matches\n" +
+		"/^(?P<host>[a-z0-9.-]+) (?P<user>\\w+) \\[(?P<date>[^\\]]+)\\] \"(?P<method>[A-Z]+) (?P<path>\\S+)\" (?P<code>\\d+) (?P<size>\\d+)$/ {\n" +
+		"  matches++\n}\n"
+	line := logline.New("bench", `www.example.com frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif" 200 2326`)
+	for workers := 1; workers <= runtime.GOMAXPROCS(0); workers *= 2 {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			lines := make(chan *logline.LogLine)
+			l, err := NewLoader(LoaderOptions{Store: metrics.NewStore(), Lines: lines, W: watcher.NewFakeWatcher(), Workers: workers})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < 16; i++ {
+				if err := l.CompileAndRun(fmt.Sprintf("prog%d", i), strings.NewReader(prog)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lines <- line
+			}
+			close(lines)
+			<-l.VMsDone
+		})
+	}
+}
+
+// TestProgLineQueueDepth tests that the queue depth of a program counts the
+// lines waiting while it's held up, and falls to zero once it catches up.
+func TestProgLineQueueDepth(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	l, err := NewLoader(LoaderOptions{Store: metrics.NewStore(), Lines: lines, W: watcher.NewFakeWatcher(), Workers: 1})
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.CompileAndRun("queued", strings.NewReader(parallelProgram)); err != nil {
+		t.Fatal(err)
+	}
+	// Take the only worker, so that the program holds its first line and
+	// the rest wait in its buffer.
+	l.workers <- struct{}{}
+	for i := 0; i < 5; i++ {
+		lines <- logline.New("test", fmt.Sprintf("line %d", i))
+	}
+	depth := func() string {
+		if d := ProgLineQueueDepth.Get("queued"); d != nil {
+			return d.String()
+		}
+		return ""
+	}
+	for i := 0; i < 100 && depth() != "4"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := depth(); d != "4" {
+		t.Errorf("queue depth while held up: got %q, want 4", d)
+	}
+	<-l.workers
+	close(lines)
+	<-l.VMsDone
+	if d := depth(); d != "0" {
+		t.Errorf("queue depth after catching up: got %q, want 0", d)
+	}
+}
+
+// BenchmarkProgLineBuffer measures the line throughput of programs of
+// differing speeds as the number of lines buffered for each grows.
+func BenchmarkProgLineBuffer(b *testing.B) {
+	fast := "counter matches\n/GET/ {\n  matches++\n}\n"
+	slow := "counter matches\n" +
+		"/^(?P<host>[a-z0-9.-]+) (?P<user>\\w+) \\[(?P<date>[^\\]]+)\\] \"(?P<method>[A-Z]+) (?P<path>\\S+)\" (?P<code>\\d+) (?P<size>\\d+)$/ {\n" +
+		"  matches++\n}\n"
+	line := logline.New("bench", `www.example.com frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif" 200 2326`)
+	for _, buffer := range []int{1, DefaultProgLineBuffer, 10 * DefaultProgLineBuffer} {
+		b.Run(fmt.Sprintf("buffer=%d", buffer), func(b *testing.B) {
+			lines := make(chan *logline.LogLine)
+			l, err := NewLoader(LoaderOptions{Store: metrics.NewStore(), Lines: lines, W: watcher.NewFakeWatcher(), ProgLineBuffer: buffer})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i, prog := range []string{fast, slow} {
+				if err := l.CompileAndRun(fmt.Sprintf("prog%d", i), strings.NewReader(prog)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lines <- line
+			}
+			close(lines)
+			<-l.VMsDone
+		})
+	}
+}
+
+// BenchmarkIgnorePattern measures the line throughput of programs when the
+// lines are ignored before reaching them, against when they're not.
+func BenchmarkIgnorePattern(b *testing.B) {
+	prog := "counter matches\n" +
+		"/^(?P<host>[a-z0-9.-]+) (?P<user>\\w+) \\[(?P<date>[^\\]]+)\\] \"(?P<method>[A-Z]+) (?P<path>\\S+)\" (?P<code>\\d+) (?P<size>\\d+)$/ {\n" +
+		"  matches++\n}\n"
+	line := logline.New("bench", `www.example.com frank [10/Oct/2000:13:55:36 -0700] "GET /healthz" 200 2326`)
+	for name, pattern := range map[string]string{"not ignored": "", "ignored": `"GET /healthz"`} {
+		pattern := pattern
+		b.Run(name, func(b *testing.B) {
+			lines := make(chan *logline.LogLine)
+			o := LoaderOptions{Store: metrics.NewStore(), Lines: lines, W: watcher.NewFakeWatcher()}
+			if pattern != "" {
+				o.IgnorePattern = regexp.MustCompile(pattern)
+			}
+			l, err := NewLoader(o)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < 16; i++ {
+				if err := l.CompileAndRun(fmt.Sprintf("prog%d", i), strings.NewReader(prog)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lines <- line
+			}
+			close(lines)
+			<-l.VMsDone
+		})
+	}
+}
+
+func TestProgramNamespace(t *testing.T) {
+	for name, expected := range map[string]string{
+		"apache.mtail":    "apache",
+		"team-b.mtail":    "team_b",
+		"2fa.mtail":       "_fa",
+		"http_v2.mtail":   "http_v2",
+		"nginx.log.mtail": "nginx_log",
+		"no_extension":    "no_extension",
+	} {
+		if ns := programNamespace(name); ns != expected {
+			t.Errorf("programNamespace(%q): got %q, want %q", name, ns, expected)
+		}
+		if !validNamespace.MatchString(programNamespace(name)) {
+			t.Errorf("programNamespace(%q) isn't a valid namespace", name)
+		}
+	}
+}
+
+func TestStrictMetricNames(t *testing.T) {
+	prog := "counter requests as \"requests-total\" by \"status.code\"\ncounter \"__reserved\"\ncounter lines\n"
+	for _, strict := range []bool{false, true} {
+		o := LoaderOptions{Store: metrics.NewStore(), Lines: make(chan *logline.LogLine), W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), CompileOnly: true, StrictMetricNames: strict}
+		l, err := NewLoader(o)
+		if err != nil {
+			t.Fatalf("couldn't create loader: %s", err)
+		}
+		err = l.CompileAndRun("names", strings.NewReader(prog))
+		if !strict {
+			if err != nil {
+				t.Errorf("invalid names rejected without strict_metric_names: %s", err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatal("invalid names not rejected with strict_metric_names")
+		}
+		for _, expected := range []string{`"requests-total"`, `"status.code"`, `"__reserved"`} {
+			if !strings.Contains(err.Error(), expected) {
+				t.Errorf("error doesn't contain %s: %s", expected, err)
+			}
+		}
+		if strings.Contains(err.Error(), "lines") {
+			t.Errorf("error contains the valid metric: %s", err)
+		}
+	}
+}
+
+// TestKeysExportedAsSameName tests that a program is rejected if two keys of a
+// metric would be exported as the same Prometheus label, even without
+// strict_metric_names.
+func TestKeysExportedAsSameName(t *testing.T) {
+	o := LoaderOptions{Store: metrics.NewStore(), Lines: make(chan *logline.LogLine), W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), CompileOnly: true}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	err = l.CompileAndRun("keys", strings.NewReader("counter requests by \"status.code\", \"status-code\"\n"))
+	if err == nil {
+		t.Fatal("keys exported as the same name not rejected")
+	}
+	if !strings.Contains(err.Error(), `"status_code"`) {
+		t.Errorf("error doesn't contain the exported name: %s", err)
+	}
+}
+
+func TestWarningsAsErrors(t *testing.T) {
+	prog := "counter lines\ncounter errors\n/(\\d+)/ {\n  lines++\n}\n"
+	for _, werror := range []bool{false, true} {
+		o := LoaderOptions{Store: metrics.NewStore(), Lines: make(chan *logline.LogLine), W: watcher.NewFakeWatcher(), FS: afero.NewMemMapFs(), CompileOnly: true, WarningsAsErrors: werror}
+		l, err := NewLoader(o)
+		if err != nil {
+			t.Fatalf("couldn't create loader: %s", err)
+		}
+		err = l.CompileAndRun("warnings", strings.NewReader(prog))
+		if !werror {
+			if err != nil {
+				t.Errorf("warnings failed the load without Werror: %s", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "warnings:2:") {
+			t.Errorf("warnings didn't fail the load with Werror: %v", err)
+		}
+	}
+}
+
+// TestDuplicateProgramIgnored tests that a program with the same name as one
+// loaded from another directory isn't loaded, nor unloaded when deleted.
+func TestDuplicateProgramIgnored(t *testing.T) {
+	store := metrics.NewStore()
+	fs := afero.NewMemMapFs()
+	for _, p := range []string{"/a/test.mtail", "/b/test.mtail"} {
+		if err := afero.WriteFile(fs, p, []byte("counter "+path.Base(path.Dir(p))+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := LoaderOptions{Store: store, Lines: make(chan *logline.LogLine), W: watcher.NewFakeWatcher(), FS: fs}
+	l, err := NewLoader(o)
+	if err != nil {
+		t.Fatalf("couldn't create loader: %s", err)
+	}
+	if err := l.LoadProg("/a/test.mtail"); err != nil {
+		t.Fatal(err)
+	}
+	err = l.LoadProg("/b/test.mtail")
+	if _, ok := err.(*duplicateProgError); !ok {
+		t.Errorf("expected a duplicate program error, got %v", err)
+	}
+	l.UnloadProgram("/b/test.mtail")
+	store.RLock()
+	defer store.RUnlock()
+	if len(store.Metrics) != 1 || store.Metrics[0].Name != "a" {
+		t.Errorf("the first program's metrics were replaced: %v", store.Metrics)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+)
+
+// parseLogfmt parses a line of logfmt style key=value pairs separated by
+// spaces.  A value may be double quoted to include spaces, with \" and \\
+// escaping a quote and backslash inside the quotes.  A bare key without a
+// value maps to the empty string.  If a key appears more than once, the last
+// value is kept.
+func parseLogfmt(line string) map[string]string {
+	fields := make(map[string]string)
+	i := 0
+	for i < len(line) {
+		// Skip the spaces between pairs.
+		for i < len(line) && line[i] == ' ' {
+			i++
+		}
+		start := i
+		for i < len(line) && line[i] != ' ' && line[i] != '=' {
+			i++
+		}
+		key := line[start:i]
+		if i >= len(line) || line[i] != '=' {
+			if key != "" {
+				fields[key] = ""
+			}
+			continue
+		}
+		i++ // Skip the =.
+		var value string
+		if i < len(line) && line[i] == '"' {
+			value, i = parseLogfmtQuoted(line, i+1)
+		} else {
+			start = i
+			for i < len(line) && line[i] != ' ' {
+				i++
+			}
+			value = line[start:i]
+		}
+		if key != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// parseLogfmtQuoted returns the quoted value starting at i, just after the
+// opening quote, and the position after the closing quote.  An unterminated
+// value runs to the end of the line.
+func parseLogfmtQuoted(line string, i int) (string, int) {
+	var b bytes.Buffer
+	for i < len(line) {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line):
+			b.WriteByte(line[i+1])
+			i += 2
+		case c == '"':
+			return b.String(), i + 1
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String(), i
+}
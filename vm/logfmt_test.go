@@ -0,0 +1,43 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+var logfmtTests = []struct {
+	line   string
+	fields map[string]string
+}{
+	{"", map[string]string{}},
+	{"level=error user=alice latency=12ms",
+		map[string]string{"level": "error", "user": "alice", "latency": "12ms"}},
+	{`msg="disk full" code=507`,
+		map[string]string{"msg": "disk full", "code": "507"}},
+	{`msg="say \"hi\"" path="C:\\tmp"`,
+		map[string]string{"msg": `say "hi"`, "path": `C:\tmp`}},
+	{"debug level=info",
+		map[string]string{"debug": "", "level": "info"}},
+	{"empty= next=1",
+		map[string]string{"empty": "", "next": "1"}},
+	{`  spaced=1   out=2  `,
+		map[string]string{"spaced": "1", "out": "2"}},
+	{`msg="unterminated value`,
+		map[string]string{"msg": "unterminated value"}},
+	{"a=1 a=2",
+		map[string]string{"a": "2"}},
+	{"=orphan b=2",
+		map[string]string{"b": "2"}},
+}
+
+func TestParseLogfmt(t *testing.T) {
+	for _, tc := range logfmtTests {
+		if diff := pretty.Compare(tc.fields, parseLogfmt(tc.line)); diff != "" {
+			t.Errorf("%q: fields diff:\n%s", tc.line, diff)
+		}
+	}
+}
@@ -9,7 +9,10 @@ import (
     "flag"
     "fmt"
     "regexp"
+    "regexp/syntax"
     "strconv"
+    "strings"
+    "time"
 
     "github.com/google/mtail/metrics"
 )
@@ -20,30 +23,40 @@ import (
 {
     intVal int64
     floatVal float64
+    duration time.Duration
     op int
     text string
     texts []string
-    flag bool
+    labelSets [][]string
+    intVals []int64
+    floatVals []float64
     n node
     kind metrics.Kind
 }
 
-%type <n> stmt_list stmt cond arg_expr_list compound_statement conditional_statement expression_statement
-%type <n> expr primary_expr multiplicative_expr additive_expr postfix_expr unary_expr assign_expr rel_expr shift_expr bitwise_expr
+%type <n> stmt_list block_body stmt cond arg_expr_list compound_statement conditional_statement expression_statement
+%type <n> expr primary_expr multiplicative_expr additive_expr postfix_expr unary_expr assign_expr rel_expr shift_expr bitwise_expr coalesce_expr
 %type <n> declaration declarator definition decoration_statement
 %type <kind> type_spec
 %type <text> as_spec
-%type <texts> by_spec by_expr_list
-%type <flag> hide_spec
+%type <texts> by_spec by_expr_list label_set string_list
+%type <labelSets> init_spec label_set_list
+%type <intVals> buckets_spec bucket_list
+%type <floatVals> quantiles_spec quantile_list
+%type <duration> after_spec reset_spec
+%type <intVal> limit_spec
 %type <op> relop shift_op bitwise_op
 %type <text> pattern_expr
+%type <text> id
 // Tokens and types are defined here.
 // Invalid input
 %token <text> INVALID
 // Types
-%token COUNTER GAUGE TIMER
+%token COUNTER GAUGE TIMER HISTOGRAM
 // Reserved words
-%token AS BY CONST HIDDEN DEF NEXT
+%token AFTER AS BY BUCKETS CONST HIDDEN DEF DEL ELSE EVERY NEXT RECORD RESET
+// Keywords that can also be used as names, so they keep their text.
+%token <text> LIMIT LOGS LRU NAMESPACE QUANTILES SAMPLE SUMMARY UPDATED
 // Builtins
 %token <text> BUILTIN
 // Literals: re2 syntax regular expression, quoted strings, regex capture group
@@ -55,18 +68,25 @@ import (
 %token <text> DECO
 %token <intVal> INTLITERAL
 %token <floatVal> FLOATLITERAL
+%token <duration> DURATIONLITERAL
 // Operators, in order of precedence
 %token <op> INC
-%token <op> DIV MUL MINUS PLUS POW
+%token <op> DIV MOD MUL MINUS PLUS POW
 %token <op> SHL SHR
 %token <op> LT GT LE GE EQ NE
 %token <op> AND OR XOR NOT
+%token <op> COALESCE
 %token <op> ADD_ASSIGN ASSIGN
 // Punctuation
 %token LCURLY RCURLY LPAREN RPAREN LSQUARE RSQUARE
 %token COMMA
 %token NL
 
+// A string after a declaration is its help text, and a keyword after one is
+// its option, rather than the start of a statement on the same line.
+%nonassoc DECLARATION
+%nonassoc STRING LIMIT LRU QUANTILES UPDATED
+
 %start start
 %%
 
@@ -106,12 +126,58 @@ stmt
   { $$ = $1 }
   | NEXT
   {
+    // Remember where the decorated block goes, so that definition can find
+    // the capture groups visible to it.
+    mtaillex.(*parser).nextScope = mtaillex.(*parser).s
     $$ = &nextNode{}
   }
-  | CONST ID pattern_expr
+  | DEL postfix_expr
+  {
+    $$ = &delNode{$2}
+  }
+  /* Lines that don't match the record start pattern are joined to the
+     record before them, so the program sees each record as one line. */
+  | RECORD pattern_expr
+  {
+    if re, err := mtaillex.(*parser).compileRegex($2); err != nil {
+      mtaillex.(*parser).ErrorP(regexError(err), mtaillex.(*parser).pos)
+    } else {
+      $$ = &recordNode{pattern: $2, re: re}
+    }
+  }
+  /* The names of the program's metrics are prefixed with the namespace when
+     exported, to keep them apart from other programs' metrics. */
+  | NAMESPACE STRING
+  {
+    $$ = &namespaceNode{name: $2}
+  }
+  /* Only lines from logs whose path matches one of the program's log
+     patterns are sent to it. */
+  | LOGS STRING
+  {
+    $$ = &logsNode{pattern: $2}
+  }
+  /* Each line of a sampled log stands for this many events, so increments
+     without an amount count it instead of one. */
+  | SAMPLE INTLITERAL
+  {
+    if $2 <= 0 {
+      mtaillex.Error(fmt.Sprintf("Sample rate %d is not positive.", $2))
+    }
+    $$ = &sampleNode{rate: $2}
+  }
+  | CONST id
+  {
+    if _, ok := mtaillex.(*parser).res[$2]; ok {
+      mtaillex.Error(fmt.Sprintf("Constant '%s' already defined.", $2))
+    }
+    mtaillex.(*parser).constName = $2
+  }
+  pattern_expr
   {
+    mtaillex.(*parser).constName = ""
     // Store the regex for concatenation
-    mtaillex.(*parser).res[$2] = $3
+    mtaillex.(*parser).res[$2] = $4
   }
   ;
 
@@ -119,7 +185,15 @@ conditional_statement
   : cond compound_statement
   {
       if $1 != nil && $2 != nil {
-          $$ = &condNode{$1, []node{$2}}
+          $$ = &condNode{$1, []node{$2}, nil}
+      } else {
+          $$ = $2
+      }
+  }
+  | cond compound_statement ELSE compound_statement
+  {
+      if $1 != nil && $2 != nil {
+          $$ = &condNode{$1, []node{$2}, $4}
       } else {
           $$ = $2
       }
@@ -134,7 +208,7 @@ expression_statement
   ;
 
 compound_statement
-  : LCURLY { mtaillex.(*parser).startScope() } stmt_list RCURLY
+  : LCURLY { mtaillex.(*parser).startScope() } block_body RCURLY
   {
     $$ = $3
     $$.(*stmtlistNode).s = mtaillex.(*parser).s
@@ -142,6 +216,35 @@ compound_statement
   }
   ;
 
+/* The last statement of a block needn't end the line, so that a block of
+   statements separated by semicolons fits on one line, as in
+   /(\d+)/ { a++; b += $1 }. */
+block_body
+  : stmt_list
+  { $$ = $1 }
+  | stmt_list expr
+  {
+    $$ = $1
+    $$.(*stmtlistNode).children = append($$.(*stmtlistNode).children, $2)
+  }
+  ;
+
+/* Operators bind from tightest to loosest as follows, and are left
+   associative within each level:
+
+     ++ ~               increment and bitwise not
+     * / % **           multiplicative and power
+     + -                additive
+     << >>              shift
+     < <= > >= == !=    comparison
+     & | ^              bitwise
+     or                 default for an empty string
+     = +=               assignment
+
+   So $a + $b * 2 > 10 compares the sum against 10.  A comparison is only
+   valid as the condition of a block, as in $latency > 500 { ... }.  The
+   value of $path or "-" is "-" if the optional capture group $path didn't
+   match, and $path otherwise. */
 expr
   : assign_expr
   {
@@ -150,15 +253,24 @@ expr
   ;
 
 assign_expr
-  : bitwise_expr
+  : coalesce_expr
   {
      $$ = $1
   }
-  | unary_expr ASSIGN bitwise_expr
+  | unary_expr ASSIGN coalesce_expr
   {
     $$ = &binaryExprNode{$1, $3, $2}
   }
-  | unary_expr ADD_ASSIGN bitwise_expr
+  | unary_expr ADD_ASSIGN coalesce_expr
+  {
+    $$ = &binaryExprNode{$1, $3, $2}
+  }
+  ;
+
+coalesce_expr
+  : bitwise_expr
+  { $$ = $1 }
+  | coalesce_expr COALESCE bitwise_expr
   {
     $$ = &binaryExprNode{$1, $3, $2}
   }
@@ -248,6 +360,10 @@ multiplicative_expr
   {
     $$ = &binaryExprNode{$1, $3, '/'}
   }
+  | multiplicative_expr MOD unary_expr
+  {
+    $$ = &binaryExprNode{$1, $3, $2}
+  }
   | multiplicative_expr POW unary_expr
   {
     $$ = &binaryExprNode{$1, $3, $2}
@@ -271,6 +387,14 @@ unary_expr
   {
     $$ = &builtinNode{$1, $3}
   }
+  /* Only the fields returned by split and logfmt can be indexed.  Fields
+     from split are numbered from 0, unlike capture groups which are numbered
+     from 1, so in /(.*)/ { ... } split($1, " ")[0] is the first word of the
+     line.  Fields from logfmt are indexed by key, as in logfmt($1)["user"]. */
+  | BUILTIN LPAREN arg_expr_list RPAREN LSQUARE expr RSQUARE
+  {
+    $$ = &indexedExprNode{&builtinNode{$1, $3}, $6}
+  }
   ;
 
 arg_expr_list
@@ -302,7 +426,7 @@ postfix_expr
   ;
 
 primary_expr
-  : ID
+  : id
   {
     if sym, ok := mtaillex.(*parser).s.lookupSym($1, IDSymbol); ok {
       $$ = &idNode{$1, sym}
@@ -343,19 +467,22 @@ primary_expr
 cond
   : pattern_expr
   {
-    if re, err := regexp.Compile($1); err != nil {
-      mtaillex.(*parser).ErrorP(fmt.Sprintf(err.Error()), mtaillex.(*parser).pos)
+    if re, err := mtaillex.(*parser).compileRegex($1); err != nil {
+      mtaillex.(*parser).ErrorP(regexError(err), mtaillex.(*parser).pos)
       // TODO(jaq): force a parse error
     } else {
-      $$ = &regexNode{pattern: $1}
+      // The compiler stores the regex in the program's regex table, so it
+      // is only compiled once.
+      $$ = &regexNode{pattern: $1, re: re, addr: -1, parts: mtaillex.(*parser).patternParts}
       // We can reserve storage for these capturing groups, storing them in
       // the current scope, so that future CAPTUREGROUPs can retrieve their
-      // value.  At parse time, we can warn about nonexistent names.
-      for i := 1; i < re.NumSubexp() + 1; i++ {
+      // value.  At parse time, we can warn about nonexistent names.  $0 is
+      // the whole match, and $1 the first group.
+      for i := 0; i < re.NumSubexp() + 1; i++ {
         sym := mtaillex.(*parser).s.addSym(fmt.Sprintf("%d", i),
                                             CaprefSymbol, $$,
                                             mtaillex.(*parser).pos)
-        sym.addr = i - 1
+        sym.addr = i
       }
       for i, capref := range re.SubexpNames() {
         if capref != "" {
@@ -378,15 +505,22 @@ pattern_expr
     // Stash the start of the pattern_expr in a state variable.
     // We know it's the start because pattern_expr is left associative.
     mtaillex.(*parser).pos = mtaillex.(*parser).t.pos
+    mtaillex.(*parser).patternParts = []patternPart{mtaillex.(*parser).regexPart(0)}
     $$ = $3
   }
   | pattern_expr PLUS opt_nl DIV { mtaillex.(*parser).inRegex() } REGEX DIV
   {
+    mtaillex.(*parser).patternParts = append(mtaillex.(*parser).patternParts, mtaillex.(*parser).regexPart(len($1)))
     $$ = $1 + $6
   }
-  | pattern_expr PLUS ID
+  | pattern_expr PLUS id
   {
-    if s, ok := mtaillex.(*parser).res[$3]; ok {
+    // Constants must be defined before they're used, so a constant can only
+    // form a cycle by referring to itself.
+    if $3 == mtaillex.(*parser).constName {
+      mtaillex.Error(fmt.Sprintf("Constant '%s' refers to itself.", $3))
+    } else if s, ok := mtaillex.(*parser).res[$3]; ok {
+      mtaillex.(*parser).patternParts = append(mtaillex.(*parser).patternParts, patternPart{offset: len($1)})
       $$ = $1 + s
     } else {
       mtaillex.Error(fmt.Sprintf("Constant '%s' not defined.", $3))
@@ -396,35 +530,15 @@ pattern_expr
 
 
 declaration
-  : hide_spec type_spec declarator
-  {
-    $$ = $3
-    d := $$.(*declNode)
-    d.kind = $2
-
-    var n string
-    if d.exportedName != "" {
-        n = d.exportedName
-	} else {
-        n = d.name
-   	}
-    d.m = metrics.NewMetric(n, mtaillex.(*parser).name, d.kind, d.keys...)
-    d.sym = mtaillex.(*parser).s.addSym(d.name, IDSymbol, d.m,
-                                          mtaillex.(*parser).t.pos)
-    if !$1 {
-       mtaillex.(*parser).ms.Add(d.m)
-    }
-  }
-  ;
-
-hide_spec
-  : /* empty */
+  : type_spec declarator %prec DECLARATION
   {
-    $$ = false
+    $$ = mtaillex.(*parser).declare($1, $2.(*declNode), false)
   }
-  | HIDDEN
+  /* A declaration can't start with an empty hide_spec, as keywords like
+     summary can also start an expression. */
+  | HIDDEN type_spec declarator %prec DECLARATION
   {
-    $$ = true
+    $$ = mtaillex.(*parser).declare($2, $3.(*declNode), true)
   }
   ;
 
@@ -439,14 +553,62 @@ declarator
     $$ = $1
     $$.(*declNode).exportedName = $2
   }
-  | ID
+  | declarator after_spec
   {
-    $$ = &declNode{name: $1}
-
+    $$ = $1
+    $$.(*declNode).ttl = $2
+  }
+  | declarator reset_spec
+  {
+    $$ = $1
+    $$.(*declNode).reset = $2
+  }
+  | declarator UPDATED
+  {
+    $$ = $1
+    $$.(*declNode).updated = true
+  }
+  | declarator limit_spec %prec DECLARATION
+  {
+    $$ = $1
+    $$.(*declNode).limit = $2
+  }
+  | declarator limit_spec LRU
+  {
+    $$ = $1
+    $$.(*declNode).limit = $2
+    $$.(*declNode).evictLRU = true
+  }
+  | declarator buckets_spec
+  {
+    $$ = $1
+    $$.(*declNode).buckets = $2
+    $$.(*declNode).bucketsPos = mtaillex.(*parser).pos
+  }
+  | declarator quantiles_spec
+  {
+    $$ = $1
+    $$.(*declNode).quantiles = $2
+    $$.(*declNode).quantilesPos = mtaillex.(*parser).pos
+  }
+  | declarator STRING
+  {
+    $$ = $1
+    $$.(*declNode).help = $2
+  }
+  | declarator init_spec
+  {
+    $$ = $1
+    $$.(*declNode).labelSets = $2
+    $$.(*declNode).labelSetsPos = mtaillex.(*parser).pos
+  }
+  | id
+  {
+    $$ = &declNode{name: $1, pos: mtaillex.(*parser).t.pos}
   }
   | STRING
   {
-    $$ = &declNode{name: $1}
+    $$ = &declNode{name: $1, pos: mtaillex.(*parser).t.pos}
   }
   ;
 
@@ -463,6 +625,29 @@ type_spec
   {
     $$ = metrics.Timer
   }
+  | HISTOGRAM
+  {
+    $$ = metrics.Histogram
+  }
+  | SUMMARY
+  {
+    $$ = metrics.Summary
+  }
+  ;
+
+/* The keywords that only mean something in a declaration, or at the start of
+   a statement, can also name metrics, keys, constants and decorators, so that
+   programs written before they were added still parse. */
+id
+  : ID
+  | LIMIT
+  | LOGS
+  | LRU
+  | NAMESPACE
+  | QUANTILES
+  | SAMPLE
+  | SUMMARY
+  | UPDATED
   ;
 
 by_spec
@@ -473,7 +658,7 @@ by_spec
   ;
 
 by_expr_list
-  : ID
+  : id
   {
     $$ = make([]string, 0)
     $$ = append($$, $1)
@@ -483,7 +668,7 @@ by_expr_list
     $$ = make([]string, 0)
     $$ = append($$, $1)
   }
-  | by_expr_list COMMA ID
+  | by_expr_list COMMA id
   {
     $$ = $1
     $$ = append($$, $3)
@@ -495,6 +680,135 @@ by_expr_list
   }
   ;
 
+after_spec
+  : AFTER DURATIONLITERAL
+  {
+    $$ = $2
+  }
+  ;
+
+/* A reset interval zeroes the label sets of a metric at the end of each
+   interval, for metrics that count per interval rather than accumulate. */
+reset_spec
+  : RESET EVERY DURATIONLITERAL
+  {
+    if $3 <= 0 {
+      mtaillex.Error(fmt.Sprintf("Reset interval %s is not positive.", $3))
+    }
+    $$ = $3
+  }
+  ;
+
+/* A limit caps the number of label sets of a metric.  New label sets are
+   dropped at the limit, unless it's followed by lru, when the least recently
+   used label sets are evicted to make room for them. */
+limit_spec
+  : LIMIT INTLITERAL
+  {
+    if $2 <= 0 {
+      mtaillex.Error(fmt.Sprintf("Limit %d is not positive.", $2))
+    }
+    $$ = $2
+  }
+  ;
+
+buckets_spec
+  : BUCKETS { mtaillex.(*parser).pos = mtaillex.(*parser).t.pos } bucket_list
+  {
+    $$ = $3
+  }
+  ;
+
+bucket_list
+  : INTLITERAL
+  {
+    $$ = make([]int64, 0)
+    $$ = append($$, $1)
+  }
+  | bucket_list COMMA INTLITERAL
+  {
+    $$ = $1
+    if $3 <= $$[len($$)-1] {
+      mtaillex.Error(fmt.Sprintf("Bucket %d is not greater than the previous bucket %d.", $3, $$[len($$)-1]))
+    }
+    $$ = append($$, $3)
+  }
+  ;
+
+quantiles_spec
+  : QUANTILES { mtaillex.(*parser).pos = mtaillex.(*parser).t.pos } quantile_list
+  {
+    $$ = $3
+  }
+  ;
+
+/* Quantiles are fractions between 0 and 1, such as 0.99, in increasing
+   order. */
+quantile_list
+  : FLOATLITERAL
+  {
+    if $1 <= 0 || $1 >= 1 {
+      mtaillex.Error(fmt.Sprintf("Quantile %g is not between 0 and 1.", $1))
+    }
+    $$ = make([]float64, 0)
+    $$ = append($$, $1)
+  }
+  | quantile_list COMMA FLOATLITERAL
+  {
+    $$ = $1
+    if $3 <= 0 || $3 >= 1 {
+      mtaillex.Error(fmt.Sprintf("Quantile %g is not between 0 and 1.", $3))
+    } else if $3 <= $$[len($$)-1] {
+      mtaillex.Error(fmt.Sprintf("Quantile %g is not greater than the previous quantile %g.", $3, $$[len($$)-1]))
+    }
+    $$ = append($$, $3)
+  }
+  ;
+
+init_spec
+  : ASSIGN { mtaillex.(*parser).pos = mtaillex.(*parser).t.pos } LCURLY label_set_list RCURLY
+  {
+    $$ = $4
+  }
+  ;
+
+label_set_list
+  : label_set
+  {
+    $$ = make([][]string, 0)
+    $$ = append($$, $1)
+  }
+  | label_set_list COMMA label_set
+  {
+    $$ = $1
+    $$ = append($$, $3)
+  }
+  ;
+
+label_set
+  : STRING
+  {
+    $$ = []string{$1}
+  }
+  | LCURLY string_list RCURLY
+  {
+    $$ = $2
+  }
+  ;
+
+string_list
+  : STRING
+  {
+    $$ = make([]string, 0)
+    $$ = append($$, $1)
+  }
+  | string_list COMMA STRING
+  {
+    $$ = $1
+    $$ = append($$, $3)
+  }
+  ;
+
 as_spec
   : AS STRING
   {
@@ -503,19 +817,32 @@ as_spec
   ;
 
 definition
-: DEF ID compound_statement
+: DEF id { mtaillex.(*parser).nextScope = nil } compound_statement
   {
-      $$ = &defNode{name: $2, children: []node{$3}}
+      $$ = &defNode{name: $2, children: []node{$4}}
       d := $$.(*defNode)
       d.sym = mtaillex.(*parser).s.addSym(d.name, DefSymbol, d, mtaillex.(*parser).t.pos)
+      d.caprefs = mtaillex.(*parser).nextScope.caprefsUntil(mtaillex.(*parser).s)
   }
   ;
 
 decoration_statement
-  : DECO compound_statement
+  : DECO
   {
-    if sym, ok := mtaillex.(*parser).s.lookupSym($1, DefSymbol); ok {
-      $$ = &decoNode{$1, []node{$2}, sym.binding.(*defNode)}
+    // The decorated block is inlined at the decorator's next statement, so
+    // it can refer to the capture groups visible there.
+    mtaillex.(*parser).startScope()
+    if sym, ok := mtaillex.(*parser).s.lookupSym($1, DefSymbol); ok && sym != nil {
+      for _, c := range sym.binding.(*defNode).caprefs {
+        mtaillex.(*parser).s.insertSym(c)
+      }
+    }
+  }
+  compound_statement
+  {
+    mtaillex.(*parser).endScope()
+    if sym, ok := mtaillex.(*parser).s.lookupSym($1, DefSymbol); ok && sym != nil {
+      $$ = &decoNode{$1, []node{$3}, sym.binding.(*defNode)}
     } else {
       mtaillex.Error(fmt.Sprintf("Decorator %s not defined", $1))
       // TODO(jaq): force a parse error.
@@ -540,7 +867,12 @@ type parser struct {
     pos position             // Maybe contains the position of the start of a node.
     s      *scope
     res    map[string]string // Mapping of regex constants to patterns.
+    constName string         // Name of the regex constant being defined, if any.
+    nextScope *scope         // Scope of the most recent next statement.
     ms     *metrics.Store     // List of metrics exported by this program.
+    regexes []*regexp.Regexp  // Regexes taken from the shared cache, released when the program stops.
+    regexStart position       // Position of the slash opening the most recent regex literal.
+    patternParts []patternPart // Where the parts of the most recent pattern_expr start.
 }
 
 func newParser(name string, input io.Reader, ms *metrics.Store) *parser {
@@ -548,6 +880,82 @@ func newParser(name string, input io.Reader, ms *metrics.Store) *parser {
     return &parser{name: name, l: newLexer(name, input), res: make(map[string]string), ms: ms}
 }
 
+// compileRegex compiles a pattern through the cache shared by all programs,
+// keeping the reference to release when the program stops.
+func (p *parser) compileRegex(pattern string) (*regexp.Regexp, error) {
+    re, err := regexes.compile(pattern)
+    if err != nil {
+        return nil, err
+    }
+    p.regexes = append(p.regexes, re)
+    return re, nil
+}
+
+// regexError describes an error compiling a regular expression.  Malformed
+// inline flags, like the z in (?z), are reported with the accepted flags.
+func regexError(err error) string {
+    if e, ok := err.(*syntax.Error); ok && e.Code == syntax.ErrInvalidPerlOp &&
+        strings.HasPrefix(e.Expr, "(?") && !strings.HasPrefix(e.Expr, "(?P") {
+        return fmt.Sprintf("invalid regular expression flags in %q: flags must be one or more of i, m, s and U", e.Expr)
+    }
+    return err.Error()
+}
+
+// declare defines the metric declared by d, of the given kind, and adds it to
+// the program's scope and metric store.
+func (p *parser) declare(kind metrics.Kind, d *declNode, hidden bool) node {
+    d.kind = kind
+    d.hidden = hidden
+
+    var n string
+    if d.exportedName != "" {
+        n = d.exportedName
+    } else {
+        n = d.name
+    }
+    d.m = metrics.NewMetric(n, p.name, d.kind, d.keys...)
+    d.m.TTL = d.ttl
+    d.m.Limit = int(d.limit)
+    d.m.EvictLRU = d.evictLRU
+    d.m.Hidden = d.hidden
+    d.m.Reset = d.reset
+    d.m.Help = d.help
+    d.m.ExportUpdated = d.updated
+    if d.kind == metrics.Histogram {
+        if len(d.buckets) > 0 {
+            d.m.Buckets = d.buckets
+        } else {
+            d.m.Buckets = append([]int64{}, metrics.DefaultBuckets...)
+        }
+    } else if len(d.buckets) > 0 {
+        p.ErrorP(fmt.Sprintf("Buckets are only valid for a histogram, not a %s.", d.kind), d.bucketsPos)
+    }
+    if d.kind == metrics.Summary {
+        if len(d.quantiles) > 0 {
+            d.m.Quantiles = d.quantiles
+        } else {
+            d.m.Quantiles = append([]float64{}, metrics.DefaultQuantiles...)
+        }
+    } else if len(d.quantiles) > 0 {
+        p.ErrorP(fmt.Sprintf("Quantiles are only valid for a summary, not a %s.", d.kind), d.quantilesPos)
+    }
+    // Create the initial label sets now, so they're exported at zero before
+    // any line is processed.  They're timestamped at load, for the exporters
+    // that send a timestamp.
+    for _, ls := range d.labelSets {
+        if len(ls) != len(d.keys) {
+            p.ErrorP(fmt.Sprintf("Initial label set %q has %d labels, but metric %s has %d keys.", ls, len(ls), d.name, len(d.keys)), d.labelSetsPos)
+            continue
+        }
+        if dm, err := d.m.GetDatum(ls...); err == nil {
+            dm.Set(0, time.Now())
+        }
+    }
+    d.sym = p.s.addSym(d.name, IDSymbol, d.m, p.t.pos)
+    p.ms.Add(d.m)
+    return d
+}
+
 func (p *parser) ErrorP(s string, pos position) {
     p.errors.Add(pos, s)
 }
@@ -576,7 +984,14 @@ func (p *parser) Lex(lval *mtailSymType) int {
         p.Error(fmt.Sprintf("bad number '%s': %s", p.t.text, err))
         return INVALID
       }
-    case LT, GT, LE, GE, NE, EQ, SHL, SHR, AND, OR, XOR, NOT, INC, DIV, MUL, MINUS, PLUS, ASSIGN, ADD_ASSIGN, POW:
+    case DURATIONLITERAL:
+      var err error
+      lval.duration, err = time.ParseDuration(p.t.text)
+      if err != nil {
+        p.Error(fmt.Sprintf("bad duration '%s': %s", p.t.text, err))
+        return INVALID
+      }
+    case LT, GT, LE, GE, NE, EQ, SHL, SHR, AND, OR, XOR, NOT, INC, DIV, MUL, MINUS, PLUS, ASSIGN, ADD_ASSIGN, POW, MOD, COALESCE:
       lval.op = int(p.t.kind)
     default:
       lval.text = p.t.text
@@ -596,7 +1011,17 @@ func (p *parser) endScope() {
 }
 
 func (p *parser) inRegex() {
+    p.regexStart = p.t.pos
     p.l.in_regex = true
 }
 
+// regexPart returns the part of a pattern at offset that is the most recent
+// regex literal, which starts just after its opening slash.
+func (p *parser) regexPart(offset int) patternPart {
+    pos := p.regexStart
+    pos.startcol++
+    pos.endcol = pos.startcol
+    return patternPart{offset: offset, pos: pos, literal: true}
+}
+
 var mtailDebugFlag = flag.Int("mtailDebug", 0, "Set parser debug level.")
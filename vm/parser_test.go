@@ -38,15 +38,71 @@ var mtailPrograms = []validProgram{
 	{"declare hidden counter",
 		"hidden counter foo\n"},
 
+	{"declare hidden gauge used by program",
+		"hidden gauge last_ts\n" +
+			"counter delta\n" +
+			"/(\\d+)/ {\n" +
+			"  delta += $1 - last_ts\n" +
+			"  last_ts = $1\n" +
+			"}\n"},
+
 	{"declare gauge",
 		"gauge foo\n"},
 
 	{"declare timer",
 		"timer foo\n"},
 
+	{"declare histogram",
+		"histogram foo by bar\n"},
+
+	{"declare histogram with buckets",
+		"histogram foo buckets 1, 2, 4, 8\n"},
+
+	{"declare summary",
+		"summary foo by bar\n"},
+
+	{"declare summary with quantiles",
+		"summary foo quantiles 0.5, 0.9, 0.99\n"},
+
+	{"keywords as names",
+		"counter summary by limit, logs, lru\ngauge quantiles\n" +
+			"/(\\d+)/ {\n  summary[$1][1][2]++\n  quantiles = summary[$1][1][2]\n}\n"},
+
+	{"keyword as name after declaration",
+		"counter sample limit 10 lru\nsample++\nhidden summary updated\nupdated = 1\n"},
+
+	{"declare with ttl",
+		"counter foo by user after 1h0m0s\n"},
+
+	{"declare with reset",
+		"counter foo by user reset every 1m0s\n"},
+
+	{"statements on one line",
+		"counter a\ncounter b by x\n/(\\d+)/ { a++; b[$1]++ }\n" +
+			"/(\\d+)/ {\n  a++; b[$1] += $1\n}\n"},
+
+	{"declare with update times",
+		"counter requests by code updated\n"},
+
+	{"declare with help",
+		"counter errors \"Total application errors\"\n" +
+			"gauge \"queue-length\" \"Jobs \\\"waiting\\\"\" by queue\n"},
+
+	{"declare with limit",
+		"counter foo by request limit 100\n" +
+			"counter bar by request limit 100 lru\n"},
+
+	{"declare with initial label sets",
+		"counter errors by code = {\"500\", \"503\"}\n" +
+			"counter requests by method, code = {{\"GET\", \"200\"}, {\"POST\", \"500\"}}\n"},
+
 	{"simple pattern action",
 		"/foo/ {}\n"},
 
+	{"regex flags and anchors",
+		"/^(?i)error: (?P<msg>.*\\/.*)$/ {}\n" +
+			"/(?s:a.b)\\z/ {}\n"},
+
 	{"more complex action, calling builtin",
 		"counter line_count\n" +
 			"/foo/ {\n" +
@@ -83,6 +139,20 @@ var mtailPrograms = []validProgram{
 			"  }\n" +
 			"}\n"},
 
+	{"else",
+		"counter errors\ncounter ok\n" +
+			"/error/ { errors++\n} else { ok++\n}\n"},
+
+	{"nested else",
+		"counter a\ncounter b\n" +
+			"/foo(\\d+)/ {\n" +
+			"  $1 > 0 {\n" +
+			"    a++\n" +
+			"  } else {\n" +
+			"    /bar/ { b++\n    } else { a++\n    }\n" +
+			"  }\n" +
+			"}\n"},
+
 	{"nested scope",
 		"counter foo\n" +
 			"/fo(o)/ {\n" +
@@ -182,6 +252,21 @@ var mtailPrograms = []validProgram{
 			"}\n",
 	},
 
+	{"split index",
+		"counter hosts by host\n" +
+			"/(.*)/ {\n" +
+			"  hosts[split($1, \",\")[1]]++\n" +
+			"}\n",
+	},
+
+	{"del",
+		"counter foo by a\n" +
+			"/(.*)/ {\n" +
+			"  del foo[$1]\n" +
+			"  del foo\n" +
+			"}\n",
+	},
+
 	{"def and next",
 		"def foobar {/(?P<date>.*)/ {" +
 			"  next" +
@@ -189,9 +274,47 @@ var mtailPrograms = []validProgram{
 			"}",
 	},
 
+	{"decorator capture groups",
+		"counter hosts by host\n" +
+			"def syslog {\n" +
+			"  /(?P<date>\\w+\\s+\\d+\\s+\\d+:\\d+:\\d+)\\s+(?P<hostname>\\w+)/ {\n" +
+			"    strptime($date, \"Jan _2 15:04:05\")\n" +
+			"    next\n" +
+			"  }\n" +
+			"}\n" +
+			"@syslog {\n" +
+			"  /myapp/ {\n" +
+			"    hosts[$hostname]++\n" +
+			"  }\n" +
+			"}\n"},
+
+	{"nested decorators",
+		"counter c by x\n" +
+			"def outer {\n" +
+			"  /(?P<a>a)/ {\n" +
+			"    next\n" +
+			"  }\n" +
+			"}\n" +
+			"def inner {\n" +
+			"  @outer {\n" +
+			"    /(?P<b>b)/ {\n" +
+			"      next\n" +
+			"    }\n" +
+			"  }\n" +
+			"}\n" +
+			"@inner {\n" +
+			"  c[$a]++\n" +
+			"  c[$b]++\n" +
+			"}\n"},
+
 	{"const",
 		`const IP /\d+(\.\d+){3}/`},
 
+	{"const concatenated from consts",
+		"const IP /\\d+(\\.\\d+){3}/\n" +
+			"const CLIENT /client=/ + IP\n" +
+			"/^/ + CLIENT + / / {}\n"},
+
 	{"bitwise",
 		`/foo(\d)/ {
   $1 & 7
@@ -200,6 +323,58 @@ var mtailPrograms = []validProgram{
   $1 >> 20
   $1 ^ 15
   ~ 1
+}`},
+	{"namespace",
+		`namespace "teamA"
+counter requests
+/GET/ {
+  requests++
+}`},
+	{"logs",
+		`logs "/var/log/apache/*.log"
+counter requests
+/GET/ {
+  requests++
+}`},
+	{"default for empty capref",
+		`counter paths by path
+/^GET(?: (\S+))?$/ {
+  paths[$1 or "-"]++
+}`},
+	{"sample",
+		`sample 100
+counter requests
+/GET/ {
+  requests++
+}`},
+	{"record",
+		`record /^\d{4}-\d{2}-\d{2} /
+counter exceptions
+/Exception/ {
+  exceptions++
+}`},
+	{"subst",
+		"counter paths by path\n" +
+			"/(.*)/ {\n" +
+			"  paths[subst($1, \"/user/(\\d+)\", \"/user/:id\")]++\n" +
+			"}\n"},
+
+	{"substr and strlen",
+		`counter paths by prefix
+/(.*)/ {
+  strlen($1) > 3 {
+    paths[substr($1, 0, 4)]++
+  }
+}`},
+	{"arithmetic conditions",
+		`counter slow_requests
+/latency=(?P<latency>\d+)/ {
+  $latency - 100 * 2 > 500 {
+    slow_requests++
+  }
+  $latency % 2 != 0 {
+    slow_requests += $latency / 1000
+  }
 }`},
 	{"floats",
 		`gauge foo
@@ -289,6 +464,17 @@ var InvalidPrograms = []InvalidProgram{
 			"in this or an outer scope"},
 	},
 
+	{"decorator capture group outside decorated block",
+		"def foo {\n" +
+			"  /(?P<a>a)/ {\n" +
+			"    next\n" +
+			"  }\n" +
+			"}\n" +
+			"@foo {\n" +
+			"}\n" +
+			"$a++\n",
+		[]string{"decorator capture group outside decorated block:8:1-2: Capture group $a not defined by prior regular expression in this or an outer scope"}},
+
 	{"undefined decorator",
 		"@foo {}\n",
 		[]string{"undefined decorator:1:7: Decorator foo not defined"}},
@@ -298,6 +484,55 @@ var InvalidPrograms = []InvalidProgram{
 		[]string{"unterminated const regex:1:10-17: Unterminated regular expression: \"/(?P<foo>\"",
 			"unterminated const regex:1:10-17: syntax error"}},
 
+	{"buckets on counter",
+		"counter foo buckets 1, 2\n",
+		[]string{"buckets on counter:1:13-19: Buckets are only valid for a histogram, not a Counter."}},
+
+	{"zero limit",
+		"counter foo by bar limit 0\n",
+		[]string{"zero limit:1:26: Limit 0 is not positive."}},
+
+	{"wrong size initial label set",
+		"counter errors by code = {\"500\", {\"503\", \"x\"}}\n",
+		[]string{"wrong size initial label set:1:24: Initial label set [\"503\" \"x\"] has 2 labels, but metric errors has 1 keys."}},
+
+	{"quantiles on histogram",
+		"histogram foo quantiles 0.5\n",
+		[]string{"quantiles on histogram:1:15-23: Quantiles are only valid for a summary, not a Histogram."}},
+
+	{"quantile out of range",
+		"summary foo quantiles 0.5, 1.5\n",
+		[]string{"quantile out of range:1:28-30: Quantile 1.5 is not between 0 and 1."}},
+
+	{"decreasing quantiles",
+		"summary foo quantiles 0.9, 0.5\n",
+		[]string{"decreasing quantiles:1:28-30: Quantile 0.5 is not greater than the previous quantile 0.9."}},
+
+	{"zero reset interval",
+		"counter foo reset every 0s\n",
+		[]string{"zero reset interval:1:25-26: Reset interval 0s is not positive."}},
+
+	{"decreasing buckets",
+		"histogram foo buckets 2, 1\n",
+		[]string{"decreasing buckets:1:26: Bucket 1 is not greater than the previous bucket 2."}},
+
+	{"bad duration",
+		"counter foo after 1x\n",
+		[]string{"bad duration:1:19-20: bad duration '1x': time: unknown unit \"x\" in duration \"1x\"",
+			"bad duration:1:19-20: syntax error"}},
+
+	{"bad regex flag",
+		"counter foo\n/(?z)foo/ {\n  foo++\n}\n",
+		[]string{"bad regex flag:2:9: invalid regular expression flags in \"(?z\": flags must be one or more of i, m, s and U"}},
+
+	{"redefined const regex",
+		"const X /foo/\nconst X /bar/\n",
+		[]string{"redefined const regex:2:7: Constant 'X' already defined."}},
+
+	{"self-referential const regex",
+		"const X /foo/ + X\n",
+		[]string{"self-referential const regex:1:17: Constant 'X' refers to itself."}},
+
 	{"undefined const regex",
 		"/foo / + X + / bar/ {}\n",
 		[]string{"undefined const regex:1:10: Constant 'X' not defined."}},
@@ -316,3 +551,15 @@ func TestInvalidPrograms(t *testing.T) {
 		}
 	}
 }
+
+func TestHelpText(t *testing.T) {
+	store := metrics.NewStore()
+	if _, err := Compile("help", strings.NewReader("counter errors \"Total application errors\" by code\ngauge queued\n"), store, false, false); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"Total application errors", ""} {
+		if got := store.Metrics[i].Help; got != want {
+			t.Errorf("%s help: got %q, want %q", store.Metrics[i].Name, got, want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// validFlag matches the names of the flags tested by #if.
+var validFlag = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// preprocess evaluates the #if and #endif directives in the source of the
+// named program against the flags set, so that one program can be deployed
+// with blocks for only some environments.  The lines between "#if staging &&
+// canary" and "#endif" are kept if every flag named is set, and are blanked
+// otherwise, so that positions in compile errors still match the file.
+// Blocks may nest.  Directives are comments to older versions of mtail.
+func preprocess(name string, src []byte, flags map[string]bool) ([]byte, error) {
+	if !bytes.Contains(src, []byte("#if")) && !bytes.Contains(src, []byte("#endif")) {
+		return src, nil
+	}
+	var errs ErrorList
+	var open []position // The positions of the #ifs of the open blocks.
+	skipping := 0       // The number of open blocks being skipped.
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	for i, line := range lines {
+		directive := strings.TrimSpace(string(line))
+		pos := position{name, i, 0, len(strings.TrimRight(string(line), "\n")) - 1}
+		switch {
+		case directive == "#endif" || strings.HasPrefix(directive, "#endif "):
+			if len(open) == 0 {
+				errs.Add(pos, "#endif without an #if.")
+				break
+			}
+			open = open[:len(open)-1]
+			if skipping > 0 {
+				skipping--
+			}
+		case directive == "#if" || strings.HasPrefix(directive, "#if ") || strings.HasPrefix(directive, "#if\t"):
+			keep := true
+			for _, f := range strings.Split(directive[len("#if"):], "&&") {
+				f = strings.TrimSpace(f)
+				if !validFlag.MatchString(f) {
+					errs.Add(pos, fmt.Sprintf("Invalid flag %q in #if; flags are names joined by &&.", f))
+				}
+				keep = keep && flags[f]
+			}
+			open = append(open, pos)
+			if skipping > 0 || !keep {
+				skipping++
+			}
+		case skipping == 0:
+			continue
+		}
+		// Blank the directives and skipped lines, keeping their newlines.
+		if bytes.HasSuffix(line, []byte("\n")) {
+			lines[i] = []byte("\n")
+		} else {
+			lines[i] = nil
+		}
+	}
+	for _, pos := range open {
+		errs.Add(pos, "#if without an #endif.")
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return bytes.Join(lines, nil), nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+)
+
+var preprocessTests = []struct {
+	name     string
+	src      string
+	flags    []string
+	expected string
+	err      string
+}{
+	{"set",
+		"counter a\n#if staging\ncounter b\n#endif\n",
+		[]string{"staging"},
+		"counter a\n\ncounter b\n\n",
+		""},
+	{"unset",
+		"counter a\n#if staging\ncounter b\n#endif\ncounter c\n",
+		nil,
+		"counter a\n\n\n\ncounter c\n",
+		""},
+	{"and",
+		"#if staging && canary\ncounter a\n#endif\n#if  staging&&prod\ncounter b\n#endif\n",
+		[]string{"staging", "canary"},
+		"\ncounter a\n\n\n\n\n",
+		""},
+	{"nested",
+		"#if prod\n#if canary\ncounter a\n#endif\ncounter b\n#endif\n#if staging\n#if canary\ncounter c\n#endif\n#endif",
+		[]string{"prod"},
+		"\n\n\n\ncounter b\n\n\n\n\n\n",
+		""},
+	{"comments",
+		"# if staging\n#iffy\ncounter a\n",
+		nil,
+		"# if staging\n#iffy\ncounter a\n",
+		""},
+	{"unterminated",
+		"counter a\n#if staging\ncounter b\n",
+		nil,
+		"",
+		"unterminated:2:1-11: #if without an #endif."},
+	{"unmatched endif",
+		"counter a\n#endif\n",
+		nil,
+		"",
+		"unmatched endif:2:1-6: #endif without an #if."},
+	{"invalid flag",
+		"#if staging || prod\n#endif\n",
+		nil,
+		"",
+		"invalid flag:1:1-19: Invalid flag \"staging || prod\" in #if; flags are names joined by &&."},
+}
+
+func TestPreprocess(t *testing.T) {
+	for _, tc := range preprocessTests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			flags := make(map[string]bool)
+			for _, f := range tc.flags {
+				flags[f] = true
+			}
+			result, err := preprocess(tc.name, []byte(tc.src), flags)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Errorf("error: got %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(result) != tc.expected {
+				t.Errorf("got %q, want %q", result, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"time"
+)
+
+// tokenBucket limits the rate of lines sent to a program.  Each line takes a
+// token, and tokens are added at the rate up to a burst of one second's worth,
+// so a program that has been idle can briefly take lines faster than the
+// rate.
+type tokenBucket struct {
+	rate   float64   // Tokens added per second.
+	tokens float64   // Tokens available.
+	last   time.Time // When tokens were last added.
+}
+
+func newTokenBucket(rate int, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// allow takes a token, reporting false if there are none left.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.rate {
+			b.tokens = b.rate
+		}
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,33 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, start)
+	for i, expected := range []bool{true, true, false} {
+		if r := b.allow(start); r != expected {
+			t.Errorf("line %d at start: got %v, want %v", i, r, expected)
+		}
+	}
+	// Half a second adds one token.
+	if !b.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("token not added after half a second")
+	}
+	if b.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("more than one token added after half a second")
+	}
+	// An idle bucket only fills up to the burst of one second's worth.
+	later := start.Add(time.Hour)
+	for i, expected := range []bool{true, true, false} {
+		if r := b.allow(later); r != expected {
+			t.Errorf("line %d after idling: got %v, want %v", i, r, expected)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/mtail/logline"
+)
+
+const (
+	// DefaultMaxRecordSize is the size in bytes beyond which lines aren't
+	// added to a multi-line record.
+	DefaultMaxRecordSize = 64 * 1024
+	// DefaultRecordFlushTimeout is how long after its last line is read an
+	// incomplete multi-line record is run anyway.
+	DefaultRecordFlushTimeout = time.Second
+)
+
+// partialRecord is a record whose last line may not have been read yet.
+type partialRecord struct {
+	first     *logline.LogLine // The line that started the record, whose time and stream are the record's.
+	lines     []string
+	size      int
+	truncated bool
+	updated   time.Time // When a line was last read for the record.
+}
+
+// join returns the record as one line, with the lines of the record separated
+// by newlines.
+func (r *partialRecord) join() *logline.LogLine {
+	l := logline.New(r.first.Filename, strings.Join(r.lines, "\n"))
+	l.Time = r.first.Time
+	l.Stream = r.first.Stream
+	return l
+}
+
+// recordJoiner joins the lines of log records that span many lines, such as
+// Java stack traces, into one line with embedded newlines.  A record begins
+// with a line that matches the start pattern, and ends before the next such
+// line from the same log.  Records are kept separately for each log, so lines
+// from different logs can be interleaved.
+type recordJoiner struct {
+	name    string // Name of the program, for counting truncations.
+	start   *regexp.Regexp
+	maxSize int
+	records map[string]*partialRecord // Incomplete records, by log filename.
+}
+
+func newRecordJoiner(name string, start *regexp.Regexp, maxSize int) *recordJoiner {
+	return &recordJoiner{
+		name:    name,
+		start:   start,
+		maxSize: maxSize,
+		records: make(map[string]*partialRecord)}
+}
+
+// add adds the line to the record being read from its log, returning the
+// previous record if the line starts a new one.  A line that doesn't start a
+// record, but has no record before it, such as when a log is first read from
+// the middle, starts a record of its own.  Lines that would make a record
+// larger than the maximum size are dropped.
+func (j *recordJoiner) add(l *logline.LogLine, now time.Time) *logline.LogLine {
+	r, ok := j.records[l.Filename]
+	if !ok || j.start.MatchString(l.Line) {
+		j.records[l.Filename] = &partialRecord{first: l, lines: []string{l.Line}, size: len(l.Line), updated: now}
+		if ok {
+			return r.join()
+		}
+		return nil
+	}
+	r.updated = now
+	if r.size+1+len(l.Line) > j.maxSize {
+		if !r.truncated {
+			RecordTruncations.Add(j.name, 1)
+			r.truncated = true
+		}
+		return nil
+	}
+	r.lines = append(r.lines, l.Line)
+	r.size += 1 + len(l.Line)
+	return nil
+}
+
+// expire removes and returns the records that haven't had a line added since
+// the timeout before now, as no more lines may come.
+func (j *recordJoiner) expire(now time.Time, timeout time.Duration) []*logline.LogLine {
+	return j.remove(func(r *partialRecord) bool {
+		return now.Sub(r.updated) >= timeout
+	})
+}
+
+// flush removes and returns all the incomplete records.
+func (j *recordJoiner) flush() []*logline.LogLine {
+	return j.remove(func(*partialRecord) bool { return true })
+}
+
+// remove removes and returns the records selected by f, ordered by log
+// filename.
+func (j *recordJoiner) remove(f func(*partialRecord) bool) []*logline.LogLine {
+	var filenames []string
+	for filename, r := range j.records {
+		if f(r) {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+	var records []*logline.LogLine
+	for _, filename := range filenames {
+		records = append(records, j.records[filename].join())
+		delete(j.records, filename)
+	}
+	return records
+}
+
+// runRecords runs the program once on each record joined from the lines, rather
+// than on each line.  Incomplete records are run when the lines channel is
+// closed, or after no line has been read from their log for the flush timeout.
+func (v *VM) runRecords(lines <-chan *logline.LogLine) {
+	j := newRecordJoiner(v.name, v.recordStart, v.maxRecordSize)
+	run := func(r *logline.LogLine) {
+		if !v.disabled {
+			v.runLine(r)
+		}
+	}
+	// Checking twice per timeout runs an idle record at most half a timeout
+	// late.
+	tick := v.clock.NewTicker(v.recordFlushTimeout / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				for _, r := range j.flush() {
+					run(r)
+				}
+				return
+			}
+			v.setQueueDepth(lines)
+			if r := j.add(line, v.clock.Now()); r != nil {
+				run(r)
+			}
+		case now := <-tick.C:
+			for _, r := range j.expire(now, v.recordFlushTimeout) {
+				run(r)
+			}
+		}
+	}
+}
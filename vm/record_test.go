@@ -0,0 +1,162 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+)
+
+var recordStart = regexp.MustCompile(`^\d{4}-\d{2}-\d{2} `)
+
+func TestRecordJoiner(t *testing.T) {
+	j := newRecordJoiner("test", recordStart, DefaultMaxRecordSize)
+	now := time.Now()
+	input := []*logline.LogLine{
+		logline.New("a", "\tat Orphan.frame"),
+		logline.New("a", "2017-01-01 INFO started"),
+		logline.New("a", "2017-01-01 ERROR failed"),
+		logline.New("b", "2017-01-01 INFO other log"),
+		logline.New("a", "java.lang.NullPointerException"),
+		logline.New("b", "2017-01-01 INFO still other log"),
+		logline.New("a", "\tat Foo.bar(Foo.java:10)"),
+		logline.New("a", "2017-01-01 INFO recovered"),
+	}
+	var records []string
+	for _, l := range input {
+		if r := j.add(l, now); r != nil {
+			records = append(records, r.Filename+": "+r.Line)
+		}
+	}
+	for _, r := range j.flush() {
+		records = append(records, r.Filename+": "+r.Line)
+	}
+	expected := []string{
+		"a: \tat Orphan.frame",
+		"a: 2017-01-01 INFO started",
+		"b: 2017-01-01 INFO other log",
+		"a: 2017-01-01 ERROR failed\njava.lang.NullPointerException\n\tat Foo.bar(Foo.java:10)",
+		"a: 2017-01-01 INFO recovered",
+		"b: 2017-01-01 INFO still other log",
+	}
+	if strings.Join(records, "|") != strings.Join(expected, "|") {
+		t.Errorf("records don't match\ngot:  %q\nwant: %q", records, expected)
+	}
+}
+
+func TestRecordJoinerMaxSize(t *testing.T) {
+	j := newRecordJoiner("test", recordStart, 30)
+	now := time.Now()
+	for _, line := range []string{"2017-01-01 ERROR failed", "first", "second", "third", "2017-01-01 next"} {
+		if r := j.add(logline.New("a", line), now); r != nil && r.Line != "2017-01-01 ERROR failed\nfirst" {
+			t.Errorf("record not truncated: %q", r.Line)
+		}
+	}
+}
+
+func TestRecordJoinerExpire(t *testing.T) {
+	j := newRecordJoiner("test", recordStart, DefaultMaxRecordSize)
+	start := time.Now()
+	j.add(logline.New("a", "2017-01-01 ERROR failed"), start)
+	j.add(logline.New("b", "2017-01-01 INFO ok"), start)
+	j.add(logline.New("a", "\tat Foo.bar"), start.Add(time.Second))
+	r := j.expire(start.Add(time.Second), time.Second)
+	if len(r) != 1 || r[0].Filename != "b" {
+		t.Errorf("expected only the idle record to expire, got %v", r)
+	}
+	r = j.expire(start.Add(2*time.Second), time.Second)
+	if len(r) != 1 || r[0].Line != "2017-01-01 ERROR failed\n\tat Foo.bar" {
+		t.Errorf("expected the record to expire, got %v", r)
+	}
+	if len(j.flush()) != 0 {
+		t.Errorf("expired records not removed")
+	}
+}
+
+const recordProgram = `record /^\d{4}-\d{2}-\d{2} /
+counter records
+counter exceptions
+/^\d/ {
+  records++
+}
+/Exception/ {
+  exceptions++
+}
+`
+
+// runRecordProgram compiles recordProgram and starts it reading from lines.
+func runRecordProgram(t *testing.T, lines <-chan *logline.LogLine, timeout time.Duration) (*metrics.Store, chan struct{}) {
+	store := metrics.NewStore()
+	v, err := Compile("records", strings.NewReader(recordProgram), store, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.recordFlushTimeout = timeout
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	return store, done
+}
+
+// counterValue returns the value of the named counter in the store.
+func counterValue(t *testing.T, store *metrics.Store, name string) int64 {
+	for _, m := range store.Metrics {
+		if m.Name == name {
+			d, err := m.GetDatum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return atomic.LoadInt64(&d.Value)
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
+
+func TestRunRecords(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	store, done := runRecordProgram(t, lines, time.Hour)
+	for _, line := range []string{
+		"2017-01-01 INFO started",
+		"2017-01-01 ERROR failed",
+		"java.lang.NullPointerException",
+		"\tat Foo.bar(Foo.java:10)",
+		"2017-01-01 INFO ok",
+		"2017-01-01 ERROR failed again",
+		"java.lang.IllegalStateException",
+	} {
+		lines <- logline.New("log", line)
+	}
+	close(lines)
+	<-done
+	if r := counterValue(t, store, "records"); r != 4 {
+		t.Errorf("got %d records, want 4", r)
+	}
+	if e := counterValue(t, store, "exceptions"); e != 2 {
+		t.Errorf("got %d exceptions, want 2", e)
+	}
+}
+
+func TestRunRecordsFlushTimeout(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	store, done := runRecordProgram(t, lines, 10*time.Millisecond)
+	defer func() {
+		close(lines)
+		<-done
+	}()
+	lines <- logline.New("log", "2017-01-01 ERROR failed")
+	lines <- logline.New("log", "java.lang.NullPointerException")
+	for i := 0; i < 100; i++ {
+		if counterValue(t, store, "exceptions") == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("incomplete record wasn't run after the flush timeout")
+}
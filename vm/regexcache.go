@@ -0,0 +1,65 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"regexp"
+	"sync"
+)
+
+// The regular expressions of all programs are compiled through a shared
+// cache, so that programs with the same patterns share one compiled copy
+// rather than each holding their own.  A *regexp.Regexp is safe for
+// concurrent use, so the VMs can match against it at the same time.  Each
+// program holds a reference to the patterns it uses until its VM stops.
+
+// regexCache holds the compiled regular expressions in use, by pattern.
+type regexCache struct {
+	sync.Mutex
+	res map[string]*cachedRegex
+}
+
+type cachedRegex struct {
+	re   *regexp.Regexp
+	refs int // Number of references held by programs.
+}
+
+var regexes = &regexCache{res: make(map[string]*cachedRegex)}
+
+// compile returns the compiled regular expression for the pattern, compiling
+// it only if no program holds it already.  The caller holds a reference to it
+// until released.
+func (c *regexCache) compile(pattern string) (*regexp.Regexp, error) {
+	c.Lock()
+	defer c.Unlock()
+	if r, ok := c.res[pattern]; ok {
+		r.refs++
+		return r.re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	c.res[pattern] = &cachedRegex{re: re, refs: 1}
+	UniqueRegexes.Set(int64(len(c.res)))
+	return re, nil
+}
+
+// release drops a reference to each of the regular expressions, removing
+// those no longer used by any program.
+func (c *regexCache) release(res []*regexp.Regexp) {
+	c.Lock()
+	defer c.Unlock()
+	for _, re := range res {
+		r, ok := c.res[re.String()]
+		if !ok || r.re != re {
+			continue
+		}
+		r.refs--
+		if r.refs == 0 {
+			delete(c.res, re.String())
+		}
+	}
+	UniqueRegexes.Set(int64(len(c.res)))
+}
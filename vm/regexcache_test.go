@@ -0,0 +1,91 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/logline"
+	"github.com/google/mtail/metrics"
+)
+
+// stopVM runs the VM on no lines, which releases its regexes.
+func stopVM(v *VM) {
+	lines := make(chan *logline.LogLine)
+	close(lines)
+	done := make(chan struct{})
+	v.Run(lines, done)
+}
+
+func TestRegexesSharedBetweenPrograms(t *testing.T) {
+	before := UniqueRegexes.Value()
+	v1, err := Compile("one", strings.NewReader("/regexcache shared/ {\n}\n/regexcache one/ {\n}\n"), metrics.NewStore(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := Compile("two", strings.NewReader("/regexcache shared/ {\n}\n"), metrics.NewStore(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.re[0] != v2.re[0] {
+		t.Errorf("identical patterns compiled twice")
+	}
+	if n := UniqueRegexes.Value() - before; n != 2 {
+		t.Errorf("expected 2 more unique regexes, got %d", n)
+	}
+
+	stopVM(v1)
+	if n := UniqueRegexes.Value() - before; n != 1 {
+		t.Errorf("expected the pattern still used by two to remain, got %d more unique regexes", n)
+	}
+	stopVM(v2)
+	if n := UniqueRegexes.Value() - before; n != 0 {
+		t.Errorf("expected all the patterns to be released, got %d more unique regexes", n)
+	}
+}
+
+func TestRegexesReleasedOnCompileError(t *testing.T) {
+	before := UniqueRegexes.Value()
+	if _, err := Compile("bad", strings.NewReader("/regexcache bad/ {\n  nosuchmetric++\n}\n"), metrics.NewStore(), false, false); err == nil {
+		t.Fatal("expected compile error")
+	}
+	if n := UniqueRegexes.Value() - before; n != 0 {
+		t.Errorf("regexes of a failed compile not released, got %d more unique regexes", n)
+	}
+}
+
+// TestRegexCacheConcurrentPrograms tests that programs sharing a regex can
+// match with it and release it concurrently.
+func TestRegexCacheConcurrentPrograms(t *testing.T) {
+	before := UniqueRegexes.Value()
+	var vms []*VM
+	for i := 0; i < 10; i++ {
+		v, err := Compile("concurrent", strings.NewReader("counter c\n/regexcache concurrent (\\d+)/ {\n  c++\n}\n"), metrics.NewStore(), false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vms = append(vms, v)
+	}
+	var wg sync.WaitGroup
+	for _, v := range vms {
+		wg.Add(1)
+		go func(v *VM) {
+			defer wg.Done()
+			lines := make(chan *logline.LogLine)
+			done := make(chan struct{})
+			go v.Run(lines, done)
+			for i := 0; i < 100; i++ {
+				lines <- logline.New("test", "regexcache concurrent 1")
+			}
+			close(lines)
+			<-done
+		}(v)
+	}
+	wg.Wait()
+	if n := UniqueRegexes.Value() - before; n != 0 {
+		t.Errorf("expected all the patterns to be released, got %d more unique regexes", n)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"expvar"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ProgStatus describes a program known to the loader.
+type ProgStatus struct {
+	Name      string
+	Path      string    `json:",omitempty"` // Source file of the program, if it was loaded from one.
+	Status    string    // "healthy", "unhealthy" once disabled by a runtime panic, or "load failed".
+	Running   bool      // Whether a version of the program is running; an earlier version keeps running after a failed reload.
+	LoadError string    `json:",omitempty"` // Error of the last load, if it failed.
+	LoadTime  time.Time `json:",omitempty"` // When the running version was loaded.
+	Lines     int64     // Lines sent to the program.
+	Errors    int64     // Runtime errors of the program.
+}
+
+// progRecord is the load history of a program.
+type progRecord struct {
+	path     string    // Source file, if loaded from one.
+	loadErr  error     // Error of the last load, if it failed.
+	loadTime time.Time // When the running version was loaded, zero if none has.
+}
+
+// recordLoad records the outcome of loading the named program from path.
+// The caller holds handleMu.
+func (l *Loader) recordLoad(name, path string, err error) {
+	r, ok := l.progs[name]
+	if !ok {
+		r = &progRecord{}
+		l.progs[name] = r
+	}
+	r.path = path
+	r.loadErr = err
+	if err == nil {
+		r.loadTime = time.Now()
+	}
+}
+
+// ProgStatuses returns the status of each program loaded or that failed to
+// load, sorted by name.
+func (l *Loader) ProgStatuses() []ProgStatus {
+	l.handleMu.RLock()
+	defer l.handleMu.RUnlock()
+	statuses := make([]ProgStatus, 0, len(l.progs))
+	for name, r := range l.progs {
+		_, running := l.handles[name]
+		s := ProgStatus{
+			Name:     name,
+			Path:     r.path,
+			Running:  running,
+			LoadTime: r.loadTime,
+			Lines:    expvarCount(ProgLines, name),
+			Errors:   expvarCount(RuntimeErrors, name),
+		}
+		switch {
+		case r.loadErr != nil:
+			s.Status = "load failed"
+			s.LoadError = r.loadErr.Error()
+		case expvarCount(ProgHealthy, name) == 0:
+			s.Status = "unhealthy"
+		default:
+			s.Status = "healthy"
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// expvarCount returns the value of key in the expvar map m, or 0 if unset.
+func expvarCount(m *expvar.Map, key string) int64 {
+	v := m.Get(key)
+	if v == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(v.String(), 10, 64)
+	return n
+}
@@ -45,3 +45,28 @@ func (s *scope) addSym(name string, kind symtype, binding interface{}, loc posit
 	s.symtab[name][kind] = sym
 	return sym
 }
+
+// insertSym adds an existing symbol to the scope, such as a capture group
+// defined elsewhere that is visible here.
+func (s *scope) insertSym(sym *symbol) {
+	if _, ok := s.symtab[sym.name]; !ok {
+		s.symtab[sym.name] = make([]*symbol, endSymbol)
+	}
+	s.symtab[sym.name][sym.kind] = sym
+}
+
+// caprefsUntil returns the capture group symbols visible in s that are defined
+// in scopes nested within outer.  Symbols in inner scopes hide those of the
+// same name in outer ones.
+func (s *scope) caprefsUntil(outer *scope) (caprefs []*symbol) {
+	seen := make(map[string]bool)
+	for ; s != nil && s != outer; s = s.parent {
+		for name, syms := range s.symtab {
+			if sym := syms[CaprefSymbol]; sym != nil && !seen[name] {
+				seen[name] = true
+				caprefs = append(caprefs, sym)
+			}
+		}
+	}
+	return
+}
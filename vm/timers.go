@@ -0,0 +1,129 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package vm
+
+import (
+	"container/heap"
+	"expvar"
+	"time"
+)
+
+const (
+	// DefaultTimerLimit is the most timers started by starttimer that a
+	// program keeps at once.
+	DefaultTimerLimit = 10000
+	// DefaultTimerTTL is how long after it's started a timer is forgotten
+	// if elapsed isn't called for it.
+	DefaultTimerTTL = time.Hour
+)
+
+var (
+	// TimerEvictions counts the timers forgotten before elapsed was called
+	// for them, to keep a program within its limit, by program.
+	TimerEvictions = expvar.NewMap("timer_evictions_total")
+	// UnknownTimers counts the calls to elapsed for keys with no timer
+	// started, or whose timer was forgotten, by program.
+	UnknownTimers = expvar.NewMap("timer_unknown_keys_total")
+)
+
+// timerTable holds the times that timers were started by starttimer, by key,
+// so that elapsed can measure the time between two lines sharing a key, such
+// as the start and end of a request.  Any key is forgotten after the TTL, and
+// the table holds at most the limit, as a key whose end is never logged would
+// be held forever.  The timers are also kept in a heap, oldest first, so that
+// those to forget are found without a scan of them all.
+type timerTable struct {
+	name   string // Name of the program, for counting evictions.
+	limit  int
+	ttl    time.Duration
+	timers map[string]*timer
+	oldest timerHeap
+}
+
+// timer is a timer started by starttimer.
+type timer struct {
+	key   string
+	start time.Time
+	index int // Index in the timerTable's heap.
+}
+
+func newTimerTable(name string, limit int, ttl time.Duration) *timerTable {
+	return &timerTable{
+		name:   name,
+		limit:  limit,
+		ttl:    ttl,
+		timers: make(map[string]*timer)}
+}
+
+// start starts the timer for the key at ts, replacing any already started.
+// Timers that have expired are forgotten as new ones start, and at the limit
+// the oldest is forgotten too.
+func (tt *timerTable) start(key string, ts time.Time) {
+	if t, ok := tt.timers[key]; ok {
+		t.start = ts
+		heap.Fix(&tt.oldest, t.index)
+		return
+	}
+	for len(tt.oldest) > 0 && ts.Sub(tt.oldest[0].start) > tt.ttl {
+		tt.evict()
+	}
+	if len(tt.timers) >= tt.limit {
+		tt.evict()
+	}
+	t := &timer{key: key, start: ts}
+	tt.timers[key] = t
+	heap.Push(&tt.oldest, t)
+}
+
+// evict forgets the oldest timer.
+func (tt *timerTable) evict() {
+	t := heap.Pop(&tt.oldest).(*timer)
+	delete(tt.timers, t.key)
+	TimerEvictions.Add(tt.name, 1)
+}
+
+// elapsed returns the seconds from the start of the timer for the key to ts,
+// and forgets it.  It reports false if there's no timer for the key, or
+// it has expired.
+func (tt *timerTable) elapsed(key string, ts time.Time) (float64, bool) {
+	t, ok := tt.timers[key]
+	if !ok {
+		return 0, false
+	}
+	delete(tt.timers, key)
+	heap.Remove(&tt.oldest, t.index)
+	d := ts.Sub(t.start)
+	if d > tt.ttl {
+		return 0, false
+	}
+	return d.Seconds(), true
+}
+
+// timerHeap orders timers with the earliest started first.  It implements
+// heap.Interface.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool { return h[i].start.Before(h[j].start) }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
+}
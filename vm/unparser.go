@@ -71,6 +71,14 @@ func (u *Unparser) unparse(n node) {
 		}
 		u.outdent()
 		u.emit("}")
+		if v.elseNode != nil {
+			u.emit(" else {")
+			u.newline()
+			u.indent()
+			u.unparse(v.elseNode)
+			u.outdent()
+			u.emit("}")
+		}
 
 	case *regexNode:
 		u.emit("/" + strings.Replace(v.pattern, "/", "\\/", -1) + "/")
@@ -100,12 +108,16 @@ func (u *Unparser) unparse(n node) {
 			u.emit(" | ")
 		case XOR:
 			u.emit(" ^ ")
+		case COALESCE:
+			u.emit(" or ")
 		case NOT:
 			u.emit(" ~ ")
 		case '+', '-', '*', '/':
 			u.emit(fmt.Sprintf(" %c ", v.op))
 		case POW:
 			u.emit(" ** ")
+		case MOD:
+			u.emit(" % ")
 		case ASSIGN:
 			u.emit(" = ")
 		case ADD_ASSIGN:
@@ -136,6 +148,9 @@ func (u *Unparser) unparse(n node) {
 		u.emit("]")
 
 	case *declNode:
+		if v.hidden {
+			u.emit("hidden ")
+		}
 		switch v.kind {
 		case metrics.Counter:
 			u.emit("counter ")
@@ -143,11 +158,62 @@ func (u *Unparser) unparse(n node) {
 			u.emit("gauge ")
 		case metrics.Timer:
 			u.emit("timer ")
+		case metrics.Histogram:
+			u.emit("histogram ")
+		case metrics.Summary:
+			u.emit("summary ")
 		}
 		u.emit(v.name)
+		if v.help != "" {
+			u.emit(" \"" + strings.Replace(v.help, `"`, `\"`, -1) + "\"")
+		}
 		if len(v.keys) > 0 {
 			u.emit(" by " + strings.Join(v.keys, ", "))
 		}
+		if len(v.buckets) > 0 {
+			var b []string
+			for _, bucket := range v.buckets {
+				b = append(b, strconv.FormatInt(bucket, 10))
+			}
+			u.emit(" buckets " + strings.Join(b, ", "))
+		}
+		if len(v.quantiles) > 0 {
+			var q []string
+			for _, quantile := range v.quantiles {
+				q = append(q, strconv.FormatFloat(quantile, 'f', -1, 64))
+			}
+			u.emit(" quantiles " + strings.Join(q, ", "))
+		}
+		if v.ttl > 0 {
+			u.emit(" after " + v.ttl.String())
+		}
+		if v.reset > 0 {
+			u.emit(" reset every " + v.reset.String())
+		}
+		if v.updated {
+			u.emit(" updated")
+		}
+		if v.limit > 0 {
+			u.emit(" limit " + strconv.FormatInt(v.limit, 10))
+			if v.evictLRU {
+				u.emit(" lru")
+			}
+		}
+		if len(v.labelSets) > 0 {
+			var sets []string
+			for _, ls := range v.labelSets {
+				var labels []string
+				for _, l := range ls {
+					labels = append(labels, strconv.Quote(l))
+				}
+				if len(ls) == 1 {
+					sets = append(sets, labels[0])
+				} else {
+					sets = append(sets, "{"+strings.Join(labels, ", ")+"}")
+				}
+			}
+			u.emit(" = {" + strings.Join(sets, ", ") + "}")
+		}
 
 	case *unaryExprNode:
 		switch v.op {
@@ -188,6 +254,22 @@ func (u *Unparser) unparse(n node) {
 	case *nextNode:
 		u.emit("next")
 
+	case *delNode:
+		u.emit("del ")
+		u.unparse(v.n)
+
+	case *recordNode:
+		u.emit("record /" + strings.Replace(v.pattern, "/", "\\/", -1) + "/")
+
+	case *namespaceNode:
+		u.emit("namespace \"" + v.name + "\"")
+
+	case *logsNode:
+		u.emit("logs \"" + v.pattern + "\"")
+
+	case *sampleNode:
+		u.emit(fmt.Sprintf("sample %d", v.rate))
+
 	default:
 		panic(fmt.Sprintf("unparser found undefined type %T", n))
 	}
@@ -6,92 +6,206 @@
 package vm
 
 import (
+	"context"
+	"expvar"
 	"fmt"
+	"io"
 	"math"
-	"os"
 	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
 	"github.com/google/mtail/metrics"
 )
 
+var (
+	// StrptimeErrors counts the timestamps that strptime failed to parse, by
+	// program.
+	StrptimeErrors = expvar.NewMap("strptime_errors_total")
+	// ConversionErrors counts the values that int or float failed to
+	// convert, by program.
+	ConversionErrors = expvar.NewMap("conversion_errors_total")
+	// LineMatches counts the lines matched by at least one regular expression,
+	// by program.
+	LineMatches = expvar.NewMap("line_matches_total")
+	// RegexMatchAttempts counts the regular expression matches attempted, by
+	// program.
+	RegexMatchAttempts = expvar.NewMap("regex_match_attempts_total")
+	// RuntimeErrors counts the runtime errors and panics, by program.
+	RuntimeErrors = expvar.NewMap("prog_runtime_errors_total")
+	// JSONParseErrors counts the strings that getjson failed to parse as
+	// JSON, by program.
+	JSONParseErrors = expvar.NewMap("json_parse_errors_total")
+	// RecordTruncations counts the multi-line records cut short at the
+	// maximum record size, by program.
+	RecordTruncations = expvar.NewMap("record_truncations_total")
+	// FormatErrors counts the calls to format that failed at runtime, by
+	// program.
+	FormatErrors = expvar.NewMap("format_errors_total")
+	// UniqueRegexes is the number of distinct regular expressions compiled
+	// for the loaded programs, which share identical patterns.
+	UniqueRegexes = metrics.NewGaugeInt("unique_regexes")
+	// IPErrors counts the invalid IP addresses and networks given to cidr and
+	// in_cidr, by program.
+	IPErrors = expvar.NewMap("ip_errors_total")
+	// NegativeIncrements counts the negative amounts added to counters, which
+	// are skipped, by program.
+	NegativeIncrements = expvar.NewMap("counter_negative_increments_total")
+	// LineTimeouts counts the lines abandoned for taking longer than the line
+	// timeout to run, by program.
+	LineTimeouts = expvar.NewMap("prog_line_timeouts_total")
+	// DivisionsByZero counts the divisions and remainders by zero, which skip
+	// the rest of the program for the line, by program.
+	DivisionsByZero = expvar.NewMap("divisions_by_zero_total")
+)
+
+// deadlineCheckInterval is how many instructions run between checks of the
+// line deadline, besides the check after each regular expression match, to
+// keep the cost of checking low.
+const deadlineCheckInterval = 64
+
 type opcode int
 
 const (
-	match     opcode = iota // Match a regular expression against input, and set the match register.
-	cmp                     // Compare two values on the stack and set the match register.
-	jnm                     // Jump if no match.
-	jm                      // Jump if match.
-	inc                     // Increment a variable value
-	strptime                // Parse into the timestamp register
-	timestamp               // Return value of timestamp register onto TOS.
-	settime                 // Set timestamp register to value at TOS.
-	push                    // Push operand onto stack
-	capref                  // Push capture group reference at operand onto stack
-	str                     // Push string constant at operand onto stack
-	set                     // Set a variable value
-	add                     // Add top values on stack and push to stack
-	sub                     // Subtract top value from second top value on stack, and push to stack.
-	mul                     // Multiply top values on stack and push to stack
-	div                     // Divide top value into second top on stack, and push
-	pow                     // Put second TOS to power of TOS, and push.
-	and                     // Bitwise AND the 2 at top of stack, and push result
-	or                      // Bitwise OR the 2 at top of stack, and push result
-	xor                     // Bitwise XOR the 2 at top of stack, and push result
-	not                     // Bitwise NOT the top of stack, and push result
-	shl                     // Shift TOS left, push result
-	shr                     // Shift TOS right, push result
-	mload                   // Load metric at operand onto top of stack
-	dload                   // Pop operand keys and metric off stack and load datum at metric[key] onto stack.
-	tolower                 // Convert the string at the top of the stack to lowercase.
-	length                  // Compute the length of a string.
-	strtol                  // Convert a string to a number, given a base.
+	match       opcode = iota // Match a regular expression against input, and set the match register.
+	cmp                       // Compare two values on the stack and set the match register.
+	jnm                       // Jump if no match.
+	jm                        // Jump if match.
+	inc                       // Increment a variable value
+	strptime                  // Parse into the timestamp register
+	timestamp                 // Return value of timestamp register onto TOS.
+	settime                   // Set timestamp register to value at TOS.
+	push                      // Push operand onto stack
+	capref                    // Push capture group reference at operand onto stack
+	str                       // Push string constant at operand onto stack
+	set                       // Set a variable value
+	add                       // Add top values on stack and push to stack
+	sub                       // Subtract top value from second top value on stack, and push to stack.
+	mul                       // Multiply top values on stack and push to stack
+	div                       // Divide top value into second top on stack, and push
+	pow                       // Put second TOS to power of TOS, and push.
+	and                       // Bitwise AND the 2 at top of stack, and push result
+	or                        // Bitwise OR the 2 at top of stack, and push result
+	xor                       // Bitwise XOR the 2 at top of stack, and push result
+	not                       // Bitwise NOT the top of stack, and push result
+	shl                       // Shift TOS left, push result
+	shr                       // Shift TOS right, push result
+	mload                     // Load metric at operand onto top of stack
+	dload                     // Pop operand keys and metric off stack and load datum at metric[key] onto stack.
+	tolower                   // Convert the string at the top of the stack to lowercase.
+	length                    // Compute the length of a string.
+	strtol                    // Convert a string to a number, given a base.
+	observe                   // Record the value at TOS in the histogram at second TOS.
+	getfilename               // Push the name of the log file the input was read from.
+	toupper                   // Convert the string at the top of the stack to uppercase.
+	toint                     // Convert the value at the top of the stack to an integer.
+	tofloat                   // Convert the value at the top of the stack to a float.
+	jmp                       // Jump unconditionally.
+	split                     // Split the string at second TOS into fields separated by TOS.
+	index                     // Push the field of the fields at second TOS indexed by TOS.
+	logfmt                    // Parse the logfmt key=value pairs in the string at TOS into fields.
+	getjson                   // Push the value at the path at TOS in the JSON string at second TOS.
+	del                       // Pop operand keys and metric off stack and remove the datum at metric[key], or all data if operand is 0.
+	mod                       // Push the remainder of second TOS divided by TOS.
+	substr                    // Push the substring of the string at third TOS from second TOS of length TOS.
+	strlen                    // Push the number of characters in the string at TOS.
+	sprintf                   // Push the string formatted from the format string and operand-1 arguments on the stack.
+	cidr                      // Push the network of the IP address at second TOS with the prefix length at TOS.
+	incidr                    // Set the match register if the IP address at second TOS is in the network at TOS.
+	subst                     // Push the string at second TOS with the matches of the regex at operand replaced by TOS.
+	starttimer                // Start the timer keyed by TOS at the time register.
+	elapsed                   // Push the seconds from the start of the timer keyed by TOS to the time register.
+	getstream                 // Push the stream the input was written to, such as stdout, if known.
+	gettime                   // Parse the timestamp at the start of the input into the time register, and push it.
+	coalesce                  // Push second TOS, or TOS if second TOS is the empty string.
 )
 
 var opNames = map[opcode]string{
-	match:     "match",
-	cmp:       "cmp",
-	jnm:       "jnm",
-	jm:        "jm",
-	inc:       "inc",
-	strptime:  "strptime",
-	timestamp: "timestamp",
-	settime:   "settime",
-	push:      "push",
-	capref:    "capref",
-	str:       "str",
-	set:       "set",
-	add:       "add",
-	sub:       "sub",
-	mul:       "mul",
-	div:       "div",
-	pow:       "pow",
-	shl:       "shl",
-	shr:       "shr",
-	and:       "and",
-	or:        "or",
-	xor:       "xor",
-	not:       "not",
-	mload:     "mload",
-	dload:     "dload",
-	tolower:   "tolower",
-	length:    "length",
-	strtol:    "strtol",
+	match:       "match",
+	cmp:         "cmp",
+	jnm:         "jnm",
+	jm:          "jm",
+	inc:         "inc",
+	strptime:    "strptime",
+	timestamp:   "timestamp",
+	settime:     "settime",
+	push:        "push",
+	capref:      "capref",
+	str:         "str",
+	set:         "set",
+	add:         "add",
+	sub:         "sub",
+	mul:         "mul",
+	div:         "div",
+	pow:         "pow",
+	shl:         "shl",
+	shr:         "shr",
+	and:         "and",
+	or:          "or",
+	xor:         "xor",
+	not:         "not",
+	mload:       "mload",
+	dload:       "dload",
+	tolower:     "tolower",
+	length:      "length",
+	strtol:      "strtol",
+	observe:     "observe",
+	getfilename: "getfilename",
+	toupper:     "toupper",
+	toint:       "toint",
+	tofloat:     "tofloat",
+	jmp:         "jmp",
+	split:       "split",
+	index:       "index",
+	logfmt:      "logfmt",
+	getjson:     "getjson",
+	del:         "del",
+	mod:         "mod",
+	substr:      "substr",
+	strlen:      "strlen",
+	sprintf:     "sprintf",
+	cidr:        "cidr",
+	incidr:      "incidr",
+	subst:       "subst",
+	starttimer:  "starttimer",
+	elapsed:     "elapsed",
+	getstream:   "getstream",
+	gettime:     "gettime",
+	coalesce:    "coalesce",
 }
 
 var builtin = map[string]opcode{
-	"timestamp": timestamp,
-	"len":       length,
-	"settime":   settime,
-	"strptime":  strptime,
-	"strtol":    strtol,
-	"tolower":   tolower,
+	"timestamp":   timestamp,
+	"len":         length,
+	"settime":     settime,
+	"strptime":    strptime,
+	"strtol":      strtol,
+	"tolower":     tolower,
+	"getfilename": getfilename,
+	"getstream":   getstream,
+	"gettime":     gettime,
+	"toupper":     toupper,
+	"int":         toint,
+	"float":       tofloat,
+	"split":       split,
+	"logfmt":      logfmt,
+	"getjson":     getjson,
+	"substr":      substr,
+	"strlen":      strlen,
+	"format":      sprintf,
+	"cidr":        cidr,
+	"in_cidr":     incidr,
+	"subst":       subst,
+	"starttimer":  starttimer,
+	"elapsed":     elapsed,
 }
 
 type instr struct {
@@ -100,11 +214,13 @@ type instr struct {
 }
 
 type thread struct {
-	pc      int              // Program counter.
-	match   bool             // Match register.
-	matches map[int][]string // Match result variables.
-	time    time.Time        // Time register.
-	stack   []interface{}    // Data stack.
+	pc      int                // Program counter.
+	match   bool               // Match register.
+	matched bool               // Whether any regular expression matched the input.
+	matches map[int][]string   // Match result variables.
+	time    time.Time          // Time register.
+	stack   []interface{}      // Data stack.
+	json    map[string]jsonDoc // Strings parsed by getjson on this line.
 }
 
 // VM describes the virtual machine for each program.  It contains virtual
@@ -121,13 +237,34 @@ type VM struct {
 
 	timeMemos map[string]time.Time // memo of time string parse results
 
+	timeLayouts []string // Layouts of the timestamps gettime looks for, in order.
+
 	t *thread // Current thread of execution
 
-	input string // Log line input to this round of execution.
+	input *logline.LogLine // Log line input to this round of execution.
 
 	terminate bool // Flag to stop the VM program.
+	disabled  bool // Set when the program has panicked, to stop processing lines.
 
 	syslogUseCurrentYear bool // Overwrite zero years with the current year in a strptime.
+
+	logs               []string       // Patterns of the log paths whose lines are sent to the program, or all logs if empty.
+	sampleRate         int64          // Events each line stands for, added by increments without an amount; 1 if zero.
+	recordStart        *regexp.Regexp // Pattern matching the first line of each record, if records span lines.
+	maxRecordSize      int            // Size in bytes beyond which lines aren't added to a record.
+	recordFlushTimeout time.Duration  // Incomplete records are run after no lines are read from their log for this long.
+
+	regexes []*regexp.Regexp // References to the shared regex cache, released when the VM stops.
+
+	timers *timerTable // Timers started by starttimer, by key.
+
+	workers chan struct{} // Semaphore shared by the programs of a loader, limiting how many run at once, if not nil.
+
+	clock clock.Clock // Tells the current time, for lines without a timestamp.
+
+	lineTimeout time.Duration // Lines taking longer than this to run are abandoned, if non-zero.
+
+	queueDepth *expvar.Int // Set to the number of lines waiting for the program as each is taken, if not nil.
 }
 
 // Push a value onto the stack
@@ -135,6 +272,15 @@ func (t *thread) Push(value interface{}) {
 	t.stack = append(t.stack, value)
 }
 
+// lineTime returns the time register if strptime or settime have set it from
+// the log, or else the current time.
+func (v *VM) lineTime() time.Time {
+	if v.t.time.IsZero() {
+		return v.clock.Now()
+	}
+	return v.t.time
+}
+
 // Pop a value off the stack
 func (t *thread) Pop() (value interface{}) {
 	last := len(t.stack) - 1
@@ -145,6 +291,7 @@ func (t *thread) Pop() (value interface{}) {
 
 // Log a runtime error and terminate the program
 func (v *VM) errorf(format string, args ...interface{}) {
+	RuntimeErrors.Add(v.name, 1)
 	glog.Infof("Runtime error: "+format+"\n", args...)
 	glog.Infof("VM stack:\n%s", debug.Stack())
 	glog.Infof("Dumping vm state")
@@ -169,8 +316,43 @@ func (v *VM) errorf(format string, args ...interface{}) {
 	v.terminate = true
 }
 
+// conversionError counts a failed int or float conversion, and skips the rest
+// of the program for this line.  Empty strings fail to convert too.
+func (v *VM) conversionError(err error) {
+	v.skipStore(err)
+	v.terminate = true
+}
+
+// skipStore counts a failed int or float conversion of a value to be stored
+// in a metric, which skips only that store rather than the rest of the
+// program.
+func (v *VM) skipStore(err error) {
+	glog.V(1).Infof("Conversion failed in %s: %s", v.name, err)
+	ConversionErrors.Add(v.name, 1)
+}
+
+// divisionByZero counts a division or remainder by zero, such as a ratio of
+// metrics whose divisor hasn't been incremented yet, and skips the rest of
+// the program for this line.
+func (v *VM) divisionByZero() {
+	glog.V(1).Infof("Division by zero in %s", v.name)
+	DivisionsByZero.Add(v.name, 1)
+	v.terminate = true
+}
+
+// ipError counts an invalid IP address or network, which evaluates as empty
+// or not matching rather than ending the program for the line.
+func (v *VM) ipError(err error) {
+	glog.V(1).Infof("IP address error in %s: %s", v.name, err)
+	IPErrors.Add(v.name, 1)
+}
+
 func (t *thread) PopInt() (int64, error) {
-	val := t.Pop()
+	return toInt(t.Pop())
+}
+
+// toInt converts a value from the stack to an integer.
+func toInt(val interface{}) (int64, error) {
 	switch n := val.(type) {
 	case int64:
 		return n, nil
@@ -182,14 +364,89 @@ func (t *thread) PopInt() (int64, error) {
 			return 0, fmt.Errorf("conversion of %q to numeric failed: %s", val, err)
 		}
 		return r, nil
+	case float64:
+		// Converting a float outside the range of an int64 gives an
+		// undefined result.
+		if math.IsNaN(n) || n < math.MinInt64 || n >= math.MaxInt64 {
+			return 0, fmt.Errorf("%v is out of the range of an integer", n)
+		}
+		return int64(n), nil
 	case time.Time:
 		return n.Unix(), nil
 	case *metrics.Datum:
-		return n.Value, nil
+		// The current value of a metric, which may be read in an expression.
+		return n.Get(), nil
 	}
 	return 0, fmt.Errorf("unexpected numeric type %T %q", val, val)
 }
 
+// isFloat returns whether a value from the stack is a float, such as the
+// result of float(), that arithmetic on it keeps.
+func isFloat(val interface{}) bool {
+	_, ok := val.(float64)
+	return ok
+}
+
+// toFloat converts a value from the stack to a float.
+func toFloat(val interface{}) (float64, error) {
+	if f, ok := val.(float64); ok {
+		return f, nil
+	}
+	i, err := toInt(val)
+	return float64(i), err
+}
+
+// arith pops the operands of an arithmetic instruction, and pushes fi of
+// them as integers, or ff of them as floats if either is a float.
+func (v *VM) arith(t *thread, fi func(a, b int64) int64, ff func(a, b float64) float64) {
+	b, a := t.Pop(), t.Pop()
+	if isFloat(a) || isFloat(b) {
+		x, err := toFloat(a)
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		y, err := toFloat(b)
+		if err != nil {
+			v.errorf("%s", err)
+		}
+		t.Push(ff(x, y))
+		return
+	}
+	x, err := toInt(a)
+	if err != nil {
+		v.errorf("%s", err)
+	}
+	y, err := toInt(b)
+	if err != nil {
+		v.errorf("%s", err)
+	}
+	t.Push(fi(x, y))
+}
+
+// popKey pops a metric key off the stack.  Numbers, such as the result of
+// strlen, are formatted as decimal strings.
+func (t *thread) popKey() string {
+	return toString(t.Pop())
+}
+
+// substring returns the characters of s from start, counting from 0, up to n
+// characters long.  The range is clamped to the string, so a start past the
+// end or a negative length yields the empty string.
+func substring(s string, start, n int64) string {
+	r := []rune(s)
+	if start < 0 {
+		start = 0
+	}
+	if start > int64(len(r)) || n <= 0 {
+		return ""
+	}
+	end := int64(len(r))
+	if n < end-start {
+		end = start + n
+	}
+	return string(r[start:end])
+}
+
 // Execute performs an instruction cycle in the VM -- acting on the current
 // instruction, and returns a boolean indicating if the current thread should
 // terminate.
@@ -200,29 +457,45 @@ func (v *VM) execute(t *thread, i instr) {
 		// Store the results in the operandth element of the stack,
 		// where i.opnd == the matched re index
 		index := i.opnd.(int)
-		t.matches[index] = v.re[index].FindStringSubmatch(v.input)
+		RegexMatchAttempts.Add(v.name, 1)
+		t.matches[index] = v.re[index].FindStringSubmatch(v.input.Line)
 		t.match = t.matches[index] != nil
+		t.matched = t.matched || t.match
 
 	case cmp:
 		// Compare two elements on the stack.
 		// Set the match register based on the truthiness of the comparison.
-		// Operand contains the expected result.
-		b, err := t.PopInt()
+		// Operand contains the expected result.  A capture group that isn't
+		// a number, such as an empty optional group, skips the rest of the
+		// program rather than matching.  A float, such as a ratio from
+		// float(), is compared as a float.
+		b := t.Pop()
+		y, err := toFloat(b)
 		if err != nil {
-			v.errorf("%s", err)
+			v.conversionError(err)
+			return
 		}
-		a, err := t.PopInt()
+		a := t.Pop()
+		x, err := toFloat(a)
 		if err != nil {
-			v.errorf("%s", err)
+			v.conversionError(err)
+			return
+		}
+		less, equal := x < y, x == y
+		if !isFloat(a) && !isFloat(b) {
+			// Integers are compared exactly, as floats can't hold them all.
+			m, _ := toInt(a)
+			n, _ := toInt(b)
+			less, equal = m < n, m == n
 		}
 
 		switch i.opnd {
 		case -1:
-			t.match = a < b
+			t.match = less
 		case 0:
-			t.match = a == b
+			t.match = equal
 		case 1:
-			t.match = a > b
+			t.match = !less && !equal
 		}
 
 	case jnm:
@@ -235,52 +508,96 @@ func (v *VM) execute(t *thread, i instr) {
 			t.pc = i.opnd.(int)
 		}
 
+	case jmp:
+		t.pc = i.opnd.(int)
+
 	case inc:
 		// increment a counter
 		var delta int64 = 1
+		if v.sampleRate > 0 {
+			delta = v.sampleRate
+		}
 		// If opnd is non-nil, the delta is on the stack.
 		if i.opnd != nil {
 			var err error
 			delta, err = t.PopInt()
 			if err != nil {
 				v.errorf("%s", err)
+				return
+			}
+			// Counters only go up, so a negative delta is an error in the
+			// program or the log rather than a decrement.
+			if k, ok := i.opnd.(metrics.Kind); ok && k == metrics.Counter && delta < 0 {
+				glog.V(1).Infof("Negative increment of a counter in %s: %d", v.name, delta)
+				NegativeIncrements.Add(v.name, 1)
+				t.Pop()
+				return
 			}
 		}
 		switch n := t.Pop().(type) {
 		case metrics.Incrementable:
-			n.IncBy(delta, t.time)
+			n.IncBy(delta, v.lineTime())
 		case int:
 			m := v.m[n]
 			d, err := m.GetDatum()
 			if err != nil {
 				v.errorf("GetDatum failed: %s", err)
 			}
-			d.IncBy(delta, t.time)
+			d.IncBy(delta, v.lineTime())
 		default:
 			v.errorf("Unexpected type to increment: %T %q", n, n)
 		}
 
 	case set:
-		// Set a gauge
+		// Set a gauge to the value at TOS, replacing its previous value.  A
+		// value that isn't a number, such as a capture group that didn't
+		// match digits, leaves the gauge as it was, and the rest of the
+		// program still runs.
 		value, err := t.PopInt()
 		if err != nil {
-			v.errorf("%s", err)
+			v.skipStore(err)
+			t.Pop()
+			return
 		}
 
 		switch n := t.Pop().(type) {
 		case metrics.Settable:
-			n.Set(value, t.time)
+			n.Set(value, v.lineTime())
 		case int:
 			m := v.m[n]
 			d, err := m.GetDatum()
 			if err != nil {
 				v.errorf("GetDatum failed: %s", err)
 			}
-			d.Set(value, t.time)
+			d.Set(value, v.lineTime())
 		default:
 			v.errorf("Unexpected type to set: %T %q", n, n)
 		}
 
+	case observe:
+		// Record an observation in a histogram.  A value that isn't a number
+		// isn't recorded, as for set.
+		value, err := t.PopInt()
+		if err != nil {
+			v.skipStore(err)
+			t.Pop()
+			return
+		}
+
+		switch n := t.Pop().(type) {
+		case metrics.Observable:
+			n.Observe(value, v.lineTime())
+		case int:
+			m := v.m[n]
+			d, err := m.GetDatum()
+			if err != nil {
+				v.errorf("GetDatum failed: %s", err)
+			}
+			d.Observe(value, v.lineTime())
+		default:
+			v.errorf("Unexpected type to observe: %T %q", n, n)
+		}
+
 	case strptime:
 		// Parse a time string into the time register
 		layout := t.Pop().(string)
@@ -299,12 +616,17 @@ func (v *VM) execute(t *thread, i instr) {
 		if tm, ok := v.timeMemos[ts]; !ok {
 			tm, err := time.Parse(layout, ts)
 			if err != nil {
-				v.errorf("time.Parse(%s, %s) failed: %s", layout, ts, err)
+				// Use the current time rather than dropping the line, and
+				// don't memoise it.
+				glog.V(1).Infof("time.Parse(%s, %s) failed: %s", layout, ts, err)
+				StrptimeErrors.Add(v.name, 1)
+				t.time = v.clock.Now().UTC()
+				break
 			}
 			// Hack for yearless syslog.
 			if tm.Year() == 0 && v.syslogUseCurrentYear {
 				// No .UTC() as we use local time to match the local log.
-				tm = tm.AddDate(time.Now().Year(), 0, 0)
+				tm = tm.AddDate(v.clock.Now().Year(), 0, 0)
 			}
 			v.timeMemos[ts] = tm
 			t.time = tm
@@ -312,13 +634,31 @@ func (v *VM) execute(t *thread, i instr) {
 			t.time = tm
 		}
 
+	case gettime:
+		// Parse the timestamp leading the line with the first layout that
+		// matches it.  If none do, use the current time rather than dropping
+		// the line.
+		if tm, ok := v.parseLeadingTime(v.input.Line); ok {
+			t.time = tm
+		} else {
+			glog.V(1).Infof("No timestamp found at the start of %q", v.input.Line)
+			GettimeMisses.Add(v.name, 1)
+			t.time = v.clock.Now().UTC()
+		}
+		t.Push(t.time.Unix())
+
 	case timestamp:
 		// Put the time register onto the stack
 		t.Push(t.time.Unix())
 
 	case settime:
 		// Pop TOS and store in time register
-		t.time = time.Unix(t.Pop().(int64), 0).UTC()
+		ts, err := t.PopInt()
+		if err != nil {
+			v.conversionError(err)
+			return
+		}
+		t.time = time.Unix(ts, 0).UTC()
 
 	case capref:
 		// Put a capture group reference onto the stack.
@@ -337,42 +677,53 @@ func (v *VM) execute(t *thread, i instr) {
 
 	case add:
 		// Add two values at TOS, and push result onto stack
-		b, err := t.PopInt()
-		if err != nil {
-			v.errorf("%s", err)
-		}
-		a, err := t.PopInt()
-		if err != nil {
-			v.errorf("%s", err)
-		}
-		t.Push(a + b)
+		v.arith(t, func(a, b int64) int64 { return a + b }, func(a, b float64) float64 { return a + b })
 
 	case sub:
 		// Subtract two values at TOS, push result onto stack
-		b, err := t.PopInt()
-		if err != nil {
-			v.errorf("%s", err)
-		}
-		a, err := t.PopInt()
-		if err != nil {
-			v.errorf("%s", err)
-		}
-		t.Push(a - b)
+		v.arith(t, func(a, b int64) int64 { return a - b }, func(a, b float64) float64 { return a - b })
 
 	case mul:
 		// Multiply two values at TOS, push result
-		b, err := t.PopInt()
+		v.arith(t, func(a, b int64) int64 { return a * b }, func(a, b float64) float64 { return a * b })
+
+	case div:
+		// Divide two values at TOS, push result.  Integers are divided
+		// exactly as integers, so a ratio needs an operand converted with
+		// float().
+		b, a := t.Pop(), t.Pop()
+		if isFloat(a) || isFloat(b) {
+			x, err := toFloat(a)
+			if err != nil {
+				v.errorf("%s", err)
+			}
+			y, err := toFloat(b)
+			if err != nil {
+				v.errorf("%s", err)
+			}
+			if y == 0 {
+				v.divisionByZero()
+				return
+			}
+			t.Push(x / y)
+			return
+		}
+		x, err := toInt(a)
 		if err != nil {
 			v.errorf("%s", err)
 		}
-		a, err := t.PopInt()
+		y, err := toInt(b)
 		if err != nil {
 			v.errorf("%s", err)
 		}
-		t.Push(a * b)
+		if y == 0 {
+			v.divisionByZero()
+			return
+		}
+		t.Push(x / y)
 
-	case div:
-		// Divide two values at TOS, push result
+	case mod:
+		// Divide two values at TOS, push the remainder
 		b, err := t.PopInt()
 		if err != nil {
 			v.errorf("%s", err)
@@ -381,7 +732,11 @@ func (v *VM) execute(t *thread, i instr) {
 		if err != nil {
 			v.errorf("%s", err)
 		}
-		t.Push(a / b)
+		if b == 0 {
+			v.divisionByZero()
+			return
+		}
+		t.Push(a % b)
 
 	case pow:
 		b, err := t.PopInt()
@@ -438,6 +793,17 @@ func (v *VM) execute(t *thread, i instr) {
 		}
 		t.Push(a | b)
 
+	case coalesce:
+		// Use the default at TOS in place of an empty string, such as an
+		// optional capture group that didn't match.
+		b := t.Pop()
+		a := t.Pop()
+		if s, ok := a.(string); ok && s == "" {
+			t.Push(b)
+		} else {
+			t.Push(a)
+		}
+
 	case xor:
 		b, err := t.PopInt()
 		if err != nil {
@@ -469,29 +835,185 @@ func (v *VM) execute(t *thread, i instr) {
 		keys := make([]string, index)
 		//fmt.Printf("keys: %v\n", keys)
 		for a := 0; a < index; a++ {
-			s := t.Pop().(string)
+			s := t.popKey()
 			//fmt.Printf("s: %v\n", s)
 			keys[a] = s
 			//fmt.Printf("Keys: %v\n", keys)
 		}
 		//fmt.Printf("Keys: %v\n", keys)
 		d, err := m.GetDatum(keys...)
-		if err != nil {
+		if err == metrics.ErrLabelSetLimit {
+			// The datum is dropped, so the update that follows has no
+			// effect.
+			glog.V(1).Infof("Label set %q dropped from %s in %s: %s", keys, m.Name, v.name, err)
+		} else if err != nil {
 			v.errorf("GetDatum failed: %s", err)
 		}
 		//fmt.Printf("Found %v\n", d)
 		t.Push(d)
 
+	case del:
+		// Remove the datum of the metric at TOS named by the operand keys,
+		// or all of its data if there are no keys.
+		m := t.Pop().(*metrics.Metric)
+		n := i.opnd.(int)
+		if n == 0 {
+			m.RemoveAll()
+			break
+		}
+		keys := make([]string, n)
+		for a := 0; a < n; a++ {
+			keys[a] = t.popKey()
+		}
+		if err := m.RemoveDatum(keys...); err != nil {
+			v.errorf("RemoveDatum failed: %s", err)
+		}
+
+	case getfilename:
+		t.Push(v.input.Filename)
+
+	case getstream:
+		t.Push(v.input.Stream)
+
+	case starttimer:
+		// Start the timer keyed by TOS at the time of the line.
+		v.timers.start(toString(t.Pop()), v.lineTime())
+
+	case elapsed:
+		// Push the seconds since the timer keyed by TOS was started, as a
+		// float, and stop it.  The program ends for the line if there's
+		// no timer.
+		key := toString(t.Pop())
+		s, ok := v.timers.elapsed(key, v.lineTime())
+		if !ok {
+			glog.V(1).Infof("No timer started for %q in %s", key, v.name)
+			UnknownTimers.Add(v.name, 1)
+			v.terminate = true
+			return
+		}
+		t.Push(s)
+
+	case substr:
+		// Push the substring of the string at third TOS, starting at the
+		// character at second TOS and of the length at TOS.
+		n, err := t.PopInt()
+		if err != nil {
+			v.conversionError(err)
+			return
+		}
+		start, err := t.PopInt()
+		if err != nil {
+			v.conversionError(err)
+			return
+		}
+		s := t.Pop().(string)
+		t.Push(substring(s, start, n))
+
+	case strlen:
+		// Push the number of characters, rather than bytes, in the string at
+		// TOS.
+		s := t.Pop().(string)
+		t.Push(int64(utf8.RuneCountInString(s)))
+
+	case sprintf:
+		// Format the arguments on the stack with the format string below
+		// them, and push the result.
+		args := make([]interface{}, i.opnd.(int)-1)
+		for a := len(args) - 1; a >= 0; a-- {
+			args[a] = t.Pop()
+		}
+		f := toString(t.Pop())
+		s, err := formatString(f, args)
+		if err != nil {
+			glog.V(1).Infof("Format failed in %s: %s", v.name, err)
+			FormatErrors.Add(v.name, 1)
+			v.terminate = true
+			return
+		}
+		t.Push(s)
+
+	case cidr:
+		// Push the network of the address at second TOS, or the empty
+		// string if the address or prefix length at TOS is invalid.
+		prefix := toString(t.Pop())
+		ip := toString(t.Pop())
+		n, err := networkOf(ip, prefix)
+		if err != nil {
+			v.ipError(err)
+		}
+		t.Push(n)
+
+	case incidr:
+		// Set the match register if the address at second TOS is in the
+		// network at TOS.  An invalid address or network doesn't match.
+		network := toString(t.Pop())
+		ip := toString(t.Pop())
+		match, err := inCIDR(ip, network)
+		if err != nil {
+			v.ipError(err)
+		}
+		t.match = match
+
+	case subst:
+		// Replace the matches of the regex at operand in the string at
+		// second TOS with the replacement at TOS, which can refer to the
+		// capture groups as ${1} or ${name}, and push the result.
+		repl := toString(t.Pop())
+		s := toString(t.Pop())
+		t.Push(v.re[i.opnd.(int)].ReplaceAllString(s, repl))
+
 	case tolower:
 		// Lowercase a string from TOS, and push result back.
 		s := t.Pop().(string)
 		t.Push(strings.ToLower(s))
 
+	case toupper:
+		// Uppercase a string from TOS, and push result back.
+		s := t.Pop().(string)
+		t.Push(strings.ToUpper(s))
+
 	case length:
 		// Compute the length of a string from TOS, and push result back.
 		s := t.Pop().(string)
 		t.Push(len(s))
 
+	case toint:
+		// Convert the value at TOS to an integer, and push the result back.
+		// Strings have surrounding whitespace removed before being parsed.
+		val := t.Pop()
+		if s, ok := val.(string); ok {
+			val = strings.TrimSpace(s)
+		}
+		t.Push(val)
+		n, err := t.PopInt()
+		if err != nil {
+			v.conversionError(err)
+			return
+		}
+		t.Push(n)
+
+	case tofloat:
+		// Convert the value at TOS to a float, and push the result back.
+		// Strings have surrounding whitespace removed before being parsed.
+		var f float64
+		var err error
+		switch val := t.Pop().(type) {
+		case string:
+			f, err = strconv.ParseFloat(strings.TrimSpace(val), 64)
+		case float64:
+			f = val
+		default:
+			t.Push(val)
+			var n int64
+			n, err = t.PopInt()
+			f = float64(n)
+		}
+		if err != nil {
+			v.conversionError(err)
+			return
+		}
+		t.Push(f)
+
 	case strtol:
 		base, err := t.PopInt()
 		if err != nil {
@@ -504,6 +1026,63 @@ func (v *VM) execute(t *thread, i instr) {
 		}
 		t.Push(i)
 
+	case split:
+		// Split the string at second TOS by the separator at TOS, and push the
+		// fields back.
+		sep := t.Pop().(string)
+		s := t.Pop().(string)
+		t.Push(strings.Split(s, sep))
+
+	case logfmt:
+		// Parse the string at TOS into a map of fields, and push it back.
+		s := t.Pop().(string)
+		t.Push(parseLogfmt(s))
+
+	case getjson:
+		// Parse the string at second TOS as JSON, and push the value at the
+		// path at TOS.  A string that isn't JSON is counted and yields the
+		// empty string.
+		path := t.Pop().(string)
+		s := t.Pop().(string)
+		doc, err := t.parseJSON(s)
+		if err != nil {
+			glog.V(1).Infof("JSON parse failed in %s: %s", v.name, err)
+			JSONParseErrors.Add(v.name, 1)
+			t.Push("")
+			return
+		}
+		t.Push(jsonPath(doc, path))
+
+	case index:
+		// Push the field at the index at TOS of the fields at second TOS.
+		// Fields from split are numbered from 0, and those from logfmt are
+		// looked up by key; an index out of range or a missing key yields the
+		// empty string.
+		key := t.Pop()
+		switch fields := t.Pop().(type) {
+		case []string:
+			t.Push(key)
+			n, err := t.PopInt()
+			if err != nil {
+				v.errorf("%s", err)
+				return
+			}
+			if n < 0 || n >= int64(len(fields)) {
+				t.Push("")
+			} else {
+				t.Push(fields[n])
+			}
+		case map[string]string:
+			k, ok := key.(string)
+			if !ok {
+				v.errorf("logfmt fields must be indexed by a string, not %v", key)
+				return
+			}
+			t.Push(fields[k])
+		default:
+			v.errorf("can't index %v", fields)
+		}
+
 	default:
 		v.errorf("illegal instruction: %q", i.op)
 	}
@@ -511,38 +1090,105 @@ func (v *VM) execute(t *thread, i instr) {
 
 // processLine handles the incoming lines from the input channel, by running a
 // fetch-execute cycle on the VM bytecode with the line as input to the
-// program, until termination.
-func (v *VM) processLine(input string) {
+// program, until termination, or until ctx is done or the line timeout has
+// passed.  A line that runs out of time is abandoned and counted, though the
+// updates it has already made to metrics are kept.  A single match can't be
+// interrupted, so the time is checked after each match, and every
+// deadlineCheckInterval instructions.
+func (v *VM) processLine(ctx context.Context, input *logline.LogLine) {
 	t := new(thread)
 	v.t = t
 	v.input = input
+	v.terminate = false
 	t.stack = make([]interface{}, 0)
 	t.matches = make(map[int][]string, 0)
-	for {
-		if t.pc >= len(v.prog) {
-			return
-		}
+	// Logs that record when each line was written, such as Docker's, set the
+	// time register before the program runs.
+	t.time = input.Time
+	var deadline time.Time
+	if v.lineTimeout > 0 {
+		deadline = v.clock.Now().Add(v.lineTimeout)
+	}
+	for n := 1; t.pc < len(v.prog); n++ {
 		i := v.prog[t.pc]
 		t.pc++
 		v.execute(t, i)
 		if v.terminate {
-			return
+			break
+		}
+		if !deadline.IsZero() && (i.op == match || n%deadlineCheckInterval == 0) && v.pastDeadline(ctx, deadline) {
+			glog.V(1).Infof("Program %s took longer than %s on input %q from %s, abandoning it", v.name, v.lineTimeout, input.Line, input.Filename)
+			LineTimeouts.Add(v.name, 1)
+			break
 		}
 	}
+	if t.matched {
+		LineMatches.Add(v.name, 1)
+	}
+}
+
+// pastDeadline reports whether ctx has been cancelled, or the VM's clock has
+// reached the deadline.
+func (v *VM) pastDeadline(ctx context.Context, deadline time.Time) bool {
+	return ctx.Err() != nil || !v.clock.Now().Before(deadline)
+}
+
+// runLine processes a single line, recovering from any panic in the program
+// by disabling it, so that other programs are unaffected.  If there's a line
+// timeout, the line is abandoned once it has run for that long.
+func (v *VM) runLine(input *logline.LogLine) {
+	if v.workers != nil {
+		// Wait for a free worker, so that no more programs run at once
+		// than the loader allows.
+		v.workers <- struct{}{}
+		defer func() { <-v.workers }()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Infof("Program %s panicked on input %q from %s and has been disabled: %s\n%s", v.name, input.Line, input.Filename, r, debug.Stack())
+			RuntimeErrors.Add(v.name, 1)
+			v.disabled = true
+			setHealthy(v.name, false)
+		}
+	}()
+	ctx := context.Background()
+	if v.lineTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.lineTimeout)
+		defer cancel()
+	}
+	v.processLine(ctx, input)
 }
 
 // Run executes the virtual machine on each line of input received.  When the
 // input closes, it signals to the loader that it has terminated by closing the
-// shutdown channel.
-func (v *VM) Run(lines <-chan string, shutdown chan<- struct{}) {
+// shutdown channel.  A disabled program continues to receive lines, but
+// ignores them.
+func (v *VM) Run(lines <-chan *logline.LogLine, shutdown chan<- struct{}) {
 	glog.Infof("Starting program %s", v.name)
 	defer close(shutdown)
-	for line := range lines {
-		v.processLine(line)
+	defer regexes.release(v.regexes)
+	if v.recordStart != nil {
+		v.runRecords(lines)
+	} else {
+		for line := range lines {
+			v.setQueueDepth(lines)
+			if v.disabled {
+				continue
+			}
+			v.runLine(line)
+		}
 	}
 	glog.Infof("Stopping program %s", v.name)
 }
 
+// setQueueDepth records the number of lines waiting for the program.
+func (v *VM) setQueueDepth(lines <-chan *logline.LogLine) {
+	if v.queueDepth != nil {
+		v.queueDepth.Set(int64(len(lines)))
+	}
+}
+
 // New creates a new virtual machine with the given name, and compiler
 // artifacts for executable and data segments.
 func New(name string, re []*regexp.Regexp, str []string, m []*metrics.Metric, prog []instr, syslogUseCurrentYear bool) *VM {
@@ -553,29 +1199,85 @@ func New(name string, re []*regexp.Regexp, str []string, m []*metrics.Metric, pr
 		m:                    m,
 		prog:                 prog,
 		timeMemos:            make(map[string]time.Time, 0),
+		timeLayouts:          DefaultTimeLayouts,
 		syslogUseCurrentYear: syslogUseCurrentYear,
+		maxRecordSize:        DefaultMaxRecordSize,
+		recordFlushTimeout:   DefaultRecordFlushTimeout,
+		timers:               newTimerTable(name, DefaultTimerLimit, DefaultTimerTTL),
+		clock:                clock.Real,
 	}
 }
 
-// DumpByteCode emits the program disassembly and data to standard out.
-func (v *VM) DumpByteCode(name string) {
-	fmt.Printf("Prog %s\n", name)
-	fmt.Println("Metrics")
+// DumpByteCode writes the program disassembly and data to out.  Operands that
+// refer to a regular expression, string, metric or capture group are
+// annotated with what they refer to.
+func (v *VM) DumpByteCode(name string, out io.Writer) {
+	fmt.Fprintf(out, "Prog %s\n", name)
+	fmt.Fprintln(out, "Metrics")
 	for i, m := range v.m {
 		if m.Program == v.name {
-			fmt.Printf(" %8d %s\n", i, m)
+			fmt.Fprintf(out, " %8d %s\n", i, m)
 		}
 	}
-	fmt.Println("REs")
+	fmt.Fprintln(out, "REs")
 	for i, re := range v.re {
-		fmt.Printf(" %8d /%s/\n", i, re)
+		fmt.Fprintf(out, " %8d /%s/\n", i, re)
+	}
+	fmt.Fprintln(out, "Strings")
+	for i, s := range v.str {
+		fmt.Fprintf(out, " %8d %q\n", i, s)
 	}
 	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 0, 1, ' ', tabwriter.AlignRight)
+	w.Init(out, 0, 0, 1, ' ', tabwriter.AlignRight)
 
 	fmt.Fprintln(w, "disasm\tl\top\topnd\t")
 	for n, i := range v.prog {
-		fmt.Fprintf(w, "\t%d\t%s\t%d\t\n", n, opNames[i.op], i.opnd)
+		opnd := ""
+		if i.opnd != nil {
+			opnd = fmt.Sprintf("%v", i.opnd)
+		}
+		note := v.annotate(i)
+		if note != "" {
+			note = " " + note
+		}
+		fmt.Fprintf(w, "\t%d\t%s\t%s\t%s\n", n, opNames[i.op], opnd, note)
 	}
 	w.Flush()
 }
+
+// annotate describes what the operand of the instruction refers to, for the
+// bytecode dump.
+func (v *VM) annotate(i instr) string {
+	n, ok := i.opnd.(int)
+	if !ok {
+		return ""
+	}
+	switch i.op {
+	case match:
+		if n >= 0 && n < len(v.re) {
+			return "/" + v.re[n].String() + "/"
+		}
+	case str:
+		if n >= 0 && n < len(v.str) {
+			return strconv.Quote(v.str[n])
+		}
+	case mload:
+		if n >= 0 && n < len(v.m) {
+			return v.m[n].Name
+		}
+	case capref:
+		return "$" + strconv.Itoa(n)
+	case cmp:
+		switch n {
+		case -1:
+			return "<"
+		case 0:
+			return "=="
+		case 1:
+			return ">"
+		}
+	case jnm, jm, jmp:
+		return "-> " + strconv.Itoa(n)
+	}
+	return ""
+}
@@ -4,10 +4,15 @@
 package vm
 
 import (
+	"fmt"
+	"math"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/mtail/clock"
+	"github.com/google/mtail/logline"
 	"github.com/google/mtail/metrics"
 	"github.com/kylelemons/godebug/pretty"
 )
@@ -69,7 +74,7 @@ var instructions = []struct {
 		[]string{},
 		[]interface{}{},
 		[]interface{}{},
-		thread{match: true, pc: 0, matches: map[int][]string{0: {"aaaab"}}},
+		thread{match: true, matched: true, pc: 0, matches: map[int][]string{0: {"aaaab"}}},
 	},
 	{"cmp lt",
 		instr{cmp, -1},
@@ -99,6 +104,13 @@ var instructions = []struct {
 		[]interface{}{2, "2"},
 		[]interface{}{},
 		thread{pc: 0, match: false, matches: map[int][]string{}}},
+	{"cmp float",
+		instr{cmp, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{0.25, 0},
+		[]interface{}{},
+		thread{pc: 0, match: true, matches: map[int][]string{}}},
 	{"cmp ne",
 		instr{cmp, 0},
 		[]*regexp.Regexp{},
@@ -127,6 +139,13 @@ var instructions = []struct {
 		[]interface{}{},
 		[]interface{}{},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"jmp",
+		instr{jmp, 37},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{},
+		[]interface{}{},
+		thread{pc: 37, matches: map[int][]string{}}},
 	{"strptime",
 		instr{strptime, 0},
 		[]*regexp.Regexp{},
@@ -157,11 +176,25 @@ var instructions = []struct {
 		[]interface{}{int64(1)},
 		thread{pc: 0, matches: map[int][]string{}}},
 	{"div",
-		instr{sub, 0},
+		instr{div, 0},
 		[]*regexp.Regexp{},
 		[]string{},
-		[]interface{}{4, 2},
-		[]interface{}{int64(2)},
+		[]interface{}{7, 2},
+		[]interface{}{int64(3)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"div float",
+		instr{div, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{1.0, 4},
+		[]interface{}{0.25},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"mod",
+		instr{mod, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{7, 3},
+		[]interface{}{int64(1)},
 		thread{pc: 0, matches: map[int][]string{}}},
 	{"tolower",
 		instr{tolower, 0},
@@ -170,6 +203,90 @@ var instructions = []struct {
 		[]interface{}{"mIxeDCasE"},
 		[]interface{}{"mixedcase"},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"tolower utf8",
+		instr{tolower, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"ÇAFÉ ΣΊΣΥΦΟΣ"},
+		[]interface{}{"çafé σίσυφοσ"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"substr",
+		instr{substr, 3},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"/api/v1/users", int64(0), int64(4)},
+		[]interface{}{"/api"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"substr utf8",
+		instr{substr, 3},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"ÇAFÉ ΣΊΣΥΦΟΣ", int64(3), int64(3)},
+		[]interface{}{"É Σ"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"subst",
+		instr{subst, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`/user/(\d+)/(?P<page>\w+)`)},
+		[]string{},
+		[]interface{}{"GET /user/123/profile", "/user/:id/${page}?id=${1}"},
+		[]interface{}{"GET /user/:id/profile?id=123"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"subst every match",
+		instr{subst, 0},
+		[]*regexp.Regexp{regexp.MustCompile(`\d+`)},
+		[]string{},
+		[]interface{}{"/a/1/b/22", ":n"},
+		[]interface{}{"/a/:n/b/:n"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"strlen utf8",
+		instr{strlen, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"ÇAFÉ ΣΊΣΥΦΟΣ"},
+		[]interface{}{int64(12)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"toupper",
+		instr{toupper, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"mIxeDCasE"},
+		[]interface{}{"MIXEDCASE"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"toupper utf8",
+		instr{toupper, 0},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"çafé ωμέγα"},
+		[]interface{}{"ÇAFÉ ΩΜΈΓΑ"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"toint",
+		instr{toint, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{" 42\t"},
+		[]interface{}{int64(42)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"toint float",
+		instr{toint, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{2.7},
+		[]interface{}{int64(2)},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"tofloat",
+		instr{tofloat, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{" 1.5 "},
+		[]interface{}{1.5},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"tofloat int",
+		instr{tofloat, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{int64(3)},
+		[]interface{}{3.0},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"length",
 		instr{length, 0},
 		[]*regexp.Regexp{},
@@ -254,6 +371,55 @@ var instructions = []struct {
 		[]interface{}{"ff", 16},
 		[]interface{}{int64(255)},
 		thread{pc: 0, matches: map[int][]string{}}},
+	{"split",
+		instr{split, 2},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{"a,b,c", ","},
+		[]interface{}{[]string{"a", "b", "c"}},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"index",
+		instr{index, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{[]string{"a", "b", "c"}, 1},
+		[]interface{}{"b"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"index out of range",
+		instr{index, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{[]string{"a", "b", "c"}, 3},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"logfmt",
+		instr{logfmt, 1},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{`level=error user=alice`},
+		[]interface{}{map[string]string{"level": "error", "user": "alice"}},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"index key",
+		instr{index, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{map[string]string{"user": "alice"}, "user"},
+		[]interface{}{"alice"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"index missing key",
+		instr{index, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{map[string]string{"user": "alice"}, "host"},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"index negative",
+		instr{index, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{[]string{"a", "b", "c"}, -1},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"settime",
 		instr{settime, 0},
 		[]*regexp.Regexp{},
@@ -261,6 +427,20 @@ var instructions = []struct {
 		[]interface{}{int64(0)},
 		[]interface{}{},
 		thread{pc: 0, time: time.Unix(0, 0).UTC(), matches: map[int][]string{}}},
+	{"getfilename",
+		instr{getfilename, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{},
+		[]interface{}{"test"},
+		thread{pc: 0, matches: map[int][]string{}}},
+	{"getstream",
+		instr{getstream, nil},
+		[]*regexp.Regexp{},
+		[]string{},
+		[]interface{}{},
+		[]interface{}{""},
+		thread{pc: 0, matches: map[int][]string{}}},
 	{"push int",
 		instr{push, 1},
 		[]*regexp.Regexp{},
@@ -293,7 +473,7 @@ func TestInstrs(t *testing.T) {
 			v.t.Push(item)
 		}
 		v.t.matches = make(map[int][]string, 0)
-		v.input = "aaaab"
+		v.input = logline.New("test", "aaaab")
 		v.execute(v.t, tc.i)
 
 		diff := pretty.Compare(tc.expectedStack, v.t.stack)
@@ -308,3 +488,693 @@ func TestInstrs(t *testing.T) {
 		}
 	}
 }
+
+// TestRunRecoversPanic tests that a program that panics is disabled, but
+// keeps draining its input.
+func TestRunRecoversPanic(t *testing.T) {
+	v := New("panics", nil, nil, nil, []instr{instr{mload, 0}}, true)
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	lines <- logline.New("test", "a")
+	lines <- logline.New("test", "b")
+	close(lines)
+	<-done
+	if !v.disabled {
+		t.Errorf("program not disabled after panic")
+	}
+	if h := ProgHealthy.Get("panics"); h == nil || h.String() != "0" {
+		t.Errorf("program health not recorded as 0: %v", h)
+	}
+	if e := RuntimeErrors.Get("panics"); e == nil || e.String() != "1" {
+		t.Errorf("panic not counted as a runtime error: %v", e)
+	}
+}
+
+func TestMatchCounters(t *testing.T) {
+	re := []*regexp.Regexp{regexp.MustCompile("a")}
+	v := New("counters", re, nil, nil, []instr{instr{match, 0}}, true)
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	lines <- logline.New("test", "a")
+	lines <- logline.New("test", "b")
+	close(lines)
+	<-done
+	if e := RegexMatchAttempts.Get("counters"); e == nil || e.String() != "2" {
+		t.Errorf("match attempts not counted: %v", e)
+	}
+	if e := LineMatches.Get("counters"); e == nil || e.String() != "1" {
+		t.Errorf("matched lines not counted: %v", e)
+	}
+}
+
+// TestStrptimeParseError tests that an unparseable timestamp is counted and
+// replaced with the current time, without terminating the program.
+func TestStrptimeParseError(t *testing.T) {
+	v := New("badtime", nil, nil, nil, []instr{instr{strptime, 0}}, true)
+	v.t = new(thread)
+	v.t.stack = []interface{}{"not a time", "2006/01/02 15:04:05"}
+	v.t.matches = make(map[int][]string, 0)
+	before := time.Now()
+	v.execute(v.t, instr{strptime, 0})
+	if v.terminate {
+		t.Errorf("program terminated on parse error")
+	}
+	if v.t.time.Before(before) || v.t.time.After(time.Now()) {
+		t.Errorf("timestamp not set to now: %v", v.t.time)
+	}
+	if e := StrptimeErrors.Get("badtime"); e == nil || e.String() != "1" {
+		t.Errorf("parse error not counted: %v", e)
+	}
+}
+
+var conversionErrorTests = []struct {
+	name string
+	op   opcode
+	val  string
+}{
+	{"int of empty string", toint, ""},
+	{"int of text", toint, "-"},
+	{"float of text", tofloat, "1.2.3"},
+	{"compare text", cmp, "slow"},
+}
+
+// TestConversionError tests that an unconvertible value is counted, and
+// terminates the program for the current line.
+func TestConversionError(t *testing.T) {
+	for _, tc := range conversionErrorTests {
+		v := New("badconv", nil, nil, nil, []instr{instr{tc.op, 1}}, true)
+		v.t = new(thread)
+		v.t.stack = []interface{}{tc.val}
+		v.t.matches = make(map[int][]string, 0)
+		before := "0"
+		if e := ConversionErrors.Get("badconv"); e != nil {
+			before = e.String()
+		}
+		v.execute(v.t, instr{tc.op, 1})
+		if !v.terminate {
+			t.Errorf("%s: program not terminated", tc.name)
+		}
+		if len(v.t.stack) != 0 {
+			t.Errorf("%s: stack not empty: %v", tc.name, v.t.stack)
+		}
+		if after := ConversionErrors.Get("badconv"); after == nil || after.String() == before {
+			t.Errorf("%s: conversion error not counted", tc.name)
+		}
+	}
+}
+
+var substringTests = []struct {
+	s        string
+	start, n int64
+	expected string
+}{
+	{"hello", 1, 3, "ell"},
+	{"hello", 0, 0, ""},
+	{"hello", 3, 10, "lo"},
+	{"hello", -2, 3, "hel"},
+	{"hello", 5, 1, ""},
+	{"hello", 9, 1, ""},
+	{"hello", 1, -1, ""},
+	{"日本語のテキスト", 2, 3, "語のテ"},
+	{"日本語", 1, 5, "本語"},
+}
+
+// TestSubstring tests that substrings count characters rather than bytes, and
+// that out of range arguments are clamped to the string.
+func TestSubstring(t *testing.T) {
+	for _, tc := range substringTests {
+		if r := substring(tc.s, tc.start, tc.n); r != tc.expected {
+			t.Errorf("substring(%q, %d, %d): got %q, want %q", tc.s, tc.start, tc.n, r, tc.expected)
+		}
+	}
+}
+
+// TestDivisionByZero tests that dividing by zero is a runtime error for the
+// current line, rather than a panic that disables the program.
+func TestDivisionByZero(t *testing.T) {
+	for _, op := range []opcode{div, mod} {
+		v := New("divzero", nil, nil, nil, []instr{instr{op, nil}}, true)
+		v.t = new(thread)
+		v.t.stack = []interface{}{int64(1), int64(0)}
+		v.t.matches = make(map[int][]string, 0)
+		v.execute(v.t, instr{op, nil})
+		if !v.terminate {
+			t.Errorf("%s: program not terminated", opNames[op])
+		}
+		if len(v.t.stack) != 0 {
+			t.Errorf("%s: stack not empty: %v", opNames[op], v.t.stack)
+		}
+	}
+	if e := DivisionsByZero.Get("divzero"); e == nil || e.String() != "2" {
+		t.Errorf("divisions by zero not counted: %v", e)
+	}
+}
+
+// TestMetricRatio tests that a gauge can be set from the current values of
+// other metrics, that it's left as it was while the divisor is zero, and that
+// a ratio divided as floats with float() keeps its fraction.
+func TestMetricRatio(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "counter requests\ncounter errors\ngauge error_percent\ncounter high\n" +
+		"/^(?P<code>\\d+)$/ {\n" +
+		"  requests++\n" +
+		"  $code >= 500 {\n" +
+		"    errors++\n" +
+		"  }\n" +
+		"}\n" +
+		"/^\\d+$|^healthz$/ {\n" +
+		"  error_percent = errors * 100 / requests\n" +
+		"  float(errors) / requests > 0.4 {\n" +
+		"    high++\n" +
+		"  }\n" +
+		"}\n"
+	v, err := Compile("ratio", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	// The first line divides by zero requests, leaving the gauge unset.
+	for _, l := range []string{"healthz", "200", "500", "200", "503"} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	expected := map[string]int64{"requests": 4, "errors": 2, "error_percent": 50, "high": 2}
+	for _, m := range store.Metrics {
+		d, err := m.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Get() != expected[m.Name] {
+			t.Errorf("%s: got %d, want %d", m.Name, d.Get(), expected[m.Name])
+		}
+	}
+	if e := DivisionsByZero.Get("ratio"); e == nil || e.String() != "1" {
+		t.Errorf("division by zero not counted: %v", e)
+	}
+}
+
+// TestSampledIncrements tests that increments count the program's sample rate
+// by default, and the amount given otherwise.
+func TestSampledIncrements(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "sample 100\ncounter events\ncounter weighted\n" +
+		"/^(?P<weight>\\d+)$/ {\n" +
+		"  events++\n" +
+		"  weighted += $weight\n" +
+		"}\n"
+	v, err := Compile("sampled", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for _, l := range []string{"10", "250", "1"} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	expected := map[string]int64{"events": 300, "weighted": 261}
+	for _, m := range store.Metrics {
+		d, err := m.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Get() != expected[m.Name] {
+			t.Errorf("%s: got %d, want %d", m.Name, d.Get(), expected[m.Name])
+		}
+	}
+}
+
+// TestCaprefDefault tests that an optional capture group that didn't match
+// is replaced by the default given with or, and kept otherwise.
+func TestCaprefDefault(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "counter requests by path\n" +
+		"/^GET(?: (?P<path>\\S+))?$/ {\n" +
+		"  requests[$path or \"-\"]++\n" +
+		"}\n"
+	v, err := Compile("default", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for _, l := range []string{"GET /index.html", "GET", "GET /index.html"} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	counts := make(map[string]int64)
+	lc := make(chan *metrics.LabelSet)
+	go store.Metrics[0].EmitLabelSets(lc)
+	for ls := range lc {
+		counts[ls.Labels["path"]] = ls.Datum.Get()
+	}
+	expected := map[string]int64{"/index.html": 2, "-": 1}
+	if diff := pretty.Compare(expected, counts); len(diff) > 0 {
+		t.Errorf("requests don't match:\n%s", diff)
+	}
+}
+
+// TestTimestampRoundTrip tests that the time set by timestamp() is stored
+// with the datum updated by the program.
+func TestTimestampRoundTrip(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "counter foo\n/(\\d+)/ {\n  timestamp($1)\n  foo++\n}\n"
+	v, err := Compile("timestamp", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	lines <- logline.New("test", "1343124840")
+	close(lines)
+	<-done
+	d, err := store.Metrics[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Time != time.Unix(1343124840, 0).UnixNano() {
+		t.Errorf("datum time not stored: got %d", d.Time)
+	}
+}
+
+// TestAddAssign tests adding constants, captures and computed values to
+// counters and gauges, and that negative amounts are added to gauges but
+// rejected for counters.
+func TestAddAssign(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "counter requests\ncounter bytes_total\ngauge in_flight\n" +
+		"/(?P<size>-?\\d+) (?P<delta>-?\\d+)/ {\n" +
+		"  requests += 1\n" +
+		"  bytes_total += int($size)\n" +
+		"  in_flight += $delta * 2\n" +
+		"}\n"
+	v, err := Compile("addassign", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	before := "0"
+	if e := NegativeIncrements.Get("addassign"); e != nil {
+		before = e.String()
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for _, l := range []string{"100 1", "-20 -3", "50 1"} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	expected := map[string]int64{"requests": 3, "bytes_total": 150, "in_flight": -2}
+	for _, m := range store.Metrics {
+		d, err := m.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Get() != expected[m.Name] {
+			t.Errorf("%s: got %d, want %d", m.Name, d.Get(), expected[m.Name])
+		}
+	}
+	if after := NegativeIncrements.Get("addassign"); after == nil || after.String() == before {
+		t.Error("negative increment of bytes_total not counted")
+	}
+}
+
+// TestLabelSetLimit tests that a metric with a limit drops the label sets
+// past it, and that the program carries on.
+func TestLabelSetLimit(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "counter requests by id limit 3\ncounter lines\n" +
+		"/(?P<id>\\w+)/ {\n" +
+		"  requests[$id]++\n" +
+		"  lines++\n" +
+		"}\n"
+	v, err := Compile("limit", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for _, l := range []string{"a", "b", "c", "d", "e", "a"} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	for _, m := range store.Metrics {
+		switch m.Name {
+		case "requests":
+			if len(m.LabelValues) != 3 {
+				t.Errorf("requests not capped at 3 label sets: %v", m.LabelValues)
+			}
+		case "lines":
+			d, err := m.GetDatum()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Get() != 6 {
+				t.Errorf("lines: got %d, want 6", d.Get())
+			}
+		}
+	}
+}
+
+// TestSubst tests that subst normalizes labels, with replacements that refer
+// to the capture groups of its pattern.
+func TestSubst(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "counter requests by path\n" +
+		"/GET (?P<url>\\S+)/ {\n" +
+		"  requests[subst($url, \"^/(?P<kind>\\w+)/\\d+/(\\w+)$\", \"/${kind}/:id/${2}\")]++\n" +
+		"}\n"
+	v, err := Compile("subst", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for _, l := range []string{"GET /user/123/profile", "GET /user/456/profile", "GET /repo/7/issues", "GET /about"} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	expected := map[string]int64{"/user/:id/profile": 2, "/repo/:id/issues": 1, "/about": 1}
+	for path, n := range expected {
+		d, err := store.Metrics[0].GetDatum(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Get() != n {
+			t.Errorf("%s: got %d, want %d", path, d.Get(), n)
+		}
+	}
+	if len(store.Metrics[0].LabelValues) != len(expected) {
+		t.Errorf("unexpected label sets: %v", store.Metrics[0].LabelValues)
+	}
+}
+
+// TestSetGauge tests that assigning to a gauge sets it to the value, whether
+// a timestamp parsed from the log or a numeric capture group, and that a value
+// that isn't a number leaves it unchanged without skipping the rest of the
+// program.
+func TestSetGauge(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "gauge last_backup_timestamp\ngauge backup_size_bytes\ncounter backups_total\n" +
+		"/^(?P<date>\\S+) backup complete size=(?P<size>\\S+)$/ {\n" +
+		"  strptime($date, \"2006-01-02T15:04:05Z\")\n" +
+		"  last_backup_timestamp = timestamp()\n" +
+		"  backup_size_bytes = $size\n" +
+		"  backups_total++\n" +
+		"}\n"
+	v, err := Compile("setgauge", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	before := "0"
+	if e := ConversionErrors.Get("setgauge"); e != nil {
+		before = e.String()
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for _, l := range []string{
+		"2017-03-01T02:00:00Z backup complete size=4096",
+		"2017-03-02T02:00:00Z backup complete size=1024",
+		"2017-03-03T02:00:00Z backup complete size=unknown",
+	} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	expected := map[string]int64{
+		"last_backup_timestamp": time.Date(2017, 3, 3, 2, 0, 0, 0, time.UTC).Unix(),
+		"backup_size_bytes":     1024,
+		"backups_total":         3,
+	}
+	for _, m := range store.Metrics {
+		d, err := m.GetDatum()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Get() != expected[m.Name] {
+			t.Errorf("%s: got %d, want %d", m.Name, d.Get(), expected[m.Name])
+		}
+	}
+	if after := ConversionErrors.Get("setgauge"); after == nil || after.String() == before {
+		t.Error("non-numeric size not counted as a conversion error")
+	}
+}
+
+// TestSummary tests that assigning to a summary observes the value in its
+// quantile estimates.
+func TestSummary(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "summary latency quantiles 0.5, 0.9\n" +
+		"/^(\\d+)$/ {\n" +
+		"  latency = $1\n" +
+		"}\n"
+	v, err := Compile("summary", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for i := 1; i <= 100; i++ {
+		lines <- logline.New("test", fmt.Sprintf("%d", i))
+	}
+	close(lines)
+	<-done
+
+	d, err := store.Metrics[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.GetCount() != 100 || d.Get() != 5050 {
+		t.Errorf("latencies not observed: count %d, sum %d", d.GetCount(), d.Get())
+	}
+	for q, expected := range map[float64]float64{0.5: 50, 0.9: 90} {
+		if got := d.GetQuantile(q); math.Abs(got-expected) > 1 {
+			t.Errorf("quantile %g: got %g, want about %g", q, got, expected)
+		}
+	}
+}
+
+// TestElapsed tests that elapsed measures the time between lines sharing a
+// key, and that a key without a start line is skipped.
+func TestElapsed(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "histogram request_ms buckets 1000, 5000, 10000\n" +
+		"/^(?P<date>\\S+) (?P<id>\\w+) start$/ {\n" +
+		"  strptime($date, \"2006-01-02T15:04:05Z\")\n" +
+		"  starttimer($id)\n" +
+		"}\n" +
+		"/^(?P<date>\\S+) (?P<id>\\w+) end$/ {\n" +
+		"  strptime($date, \"2006-01-02T15:04:05Z\")\n" +
+		"  request_ms = elapsed($id) * 1000\n" +
+		"}\n"
+	v, err := Compile("elapsed", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	before := "0"
+	if e := UnknownTimers.Get("elapsed"); e != nil {
+		before = e.String()
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for _, l := range []string{
+		"2017-03-01T02:00:00Z a start",
+		"2017-03-01T02:00:01Z b start",
+		"2017-03-01T02:00:04Z a end",
+		"2017-03-01T02:00:08.250Z b end",
+		"2017-03-01T02:00:09Z b end",
+		"2017-03-01T02:00:09Z c end",
+	} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	d, err := store.Metrics[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.GetCount() != 2 || d.Get() != 4000+7250 {
+		t.Errorf("durations not observed: count %d, sum %d", d.GetCount(), d.Get())
+	}
+	if after := UnknownTimers.Get("elapsed"); after == nil || after.String() == before {
+		t.Error("ends without a start not counted")
+	}
+}
+
+func TestTimerTableLimit(t *testing.T) {
+	tt := newTimerTable("test", 2, time.Minute)
+	start := time.Unix(1000, 0)
+	tt.start("a", start)
+	tt.start("b", start.Add(time.Second))
+	tt.start("c", start.Add(2*time.Second))
+	if len(tt.timers) != 2 || len(tt.oldest) != 2 {
+		t.Fatalf("timers not limited: %v", tt.timers)
+	}
+	if _, ok := tt.elapsed("a", start.Add(3*time.Second)); ok {
+		t.Error("oldest timer not evicted")
+	}
+	if s, ok := tt.elapsed("b", start.Add(3500*time.Millisecond)); !ok || s != 2.5 {
+		t.Errorf("elapsed b: got %g, %v", s, ok)
+	}
+	if _, ok := tt.elapsed("b", start.Add(3*time.Second)); ok {
+		t.Error("timer not stopped by elapsed")
+	}
+	if _, ok := tt.elapsed("c", start.Add(2*time.Minute)); ok {
+		t.Error("expired timer not forgotten")
+	}
+}
+
+// TestLineTimeAndStream tests that the time and stream of a line, as read
+// from a Docker log, are seen by programs.
+func TestLineTimeAndStream(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "counter lines by stream\ngauge last_line_timestamp\n" +
+		"/$/ {\n" +
+		"  lines[getstream()]++\n" +
+		"  last_line_timestamp = timestamp()\n" +
+		"}\n"
+	v, err := Compile("stream", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	ts := time.Date(2017, 3, 1, 2, 0, 0, 0, time.UTC)
+	for _, stream := range []string{"stdout", "stderr", "stdout"} {
+		lines <- &logline.LogLine{Filename: "test", Line: "hello", Stream: stream, Time: ts}
+	}
+	close(lines)
+	<-done
+
+	for stream, expected := range map[string]int64{"stdout": 2, "stderr": 1} {
+		d, err := store.Metrics[0].GetDatum(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Get() != expected {
+			t.Errorf("lines from %s: got %d, want %d", stream, d.Get(), expected)
+		}
+	}
+	d, err := store.Metrics[1].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Get() != ts.Unix() {
+		t.Errorf("timestamp: got %d, want %d", d.Get(), ts.Unix())
+	}
+}
+
+// slowClock is a fake clock that advances by step each time it's read, so
+// that every instruction that checks the time appears to take a while.
+type slowClock struct {
+	*clock.FakeClock
+	step time.Duration
+}
+
+func (c slowClock) Now() time.Time {
+	c.Advance(c.step)
+	return c.FakeClock.Now()
+}
+
+// TestLineTimeout tests that a line that takes longer than the line timeout
+// is abandoned and counted, keeping the updates made before it ran out of
+// time, and that the next line runs as usual.
+func TestLineTimeout(t *testing.T) {
+	m := []*metrics.Metric{metrics.NewMetric("matches", "slow", metrics.Counter)}
+	re := []*regexp.Regexp{regexp.MustCompile("a")}
+	var prog []instr
+	for i := 0; i < 5; i++ {
+		prog = append(prog, instr{match, 0}, instr{jnm, len(prog) + 5}, instr{mload, 0}, instr{dload, 0}, instr{inc, nil})
+	}
+	v := New("slow", re, nil, m, prog, true)
+	v.clock = slowClock{clock.NewFakeClock(time.Unix(1000, 0)), time.Second}
+	v.lineTimeout = 3 * time.Second
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	lines <- logline.New("test", "a")
+	close(lines)
+	<-done
+
+	if e := LineTimeouts.Get("slow"); e == nil || e.String() != "1" {
+		t.Errorf("line timeout not counted: %v", e)
+	}
+	d, err := m[0].GetDatum()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Get() < 1 || d.Get() >= 5 {
+		t.Errorf("matches: got %d, want the line abandoned part way", d.Get())
+	}
+	if v.disabled {
+		t.Error("program disabled by a line timeout")
+	}
+}
+
+// TestStatementsSharingCaptures tests that several statements in one block,
+// on one line, run in order with the captures of the block's pattern.
+func TestStatementsSharingCaptures(t *testing.T) {
+	store := metrics.NewStore()
+	prog := "counter requests\ncounter requests_by_code by code\ncounter bytes_total\ngauge last_method by method\n" +
+		"/^(?P<method>[A-Z]+) (?P<code>\\d+) (?P<size>\\d+)$/ { requests++; requests_by_code[$code]++; bytes_total += int($size); last_method[$method] = requests }\n"
+	v, err := Compile("statements", strings.NewReader(prog), store, false, true)
+	if err != nil {
+		t.Fatalf("Compile errors: %s", err)
+	}
+	lines := make(chan *logline.LogLine)
+	done := make(chan struct{})
+	go v.Run(lines, done)
+	for _, l := range []string{"GET 200 100", "POST 500 20", "GET 200 3"} {
+		lines <- logline.New("test", l)
+	}
+	close(lines)
+	<-done
+
+	for _, tc := range []struct {
+		metric   int
+		labels   []string
+		expected int64
+	}{
+		{0, nil, 3},
+		{1, []string{"200"}, 2},
+		{1, []string{"500"}, 1},
+		{2, nil, 123},
+		// The gauge is set after requests is incremented.
+		{3, []string{"GET"}, 3},
+		{3, []string{"POST"}, 2},
+	} {
+		d, err := store.Metrics[tc.metric].GetDatum(tc.labels...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Get() != tc.expected {
+			t.Errorf("%s%v: got %d, want %d", store.Metrics[tc.metric].Name, tc.labels, d.Get(), tc.expected)
+		}
+	}
+}
@@ -52,6 +52,9 @@ func (w *LogWatcher) run() {
 			w.events <- UpdateEvent{e.Name}
 		case e.Op&fsnotify.Remove == fsnotify.Remove:
 			w.events <- DeleteEvent{e.Name}
+		case e.Op&fsnotify.Rename == fsnotify.Rename:
+			// The file is no longer at the watched path, as if deleted.
+			w.events <- DeleteEvent{e.Name}
 		}
 	}
 	glog.Infof("Shutting down log watcher.")
@@ -95,6 +95,40 @@ func TestLogWatcher(t *testing.T) {
 	}
 }
 
+func TestLogWatcherMove(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping log watcher test in short mode")
+	}
+
+	workdir, err := ioutil.TempDir("", "log_watcher_test")
+	if err != nil {
+		t.Fatalf("could not create temporary working directory: %s", err)
+	}
+	defer os.RemoveAll(workdir)
+
+	logfile := filepath.Join(workdir, "logfile")
+	if err := ioutil.WriteFile(logfile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewLogWatcher()
+	if err != nil {
+		t.Fatalf("couldn't create a watcher: %s\n", err)
+	}
+	defer w.Close()
+	w.Add(workdir)
+	if err := os.Rename(logfile, filepath.Join(workdir, "elsewhere")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.Events():
+		if e != (DeleteEvent{logfile}) {
+			t.Errorf("expected delete of %s, got %q", logfile, e)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Errorf("didn't receive delete message")
+	}
+}
+
 // This test may be OS specific; possibly break it out to a file with build tags.
 func TestNewLogWatcherError(t *testing.T) {
 	if testing.Short() {
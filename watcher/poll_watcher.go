@@ -0,0 +1,212 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/clock"
+	"github.com/spf13/afero"
+)
+
+// DefaultPollInterval is the interval used by a PollWatcher when inotify isn't
+// available and no interval has been configured.
+const DefaultPollInterval = time.Second
+
+// PollWatcher implements a Watcher by periodically checking each watched path
+// with stat, for filesystems where inotify events are never delivered.  Files
+// that change size or modification time are reported as updated, and files
+// whose inode changes as created, so that rotations are detected.  Entries that
+// appear in or disappear from a watched directory are reported as created or
+// deleted.
+type PollWatcher struct {
+	fs     afero.Fs
+	ticker *clock.Ticker // Ticks each interval to start a poll.
+
+	watchesMu sync.Mutex
+	watches   map[string]*pollState // Last observed state of each watched path.
+
+	events chan Event
+	quit   chan struct{}
+	done   chan struct{}
+}
+
+// pollState is the state of a watched path at the last poll.  The FileInfo
+// fields are copied, as some filesystems return a FileInfo that reflects later
+// changes to the file.
+type pollState struct {
+	exists  bool
+	isDir   bool
+	size    int64
+	modTime time.Time
+	inode   uint64
+	entries map[string]struct{} // Names of the entries in a directory.
+}
+
+// NewPollWatcher returns a PollWatcher that checks the watched paths on fs
+// each interval of the clock c.
+func NewPollWatcher(fs afero.Fs, c clock.Clock, interval time.Duration) *PollWatcher {
+	w := &PollWatcher{
+		fs:      fs,
+		ticker:  c.NewTicker(interval),
+		watches: make(map[string]*pollState),
+		events:  make(chan Event),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// New returns a LogWatcher, or a PollWatcher on fs and the clock c if
+// pollInterval is non-zero.  If inotify can't be used, it falls back to a
+// PollWatcher with the DefaultPollInterval.
+func New(fs afero.Fs, c clock.Clock, pollInterval time.Duration) Watcher {
+	if pollInterval > 0 {
+		return NewPollWatcher(fs, c, pollInterval)
+	}
+	w, err := NewLogWatcher()
+	if err != nil {
+		glog.Warningf("Couldn't create an inotify watcher, falling back to polling every %s: %s", DefaultPollInterval, err)
+		return NewPollWatcher(fs, c, DefaultPollInterval)
+	}
+	return w
+}
+
+// Add starts watching the named file or directory.
+func (w *PollWatcher) Add(name string) error {
+	s := w.stat(name)
+	w.watchesMu.Lock()
+	defer w.watchesMu.Unlock()
+	w.watches[name] = s
+	return nil
+}
+
+// Remove stops watching the named file or directory.
+func (w *PollWatcher) Remove(name string) error {
+	w.watchesMu.Lock()
+	defer w.watchesMu.Unlock()
+	delete(w.watches, name)
+	return nil
+}
+
+// Close stops polling, and closes the events channel.
+func (w *PollWatcher) Close() error {
+	close(w.quit)
+	<-w.done
+	return nil
+}
+
+// Events returns a readable channel of events from this watcher.
+func (w *PollWatcher) Events() <-chan Event { return w.events }
+
+func (w *PollWatcher) run() {
+	defer close(w.done)
+	defer close(w.events)
+	defer w.ticker.Stop()
+	for {
+		select {
+		case <-w.ticker.C:
+			for _, e := range w.poll() {
+				select {
+				case w.events <- e:
+				case <-w.quit:
+					return
+				}
+			}
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// stat returns the current state of the path.
+func (w *PollWatcher) stat(name string) *pollState {
+	fi, err := w.fs.Stat(name)
+	if err != nil {
+		return &pollState{}
+	}
+	s := &pollState{exists: true, isDir: fi.IsDir(), size: fi.Size(), modTime: fi.ModTime(), inode: inode(fi)}
+	if s.isDir {
+		s.entries = make(map[string]struct{})
+		if d, err := w.fs.Open(name); err == nil {
+			names, _ := d.Readdirnames(-1)
+			d.Close()
+			for _, n := range names {
+				s.entries[n] = struct{}{}
+			}
+		}
+	}
+	return s
+}
+
+// poll checks each watched path against its state at the last poll, and
+// returns the events describing the changes.  The events are sent after the
+// lock is released, as receivers may add watches in response.
+func (w *PollWatcher) poll() []Event {
+	w.watchesMu.Lock()
+	names := make([]string, 0, len(w.watches))
+	for name := range w.watches {
+		names = append(names, name)
+	}
+	w.watchesMu.Unlock()
+
+	var events []Event
+	for _, name := range names {
+		s := w.stat(name)
+		w.watchesMu.Lock()
+		old, ok := w.watches[name]
+		if ok {
+			w.watches[name] = s
+		}
+		w.watchesMu.Unlock()
+		if !ok {
+			continue
+		}
+		events = append(events, changes(name, old, s)...)
+	}
+	return events
+}
+
+// changes returns the events that describe how the path changed between
+// states.
+func changes(name string, old, s *pollState) []Event {
+	var events []Event
+	switch {
+	case !s.exists:
+		if old.exists && !old.isDir {
+			events = append(events, DeleteEvent{name})
+		}
+	case s.isDir:
+		for n := range s.entries {
+			if _, ok := old.entries[n]; !ok {
+				events = append(events, CreateEvent{path.Join(name, n)})
+			}
+		}
+		for n := range old.entries {
+			if _, ok := s.entries[n]; !ok {
+				events = append(events, DeleteEvent{path.Join(name, n)})
+			}
+		}
+	case !old.exists || old.inode != s.inode:
+		events = append(events, CreateEvent{name})
+	case old.size != s.size || !old.modTime.Equal(s.modTime):
+		events = append(events, UpdateEvent{name})
+	}
+	return events
+}
+
+// inode returns the inode number of a file, or 0 if the file has no underlying
+// Sys implementation.
+func inode(fi os.FileInfo) uint64 {
+	if s, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return s.Ino
+	}
+	return 0
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/clock"
+	"github.com/kylelemons/godebug/pretty"
+	"github.com/spf13/afero"
+)
+
+func TestPollWatcher(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	if err := fs.Mkdir("/d", 0777); err != nil {
+		t.Fatal(err)
+	}
+	// The interval is long enough that only the explicit polls below run.
+	w := NewPollWatcher(fs, clock.Real, time.Hour)
+	defer w.Close()
+	w.Add("/d")
+
+	f, err := fs.Create("/d/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare([]Event{CreateEvent{"/d/log"}}, w.poll()); diff != "" {
+		t.Errorf("create event diff:\n%s", diff)
+	}
+	w.Add("/d/log")
+	if diff := pretty.Compare([]Event(nil), w.poll()); diff != "" {
+		t.Errorf("no events expected:\n%s", diff)
+	}
+
+	f.WriteString("hi\n")
+	f.Close()
+	if diff := pretty.Compare([]Event{UpdateEvent{"/d/log"}}, w.poll()); diff != "" {
+		t.Errorf("update event diff:\n%s", diff)
+	}
+
+	w.Remove("/d")
+	fs.Remove("/d/log")
+	if diff := pretty.Compare([]Event{DeleteEvent{"/d/log"}}, w.poll()); diff != "" {
+		t.Errorf("delete event diff:\n%s", diff)
+	}
+}
+
+func TestPollWatcherRotation(t *testing.T) {
+	workdir, err := ioutil.TempDir("", "poll_watcher_test")
+	if err != nil {
+		t.Fatalf("could not create temporary working directory: %s", err)
+	}
+	defer os.RemoveAll(workdir)
+
+	logfile := filepath.Join(workdir, "log")
+	if err := ioutil.WriteFile(logfile, []byte("line 1\nline 2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w := NewPollWatcher(&afero.OsFs{}, clock.Real, time.Hour)
+	defer w.Close()
+	w.Add(logfile)
+
+	// Create the new file before renaming so its inode differs from the old one.
+	if err := ioutil.WriteFile(logfile+".new", []byte("line 3\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(logfile, logfile+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(logfile+".new", logfile); err != nil {
+		t.Fatal(err)
+	}
+	if diff := pretty.Compare([]Event{CreateEvent{logfile}}, w.poll()); diff != "" {
+		t.Errorf("rotation event diff:\n%s", diff)
+	}
+}
+
+func TestPollWatcherSendsEvents(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	c := clock.NewFakeClock(time.Now())
+	w := NewPollWatcher(fs, c, time.Second)
+	w.Add("/log")
+	if _, err := fs.Create("/log"); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(time.Second)
+	if diff := pretty.Compare(CreateEvent{"/log"}, <-w.Events()); diff != "" {
+		t.Errorf("event diff:\n%s", diff)
+	}
+	w.Close()
+	if _, ok := <-w.Events(); ok {
+		t.Errorf("events channel not closed")
+	}
+}
@@ -19,7 +19,8 @@ type UpdateEvent struct {
 	Pathname string
 }
 
-// DeleteEvent signifies a watched file was deleted.
+// DeleteEvent signifies a watched file was deleted, or moved away from its
+// path.
 type DeleteEvent struct {
 	Pathname string
 }